@@ -0,0 +1,327 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File aggregate.go contains code for computing aggregate values (such as
+// sums and averages) over the models which match a query without retrieving
+// the models themselves.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// aggregateIdsScript is the first part of the aggregation scripts, which sets
+// ids to the ids of the models to aggregate over. KEYS[1] is the set of all
+// models, ARGV[1] is the prefix for the keys of the model type (e.g.
+// "Person:") and ARGV[2] is the name of the field in redis. If ARGV[3] is
+// "all", the ids are read from KEYS[1]. Otherwise the ids are ARGV[4] onwards.
+var aggregateIdsScript = `
+local ids
+if ARGV[3] == 'all' then
+	ids = redis.call('SMEMBERS', KEYS[1])
+else
+	ids = {}
+	for i = 4, #ARGV do
+		ids[#ids + 1] = ARGV[i]
+	end
+end
+`
+
+// aggregateScript returns the number of models with a numeric value for the
+// field, along with the sum, minimum and maximum of the values. The numbers
+// are returned as strings because redis converts lua numbers to integers.
+var aggregateScript = aggregateIdsScript + `
+local count, sum, min, max = 0, 0, 0, 0
+for i = 1, #ids do
+	local value = tonumber(redis.call('HGET', ARGV[1] .. ids[i], ARGV[2]))
+	if value then
+		if count == 0 or value < min then
+			min = value
+		end
+		if count == 0 or value > max then
+			max = value
+		end
+		count = count + 1
+		sum = sum + value
+	end
+end
+return {count, string.format('%.17g', sum), string.format('%.17g', min), string.format('%.17g', max)}`
+
+// groupCountScript returns the number of models for each stored value of the
+// field, as a flat list of values and counts.
+var groupCountScript = aggregateIdsScript + `
+local counts = {}
+for i = 1, #ids do
+	local value = redis.call('HGET', ARGV[1] .. ids[i], ARGV[2])
+	if value then
+		counts[value] = (counts[value] or 0) + 1
+	end
+end
+local result = {}
+for value, count in pairs(counts) do
+	result[#result + 1] = value
+	result[#result + 1] = count
+end
+return result`
+
+// aggregateResult holds the values returned by aggregateScript.
+type aggregateResult struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// Sum returns the sum of the values of the field identified by fieldName for
+// all the models which match the query. The field must have a numeric type
+// (or be a pointer to a numeric type, in which case nil values are skipped).
+// The sum is computed in the database, so the models are never retrieved, but
+// note that the values are converted to float64. Limit, offset and After are
+// taken into account. Sum will also return the first error that occured
+// during the lifetime of the query object (if any).
+func (q *Query) Sum(fieldName string) (float64, error) {
+	result, err := q.aggregate(fieldName)
+	if err != nil {
+		return 0, err
+	}
+	return result.sum, nil
+}
+
+// Avg returns the average of the values of the field identified by fieldName
+// for all the models which match the query. It has the same requirements as
+// Sum, and returns a ModelNotFoundError if there are no values to average.
+func (q *Query) Avg(fieldName string) (float64, error) {
+	result, err := q.aggregate(fieldName)
+	if err != nil {
+		return 0, err
+	}
+	if result.count == 0 {
+		return 0, NewModelNotFoundError()
+	}
+	return result.sum / float64(result.count), nil
+}
+
+// Min returns the minimum value of the field identified by fieldName for all
+// the models which match the query. It has the same requirements as Sum, and
+// returns a ModelNotFoundError if there are no values. If the field is indexed
+// and the query has no filters, limit, or offset, the minimum is read directly
+// from the index.
+func (q *Query) Min(fieldName string) (float64, error) {
+	return q.minOrMax(fieldName, false)
+}
+
+// Max returns the maximum value of the field identified by fieldName for all
+// the models which match the query. It has the same requirements as Min.
+func (q *Query) Max(fieldName string) (float64, error) {
+	return q.minOrMax(fieldName, true)
+}
+
+func (q *Query) minOrMax(fieldName string, max bool) (float64, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	fs, err := q.aggregateField(fieldName)
+	if err != nil {
+		return 0, err
+	}
+	if err := q.sweepExpired(); err != nil {
+		return 0, err
+	}
+	if q.aggregatesAll() && !q.modelSpec.softDelete && fs.indexType == indexNumeric && q.modelSpec.fieldIsIndexed(fieldName) {
+		// the answer is at one end of the index
+		command := "ZRANGE"
+		if max {
+			command = "ZREVRANGE"
+		}
+		conn := getReadConn()
+		defer conn.Close()
+		reply, err := redis.Strings(conn.Do(command, q.modelSpec.key(fs.redisName), 0, 0, "WITHSCORES"))
+		if err != nil {
+			return 0, err
+		}
+		if len(reply) == 0 {
+			return 0, NewModelNotFoundError()
+		}
+		return strconv.ParseFloat(reply[1], 64)
+	}
+	result, err := q.aggregate(fieldName)
+	if err != nil {
+		return 0, err
+	}
+	if result.count == 0 {
+		return 0, NewModelNotFoundError()
+	}
+	if max {
+		return result.max, nil
+	}
+	return result.min, nil
+}
+
+// aggregate runs aggregateScript for the field identified by fieldName over
+// the models which match the query.
+func (q *Query) aggregate(fieldName string) (aggregateResult, error) {
+	result := aggregateResult{}
+	if q.err != nil {
+		return result, q.err
+	}
+	fs, err := q.aggregateField(fieldName)
+	if err != nil {
+		return result, err
+	}
+	args, err := q.aggregateArgs(aggregateScript, fs)
+	if err != nil {
+		return result, err
+	}
+	conn := getReadConn()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("EVAL", args...))
+	if err != nil {
+		return result, err
+	}
+	var sum, min, max string
+	if _, err := redis.Scan(reply, &result.count, &sum, &min, &max); err != nil {
+		return result, err
+	}
+	for _, pair := range []struct {
+		s    string
+		dest *float64
+	}{{sum, &result.sum}, {min, &result.min}, {max, &result.max}} {
+		if *pair.dest, err = strconv.ParseFloat(pair.s, 64); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// aggregateField returns the fieldSpec for the field identified by fieldName
+// if it can be used with Sum, Avg, Min and Max.
+func (q *Query) aggregateField(fieldName string) (*fieldSpec, error) {
+	fs, found := q.modelSpec.fieldSpec(fieldName)
+	if !found {
+		return nil, fmt.Errorf("zoom: type %s has no field %s", q.modelSpec.modelType.String(), fieldName)
+	}
+	typ := fs.fieldType
+	if fs.classification == pointer {
+		typ = typ.Elem()
+	}
+	if (fs.classification != primative && fs.classification != pointer) || !typeIsNumeric(typ) {
+		return nil, fmt.Errorf("zoom: cannot aggregate %s.%s because it does not have a numeric type", q.modelSpec.modelType.String(), fieldName)
+	}
+	return fs, nil
+}
+
+// fieldIsIndexed returns true iff the field identified by fieldName has a
+// regular (i.e. not compound) index.
+func (ms modelSpec) fieldIsIndexed(fieldName string) bool {
+	_, found := ms.indexTypeForField(fieldName)
+	return found
+}
+
+// aggregatesAll returns true iff the query matches all the models of its type.
+func (q *Query) aggregatesAll() bool {
+	return len(q.filters) == 0 && !q.scopesDeleted() && q.limit == 0 && q.offset == 0 && q.after == nil
+}
+
+// aggregateArgs returns the arguments for EVAL which will run script over the
+// models which match the query. If the query matches all models the script
+// reads the ids itself, otherwise the ids are retrieved first with IdsOnly.
+func (q *Query) aggregateArgs(script string, fs *fieldSpec) (redis.Args, error) {
+	if err := q.sweepExpired(); err != nil {
+		return nil, err
+	}
+	args := redis.Args{}.Add(script).Add(1).Add(q.modelSpec.indexKey()).Add(q.modelSpec.key("")).Add(fs.redisName)
+	if q.aggregatesAll() {
+		return args.Add("all"), nil
+	}
+	ids, err := q.IdsOnly()
+	if err != nil {
+		return nil, err
+	}
+	return args.Add("ids").AddFlat(ids), nil
+}
+
+// GroupQuery is a query whose results are grouped by the value of a field.
+// It is returned by Query.GroupBy.
+type GroupQuery struct {
+	query *Query
+	field *fieldSpec
+}
+
+// GroupBy groups the models which match the query by the value of the field
+// identified by fieldName, which must have a string, numeric, or boolean type
+// (or be a pointer to one). Use a finisher such as Count on the returned
+// GroupQuery to get the result for each group.
+func (q *Query) GroupBy(fieldName string) *GroupQuery {
+	gq := &GroupQuery{query: q}
+	fs, found := q.modelSpec.fieldSpec(fieldName)
+	if !found {
+		q.setErrorIfNone(fmt.Errorf("zoom: type %s has no field %s", q.modelSpec.modelType.String(), fieldName))
+		return gq
+	}
+	if fs.classification != primative && fs.classification != pointer {
+		q.setErrorIfNone(fmt.Errorf("zoom: cannot group by %s.%s because it does not have a primative type", q.modelSpec.modelType.String(), fieldName))
+		return gq
+	}
+	gq.field = fs
+	return gq
+}
+
+// Count returns the number of models in each group, keyed by the value of the
+// field formatted with fmt.Sprint. Models for which a pointer field is nil are
+// counted under "<nil>". The counts are computed in the database, so the models
+// are never retrieved. Count will also return the first error that occured
+// during the lifetime of the query object (if any).
+func (gq *GroupQuery) Count() (map[string]int, error) {
+	q := gq.query
+	if q.err != nil {
+		return nil, q.err
+	}
+	args, err := q.aggregateArgs(groupCountScript, gq.field)
+	if err != nil {
+		return nil, err
+	}
+	conn := getReadConn()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("EVAL", args...))
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for i := 0; i < len(reply); i += 2 {
+		key, err := gq.groupKey(reply[i])
+		if err != nil {
+			return nil, err
+		}
+		count, err := redis.Int(reply[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		// different stored values may have the same formatted value
+		counts[key] += count
+	}
+	return counts, nil
+}
+
+// groupKey converts a value stored in redis to the key used for its group.
+func (gq *GroupQuery) groupKey(stored interface{}) (string, error) {
+	dest := reflect.New(gq.field.fieldType).Elem()
+	if gq.field.classification == pointer {
+		if b, ok := stored.([]byte); ok && string(b) == "NULL" {
+			return fmt.Sprint(nil), nil
+		}
+		if err := scanPointerVal(stored, dest); err != nil {
+			return "", err
+		}
+		return fmt.Sprint(dest.Elem().Interface()), nil
+	}
+	if err := scanPrimativeVal(stored, dest); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(dest.Interface()), nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File bulk.go contains query finishers which delete or update all the
+// models that match a query.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Delete deletes all the models which match the query, along with their
+// indexes, and returns the number of models that were deleted. The ids are
+// retrieved with IdsOnly and the models are then retrieved and deleted in
+// batches (of the size given by BatchSize), with a single transaction for
+// each batch. Models which are deleted before they are retrieved are skipped.
+// Delete will also return the first error that occured during the lifetime of
+// the query object (if any). If there is an error part way through, the
+// models in the previous batches will still be deleted.
+func (q *Query) Delete() (int, error) {
+	ids, err := q.IdsOnly()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, batch := range q.idBatches(ids) {
+		models, err := q.modelSpec.findModelsById(batch)
+		if err != nil {
+			return deleted, err
+		}
+		t := newTransaction(q.modelSpec.ns())
+		for _, m := range models {
+			mr, err := newModelRefFromModel(q.modelSpec.ns(), m)
+			if err != nil {
+				unlockModels(models)
+				return deleted, err
+			}
+			t.deleteModel(mr)
+		}
+		err = t.exec()
+		unlockModels(models)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += len(models)
+	}
+	return deleted, nil
+}
+
+// Update sets the fields identified by the keys of values to the
+// corresponding values for all the models which match the query, and returns
+// the number of models that were updated. Each value must be assignable or
+// convertible to the type of its field, and a nil value sets a field to its
+// zero value. The models are retrieved and saved in batches (of the size given
+// by BatchSize), so all of their indexes stay consistent. Models which are
+// deleted before they are retrieved are skipped. Each batch is retrieved and
+// saved with the models watched (using WATCH), so if another client changes or
+// deletes one of the models in between, the batch is retrieved and updated
+// again instead of overwriting the change. In cluster mode, which does not
+// support WATCH, such changes to the other fields of the models may be
+// overwritten. Update will also return the first error that occured during the
+// lifetime of the query object (if any). If there is an error part way
+// through, the models in the previous batches will still be updated. The
+// models in each batch are validated before they are saved, and a
+// *ValidationError is returned if any of them are invalid.
+func (q *Query) Update(values map[string]interface{}) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	fieldValues, err := q.modelSpec.updateValues(values)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := q.IdsOnly()
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, batch := range q.idBatches(ids) {
+		n, err := q.modelSpec.updateBatch(batch, fieldValues)
+		if err != nil {
+			return updated, err
+		}
+		updated += n
+	}
+	return updated, nil
+}
+
+// maxUpdateAttempts is the number of times Update will retrieve and save a
+// batch of models before giving up, if other clients keep changing them in
+// between.
+const maxUpdateAttempts = 10
+
+// keepOpenConn is a redis.Conn which is not closed when a transaction which
+// uses it is executed, so that more than one transaction can use the keys
+// watched on the connection.
+type keepOpenConn struct {
+	redis.Conn
+}
+
+func (keepOpenConn) Close() error {
+	return nil
+}
+
+// updateBatch retrieves the models with the given ids, sets the given field
+// values, and saves them. It returns the number of models which were updated.
+// The main hashes of the models are watched while they are retrieved and
+// saved (except in cluster mode), and the batch is tried again if any of them
+// are changed before the models are saved.
+func (ms modelSpec) updateBatch(ids []string, fieldValues map[string]reflect.Value) (int, error) {
+	conn := GetConn()
+	defer conn.Close()
+	watch := !currentConfiguration.Cluster
+	newFindTransaction := func(ns *Namespace) *transaction {
+		t := newTransactionOnConn(ns, keepOpenConn{conn})
+		t.pipelined = watch
+		return t
+	}
+	q := &Query{modelSpec: ms}
+	for attempt := 1; ; attempt++ {
+		if watch {
+			keys := redis.Args{}
+			for _, id := range ids {
+				keys = keys.Add(ms.key(id))
+			}
+			if _, err := conn.Do("WATCH", keys...); err != nil {
+				return 0, err
+			}
+		}
+		models, err := q.findModelsIn(newFindTransaction, ids)
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range models {
+			modelVal := reflect.ValueOf(m).Elem()
+			for fieldName, val := range fieldValues {
+				modelVal.FieldByName(fieldName).Set(val)
+			}
+		}
+		if err := validateModels(models); err != nil {
+			unlockModels(models)
+			return 0, err
+		}
+		t := newTransactionOnConn(ms.ns(), keepOpenConn{conn})
+		t.watched = watch
+		for _, m := range models {
+			if err := t.saveModel(m); err != nil {
+				unlockModels(models)
+				return 0, err
+			}
+		}
+		err = t.exec()
+		unlockModels(models)
+		if err == redis.ErrNil && watch {
+			// one of the models was changed by another client
+			if attempt < maxUpdateAttempts {
+				continue
+			}
+			return 0, fmt.Errorf("zoom: error in Update: the models were changed by another client %d times in a row", attempt)
+		} else if err != nil {
+			return 0, err
+		}
+		return len(models), nil
+	}
+}
+
+// updateValues converts values to a map of field names to values which can be
+// set directly on the corresponding fields of a model. It returns an error if
+// a field does not exist or if a value can't be converted to the type of its
+// field.
+func (ms modelSpec) updateValues(values map[string]interface{}) (map[string]reflect.Value, error) {
+	fieldValues := map[string]reflect.Value{}
+	for fieldName, value := range values {
+		fs, found := ms.fieldSpec(fieldName)
+		if !found {
+			return nil, fmt.Errorf("zoom: error in Update: type %s has no field %s", ms.modelType.String(), fieldName)
+		}
+		if value == nil {
+			fieldValues[fieldName] = reflect.Zero(fs.fieldType)
+			continue
+		}
+		val := reflect.ValueOf(value)
+		switch {
+		case val.Type().AssignableTo(fs.fieldType):
+		case val.Type().ConvertibleTo(fs.fieldType) && (typeIsNumeric(val.Type()) == typeIsNumeric(fs.fieldType)):
+			val = val.Convert(fs.fieldType)
+		default:
+			return nil, fmt.Errorf("zoom: error in Update: cannot use %v (type %T) as type %s for field %s", value, value, fs.fieldType.String(), fieldName)
+		}
+		fieldValues[fieldName] = val
+	}
+	return fieldValues, nil
+}
+
+// findModelsById retrieves all the fields of the models with the given ids.
+// Ids for models which no longer exist are skipped. The models are always
+// retrieved from the master, since they are about to be changed and a replica
+// may be behind.
+func (ms modelSpec) findModelsById(ids []string) ([]Model, error) {
+	q := &Query{modelSpec: ms}
+	return q.findModelsIn(newTransaction, ids)
+}
+
+// unlockModels calls Unlock on each of the models which implements Syncer.
+// The models are locked when they are retrieved.
+func unlockModels(models []Model) {
+	for _, m := range models {
+		if s, ok := m.(Syncer); ok {
+			s.Unlock()
+		}
+	}
+}
+
+// idBatches splits ids into batches of the size given by BatchSize.
+func (q *Query) idBatches(ids []string) [][]string {
+	size := int(q.batchSize)
+	if size == 0 {
+		size = defaultBatchSize
+	}
+	batches := [][]string{}
+	for len(ids) > size {
+		batches = append(batches, ids[:size])
+		ids = ids[size:]
+	}
+	if len(ids) != 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
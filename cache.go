@@ -0,0 +1,423 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File cache.go contains code for an optional in-process LRU cache of
+// models, which is used by FindById and the other functions which find models
+// so that frequently read models don't require a round trip to the database.
+
+package zoom
+
+import (
+	"container/list"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// cacheInvalidationLimit is the maximum number of recently invalidated models
+// the cache keeps track of. When there are more, none of the models which are
+// being retrieved at that moment are added to the cache.
+var cacheInvalidationLimit = 1024
+
+// cacheRetryInterval is how long the cache waits before subscribing to the
+// change events again after the subscription fails.
+var cacheRetryInterval = time.Second
+
+// findCache is the cache used by findModel. It is nil unless
+// Configuration.CacheSize is greater than 0.
+var findCache *lruCache
+
+// CacheStats contains metrics for the in-process model cache. It is returned
+// by GetCacheStats.
+type CacheStats struct {
+	Hits          uint64 // the number of models which were found in the cache
+	Misses        uint64 // the number of models which could have been cached but were not found in the cache
+	Evictions     uint64 // the number of models which were removed to make room for others
+	Invalidations uint64 // the number of models which were removed because they were saved or deleted
+	Size          int    // the number of models currently in the cache
+}
+
+// lruCache keeps the fields of recently found models, up to a fixed number of
+// models, and removes the least recently used model when it is full. Models
+// are removed when they are saved or deleted by this process, or when a change
+// event is received for them from another process.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+	stats    CacheStats
+	// epoch is incremented every time a model is invalidated, and invalidated
+	// holds the epoch at which each recently invalidated model was last
+	// invalidated, so that a model which was retrieved before it was changed
+	// is not added to the cache afterwards. Models which were retrieved before
+	// floor are never added.
+	epoch       uint64
+	invalidated map[string]uint64
+	floor       uint64
+	// ready is true while the cache is subscribed to change events. Models are
+	// not added to or read from the cache otherwise, since it might miss
+	// changes made by other processes.
+	ready   bool
+	conn    redis.PubSubConn
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// cacheEntry is a model in the cache.
+type cacheEntry struct {
+	key     string
+	fields  reflect.Value // a copy of the model struct
+	expires time.Time
+}
+
+// startCache creates the cache and subscribes to the change events for every
+// type of model in a separate goroutine. It stops any existing cache first.
+func startCache(config Configuration) {
+	stopCache()
+	if config.CacheSize <= 0 {
+		return
+	}
+	c := &lruCache{
+		capacity:    config.CacheSize,
+		items:       map[string]*list.Element{},
+		order:       list.New(),
+		invalidated: map[string]uint64{},
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	findCache = c
+	go c.subscribe()
+}
+
+// stopCache stops the cache, if there is one, and closes its connection.
+func stopCache() {
+	if findCache == nil {
+		return
+	}
+	c := findCache
+	findCache = nil
+	close(c.closing)
+	c.mu.Lock()
+	if c.conn.Conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.done
+}
+
+// subscribe receives the change events for every type of model and removes
+// the changed models from the cache. If the subscription fails, the cache is
+// cleared and stops being used until it has subscribed again.
+func (c *lruCache) subscribe() {
+	defer close(c.done)
+	for {
+		err := c.receive()
+		c.mu.Lock()
+		c.ready = false
+		c.conn = redis.PubSubConn{}
+		c.mu.Unlock()
+		c.clear()
+		if err == nil {
+			return
+		}
+		select {
+		case <-c.closing:
+			return
+		case <-time.After(cacheRetryInterval):
+		}
+	}
+}
+
+// receive subscribes to the change events and invalidates models until the
+// cache is stopped (in which case it returns nil) or there is an error.
+func (c *lruCache) receive() error {
+	// the connection is not taken from the pool, since it can't be used for
+	// anything else while it is subscribed
+	conn, err := pool.Dial()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	select {
+	case <-c.closing:
+		c.mu.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	c.conn = redis.PubSubConn{Conn: conn}
+	c.mu.Unlock()
+	defer c.conn.Close()
+	// subscribe to the events in every namespace
+	if err := c.conn.PSubscribe(defaultNamespace.key("*zoom:events:*")); err != nil {
+		return err
+	}
+	for {
+		switch reply := c.conn.Receive().(type) {
+		case redis.Subscription:
+			// models may have changed while the cache was not subscribed
+			c.clear()
+			c.mu.Lock()
+			c.ready = true
+			c.mu.Unlock()
+		case redis.PMessage:
+			// the channel is the key prefix for the namespace followed by
+			// zoom:events: and the model name
+			i := strings.LastIndex(reply.Channel, "zoom:events:")
+			parts := strings.SplitN(string(reply.Data), " ", 2)
+			if i != -1 && len(parts) == 2 {
+				prefix, modelName := reply.Channel[:i], reply.Channel[i+len("zoom:events:"):]
+				c.invalidate(prefix + modelKeyName(modelName) + ":" + parts[1])
+			}
+		case error:
+			select {
+			case <-c.closing:
+				return nil
+			default:
+				return reply
+			}
+		}
+	}
+}
+
+// cacheTTL returns how long models of this type are kept in the cache, or 0
+// if they are not cached.
+func (ms modelSpec) cacheTTL() time.Duration {
+	if ms.cacheFor != 0 {
+		return ms.cacheFor
+	}
+	return currentConfiguration.CacheTTL
+}
+
+// cacheable returns true iff models of this type can be kept in the cache.
+// Models with relationships are never cached, since the related models could
+// change without the model itself being saved.
+func (ms modelSpec) cacheable() bool {
+	return findCache != nil && ms.cacheTTL() > 0 && len(ms.relationships) == 0
+}
+
+// get copies the fields of the cached model with the given key into mr and
+// returns true, or returns false if the model is not in the cache.
+func (c *lruCache) get(mr modelRef) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.ready {
+		return false
+	}
+	elem, found := c.items[mr.key()]
+	if found && time.Now().After(elem.Value.(*cacheEntry).expires) {
+		c.remove(elem)
+		found = false
+	}
+	if !found {
+		c.stats.Misses++
+		return false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(elem)
+	copyModelFields(mr, elem.Value.(*cacheEntry).fields)
+	return true
+}
+
+// currentEpoch returns the epoch which must be passed to set when a model is
+// retrieved from the database.
+func (c *lruCache) currentEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// set adds a copy of the fields of mr to the cache, unless the model has been
+// invalidated since epoch.
+func (c *lruCache) set(mr modelRef, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.ready || epoch < c.floor || c.invalidated[mr.key()] > epoch {
+		return
+	}
+	entry := &cacheEntry{
+		key:     mr.key(),
+		fields:  copyValue(reflect.ValueOf(mr.model).Elem()),
+		expires: time.Now().Add(mr.modelSpec.cacheTTL()),
+	}
+	if elem, found := c.items[entry.key]; found {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// invalidate removes the model with the given key from the cache.
+func (c *lruCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if len(c.invalidated) >= cacheInvalidationLimit {
+		c.invalidated = map[string]uint64{}
+		c.floor = c.epoch
+	}
+	c.invalidated[key] = c.epoch
+	if elem, found := c.items[key]; found {
+		c.remove(elem)
+		c.stats.Invalidations++
+	}
+}
+
+// clear removes every model from the cache.
+func (c *lruCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.floor = c.epoch
+	c.invalidated = map[string]uint64{}
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// remove removes elem from the cache. The cache must be locked.
+func (c *lruCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*cacheEntry).key)
+}
+
+// GetCacheStats returns the metrics for the in-process model cache. All the
+// metrics are 0 if the cache is not enabled.
+func GetCacheStats() CacheStats {
+	c := findCache
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.order.Len()
+	return stats
+}
+
+// ClearCache removes every model from the in-process model cache. It is only
+// needed if models are changed without using zoom (e.g. by a migration script)
+// and can not wait for the models to expire from the cache.
+func ClearCache() {
+	if c := findCache; c != nil {
+		c.clear()
+	}
+}
+
+// findCachedModel copies the fields of the model from the cache into mr and
+// returns true if the model is cached. Otherwise, if the model can be cached,
+// it arranges for the model to be added to the cache once the commands which
+// retrieve it (starting with the command at index first) have succeeded.
+func (t *transaction) findCachedModel(mr modelRef, includes []string) (found bool, cacheAfter func(first int)) {
+	c := findCache
+	if c == nil || includes != nil || !mr.modelSpec.cacheable() {
+		return false, nil
+	}
+	if c.get(mr) {
+		return true, nil
+	}
+	if t.fromReplica {
+		// a replica may not have received a change yet when the change event
+		// for it arrives, so models read from replicas are not cached
+		return false, nil
+	}
+	epoch := c.currentEpoch()
+	return false, func(first int) {
+		if first == len(t.handlers) {
+			return
+		}
+		// the model has been retrieved once the last handler succeeds, since
+		// the commands are executed in order
+		last := len(t.handlers) - 1
+		handler := t.handlers[last]
+		t.handlers[last] = func(reply interface{}) error {
+			if err := handler(reply); err != nil {
+				return err
+			}
+			c.set(mr, epoch)
+			return nil
+		}
+	}
+}
+
+// invalidateCachedModel arranges for the model with the given id to be
+// removed from the cache once the transaction has been executed.
+func (t *transaction) invalidateCachedModel(ms modelSpec, id string) {
+	if findCache != nil {
+		t.invalidations = append(t.invalidations, ms.key(id))
+	}
+}
+
+// copyModelFields sets each of the fields of mr which zoom stores to a copy of
+// the same field of fields, which is a model struct of the same type.
+func copyModelFields(mr modelRef, fields reflect.Value) {
+	for _, fs := range mr.modelSpec.fieldSpecs {
+		mr.value(fs.fieldName).Set(copyValue(fields.FieldByName(fs.fieldName)))
+	}
+}
+
+// copyValue returns a deep copy of v, so that changes to a model which was
+// retrieved from the cache do not affect the cached model. Unexported fields of
+// structs are copied as is.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		copied := reflect.New(v.Type().Elem())
+		copied.Elem().Set(copyValue(v.Elem()))
+		return copied
+	case reflect.Interface:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(copyValue(v.Elem()))
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return copied
+	case reflect.Array:
+		copied := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		copied := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			copied.SetMapIndex(copyValue(key), copyValue(v.MapIndex(key)))
+		}
+		return copied
+	case reflect.Struct:
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				copied.Field(i).Set(copyValue(v.Field(i)))
+			}
+		}
+		return copied
+	default:
+		return v
+	}
+}
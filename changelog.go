@@ -0,0 +1,282 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File changelog.go contains code for recording the changes to models in a
+// redis stream, which is enabled with the zoom:"audit" tag on DefaultData or
+// with Configuration.ChangeLog, and for reading the changes back with a
+// consumer group.
+
+package zoom
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// logChangeScript adds an entry to the change log for a model. It must run
+// before the main hash of the model is written or deleted and before the model
+// id is added to or removed from the set of all models. KEYS[1] is the main
+// hash, KEYS[2] is the stream, KEYS[3] is the set of all models and KEYS[4], if
+// given, is the set of soft deleted models. ARGV[1] is the model id, ARGV[2] is
+// either "save" or "delete" and ARGV[3] is the approximate maximum length of
+// the stream (or 0 for no maximum). For "save", ARGV[4] onwards are the field
+// and value pairs which will be written to the main hash. The entry has the type
+// of change and the id, followed by "old:<field>" and "new:<field>" for each
+// field which changed. Saving a model which was soft deleted (e.g. restoring
+// it) is an update. Nothing is added when a model is saved without any changes
+// or when a model which does not exist is deleted.
+var logChangeScript = `
+local exists = redis.call('SISMEMBER', KEYS[3], ARGV[1]) == 1
+local stored = redis.call('HGETALL', KEYS[1])
+local old = {}
+for i = 1, #stored, 2 do
+	old[stored[i]] = stored[i + 1]
+end
+local entry = {}
+local event
+if ARGV[2] == 'save' then
+	if KEYS[4] and redis.call('SISMEMBER', KEYS[4], ARGV[1]) == 1 then
+		exists = true
+	end
+	if exists then
+		event = 'updated'
+	else
+		event = 'created'
+	end
+	for i = 4, #ARGV, 2 do
+		local field, value = ARGV[i], ARGV[i + 1]
+		if old[field] ~= value then
+			if old[field] then
+				entry[#entry + 1] = 'old:' .. field
+				entry[#entry + 1] = old[field]
+			end
+			entry[#entry + 1] = 'new:' .. field
+			entry[#entry + 1] = value
+		end
+	end
+	if exists and #entry == 0 then
+		return false
+	end
+elseif exists then
+	event = 'deleted'
+	for i = 1, #stored, 2 do
+		entry[#entry + 1] = 'old:' .. stored[i]
+		entry[#entry + 1] = stored[i + 1]
+	end
+else
+	return false
+end
+if tonumber(ARGV[3]) > 0 then
+	return redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[3], '*', 'type', event, 'id', ARGV[1], unpack(entry))
+end
+return redis.call('XADD', KEYS[2], '*', 'type', event, 'id', ARGV[1], unpack(entry))`
+
+// logsChanges returns true iff changes to models of this type are recorded in
+// the change log.
+func (ms modelSpec) logsChanges() bool {
+	return ms.audit || currentConfiguration.ChangeLog
+}
+
+// changeLogKey returns the key for the stream which records the changes to
+// models of this type.
+func (ms modelSpec) changeLogKey() string {
+	return ms.ns().key("zoom:changes:" + modelKeyName(ms.modelName))
+}
+
+// logSave adds a command to the transaction which records the changes that
+// saving the model will make in the change log. It must be added before the
+// command which writes the main hash.
+func (t *transaction) logSave(mr modelRef) error {
+	hashArgs, err := mr.mainHashArgs()
+	if err != nil {
+		return err
+	}
+	ms := mr.modelSpec
+	args := redis.Args{}.Add(logChangeScript).Add(2 + len(ms.idSetKeys())).Add(mr.key()).Add(ms.changeLogKey()).AddFlat(ms.idSetKeys())
+	args = args.Add(mr.model.GetId()).Add("save").Add(currentConfiguration.ChangeLogMaxLen).Add(hashArgs[1:]...)
+	t.command("EVAL", args, nil)
+	return nil
+}
+
+// logDelete adds a command to the transaction which records the deletion of
+// the model with the given id in the change log. It must be added before the
+// command which deletes the main hash.
+func (t *transaction) logDelete(ms modelSpec, id string) {
+	args := redis.Args{}.Add(logChangeScript).Add(3).Add(ms.key(id)).Add(ms.changeLogKey()).Add(ms.indexKey())
+	args = args.Add(id).Add("delete").Add(currentConfiguration.ChangeLogMaxLen)
+	t.command("EVAL", args, nil)
+}
+
+// Change is an entry in the change log for a type of model.
+type Change struct {
+	EntryId   string     // the id of the entry in the stream
+	Type      ChangeType // Created, Updated or Deleted
+	ModelName string
+	Id        string            // the id of the model
+	Old       map[string]string // the stored values of the fields which changed, before the change
+	New       map[string]string // the stored values of the fields which changed, after the change
+}
+
+// ChangeLogReader reads the change log for a type of model as part of a
+// consumer group, so that the changes can be processed by several consumers
+// and each change is delivered to only one of them. It is returned by
+// NewChangeLogReader.
+type ChangeLogReader struct {
+	modelSpec modelSpec
+	group     string
+	consumer  string
+}
+
+// NewChangeLogReader returns a ChangeLogReader which reads the change log for
+// the type of model identified by modelName as the consumer identified by
+// consumer in the consumer group identified by group. If the group does not
+// exist it is created, starting with the first change in the log, so a new
+// group will replay every change that has been recorded.
+func NewChangeLogReader(modelName, group, consumer string) (*ChangeLogReader, error) {
+	return defaultNamespace.NewChangeLogReader(modelName, group, consumer)
+}
+
+// NewChangeLogReader is like the package-level NewChangeLogReader but reads
+// the change log for the models in the namespace.
+func (ns *Namespace) NewChangeLogReader(modelName, group, consumer string) (*ChangeLogReader, error) {
+	ms, found := ns.modelSpec(modelName)
+	if !found {
+		return nil, NewModelNameNotRegisteredError(modelName)
+	}
+	conn := GetConn()
+	defer conn.Close()
+	if _, err := conn.Do("XGROUP", "CREATE", ms.changeLogKey(), group, "0", "MKSTREAM"); err != nil {
+		if !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+	}
+	return &ChangeLogReader{modelSpec: ms, group: group, consumer: consumer}, nil
+}
+
+// Read returns up to count changes which have not yet been delivered to any
+// consumer in the group. If there are none, Read waits for up to block for new
+// changes (or returns immediately if block is 0). The changes are pending until
+// they are acknowledged with Ack.
+func (r *ChangeLogReader) Read(count int, block time.Duration) ([]Change, error) {
+	return r.read(count, block, ">")
+}
+
+// Pending returns up to count changes which were delivered to this consumer
+// but not acknowledged, e.g. because the consumer stopped before it could
+// process them.
+func (r *ChangeLogReader) Pending(count int) ([]Change, error) {
+	return r.read(count, 0, "0")
+}
+
+func (r *ChangeLogReader) read(count int, block time.Duration, start string) ([]Change, error) {
+	args := redis.Args{}.Add("GROUP").Add(r.group).Add(r.consumer).Add("COUNT").Add(count)
+	if block > 0 {
+		args = args.Add("BLOCK").Add(int64(block / time.Millisecond))
+	}
+	args = args.Add("STREAMS").Add(r.modelSpec.changeLogKey()).Add(start)
+	conn := GetConn()
+	defer conn.Close()
+	reply, err := conn.Do("XREADGROUP", args...)
+	if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	if reply == nil {
+		// timed out waiting for changes
+		return changes, nil
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range streams {
+		// each stream is a pair of the key and its entries
+		pair, err := redis.Values(stream, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("zoom: error in ChangeLogReader: unexpected reply %v", stream)
+		}
+		entries, err := redis.Values(pair[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			change, err := r.newChange(entry)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// newChange converts an entry in the stream, which is a pair of the entry id
+// and its fields and values, to a Change.
+func (r *ChangeLogReader) newChange(entry interface{}) (Change, error) {
+	change := Change{ModelName: r.modelSpec.modelName, Old: map[string]string{}, New: map[string]string{}}
+	pair, err := redis.Values(entry, nil)
+	if err != nil {
+		return change, err
+	}
+	if len(pair) != 2 {
+		return change, fmt.Errorf("zoom: error in ChangeLogReader: unexpected entry %v", entry)
+	}
+	if change.EntryId, err = redis.String(pair[0], nil); err != nil {
+		return change, err
+	}
+	if pair[1] == nil {
+		// the entry was deleted from the stream after it was delivered
+		return change, nil
+	}
+	fields, err := redis.StringMap(pair[1], nil)
+	if err != nil {
+		return change, err
+	}
+	for field, value := range fields {
+		switch {
+		case field == "type":
+			change.Type = ChangeType(value)
+		case field == "id":
+			change.Id = value
+		case strings.HasPrefix(field, "old:"):
+			change.Old[r.fieldName(strings.TrimPrefix(field, "old:"))] = value
+		case strings.HasPrefix(field, "new:"):
+			change.New[r.fieldName(strings.TrimPrefix(field, "new:"))] = value
+		}
+	}
+	return change, nil
+}
+
+// fieldName returns the name of the field with the given redisName, or
+// redisName itself if the field no longer exists.
+func (r *ChangeLogReader) fieldName(redisName string) string {
+	for _, fs := range r.modelSpec.fieldSpecs {
+		if fs.redisName == redisName {
+			return fs.fieldName
+		}
+	}
+	return redisName
+}
+
+// Ack acknowledges that the given changes have been processed, so that they
+// are no longer pending.
+func (r *ChangeLogReader) Ack(changes ...Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	args := redis.Args{}.Add(r.modelSpec.changeLogKey()).Add(r.group)
+	for _, change := range changes {
+		args = args.Add(change.EntryId)
+	}
+	conn := GetConn()
+	defer conn.Close()
+	_, err := conn.Do("XACK", args...)
+	return err
+}
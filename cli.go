@@ -0,0 +1,82 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File cli.go contains code for running maintenance commands from the
+// command line. There is no zoom binary, since the commands can only be used
+// with model types which are registered in the program that runs them.
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CommandUsage describes the commands which can be run with RunCommand.
+const CommandUsage = `Commands:
+  reindex <model> <field>    rebuild the indexes for a single field of a model type
+  rebuild-indexes <model>    rebuild all the indexes for a model type and delete obsolete ones
+  migrate                    run all the registered migrations which have not been run yet
+  verify <model>             report differences between a model type and the stored data`
+
+// RunCommand runs one of the maintenance commands described by CommandUsage.
+// args should not include the name of the program. Progress is written to out.
+// Since model types are registered in Go code, RunCommand only knows about the
+// model types which have been registered in the current program, so each
+// application has to build its own binary which calls Init, registers its
+// models, and then calls RunCommand with os.Args[1:].
+func RunCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("zoom: no command specified.\n" + CommandUsage)
+	}
+	progress := func(done, total int) {
+		fmt.Fprintf(out, "processed %d of %d models\n", done, total)
+	}
+	switch cmd := args[0]; cmd {
+	case "reindex":
+		if len(args) != 3 {
+			return errors.New("zoom: reindex requires exactly two arguments: <model> <field>")
+		}
+		if err := ReindexField(args[1], args[2], progress); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "reindexed %s.%s\n", args[1], args[2])
+	case "rebuild-indexes":
+		if len(args) != 2 {
+			return errors.New("zoom: rebuild-indexes requires exactly one argument: <model>")
+		}
+		if err := RebuildIndexes(args[1], progress); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "rebuilt indexes for %s\n", args[1])
+	case "migrate":
+		if len(args) != 1 {
+			return errors.New("zoom: migrate does not accept any arguments")
+		}
+		if err := Migrate(); err != nil {
+			return err
+		}
+		version, err := SchemaVersion()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "schema version is %d\n", version)
+	case "verify":
+		if len(args) != 2 {
+			return errors.New("zoom: verify requires exactly one argument: <model>")
+		}
+		report, err := Verify(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, report)
+		if !report.Ok() {
+			return fmt.Errorf("zoom: stored data for %s does not match the registered type", args[1])
+		}
+	default:
+		return fmt.Errorf("zoom: unknown command %s.\n%s", cmd, CommandUsage)
+	}
+	return nil
+}
@@ -0,0 +1,823 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File cluster.go contains code for connecting to a Redis Cluster, which is
+// enabled by setting Configuration.Cluster. Commands are sent to the node which
+// serves the hash slot of their key, following MOVED and ASK redirects, and
+// transactions are split into one MULTI/EXEC block per hash slot.
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// clusterSlots is the number of hash slots in a Redis Cluster.
+const clusterSlots = 16384
+
+// clusterMaxRedirects is the maximum number of times a command is retried
+// after a MOVED, ASK, TRYAGAIN or CLUSTERDOWN reply before the error is
+// returned.
+var clusterMaxRedirects = 16
+
+// clusterRetryInterval is how long to wait before retrying a command after a
+// TRYAGAIN or CLUSTERDOWN reply, e.g. while a slot is being migrated or a
+// replica is being promoted.
+var clusterRetryInterval = 50 * time.Millisecond
+
+// modelKeyName returns the name of the type as it appears in its keys. In
+// cluster mode the name is wrapped in braces, which makes it the hash tag for
+// the keys, so that all the keys for a type are stored in the same hash slot
+// and can be used together in transactions and scripts.
+func modelKeyName(modelName string) string {
+	if currentConfiguration.Cluster {
+		return "{" + modelName + "}"
+	}
+	return modelName
+}
+
+// hashTag returns the part of key which is hashed to find its slot, i.e. the
+// part between the first { and the next } if it is not empty, or the whole key
+// otherwise.
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// keySlot returns the hash slot for key.
+func keySlot(key string) int {
+	return int(crc16([]byte(hashTag(key))) % clusterSlots)
+}
+
+// crc16 returns the CRC16 (XMODEM) checksum of data, which is the checksum used
+// by Redis Cluster to assign keys to hash slots.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keylessCommands are the commands which do not have a key and are sent to the
+// default node.
+var keylessCommands = map[string]bool{
+	"":             true,
+	"ASKING":       true,
+	"AUTH":         true,
+	"CLIENT":       true,
+	"CLUSTER":      true,
+	"COMMAND":      true,
+	"CONFIG":       true,
+	"ECHO":         true,
+	"INFO":         true,
+	"PING":         true,
+	"PSUBSCRIBE":   true,
+	"PUBLISH":      true,
+	"PUNSUBSCRIBE": true,
+	"QUIT":         true,
+	"RANDOMKEY":    true,
+	"READONLY":     true,
+	"READWRITE":    true,
+	"SELECT":       true,
+	"SUBSCRIBE":    true,
+	"TIME":         true,
+	"UNSUBSCRIBE":  true,
+	"UNWATCH":      true,
+	"WAIT":         true,
+}
+
+// broadcastCommands are the commands which apply to the whole database. They
+// are sent to every master and the replies are combined.
+var broadcastCommands = map[string]bool{
+	"DBSIZE":   true,
+	"FLUSHALL": true,
+	"FLUSHDB":  true,
+	"KEYS":     true,
+	"SCRIPT":   true,
+}
+
+// commandKey returns the key which determines which node the command is sent
+// to, or false if the command does not have a key.
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch cmd {
+	case "EVAL", "EVALSHA":
+		// the first key follows the script and the number of keys
+		if len(args) > 2 && argString(args[1]) != "0" {
+			return argString(args[2]), true
+		}
+		return "", false
+	case "XREAD", "XREADGROUP":
+		for i := 0; i+1 < len(args); i++ {
+			if strings.ToUpper(argString(args[i])) == "STREAMS" {
+				return argString(args[i+1]), true
+			}
+		}
+		return "", false
+	case "XGROUP", "XINFO", "OBJECT":
+		// the first argument is a subcommand
+		if len(args) > 1 {
+			return argString(args[1]), true
+		}
+		return "", false
+	case "SCAN":
+		// the keys which match a pattern with a hash tag are all in the same
+		// slot, so they can be scanned on the node which serves it
+		for i := 0; i+1 < len(args); i++ {
+			if strings.ToUpper(argString(args[i])) == "MATCH" {
+				pattern := argString(args[i+1])
+				if tag := hashTag(pattern); tag != pattern && !strings.ContainsAny(tag, `*?[\`) {
+					return pattern, true
+				}
+			}
+		}
+		return "", false
+	}
+	if keylessCommands[cmd] || len(args) == 0 {
+		return "", false
+	}
+	return argString(args[0]), true
+}
+
+// argString returns the string representation of a command argument, which
+// is the same as the one redigo sends to the database.
+func argString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	case float64:
+		return strconv.FormatFloat(arg, 'g', -1, 64)
+	case bool:
+		if arg {
+			return "1"
+		}
+		return "0"
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(arg)
+	}
+}
+
+// clusterRedirect is a MOVED or ASK reply, which means the command must be
+// sent to a different node.
+type clusterRedirect struct {
+	ask  bool
+	slot int
+	addr string
+}
+
+// parseRedirect returns the redirect in err, or false if err is not a MOVED or
+// ASK reply.
+func parseRedirect(err error) (clusterRedirect, bool) {
+	rerr, ok := err.(redis.Error)
+	if !ok {
+		return clusterRedirect{}, false
+	}
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return clusterRedirect{}, false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return clusterRedirect{}, false
+	}
+	return clusterRedirect{ask: fields[0] == "ASK", slot: slot, addr: fields[2]}, true
+}
+
+// isClusterRetryError returns true iff err means the command can be retried
+// after waiting a moment.
+func isClusterRetryError(err error) bool {
+	rerr, ok := err.(redis.Error)
+	return ok && (strings.HasPrefix(string(rerr), "TRYAGAIN") || strings.HasPrefix(string(rerr), "CLUSTERDOWN"))
+}
+
+// cluster keeps track of which master serves each hash slot of a Redis
+// Cluster. The topology is discovered with CLUSTER SLOTS the first time it is
+// needed, and again whenever a MOVED reply or a connection error suggests it
+// has changed.
+type cluster struct {
+	seeds []string
+	dial  func(addr string) (redis.Conn, error)
+
+	mu      sync.RWMutex
+	loaded  bool
+	slots   []string // the address of the master for each slot
+	masters []string
+	// refreshing is 1 while the topology is being refreshed in the background
+	refreshing int32
+}
+
+// newCluster returns a cluster which discovers its topology from the seed
+// nodes and connects to the nodes with dial.
+func newCluster(seeds []string, dial func(addr string) (redis.Conn, error)) *cluster {
+	return &cluster{
+		seeds: seeds,
+		dial:  dial,
+		slots: make([]string, clusterSlots),
+	}
+}
+
+// refresh discovers the topology of the cluster by asking each of the known
+// nodes in turn for CLUSTER SLOTS until one of them replies.
+func (cl *cluster) refresh() error {
+	cl.mu.RLock()
+	addrs := append(append([]string{}, cl.masters...), cl.seeds...)
+	cl.mu.RUnlock()
+	var lastErr error
+	for _, addr := range addrs {
+		slots, masters, err := cl.clusterSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cl.mu.Lock()
+		cl.slots, cl.masters, cl.loaded = slots, masters, true
+		cl.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("zoom: could not discover the cluster topology: %s", lastErr)
+}
+
+// refreshInBackground refreshes the topology in a separate goroutine, unless
+// it is already being refreshed.
+func (cl *cluster) refreshInBackground() {
+	if !atomic.CompareAndSwapInt32(&cl.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&cl.refreshing, 0)
+		cl.refresh()
+	}()
+}
+
+// clusterSlots returns the address of the master for each slot and the
+// addresses of all the masters, according to the node at addr.
+func (cl *cluster) clusterSlots(addr string) ([]string, []string, error) {
+	conn, err := cl.dial(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, nil, err
+	}
+	slots := make([]string, clusterSlots)
+	masters := []string{}
+	seen := map[string]bool{}
+	for _, r := range ranges {
+		// each range is the first slot, the last slot, the master and then
+		// any replicas, where each node is its ip, port and id
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, nil, fmt.Errorf("zoom: unexpected reply from CLUSTER SLOTS: %v", r)
+		}
+		start, err := redis.Int(fields[0], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		end, err := redis.Int(fields[1], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		master, err := clusterNodeAddr(fields[2], addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if start < 0 || end >= clusterSlots || start > end {
+			return nil, nil, fmt.Errorf("zoom: invalid slot range in reply from CLUSTER SLOTS: %d-%d", start, end)
+		}
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = master
+		}
+		if !seen[master] {
+			seen[master] = true
+			masters = append(masters, master)
+		}
+	}
+	if len(masters) == 0 {
+		return nil, nil, fmt.Errorf("zoom: no slots are assigned according to %s", addr)
+	}
+	return slots, masters, nil
+}
+
+// clusterNodeAddr returns the address of a node in the reply from CLUSTER
+// SLOTS. An empty ip means the node which sent the reply, whose address is
+// from.
+func clusterNodeAddr(node interface{}, from string) (string, error) {
+	fields, err := redis.Values(node, nil)
+	if err != nil || len(fields) < 2 {
+		return "", fmt.Errorf("zoom: unexpected node in reply from CLUSTER SLOTS: %v", node)
+	}
+	ip, err := redis.String(fields[0], nil)
+	if err != nil {
+		return "", err
+	}
+	port, err := redis.Int(fields[1], nil)
+	if err != nil {
+		return "", err
+	}
+	if ip == "" {
+		if host, _, err := net.SplitHostPort(from); err == nil {
+			ip = host
+		}
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+// ensureLoaded discovers the topology if it has not been discovered yet.
+func (cl *cluster) ensureLoaded() error {
+	cl.mu.RLock()
+	loaded := cl.loaded
+	cl.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	return cl.refresh()
+}
+
+// slotAddr returns the address of the master which serves slot. If no master
+// serves it, the address of the default node is returned, which will redirect
+// the command if the slot has been assigned since.
+func (cl *cluster) slotAddr(slot int) (string, error) {
+	if err := cl.ensureLoaded(); err != nil {
+		return "", err
+	}
+	cl.mu.RLock()
+	addr := cl.slots[slot]
+	cl.mu.RUnlock()
+	if addr == "" {
+		return cl.defaultAddr()
+	}
+	return addr, nil
+}
+
+// defaultAddr returns the address of the node which keyless commands are sent
+// to.
+func (cl *cluster) defaultAddr() (string, error) {
+	if err := cl.ensureLoaded(); err != nil {
+		return "", err
+	}
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.masters[0], nil
+}
+
+// allMasters returns the addresses of every master.
+func (cl *cluster) allMasters() ([]string, error) {
+	if err := cl.ensureLoaded(); err != nil {
+		return nil, err
+	}
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return append([]string{}, cl.masters...), nil
+}
+
+// moved records that slot is now served by the master at addr, and refreshes
+// the rest of the topology in the background since other slots have probably
+// moved too.
+func (cl *cluster) moved(slot int, addr string) {
+	cl.mu.Lock()
+	cl.slots[slot] = addr
+	cl.mu.Unlock()
+	cl.refreshInBackground()
+}
+
+// clusterConn is a redis.Conn for a Redis Cluster. It keeps a connection to
+// each node it has used, and sends each command to the node which serves the
+// slot of its key. Commands which were sent with Send are executed right away,
+// except for commands in a transaction. Commands between MULTI and EXEC are
+// grouped by slot, and each group is executed in its own MULTI/EXEC block on
+// the node which serves it, so a transaction is only atomic for the keys in
+// the same slot. Commands without a key, including the pub/sub commands, are
+// sent to the default node.
+type clusterConn struct {
+	cluster *cluster
+	conns   map[string]redis.Conn
+	// pending holds the replies for the commands which were sent but have not
+	// been received yet
+	pending []clusterReply
+	// multi is true after MULTI, and queued holds the commands which will be
+	// executed by EXEC
+	multi  bool
+	queued []clusterCommand
+	// subscribed is the connection to the default node which pub/sub replies
+	// are received from
+	subscribed redis.Conn
+	// closed is 1 after Close is called, which may be from another goroutine
+	// while a pub/sub message is being received
+	closed int32
+}
+
+// clusterReply is the reply for a command which was sent with Send. If conn is
+// not nil, the reply has not been read from conn yet.
+type clusterReply struct {
+	reply interface{}
+	err   error
+	conn  redis.Conn
+}
+
+// clusterCommand is a command queued in a transaction.
+type clusterCommand struct {
+	name string
+	args []interface{}
+}
+
+// newClusterConn returns a new connection to the cluster.
+func newClusterConn(cl *cluster) *clusterConn {
+	return &clusterConn{
+		cluster: cl,
+		conns:   map[string]redis.Conn{},
+	}
+}
+
+// nodeConn returns the connection to the node at addr, connecting to it if
+// needed.
+func (c *clusterConn) nodeConn(addr string) (redis.Conn, error) {
+	if conn, found := c.conns[addr]; found {
+		return conn, nil
+	}
+	conn, err := c.cluster.dial(addr)
+	if err != nil {
+		// the node may have failed, in which case another node has taken over
+		// its slots
+		c.cluster.refreshInBackground()
+		return nil, err
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+// checkNodeConn closes and forgets the connection to the node at addr if it
+// has failed, so that the next command reconnects.
+func (c *clusterConn) checkNodeConn(addr string) {
+	if conn, found := c.conns[addr]; found && conn.Err() != nil {
+		conn.Close()
+		delete(c.conns, addr)
+		c.cluster.refreshInBackground()
+	}
+}
+
+// errClusterConnClosed is returned when a clusterConn is used after it has
+// been closed.
+var errClusterConnClosed = errors.New("zoom: cluster connection closed")
+
+// closedErr returns errClusterConnClosed if the connection has been closed.
+func (c *clusterConn) closedErr() error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return errClusterConnClosed
+	}
+	return nil
+}
+
+func (c *clusterConn) Close() error {
+	var err error
+	for addr, conn := range c.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(c.conns, addr)
+	}
+	atomic.StoreInt32(&c.closed, 1)
+	return err
+}
+
+func (c *clusterConn) Err() error {
+	if err := c.closedErr(); err != nil {
+		return err
+	}
+	if c.subscribed != nil {
+		return c.subscribed.Err()
+	}
+	return nil
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.closedErr(); err != nil {
+		return nil, err
+	}
+	// receive the replies for the commands which were sent, which are
+	// returned by Do("") and otherwise discarded (except for errors, like
+	// redigo does)
+	var reply interface{}
+	var err error
+	if len(c.pending) > 0 {
+		if err := c.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	for len(c.pending) > 0 {
+		r, e := c.Receive()
+		if cmd == "" {
+			reply, err = r, e
+		} else if err == nil {
+			if _, ok := e.(redis.Error); ok {
+				err = e
+			}
+		}
+	}
+	if cmd == "" {
+		return reply, err
+	}
+	r, e := c.execute(strings.ToUpper(cmd), args)
+	if err != nil {
+		return r, err
+	}
+	return r, e
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	if err := c.closedErr(); err != nil {
+		return err
+	}
+	name := strings.ToUpper(cmd)
+	switch name {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		// the replies are received from the default node along with any
+		// messages, so they can't be executed right away
+		addr, err := c.cluster.defaultAddr()
+		if err != nil {
+			return err
+		}
+		conn, err := c.nodeConn(addr)
+		if err != nil {
+			return err
+		}
+		if err := conn.Send(cmd, args...); err != nil {
+			c.checkNodeConn(addr)
+			return err
+		}
+		c.subscribed = conn
+		c.pending = append(c.pending, clusterReply{conn: conn})
+		return nil
+	}
+	reply, err := c.execute(name, args)
+	c.pending = append(c.pending, clusterReply{reply: reply, err: err})
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	if err := c.closedErr(); err != nil {
+		return err
+	}
+	if c.subscribed != nil {
+		return c.subscribed.Flush()
+	}
+	return nil
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if err := c.closedErr(); err != nil {
+		return nil, err
+	}
+	if len(c.pending) == 0 {
+		if c.subscribed == nil {
+			return nil, fmt.Errorf("zoom: no replies to receive from the cluster")
+		}
+		// a pub/sub message
+		return c.subscribed.Receive()
+	}
+	r := c.pending[0]
+	c.pending = c.pending[1:]
+	if r.conn != nil {
+		return r.conn.Receive()
+	}
+	return r.reply, r.err
+}
+
+// execute executes a command, or queues it if it is part of a transaction.
+// name is the name of the command in upper case.
+func (c *clusterConn) execute(name string, args []interface{}) (interface{}, error) {
+	switch {
+	case name == "MULTI":
+		if c.multi {
+			return nil, redis.Error("ERR MULTI calls can not be nested")
+		}
+		c.multi, c.queued = true, nil
+		return "OK", nil
+	case name == "EXEC":
+		if !c.multi {
+			return nil, redis.Error("ERR EXEC without MULTI")
+		}
+		queued := c.queued
+		c.multi, c.queued = false, nil
+		return c.exec(queued)
+	case name == "DISCARD":
+		if !c.multi {
+			return nil, redis.Error("ERR DISCARD without MULTI")
+		}
+		c.multi, c.queued = false, nil
+		return "OK", nil
+	case name == "WATCH":
+		return nil, fmt.Errorf("zoom: WATCH is not supported in cluster mode")
+	case c.multi:
+		c.queued = append(c.queued, clusterCommand{name: name, args: args})
+		return "QUEUED", nil
+	case broadcastCommands[name]:
+		return c.broadcast(name, args)
+	}
+	key, keyed := commandKey(name, args)
+	if !keyed {
+		addr, err := c.cluster.defaultAddr()
+		if err != nil {
+			return nil, err
+		}
+		return c.doOnNode(addr, name, args)
+	}
+	return c.doInSlot(keySlot(key), name, args)
+}
+
+// doOnNode executes a command on the node at addr.
+func (c *clusterConn) doOnNode(addr string, name string, args []interface{}) (interface{}, error) {
+	conn, err := c.nodeConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.Do(name, args...)
+	c.checkNodeConn(addr)
+	return reply, err
+}
+
+// doInSlot executes a command on the node which serves slot, following any
+// redirects.
+func (c *clusterConn) doInSlot(slot int, name string, args []interface{}) (interface{}, error) {
+	return c.retryInSlot(slot, func(conn redis.Conn, asking bool) (interface{}, error) {
+		if asking {
+			if err := conn.Send("ASKING"); err != nil {
+				return nil, err
+			}
+		}
+		return conn.Do(name, args...)
+	})
+}
+
+// retryInSlot calls f with the connection to the node which serves slot, and
+// calls it again with a different connection after a redirect. asking is true
+// if f must send ASKING first.
+func (c *clusterConn) retryInSlot(slot int, f func(conn redis.Conn, asking bool) (interface{}, error)) (interface{}, error) {
+	addr, err := c.cluster.slotAddr(slot)
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	for i := 0; ; i++ {
+		conn, err := c.nodeConn(addr)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := f(conn, asking)
+		c.checkNodeConn(addr)
+		if i == clusterMaxRedirects {
+			return reply, err
+		}
+		if redirect, ok := parseRedirect(err); ok {
+			if !redirect.ask {
+				c.cluster.moved(redirect.slot, redirect.addr)
+			}
+			addr, asking = redirect.addr, redirect.ask
+			continue
+		}
+		if isClusterRetryError(err) {
+			time.Sleep(clusterRetryInterval)
+			if addr, err = c.cluster.slotAddr(slot); err != nil {
+				return nil, err
+			}
+			asking = false
+			continue
+		}
+		return reply, err
+	}
+}
+
+// broadcast executes a command which applies to the whole database on every
+// master and combines the replies.
+func (c *clusterConn) broadcast(name string, args []interface{}) (interface{}, error) {
+	addrs, err := c.cluster.allMasters()
+	if err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	var size int64
+	keys := []interface{}{}
+	for _, addr := range addrs {
+		r, err := c.doOnNode(addr, name, args)
+		if err != nil {
+			return r, err
+		}
+		switch name {
+		case "DBSIZE":
+			n, err := redis.Int64(r, nil)
+			if err != nil {
+				return nil, err
+			}
+			size += n
+			reply = size
+		case "KEYS":
+			values, err := redis.Values(r, nil)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, values...)
+			reply = keys
+		default:
+			if reply == nil {
+				reply = r
+			}
+		}
+	}
+	return reply, nil
+}
+
+// exec executes the commands in a transaction, in one MULTI/EXEC block for
+// each slot (in the order the slots were first used), and returns the replies
+// in the order of the commands. Commands without a key are executed in a block
+// of their own on the default node.
+func (c *clusterConn) exec(commands []clusterCommand) (interface{}, error) {
+	const noSlot = -1
+	slots := []int{}
+	groups := map[int][]int{}
+	for i, cmd := range commands {
+		slot := noSlot
+		if key, keyed := commandKey(cmd.name, cmd.args); keyed {
+			slot = keySlot(key)
+		}
+		if _, found := groups[slot]; !found {
+			slots = append(slots, slot)
+		}
+		groups[slot] = append(groups[slot], i)
+	}
+	replies := make([]interface{}, len(commands))
+	for _, slot := range slots {
+		indexes := groups[slot]
+		execBlock := func(conn redis.Conn, asking bool) (interface{}, error) {
+			if asking {
+				if err := conn.Send("ASKING"); err != nil {
+					return nil, err
+				}
+			}
+			if err := conn.Send("MULTI"); err != nil {
+				return nil, err
+			}
+			for _, i := range indexes {
+				if err := conn.Send(commands[i].name, commands[i].args...); err != nil {
+					return nil, err
+				}
+			}
+			// the error for the first command which could not be queued (e.g.
+			// a redirect) is returned instead of EXECABORT
+			return conn.Do("EXEC")
+		}
+		var reply interface{}
+		var err error
+		if slot == noSlot {
+			var addr string
+			if addr, err = c.cluster.defaultAddr(); err == nil {
+				var conn redis.Conn
+				if conn, err = c.nodeConn(addr); err == nil {
+					reply, err = execBlock(conn, false)
+					c.checkNodeConn(addr)
+				}
+			}
+		} else {
+			reply, err = c.retryInSlot(slot, execBlock)
+		}
+		if err != nil {
+			return nil, err
+		}
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != len(indexes) {
+			return nil, fmt.Errorf("zoom: expected %d replies from EXEC but got %d", len(indexes), len(values))
+		}
+		for j, i := range indexes {
+			replies[i] = values[j]
+		}
+	}
+	return replies, nil
+}
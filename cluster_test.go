@@ -0,0 +1,370 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+package zoom
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestKeySlot(t *testing.T) {
+	if got := crc16([]byte("123456789")); got != 0x31C3 {
+		t.Errorf("Incorrect checksum. Expected %x but got %x", 0x31C3, got)
+	}
+	if got := keySlot("foo"); got != 12182 {
+		t.Errorf("Incorrect slot for foo. Expected 12182 but got %d", got)
+	}
+	if keySlot("{user1000}.following") != keySlot("user1000") {
+		t.Error("Expected keys with the same hash tag to be in the same slot")
+	}
+	// an empty hash tag is not used
+	if keySlot("foo{}{bar}") != int(crc16([]byte("foo{}{bar}"))%clusterSlots) {
+		t.Error("Expected the whole key to be hashed when the hash tag is empty")
+	}
+}
+
+// fakeClusterNode is a node in a fakeCluster, which stores string values.
+type fakeClusterNode struct {
+	addr  string
+	data  map[string]string
+	execs int
+}
+
+// fakeCluster simulates a Redis Cluster with nodes which are only accessed
+// through fakeClusterConns. owners holds the address of the node which
+// actually serves each slot, which may differ from the reply to CLUSTER SLOTS,
+// and importing holds the address of the node each slot is being migrated to.
+type fakeCluster struct {
+	nodes     map[string]*fakeClusterNode
+	owners    []string
+	importing map[int]string
+	slots     []interface{}
+}
+
+func newFakeCluster(addrs ...string) *fakeCluster {
+	fc := &fakeCluster{
+		nodes:     map[string]*fakeClusterNode{},
+		owners:    make([]string, clusterSlots),
+		importing: map[int]string{},
+	}
+	for _, addr := range addrs {
+		fc.nodes[addr] = &fakeClusterNode{addr: addr, data: map[string]string{}}
+	}
+	return fc
+}
+
+// assign makes the node at addr serve the slots from start to end, and
+// includes the range in the reply to CLUSTER SLOTS.
+func (fc *fakeCluster) assign(start, end int, addr string) {
+	for slot := start; slot <= end; slot++ {
+		fc.owners[slot] = addr
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	fc.slots = append(fc.slots, []interface{}{int64(start), int64(end), []interface{}{[]byte(host), int64(portNum), []byte("id")}})
+}
+
+func (fc *fakeCluster) dial(addr string) (redis.Conn, error) {
+	node, found := fc.nodes[addr]
+	if !found {
+		return nil, fmt.Errorf("no node at %s", addr)
+	}
+	return &fakeClusterConn{cluster: fc, node: node}, nil
+}
+
+// fakeClusterConn is a connection to a fakeClusterNode.
+type fakeClusterConn struct {
+	cluster *fakeCluster
+	node    *fakeClusterNode
+	asking  bool
+	multi   bool
+	aborted bool
+	queued  [][]interface{}
+	pending [][]interface{}
+}
+
+func (c *fakeClusterConn) Close() error { return nil }
+func (c *fakeClusterConn) Err() error   { return nil }
+func (c *fakeClusterConn) Flush() error { return nil }
+
+func (c *fakeClusterConn) Receive() (interface{}, error) {
+	return nil, fmt.Errorf("Receive is not supported")
+}
+
+func (c *fakeClusterConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+// Do handles the pending commands and then cmd, and returns the first error
+// like a redigo connection.
+func (c *fakeClusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	var firstErr error
+	for _, p := range c.pending {
+		if _, err := c.handle(p[0].(string), p[1:]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.pending = nil
+	reply, err := c.handle(cmd, args)
+	if firstErr != nil {
+		return reply, firstErr
+	}
+	return reply, err
+}
+
+func (c *fakeClusterConn) handle(cmd string, args []interface{}) (interface{}, error) {
+	switch cmd {
+	case "CLUSTER":
+		return c.cluster.slots, nil
+	case "ASKING":
+		c.asking = true
+		return "OK", nil
+	case "MULTI":
+		c.multi, c.aborted, c.queued = true, false, nil
+		return "OK", nil
+	case "EXEC":
+		c.multi, c.asking = false, false
+		if c.aborted {
+			return nil, redis.Error("EXECABORT Transaction discarded because of previous errors.")
+		}
+		c.node.execs++
+		replies := []interface{}{}
+		for _, q := range c.queued {
+			reply, _ := c.run(q[0].(string), q[1:])
+			replies = append(replies, reply)
+		}
+		return replies, nil
+	}
+	if err := c.redirect(argString(args[0])); err != nil {
+		if c.multi {
+			c.aborted = true
+		}
+		return nil, err
+	}
+	if c.multi {
+		c.queued = append(c.queued, append([]interface{}{cmd}, args...))
+		return "QUEUED", nil
+	}
+	c.asking = false
+	return c.run(cmd, args)
+}
+
+// redirect returns a MOVED or ASK error if the node does not serve key.
+func (c *fakeClusterConn) redirect(key string) error {
+	slot := keySlot(key)
+	owner := c.cluster.owners[slot]
+	target, migrating := c.cluster.importing[slot]
+	switch {
+	case owner == c.node.addr && migrating:
+		if _, found := c.node.data[key]; !found {
+			return redis.Error(fmt.Sprintf("ASK %d %s", slot, target))
+		}
+		return nil
+	case owner == c.node.addr, migrating && target == c.node.addr && c.asking:
+		return nil
+	}
+	return redis.Error(fmt.Sprintf("MOVED %d %s", slot, owner))
+}
+
+func (c *fakeClusterConn) run(cmd string, args []interface{}) (interface{}, error) {
+	switch cmd {
+	case "SET":
+		c.node.data[argString(args[0])] = argString(args[1])
+		return "OK", nil
+	case "GET":
+		if value, found := c.node.data[argString(args[0])]; found {
+			return []byte(value), nil
+		}
+		return nil, nil
+	}
+	return nil, redis.Error("ERR unknown command " + cmd)
+}
+
+// keyInSlots returns a key whose slot is between start and end.
+func keyInSlots(start, end int) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if slot := keySlot(key); slot >= start && slot <= end {
+			return key
+		}
+	}
+}
+
+func TestClusterRedirects(t *testing.T) {
+	fc := newFakeCluster("127.0.0.1:7000", "127.0.0.1:7001")
+	nodeA, nodeB := fc.nodes["127.0.0.1:7000"], fc.nodes["127.0.0.1:7001"]
+	// CLUSTER SLOTS claims node A serves every slot, but half of them have
+	// moved to node B
+	fc.assign(0, clusterSlots-1, nodeA.addr)
+	for slot := clusterSlots / 2; slot < clusterSlots; slot++ {
+		fc.owners[slot] = nodeB.addr
+	}
+	keyA, keyB := keyInSlots(0, clusterSlots/2-1), keyInSlots(clusterSlots/2, clusterSlots-1)
+	conn := newClusterConn(newCluster([]string{nodeA.addr}, fc.dial))
+	defer conn.Close()
+
+	// MOVED
+	if _, err := conn.Do("SET", keyB, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if nodeB.data[keyB] != "b" {
+		t.Errorf("Expected %s to be stored on node B after a MOVED redirect", keyB)
+	}
+	if got, err := redis.String(conn.Do("GET", keyB)); err != nil {
+		t.Error(err)
+	} else if got != "b" {
+		t.Errorf("Expected %q but got %q", "b", got)
+	}
+
+	// ASK
+	askKey := keyInSlots(keySlot(keyB)+1, clusterSlots-1)
+	fc.importing[keySlot(askKey)] = nodeA.addr
+	if _, err := conn.Do("SET", askKey, "ask"); err != nil {
+		t.Fatal(err)
+	}
+	if nodeA.data[askKey] != "ask" {
+		t.Errorf("Expected %s to be stored on node A after an ASK redirect", askKey)
+	}
+	delete(fc.importing, keySlot(askKey))
+
+	// transactions should be split into one MULTI/EXEC block per slot, and
+	// the replies returned in order
+	nodeA.execs, nodeB.execs = 0, 0
+	conn.Send("MULTI")
+	conn.Send("SET", keyA, "a")
+	conn.Send("GET", keyB)
+	conn.Send("SET", keyB, "b2")
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"OK", []byte("b"), "OK"}
+	if !reflect.DeepEqual(replies, expected) {
+		t.Errorf("Incorrect replies from EXEC.\nExpected: %v\nGot:      %v", expected, replies)
+	}
+	if nodeA.execs != 1 || nodeB.execs != 1 {
+		t.Errorf("Expected one EXEC on each node but got %d and %d", nodeA.execs, nodeB.execs)
+	}
+	if nodeA.data[keyA] != "a" || nodeB.data[keyB] != "b2" {
+		t.Errorf("Expected the transaction to be executed on both nodes but got %v and %v", nodeA.data, nodeB.data)
+	}
+
+	// keys for the same model should be in the same slot
+	currentConfiguration.Cluster = true
+	defer func() { currentConfiguration.Cluster = false }()
+	ms := modelSpec{modelName: "person"}
+	if keySlot(ms.indexKey()) != keySlot(ms.key("foo")) || keySlot(ms.indexKey()) != keySlot(ms.changeLogKey()) {
+		t.Error("Expected all the keys for a type to be in the same slot")
+	}
+}
+
+func TestClusterMode(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	addr := *address
+	if *clusterAddress != "" {
+		addr = *clusterAddress
+	}
+	Init(&Configuration{
+		Address: addr,
+		Network: *network,
+		Cluster: true,
+	})
+	conn := GetConn()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		if *clusterAddress != "" {
+			t.Fatal(err)
+		}
+		testingDial()
+		t.Skipf("Skipping cluster tests because %s is not a cluster node (%s). Use -cluster-address to run them.", addr, err)
+	}
+	// the cluster always uses database 0, which is flushed by testingTearDown
+	if n, err := redis.Int(conn.Do("DBSIZE")); err != nil || n != 0 {
+		testingDial()
+		t.Fatalf("The cluster at %s is not empty, test can not continue (DBSIZE: %d, error: %v)", addr, n, err)
+	}
+
+	// saving a model with related models uses keys in more than one slot in
+	// the same transaction
+	many := []*basicModel{{Attr: "one"}, {Attr: "two"}}
+	if err := MSave(Models(many)); err != nil {
+		t.Fatal(err)
+	}
+	parent := &oneToManyModelDifferentType{Attr: "parent", Many: many}
+	if err := Save(parent); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := redis.Strings(conn.Do("KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "{basicModel}:") && !strings.HasPrefix(key, "{oneToManyModelDifferentType}:") {
+			t.Errorf("Expected every key to start with a hash tag but got %s", key)
+		}
+	}
+	if exists, err := redis.Bool(conn.Do("EXISTS", "{oneToManyModelDifferentType}:"+parent.Id+":Many")); err != nil {
+		t.Error(err)
+	} else if !exists {
+		t.Error("Expected the relationship key to have the hash tag for the type")
+	}
+	found := &oneToManyModelDifferentType{}
+	if err := ScanById(parent.Id, found); err != nil {
+		t.Fatal(err)
+	} else if len(found.Many) != 2 {
+		t.Errorf("Expected 2 related models but got %d", len(found.Many))
+	}
+
+	// queries, counts and aggregates
+	models, err := newIndexedPrimativesModels(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range models {
+		m.Int = i + 1
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+	results := []*indexedPrimativesModel{}
+	if err := NewQuery("indexedPrimativesModel").Filter("Int >", 2).Order("-Int").Scan(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Int != 5 || results[2].Int != 3 {
+		t.Errorf("Incorrect query results: %+v", results)
+	}
+	if count, err := NewQuery("indexedPrimativesModel").Filter("Int >", 1).Filter("Int <", 5).Count(); err != nil {
+		t.Error(err)
+	} else if count != 3 {
+		t.Errorf("Expected a count of 3 but got %d", count)
+	}
+	if sum, err := NewQuery("indexedPrimativesModel").Sum("Int"); err != nil {
+		t.Error(err)
+	} else if sum != 15 {
+		t.Errorf("Expected a sum of 15 but got %v", sum)
+	}
+
+	if err := Delete(parent); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := Exists("oneToManyModelDifferentType", parent.Id); err != nil {
+		t.Error(err)
+	} else if exists {
+		t.Error("Expected the model to be deleted")
+	}
+	if n, err := redis.Int(conn.Do("DBSIZE")); err != nil {
+		t.Error(err)
+	} else if n == 0 {
+		t.Error("Expected DBSIZE to include the keys on every node")
+	}
+}
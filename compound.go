@@ -0,0 +1,321 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File compound.go contains code related to compound indexes, which are
+// specified with the zoom:"index=name" struct tag or with RegisterIndex.
+// A compound index consists of one or more prefix fields followed by a
+// single sort field. For each distinct combination of values of the prefix
+// fields, there is a sorted set of model ids ordered by the sort field.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// compoundIndex describes an index on more than one field. The last field
+// is used to order the ids in each sorted set and the others form the prefix.
+type compoundIndex struct {
+	name   string
+	fields []*fieldSpec
+}
+
+// maps a registered model name to the field names for each compound index
+// specified with RegisterIndex
+var registeredIndexes = map[string][][]string{}
+
+// indexCompoundScript moves a model id into the sorted set for its current
+// prefix values. KEYS[1] is the hash which keeps track of the sorted set and
+// member for each model id, and KEYS[2] is the new sorted set. ARGV[1] is the
+// model id, ARGV[2] is the score and ARGV[3] is the member.
+var indexCompoundScript = `
+local old = redis.call('HGET', KEYS[1], ARGV[1])
+if old then
+	local oldMember = redis.call('HGET', KEYS[1], ARGV[1] .. ':member')
+	redis.call('ZREM', old, oldMember)
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+redis.call('HMSET', KEYS[1], ARGV[1], KEYS[2], ARGV[1] .. ':member', ARGV[3])
+return {}`
+
+// unindexCompoundScript removes a model id from the sorted set it is currently
+// in. KEYS[1] is the hash which keeps track of the sorted set and member for
+// each model id. ARGV[1] is the model id.
+var unindexCompoundScript = `
+local old = redis.call('HGET', KEYS[1], ARGV[1])
+if old then
+	local oldMember = redis.call('HGET', KEYS[1], ARGV[1] .. ':member')
+	redis.call('ZREM', old, oldMember)
+	redis.call('HDEL', KEYS[1], ARGV[1], ARGV[1] .. ':member')
+end
+return {}`
+
+// RegisterIndex adds a compound index on the given fields for the model type
+// identified by modelName, which must already be registered. It is equivalent
+// to adding the zoom:"index=name" struct tag to each of the fields, except that
+// the order of the fields is given explicitly. The last field is the sort field.
+// Queries which have an equality filter on each of the other fields and which
+// are either unordered or ordered by the sort field will use the compound index,
+// along with at most one additional filter on the sort field. Fields which are
+// only part of a compound index can not be used in other queries.
+func RegisterIndex(modelName string, fieldNames ...string) error {
+	if !modelNameIsRegistered(modelName) {
+		return NewModelNameNotRegisteredError(modelName)
+	}
+	registeredIndexes[modelName] = append(registeredIndexes[modelName], fieldNames)
+	if err := compileModelSpecs(); err != nil {
+		// remove the invalid index so the other model specs are still valid
+		indexes := registeredIndexes[modelName]
+		registeredIndexes[modelName] = indexes[:len(indexes)-1]
+		compileModelSpecs()
+		return err
+	}
+	return nil
+}
+
+// addCompoundIndex validates and adds a compound index with the given name
+// and fields to the model spec.
+func (ms *modelSpec) addCompoundIndex(name string, fields []*fieldSpec) error {
+	if len(fields) < 2 {
+		return fmt.Errorf("zoom: compound index %s on type %s must have at least two fields", name, ms.modelType.String())
+	}
+	for _, ci := range ms.compoundIndexes {
+		if ci.name == name {
+			return fmt.Errorf("zoom: compound index %s on type %s was specified more than once", name, ms.modelType.String())
+		}
+	}
+	for _, fs := range fields {
+		switch {
+		case fs.classification == primative && (typeIsNumeric(fs.fieldType) || typeIsTime(fs.fieldType)):
+			fs.indexType = indexNumeric
+		case fs.classification == primative && typeIsString(fs.fieldType):
+			fs.indexType = indexAlpha
+		case fs.classification == primative && typeIsBool(fs.fieldType):
+			fs.indexType = indexBoolean
+		case fs.classification == inconvertible && fs.fieldType.Kind() != reflect.Ptr && typeIsIndexScorer(fs.fieldType):
+			fs.indexType = indexNumeric
+		default:
+			return fmt.Errorf("zoom: Requested compound index on unsupported type %s\n", fs.fieldType.String())
+		}
+	}
+	ms.compoundIndexes = append(ms.compoundIndexes, &compoundIndex{name: name, fields: fields})
+	return nil
+}
+
+// compoundIndexField returns the fieldSpec for the field identified by
+// fieldName if it is part of at least one compound index.
+func (ms modelSpec) compoundIndexField(fieldName string) (*fieldSpec, bool) {
+	for _, ci := range ms.compoundIndexes {
+		for _, fs := range ci.fields {
+			if fs.fieldName == fieldName {
+				return fs, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// compoundSortField returns the fieldSpec for the field identified by
+// fieldName if it is the sort field of at least one compound index.
+func (ms modelSpec) compoundSortField(fieldName string) (*fieldSpec, bool) {
+	for _, ci := range ms.compoundIndexes {
+		if fs := ci.sortField(); fs.fieldName == fieldName {
+			return fs, true
+		}
+	}
+	return nil, false
+}
+
+// prefixFields returns all but the last field of the index
+func (ci *compoundIndex) prefixFields() []*fieldSpec {
+	return ci.fields[:len(ci.fields)-1]
+}
+
+// sortField returns the last field of the index
+func (ci *compoundIndex) sortField() *fieldSpec {
+	return ci.fields[len(ci.fields)-1]
+}
+
+// compoundIndexKey returns the key for the sorted set which holds the ids of
+// all models with the given values for the prefix fields of ci.
+func (ms modelSpec) compoundIndexKey(ci *compoundIndex, prefixValues []reflect.Value) (string, error) {
+	parts := []string{ci.name}
+	for i, fs := range ci.prefixFields() {
+		part, err := compoundKeyPart(fs, prefixValues[i])
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+	return ms.key(strings.Join(parts, ":")), nil
+}
+
+// compoundRefsKey returns the key for the hash which keeps track of the sorted
+// set and member for the id of each model in ci.
+func (ms modelSpec) compoundRefsKey(ci *compoundIndex) string {
+	return ms.key(ci.name + ":refs")
+}
+
+// compoundKeyPart converts the value of a prefix field to the string used in
+// the key for a compound index. Strings are quoted so that the key can't be
+// ambiguous, and numeric values are converted to their score so that equal
+// values always result in the same key.
+func compoundKeyPart(fs *fieldSpec, val reflect.Value) (string, error) {
+	switch fs.indexType {
+	case indexAlpha:
+		return strconv.Quote(val.String()), nil
+	case indexBoolean:
+		return strconv.FormatBool(val.Bool()), nil
+	default:
+		score, err := indexScore(val)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(score, 'f', -1, 64), nil
+	}
+}
+
+// saveModelCompoundIndex adds a command to the transaction which will move the
+// model id into the correct sorted set for the compound index.
+func (t *transaction) saveModelCompoundIndex(mr modelRef, ci *compoundIndex) error {
+	prefixValues := []reflect.Value{}
+	for _, fs := range ci.prefixFields() {
+		prefixValues = append(prefixValues, mr.value(fs.fieldName))
+	}
+	indexKey, err := mr.modelSpec.compoundIndexKey(ci, prefixValues)
+	if err != nil {
+		return err
+	}
+	id := mr.model.GetId()
+	sortField := ci.sortField()
+	val := mr.value(sortField.fieldName)
+	var score interface{}
+	member := id
+	switch sortField.indexType {
+	case indexAlpha:
+		score = 0
+		member = val.String() + " " + id
+	case indexBoolean:
+		if val.Bool() {
+			score = 1
+		} else {
+			score = 0
+		}
+	default:
+		if score, err = indexScore(val); err != nil {
+			return err
+		}
+	}
+	args := redis.Args{}.Add(indexCompoundScript).Add(2).Add(mr.modelSpec.compoundRefsKey(ci)).Add(indexKey)
+	args = args.Add(id).Add(score).Add(member)
+	t.command("EVAL", args, nil)
+	return nil
+}
+
+// removeCompoundIndexes adds commands to the transaction which will remove
+// the model id from all the compound indexes for the model.
+func (t *transaction) removeCompoundIndexes(ms modelSpec, id string) {
+	for _, ci := range ms.compoundIndexes {
+		args := redis.Args{}.Add(unindexCompoundScript).Add(1).Add(ms.compoundRefsKey(ci)).Add(id)
+		t.command("EVAL", args, nil)
+	}
+}
+
+// compoundPlan describes how a compound index can be used to get the ids
+// for some of the filters of a query.
+type compoundPlan struct {
+	index  *compoundIndex
+	prefix []filter // equality filters on the prefix fields, in index order
+	sort   *filter  // an optional filter on the sort field
+}
+
+// compoundPlan returns a plan for the compound index which covers the most
+// filters of the query, along with the filters which are not covered. If no
+// compound index can be used, it returns nil and all the filters.
+func (q *Query) compoundPlan() (*compoundPlan, []filter) {
+	if q.order.relation != nil {
+		return nil, q.filters
+	}
+	var bestPlan *compoundPlan
+	var bestUsed map[int]bool
+	for _, ci := range q.modelSpec.compoundIndexes {
+		sortField := ci.sortField()
+		if q.order.fieldName != "" && q.order.fieldName != sortField.fieldName {
+			// the ids would not be in the correct order
+			continue
+		}
+		plan := &compoundPlan{index: ci}
+		used := map[int]bool{}
+		for _, fs := range ci.prefixFields() {
+			for i, f := range q.filters {
+				if !used[i] && f.relation == nil && f.fieldName == fs.fieldName && f.filterType == equal {
+					plan.prefix = append(plan.prefix, f)
+					used[i] = true
+					break
+				}
+			}
+		}
+		if len(plan.prefix) != len(ci.prefixFields()) {
+			// there must be an equality filter for every prefix field
+			continue
+		}
+		for i, f := range q.filters {
+			if !used[i] && f.relation == nil && f.fieldName == sortField.fieldName && f.filterType != notEqual {
+				plan.sort = &q.filters[i]
+				used[i] = true
+				break
+			}
+		}
+		if bestPlan == nil || len(used) > len(bestUsed) {
+			bestPlan, bestUsed = plan, used
+		}
+	}
+	if bestPlan == nil {
+		return nil, q.filters
+	}
+	remaining := []filter{}
+	for i, f := range q.filters {
+		if !bestUsed[i] {
+			remaining = append(remaining, f)
+		}
+	}
+	return bestPlan, remaining
+}
+
+// sendIdDataForCompoundPlan adds commands to the query transaction which will
+// send the ids of all models which match the filters covered by plan, using
+// a single sorted set of the compound index.
+func (q *Query) sendIdDataForCompoundPlan(plan *compoundPlan, dataKey string) error {
+	prefixValues := []reflect.Value{}
+	for _, f := range plan.prefix {
+		prefixValues = append(prefixValues, f.filterValue)
+	}
+	indexKey, err := q.modelSpec.compoundIndexKey(plan.index, prefixValues)
+	if err != nil {
+		return err
+	}
+	sortField := plan.index.sortField()
+	reverse := q.order.orderType == descending && q.order.fieldName == sortField.fieldName
+	if plan.sort != nil {
+		return q.sendIdDataForIndexKey(q.modelSpec, indexKey, *plan.sort, dataKey, reverse)
+	}
+	var command string
+	if !reverse {
+		command = "ZRANGE"
+	} else {
+		command = "ZREVRANGE"
+	}
+	args := redis.Args{}.Add(indexKey).Add(0).Add(-1)
+	if sortField.indexType == indexAlpha {
+		q.trans.command(command, args, newSendAlphaIdsHandler(q.trans, dataKey, false))
+	} else {
+		q.trans.command(command, args, newSendDataHandler(q.trans, dataKey))
+	}
+	return nil
+}
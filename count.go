@@ -0,0 +1,223 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File count.go contains code for counting the models which match a query
+// with filters without transferring the matching ids from the database.
+
+package zoom
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// countRange describes some of the ids which match a filter, i.e. the members
+// of the set at key (if kind is "set"), or the members of the sorted set at
+// key with a score between min and max (if kind is "score") or which are
+// lexicographically between min and max (if kind is "lex"). The ids which
+// match a filter are the union of one or more ranges.
+type countRange struct {
+	kind string
+	key  string
+	min  interface{}
+	max  interface{}
+}
+
+// countIntersectionScript counts the ids which match all of the filters of a
+// query. KEYS[1] through KEYS[n-1] are temporary sorted sets, one for each
+// filter, and KEYS[n] is a temporary sorted set for the intersection. ARGV
+// consists of the number of ranges for each filter followed by the kind, key,
+// min and max of each range. The ids for each filter are stored in its
+// temporary set, which are then intersected with ZINTERSTORE. All the
+// temporary keys are deleted before the count is returned.
+var countIntersectionScript = `
+local function store(key, ids, alpha)
+	for i = 1, #ids, 1000 do
+		local args = {}
+		for j = i, math.min(i + 999, #ids) do
+			local id = ids[j]
+			if alpha then
+				id = string.match(id, '([^ ]*)$')
+			end
+			args[#args + 1] = 0
+			args[#args + 1] = id
+		end
+		redis.call('ZADD', key, unpack(args))
+	end
+end
+local a = 1
+for i = 1, #KEYS - 1 do
+	local numRanges = tonumber(ARGV[a])
+	a = a + 1
+	for r = 1, numRanges do
+		local kind, key, min, max = ARGV[a], ARGV[a + 1], ARGV[a + 2], ARGV[a + 3]
+		a = a + 4
+		if kind == 'set' then
+			store(KEYS[i], redis.call('SMEMBERS', key), false)
+		elseif kind == 'lex' then
+			store(KEYS[i], redis.call('ZRANGEBYLEX', key, min, max), true)
+		else
+			store(KEYS[i], redis.call('ZRANGEBYSCORE', key, min, max), false)
+		end
+	end
+end
+local dest = KEYS[#KEYS]
+redis.call('ZINTERSTORE', dest, #KEYS - 1, unpack(KEYS, 1, #KEYS - 1))
+local count = redis.call('ZCARD', dest)
+redis.call('DEL', unpack(KEYS))
+return count`
+
+// countRanges returns the ranges for each filter of the query. It returns
+// false if at least one of the filters can't be described by ranges, e.g.
+// because it is on a field of a related model.
+func (q *Query) countRanges() ([][]countRange, bool) {
+	allRanges := [][]countRange{}
+	for _, f := range q.filters {
+		if f.relation != nil || f.byId {
+			return nil, false
+		}
+		if _, found := q.modelSpec.indexTypeForField(f.fieldName); !found {
+			return nil, false
+		}
+		ranges, err := q.modelSpec.countRangesForFilter(f)
+		if err != nil {
+			return nil, false
+		}
+		allRanges = append(allRanges, ranges)
+	}
+	return allRanges, true
+}
+
+// countRangesForFilter returns the ranges which together contain exactly the
+// ids of the models that match f. It mirrors sendIdDataForIndexKey.
+func (ms modelSpec) countRangesForFilter(f filter) ([]countRange, error) {
+	setKey := ms.key(f.redisName)
+	switch f.filterType {
+	case isNull:
+		return []countRange{{"set", ms.nullIndexKey(f.redisName), nil, nil}}, nil
+	case isNotNull:
+		if f.indexType == indexAlpha {
+			return []countRange{{"lex", setKey, "-", "+"}}, nil
+		}
+		return []countRange{{"score", setKey, "-inf", "+inf"}}, nil
+	}
+	switch f.indexType {
+	case indexNumeric:
+		if f.filterType == notEqual {
+			value := f.indexValue
+			return []countRange{
+				{"score", setKey, "-inf", fmt.Sprintf("(%v", value)},
+				{"score", setKey, fmt.Sprintf("(%v", value), "+inf"},
+			}, nil
+		}
+		min, max := getMinMaxForNumericFilter(f)
+		return []countRange{{"score", setKey, min, max}}, nil
+	case indexBoolean:
+		// false is stored as 0 and true as 1
+		val := 0
+		if f.filterValue.Bool() {
+			val = 1
+		}
+		min, max := 0, 1
+		switch f.filterType {
+		case equal:
+			min, max = val, val
+		case notEqual:
+			min, max = 1-val, 1-val
+		case less:
+			max = val - 1
+		case greater:
+			min = val + 1
+		case lessOrEqual:
+			max = val
+		case greaterOrEqual:
+			min = val
+		}
+		if min > max {
+			// nothing can match
+			return []countRange{}, nil
+		}
+		return []countRange{{"score", setKey, min, max}}, nil
+	case indexAlpha:
+		valString := f.filterValue.String()
+		switch f.filterType {
+		case equal:
+			return []countRange{{"lex", setKey, "(" + valString, "(" + valString + delString}}, nil
+		case less:
+			return []countRange{{"lex", setKey, "-", "(" + valString}}, nil
+		case greater:
+			return []countRange{{"lex", setKey, "(" + valString + delString, "+"}}, nil
+		case lessOrEqual:
+			return []countRange{{"lex", setKey, "-", "(" + valString + delString}}, nil
+		case greaterOrEqual:
+			return []countRange{{"lex", setKey, "(" + valString, "+"}}, nil
+		case notEqual:
+			return []countRange{
+				{"lex", setKey, "-", "(" + valString},
+				{"lex", setKey, "(" + valString + delString, "+"},
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("zoom: cannot count filter %s", f.string())
+}
+
+// countFilters returns the number of models which match all the filters
+// described by allRanges. If there is only one filter, the ids in each range
+// are counted directly with ZCOUNT, ZLEXCOUNT or SCARD. Otherwise the ids are
+// intersected in the database by countIntersectionScript, which always runs
+// on the master since it writes temporary keys.
+func (q *Query) countFilters(allRanges [][]countRange) (int, error) {
+	if len(allRanges) == 1 {
+		conn := getReadConn()
+		defer conn.Close()
+		count := 0
+		for _, r := range allRanges[0] {
+			var n int
+			var err error
+			switch r.kind {
+			case "set":
+				n, err = redis.Int(conn.Do("SCARD", r.key))
+			case "lex":
+				n, err = redis.Int(conn.Do("ZLEXCOUNT", r.key, r.min, r.max))
+			default:
+				n, err = redis.Int(conn.Do("ZCOUNT", r.key, r.min, r.max))
+			}
+			if err != nil {
+				return 0, err
+			}
+			count += n
+		}
+		return count, nil
+	}
+	tmpKey := q.modelSpec.ns().key("zoom:tmp:count:" + modelKeyName(q.modelSpec.modelName) + ":" + generateRandomId())
+	keys := redis.Args{}
+	argv := redis.Args{}
+	for i, ranges := range allRanges {
+		keys = keys.Add(fmt.Sprintf("%s:%d", tmpKey, i))
+		argv = argv.Add(len(ranges))
+		for _, r := range ranges {
+			argv = argv.Add(r.kind).Add(r.key).Add(r.min).Add(r.max)
+		}
+	}
+	keys = keys.Add(tmpKey)
+	args := redis.Args{}.Add(countIntersectionScript).Add(len(keys)).AddFlat(keys).AddFlat(argv)
+	conn := GetConn()
+	defer conn.Close()
+	return redis.Int(conn.Do("EVAL", args...))
+}
+
+// limitOffsetCount returns the number of models which would be returned by
+// the query after limit and offset are applied, given the total number of
+// models which match the query.
+func (q *Query) limitOffsetCount(count int) int {
+	if q.offset > uint(count) {
+		return 0
+	}
+	count -= int(q.offset)
+	if q.limit != 0 && uint(count) > q.limit {
+		return int(q.limit)
+	}
+	return count
+}
@@ -0,0 +1,313 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File cursor.go contains code related to keyset pagination, i.e. using
+// an opaque cursor which identifies the last model of one page to get the
+// next page of a query.
+
+package zoom
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// queryCursor is the decoded form of a cursor returned by NextCursor. For
+// ordered queries it holds the score (for numeric and boolean indexes) or the
+// member (for alpha indexes) of the last model along with its id. For
+// unordered queries it holds an SSCAN cursor and, if the last page ended in
+// the middle of the batch for that SSCAN cursor, the last id which was
+// returned from the batch.
+type queryCursor struct {
+	Field  string `json:"f,omitempty"`
+	Score  string `json:"s,omitempty"`
+	Member string `json:"m,omitempty"`
+	Id     string `json:"i,omitempty"`
+	Scan   string `json:"c,omitempty"`
+}
+
+// afterCursorScript returns the ids from the sorted set at KEYS[1] which come
+// after a cursor. ARGV[1] is either "score" or "lex", ARGV[2] is either "asc"
+// or "desc", ARGV[3] is the score or member of the cursor, ARGV[4] is the id
+// of the cursor and ARGV[5] is the maximum number of ids to return (or 0 for
+// no maximum). The position after the cursor is computed every time, so the
+// results are correct even if models were added or removed since the cursor
+// was created. Members with the same score are ordered by id.
+var afterCursorScript = `
+local start
+if ARGV[1] == 'lex' then
+	if ARGV[2] == 'asc' then
+		start = redis.call('ZLEXCOUNT', KEYS[1], '-', '[' .. ARGV[3])
+	else
+		start = redis.call('ZLEXCOUNT', KEYS[1], '[' .. ARGV[3], '+')
+	end
+else
+	local equal = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[3], ARGV[3])
+	if ARGV[2] == 'asc' then
+		start = redis.call('ZCOUNT', KEYS[1], '-inf', '(' .. ARGV[3])
+		for i = 1, #equal do
+			if equal[i] <= ARGV[4] then
+				start = start + 1
+			end
+		end
+	else
+		start = redis.call('ZCOUNT', KEYS[1], '(' .. ARGV[3], '+inf')
+		for i = 1, #equal do
+			if equal[i] >= ARGV[4] then
+				start = start + 1
+			end
+		end
+	end
+end
+local stop = -1
+if tonumber(ARGV[5]) > 0 then
+	stop = start + tonumber(ARGV[5]) - 1
+end
+if ARGV[2] == 'asc' then
+	return redis.call('ZRANGE', KEYS[1], start, stop)
+end
+return redis.call('ZREVRANGE', KEYS[1], start, stop)`
+
+// After specifies that the query should only return models which come after
+// the cursor, which should be a value returned by NextCursor for a previous
+// page of the same query. An empty cursor means the query should start from
+// the beginning. Unlike Offset, the position of the cursor is found directly
+// from the index for the order of the query, so pages are not affected by
+// models which are saved or deleted before the cursor. After can be used with
+// queries ordered by an indexed field (but not by a pointer field or a field
+// of a related model) and with unordered queries without filters, which are
+// iterated through with SSCAN. It cannot be combined with Offset.
+func (q *Query) After(cursor string) *Query {
+	c := &queryCursor{}
+	if cursor != "" {
+		data, err := base64.URLEncoding.DecodeString(cursor)
+		if err == nil {
+			err = json.Unmarshal(data, c)
+		}
+		if err != nil {
+			q.setErrorIfNone(fmt.Errorf("zoom: invalid cursor %q", cursor))
+			return q
+		}
+	}
+	q.after = c
+	return q
+}
+
+// NextCursor returns a cursor which can be passed to After to get the next
+// page of results, i.e. the models which come after the last model returned
+// by the most recent run of the query. It returns an empty string if there
+// are no more results, i.e. if the query has no limit or if the last run
+// returned fewer models than the limit. For unordered queries, NextCursor can
+// only be used if After was used (typically with an empty cursor for the
+// first page).
+func (q *Query) NextCursor() (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	if q.limit == 0 || uint(len(q.pageIds)) < q.limit {
+		return "", nil
+	}
+	lastId := q.pageIds[len(q.pageIds)-1]
+	c := queryCursor{Field: q.cursorField()}
+	if q.order.fieldName == "" {
+		if q.after == nil {
+			return "", errors.New("zoom: NextCursor can only be used for unordered queries if After was used.")
+		}
+		if q.scanCursor == "0" && q.scanLastId == "" {
+			// the scan is finished
+			return "", nil
+		}
+		c.Scan, c.Id = q.scanCursor, q.scanLastId
+	} else {
+		if err := q.checkCursorOrder(); err != nil {
+			return "", err
+		}
+		conn := getReadConn()
+		defer conn.Close()
+		c.Id = lastId
+		if q.order.indexType == indexAlpha {
+			value, err := redis.String(conn.Do("HGET", q.modelSpec.key(lastId), q.order.redisName))
+			if err != nil {
+				if err == redis.ErrNil {
+					return "", NewKeyNotFoundError(q.modelSpec.key(lastId), q.modelSpec.modelType)
+				}
+				return "", err
+			}
+			c.Member = value + " " + lastId
+		} else {
+			score, err := redis.String(conn.Do("ZSCORE", q.orderIndexKey(), lastId))
+			if err != nil {
+				if err == redis.ErrNil {
+					return "", NewKeyNotFoundError(q.modelSpec.key(lastId), q.modelSpec.modelType)
+				}
+				return "", err
+			}
+			c.Score = score
+		}
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// orderIndexKey returns the key for the sorted set used to order the query.
+func (q *Query) orderIndexKey() string {
+	return q.modelSpec.key(q.order.redisName)
+}
+
+// cursorField returns the name of the field used to order the query, prefixed
+// with "-" if the order is descending. It is stored in each cursor so that a
+// cursor can't be used for a query with a different order.
+func (q *Query) cursorField() string {
+	if q.order.orderType == descending {
+		return "-" + q.order.fieldName
+	}
+	return q.order.fieldName
+}
+
+// checkCursorOrder returns an error if the order of the query can not be used
+// with a cursor.
+func (q *Query) checkCursorOrder() error {
+	if q.ordersClientSide() {
+		return fmt.Errorf("zoom: cursors cannot be used for queries ordered by %s.", q.order.fieldName)
+	}
+	if _, found := q.modelSpec.indexTypeForField(q.order.fieldName); !found {
+		return fmt.Errorf("zoom: cursors cannot be used for queries ordered by %s because it is only indexed as part of a compound index.", q.order.fieldName)
+	}
+	return nil
+}
+
+// checkAfter returns an error if the cursor given to After can not be used
+// with the query.
+func (q *Query) checkAfter() error {
+	if q.offset != 0 {
+		return errors.New("zoom: After and Offset cannot be used on the same query.")
+	}
+	if *q.after != (queryCursor{}) && q.after.Field != q.cursorField() {
+		return errors.New("zoom: the cursor given to After was for a query with a different order.")
+	}
+	if q.order.fieldName == "" {
+		if len(q.filters) != 0 {
+			return errors.New("zoom: After cannot be used for queries with filters and without an order.")
+		}
+		if q.scopesDeleted() {
+			return errors.New("zoom: After cannot be used for queries which return deleted models and do not have an order.")
+		}
+		return nil
+	}
+	return q.checkCursorOrder()
+}
+
+// sendIdDataForCursor adds a command to the query transaction which will send
+// the ids from the index for the order of the query which come after the
+// cursor given to After. If limit is not 0, at most limit ids are sent.
+func (q *Query) sendIdDataForCursor(dataKey string, limit uint) {
+	direction, cmd := "asc", "ZRANGE"
+	if q.order.orderType == descending {
+		direction, cmd = "desc", "ZREVRANGE"
+	}
+	if q.after.Id == "" {
+		// an empty cursor means the query should start from the beginning
+		stop := -1
+		if limit != 0 {
+			stop = int(limit) - 1
+		}
+		q.sendIdDataForOrderIndex(cmd, redis.Args{}.Add(q.orderIndexKey()).Add(0).Add(stop), dataKey)
+		return
+	}
+	args := redis.Args{}.Add(afterCursorScript).Add(1).Add(q.orderIndexKey())
+	if q.order.indexType == indexAlpha {
+		args = args.Add("lex").Add(direction).Add(q.after.Member)
+	} else {
+		args = args.Add("score").Add(direction).Add(q.after.Score)
+	}
+	args = args.Add(q.after.Id).Add(limit)
+	q.sendIdDataForOrderIndex("EVAL", args, dataKey)
+}
+
+// sendIdDataForOrderIndex adds the given command, which reads ids from the
+// index for the order of the query, to the query transaction and sends the
+// ids as transaction data.
+func (q *Query) sendIdDataForOrderIndex(cmd string, args redis.Args, dataKey string) {
+	if q.order.indexType == indexAlpha {
+		// special case for parsing ids from the redis response
+		q.trans.command(cmd, args, newSendAlphaIdsHandler(q.trans, dataKey, false))
+	} else {
+		q.trans.command(cmd, args, newSendDataHandler(q.trans, dataKey))
+	}
+}
+
+// scanIdsAfterCursor uses SSCAN to get the ids for an unordered query which
+// come after the cursor given to After, and keeps track of the position of the
+// scan so that NextCursor can return it. When a page ends in the middle of a
+// batch, the next page resumes after the last id it returned rather than at a
+// fixed position, so ids added to or removed from the batch in between do not
+// cause other ids to be skipped. SSCAN may still return the same id more than
+// once if the set of all models changes between pages.
+func (q *Query) scanIdsAfterCursor() ([]string, error) {
+	conn := getReadConn()
+	defer conn.Close()
+	cursor, lastId := q.after.Scan, q.after.Id
+	if cursor == "" {
+		cursor = "0"
+	}
+	count := q.limit
+	if count == 0 {
+		count = defaultBatchSize
+	}
+	ids := []string{}
+	for {
+		reply, err := redis.Values(conn.Do("SSCAN", q.modelSpec.indexKey(), cursor, "COUNT", count))
+		if err != nil {
+			return nil, err
+		}
+		var next string
+		var scanned []string
+		if _, err := redis.Scan(reply, &next, &scanned); err != nil {
+			return nil, err
+		}
+		remaining := scanned
+		if lastId != "" {
+			remaining = idsAfter(scanned, lastId)
+			lastId = ""
+		}
+		if q.limit != 0 && uint(len(ids)+len(remaining)) >= q.limit {
+			n := int(q.limit) - len(ids)
+			ids = append(ids, remaining[:n]...)
+			if n == len(remaining) {
+				// the next page starts with the next batch
+				q.scanCursor, q.scanLastId = next, ""
+			} else {
+				// the next page starts in the middle of this batch
+				q.scanCursor, q.scanLastId = cursor, remaining[n-1]
+			}
+			return ids, nil
+		}
+		ids = append(ids, remaining...)
+		cursor = next
+		if cursor == "0" {
+			q.scanCursor, q.scanLastId = "0", ""
+			return ids, nil
+		}
+	}
+}
+
+// idsAfter returns the ids in batch which come after lastId. If lastId is no
+// longer in the batch, i.e. the model was deleted since the previous page, the
+// whole batch is returned, even though it may include ids which were already
+// returned.
+func idsAfter(batch []string, lastId string) []string {
+	for i, id := range batch {
+		if id == lastId {
+			return batch[i+1:]
+		}
+	}
+	return batch
+}
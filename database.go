@@ -22,17 +22,64 @@ import (
 // Configuration contains various options. It should be created once
 // and passed in to the Init function during application startup.
 type Configuration struct {
-	Address  string // Address to connect to. Default: "localhost:6379"
-	Network  string // Network to use. Default: "tcp"
-	Database int    // Database id to use (using SELECT). Default: 0
+	Address   string // Address to connect to. Default: "localhost:6379"
+	Network   string // Network to use. Default: "tcp"
+	Database  int    // Database id to use (using SELECT). Default: 0
+	ChangeLog bool   // Record the changes to every type of model in a redis stream (see ChangeLogReader). Default: false
+	// ChangeLogMaxLen is the approximate maximum number of entries kept in the
+	// change log for each type of model. Older entries are trimmed when new
+	// ones are added (with XADD MAXLEN ~), even if a ChangeLogReader has not
+	// read them yet. If it is 0, the change logs are never trimmed and it is
+	// up to the application to trim them (e.g. with XTRIM). Default: 0
+	ChangeLogMaxLen int
+	// MaxRelatedScan is the maximum number of models a query with a filter or
+	// order on a field of a related model (e.g. "Author.Country") will scan.
+	// Such queries read the relationship of every model of the queried type,
+	// so their cost grows with the number of models, and a query which would
+	// scan more than this number of models returns an error instead. If it is
+	// 0, the default is used. Use a negative number for no limit. Default:
+	// 10000
+	MaxRelatedScan int
+	// CacheSize is the maximum number of models kept in the in-process cache
+	// used by FindById and the other functions which find models. Default: 0
+	// (the cache is disabled)
+	CacheSize int
+	// CacheTTL is how long models are kept in the cache, unless their type
+	// specifies a different duration with the zoom:"cache=<duration>" tag on
+	// DefaultData. If it is 0, only the types which specify a duration are
+	// cached. Default: 0
+	CacheTTL time.Duration
+	// KeyPrefix is added to the start of every key zoom reads or writes,
+	// followed by a colon, so that more than one application can share the
+	// same database. See also WithNamespace. Default: "" (no prefix)
+	KeyPrefix string
+	// Cluster connects to a Redis Cluster, using Address as the first node to
+	// discover the others from. The name of each type is used as the hash tag
+	// for its keys (e.g. "{Person}:all"), so that all the keys for a type are
+	// stored on the same node. Database is ignored. Default: false
+	Cluster bool
+	// Sentinel finds the master through Redis Sentinel instead of connecting
+	// to Address, so that zoom connects to the new master after a failover.
+	// Any password in Address is still used. It is ignored if Cluster is set.
+	// Default: none (Sentinel is not used)
+	Sentinel SentinelConfiguration
 }
 
 var pool *redis.Pool
 
+// readPool is the connection pool for the replicas, which is used by queries
+// when Configuration.Sentinel.ReadFromReplicas is set. Otherwise it is nil.
+var readPool *redis.Pool
+
+// currentConfiguration is the configuration passed to Init, with any zero
+// values replaced by their defaults.
+var currentConfiguration = defaultConfiguration
+
 var defaultConfiguration = Configuration{
-	Address:  "localhost:6379",
-	Network:  "tcp",
-	Database: 0,
+	Address:        "localhost:6379",
+	Network:        "tcp",
+	Database:       0,
+	MaxRelatedScan: 10000,
 }
 
 // GetConn gets a connection from the connection pool and returns it.
@@ -43,59 +90,118 @@ func GetConn() redis.Conn {
 	return pool.Get()
 }
 
+// getReadConn gets a connection which can be used for commands which only read
+// data, which is a connection to a replica if reads are routed to replicas.
+func getReadConn() redis.Conn {
+	if readPool != nil {
+		return readPool.Get()
+	}
+	return pool.Get()
+}
+
 // Init starts the Zoom library and creates a connection pool. It accepts
 // a Configuration struct as an argument. Any zero values in the configuration
 // will fallback to their default values. Init should be called once during
 // application startup.
 func Init(passedConfig *Configuration) {
 	config := getConfiguration(passedConfig)
+	currentConfiguration = config
+	dialNode := func(address string) (redis.Conn, error) {
+		return dial(config, address)
+	}
+	var cl *cluster
+	var sn *sentinel
+	if config.Cluster {
+		cl = newCluster([]string{nodeAddress(config)}, dialNode)
+	} else if len(config.Sentinel.Addresses) != 0 {
+		sn = newSentinel(config.Sentinel.Addresses, config.Sentinel.MasterName, func(address string) (redis.Conn, error) {
+			return redis.DialTimeout(config.Network, address, sentinelTimeout, sentinelTimeout, sentinelTimeout)
+		})
+	}
 	pool = &redis.Pool{
 		MaxIdle:     10,
 		MaxActive:   0,
 		IdleTimeout: 240 * time.Second,
 		Dial: func() (redis.Conn, error) {
-
-			u, err := url.Parse(config.Address)
-			if err != nil {
-				return nil, err
+			switch {
+			case cl != nil:
+				return newClusterConn(cl), nil
+			case sn != nil:
+				return sn.dialMaster(dialNode)
+			}
+			return dialNode(nodeAddress(config))
+		},
+	}
+	readPool = nil
+	if sn != nil {
+		pool.TestOnBorrow = sn.testOnBorrow
+		if config.Sentinel.ReadFromReplicas {
+			readPool = &redis.Pool{
+				MaxIdle:     10,
+				MaxActive:   0,
+				IdleTimeout: 240 * time.Second,
+				Dial: func() (redis.Conn, error) {
+					return sn.dialReplica(dialNode)
+				},
+				TestOnBorrow: sn.testOnBorrow,
 			}
+		}
+	}
+	startCache(config)
+}
 
-			address := config.Address
+// nodeAddress returns the address to connect to from config.Address, which
+// may be a url.
+func nodeAddress(config Configuration) string {
+	if u, err := url.Parse(config.Address); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return config.Address
+}
 
-			if u.Host != "" {
-				address = u.Host
-			}
+// dial connects to the redis server at address, authenticating with the
+// password in config.Address if it is a url, and selects config.Database
+// unless config.Cluster is set.
+func dial(config Configuration, address string) (redis.Conn, error) {
+	u, err := url.Parse(config.Address)
+	if err != nil {
+		return nil, err
+	}
 
-			c, err := redis.Dial(config.Network, address)
-			if err != nil {
-				return nil, err
-			}
+	c, err := redis.Dial(config.Network, address)
+	if err != nil {
+		return nil, err
+	}
 
-			if u.User != nil {
-				pw, ok := u.User.Password()
-				if !ok {
-					return nil, err
-				}
-				_, err = c.Do("AUTH", pw)
-				if err != nil {
-					return nil, err
-				}
+	if u.User != nil {
+		pw, ok := u.User.Password()
+		if !ok {
+			return nil, err
+		}
+		_, err = c.Do("AUTH", pw)
+		if err != nil {
+			return nil, err
+		}
 
-			}
+	}
 
-			if _, err := c.Do("select", strconv.Itoa(config.Database)); err != nil {
-				c.Close()
-				return nil, err
-			}
-			return c, err
-		},
+	if !config.Cluster {
+		if _, err := c.Do("select", strconv.Itoa(config.Database)); err != nil {
+			c.Close()
+			return nil, err
+		}
 	}
+	return c, err
 }
 
 // Close closes the connection pool and shuts down the Zoom library.
 // It should be run when application exits, e.g. using defer.
 func Close() {
+	stopCache()
 	pool.Close()
+	if readPool != nil {
+		readPool.Close()
+	}
 }
 
 // KeyExists returns true iff a given key exists in redis.
@@ -149,6 +255,9 @@ func getConfiguration(passedConfig *Configuration) Configuration {
 		newConfig.Network = defaultConfiguration.Network
 	}
 	// since the zero value for int is 0, we can skip config.Database
+	if newConfig.MaxRelatedScan == 0 {
+		newConfig.MaxRelatedScan = defaultConfiguration.MaxRelatedScan
+	}
 
 	return newConfig
 }
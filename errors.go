@@ -10,6 +10,7 @@ package zoom
 import (
 	"fmt"
 	"reflect"
+	"strings"
 )
 
 // TODO: add more custom error types based on common use cases throughout the package
@@ -96,3 +97,61 @@ func (e *ModelNotFoundError) Error() string {
 func NewModelNotFoundError() *ModelNotFoundError {
 	return &ModelNotFoundError{}
 }
+
+// UniqueConstraintError is returned from Save and MSave if a field with the
+// zoom:"unique" struct tag has a value which is already used by another model
+// of the same type. ConflictingId is the id of the model which already has the
+// value.
+type UniqueConstraintError struct {
+	ModelName     string
+	FieldName     string
+	ConflictingId string
+}
+
+func (e *UniqueConstraintError) Error() string {
+	return fmt.Sprintf("zoom: the value of field %s for model %s must be unique. It is already used by the model with id %s", e.FieldName, e.ModelName, e.ConflictingId)
+}
+
+func NewUniqueConstraintError(modelName, fieldName, conflictingId string) *UniqueConstraintError {
+	return &UniqueConstraintError{modelName, fieldName, conflictingId}
+}
+
+// FieldError describes a single problem found while validating a model.
+// Field is empty for errors returned by the Validate method of a model which
+// implements Validator, and Rule is the option from the zoom struct tag which
+// failed (e.g. "required" or "len<=255"), or "Validate".
+type FieldError struct {
+	ModelName string
+	Id        string
+	Field     string
+	Rule      string
+	Message   string
+}
+
+func (e FieldError) String() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s %s", e.ModelName, e.Message)
+	}
+	return fmt.Sprintf("%s.%s %s", e.ModelName, e.Field, e.Message)
+}
+
+// ValidationError is returned from Save and MSave if any of the models are
+// invalid, either because a field does not satisfy the validation options in
+// its zoom struct tag or because the Validate method of a model which
+// implements Validator returned an error. Fields lists every problem found for
+// every model, and none of the models are saved.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.String()
+	}
+	return fmt.Sprintf("zoom: validation failed: %s", strings.Join(problems, "; "))
+}
+
+func NewValidationError(fields []FieldError) *ValidationError {
+	return &ValidationError{fields}
+}
@@ -0,0 +1,285 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File expire.go contains code for models which expire after some amount of
+// time, which is enabled by embedding Expirable.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// sweepBatchSize is the maximum number of expired models which are deleted
+// in a single transaction.
+var sweepBatchSize = 1000
+
+var expirableType = reflect.TypeOf(Expirable{})
+
+// Expirable can be embedded into model structs to make them expire. When
+// ExpiresAt is not the zero time, the model is deleted (along with its
+// indexes, external lists and sets, and relationships) by the first query,
+// count, or sweep which runs after ExpiresAt. FindById and the other find
+// functions return a KeyNotFoundError for expired models, and queries never
+// return them, even if they have not been deleted yet. ExpiresAt is stored in
+// the main hash like any other time field.
+type Expirable struct {
+	ExpiresAt time.Time
+}
+
+// Expirer is an interface for models which expire. Any struct which includes
+// an embedded Expirable satisfies the Expirer interface.
+type Expirer interface {
+	GetExpiresAt() time.Time
+	SetExpiresAt(time.Time)
+}
+
+func (e Expirable) GetExpiresAt() time.Time {
+	return e.ExpiresAt
+}
+
+func (e *Expirable) SetExpiresAt(t time.Time) {
+	e.ExpiresAt = t
+}
+
+// SetTTL sets ExpiresAt so that the model expires after ttl. The model must
+// be saved for the change to take effect.
+func (e *Expirable) SetTTL(ttl time.Duration) {
+	e.ExpiresAt = time.Now().Add(ttl)
+}
+
+// SaveWithTTL is like Save but also sets the model to expire after ttl. The
+// model must embed Expirable (or otherwise implement Expirer).
+func SaveWithTTL(model Model, ttl time.Duration) error {
+	return defaultNamespace.SaveWithTTL(model, ttl)
+}
+
+// SaveWithTTL is like the package-level SaveWithTTL but saves the model in
+// the namespace.
+func (ns *Namespace) SaveWithTTL(model Model, ttl time.Duration) error {
+	e, ok := model.(Expirer)
+	if !ok {
+		return fmt.Errorf("zoom: error in SaveWithTTL: %T does not implement Expirer (does it embed zoom.Expirable?)", model)
+	}
+	e.SetExpiresAt(time.Now().Add(ttl))
+	return ns.Save(model)
+}
+
+// isExpired returns true iff m implements Expirer and has expired.
+func isExpired(m Model) bool {
+	if e, ok := m.(Expirer); ok {
+		expiresAt := e.GetExpiresAt()
+		return !expiresAt.IsZero() && !expiresAt.After(time.Now())
+	}
+	return false
+}
+
+// checkNotExpired returns a KeyNotFoundError if the model has expired.
+func checkNotExpired(mr modelRef) error {
+	if isExpired(mr.model) {
+		return NewKeyNotFoundError(mr.key(), mr.modelSpec.modelType)
+	}
+	return nil
+}
+
+// expiresKey returns the key for the sorted set of ids of the models which
+// expire, scored by the time they expire in milliseconds since the epoch.
+func (ms modelSpec) expiresKey() string {
+	return ms.key("expires")
+}
+
+// expireScore converts t to a score in the sorted set of expiring models.
+func expireScore(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// saveExpiration adds a command to the transaction which records when the
+// model expires, or that it never expires if ExpiresAt is the zero time.
+func (t *transaction) saveExpiration(mr modelRef) {
+	e := mr.model.(Expirer)
+	if expiresAt := e.GetExpiresAt(); expiresAt.IsZero() {
+		t.command("ZREM", redis.Args{}.Add(mr.modelSpec.expiresKey()).Add(mr.model.GetId()), nil)
+	} else {
+		t.command("ZADD", redis.Args{}.Add(mr.modelSpec.expiresKey()).Add(expireScore(expiresAt)).Add(mr.model.GetId()), nil)
+	}
+}
+
+// removeExpiration adds a command to the transaction which removes the model
+// with the given id from the sorted set of expiring models.
+func (t *transaction) removeExpiration(ms modelSpec, id string) {
+	t.command("ZREM", redis.Args{}.Add(ms.expiresKey()).Add(id), nil)
+}
+
+// deleteExternalKeys adds commands to the transaction which delete the keys
+// for the external lists, external sets and relationships of the model, so
+// that nothing is left behind when it expires.
+func (t *transaction) deleteExternalKeys(mr modelRef) {
+	for _, fields := range []map[string]*fieldSpec{mr.modelSpec.lists, mr.modelSpec.sets, mr.modelSpec.relationships} {
+		for _, fs := range fields {
+			t.delete(mr.key() + ":" + fs.redisName)
+		}
+	}
+}
+
+// sweepExpired deletes all the models of this type which have expired and
+// returns the number of models deleted. It does nothing if the type does not
+// embed Expirable.
+func (ms modelSpec) sweepExpired() (int, error) {
+	if !ms.expirable {
+		return 0, nil
+	}
+	deleted := 0
+	for {
+		conn := GetConn()
+		ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", ms.expiresKey(), "-inf", expireScore(time.Now()), "LIMIT", 0, sweepBatchSize))
+		conn.Close()
+		if err != nil {
+			return deleted, err
+		}
+		if len(ids) == 0 {
+			return deleted, nil
+		}
+		models, err := ms.findModelsById(ids)
+		if err != nil {
+			return deleted, err
+		}
+		t := newTransaction(ms.ns())
+		found := map[string]bool{}
+		removed := 0
+		for _, m := range models {
+			found[m.GetId()] = true
+			// check the stored value again, in case the model was saved with a
+			// new expiration after the ids were retrieved
+			if !isExpired(m) {
+				continue
+			}
+			mr, err := newModelRefFromModel(ms.ns(), m)
+			if err != nil {
+				unlockModels(models)
+				return deleted, err
+			}
+			t.purgeModel(mr)
+			t.deleteExternalKeys(mr)
+			removed++
+		}
+		deleted += removed
+		for _, id := range ids {
+			if !found[id] {
+				// the model no longer exists
+				t.removeExpiration(ms, id)
+				removed++
+			}
+		}
+		err = t.exec()
+		unlockModels(models)
+		if err != nil {
+			return deleted, err
+		}
+		if len(ids) < sweepBatchSize || removed == 0 {
+			// there are no more expired models, or the rest of them were saved
+			// with a new expiration
+			return deleted, nil
+		}
+	}
+}
+
+// SweepExpired deletes all the models which have expired, for every
+// registered type which embeds Expirable, and returns the number of models
+// deleted. Expired models are also deleted automatically whenever a query or
+// count is run for their type, so SweepExpired only needs to be called (e.g.
+// by a Sweeper) to free the memory used by models which are never queried.
+func SweepExpired() (int, error) {
+	return defaultNamespace.SweepExpired()
+}
+
+// SweepExpired is like the package-level SweepExpired but deletes the
+// models which have expired in the namespace.
+func (ns *Namespace) SweepExpired() (int, error) {
+	deleted := 0
+	for modelName := range modelSpecs {
+		ms, _ := ns.modelSpec(modelName)
+		n, err := ms.sweepExpired()
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// Sweeper calls SweepExpired periodically in a separate goroutine. It is
+// returned by StartSweeper.
+type Sweeper struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// StartSweeper starts calling SweepExpired every interval until Stop is
+// called. If SweepExpired returns an error, handleError is called with the
+// error (unless it is nil) and the sweeper keeps running.
+func StartSweeper(interval time.Duration, handleError func(error)) *Sweeper {
+	return defaultNamespace.StartSweeper(interval, handleError)
+}
+
+// StartSweeper is like the package-level StartSweeper but calls the
+// SweepExpired method of the namespace.
+func (ns *Namespace) StartSweeper(interval time.Duration, handleError func(error)) *Sweeper {
+	s := &Sweeper{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := ns.SweepExpired(); err != nil && handleError != nil {
+					handleError(err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Stop stops the sweeper and waits for any sweep in progress to finish.
+func (s *Sweeper) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+// sweepExpired deletes the expired models of the type being queried, so that
+// they are not returned by the query.
+func (q *Query) sweepExpired() error {
+	_, err := q.modelSpec.sweepExpired()
+	return err
+}
+
+// removeExpiredModels removes any models which have expired from the slice
+// pointed to by sliceVal. Models can expire after the query sweeps the expired
+// models and before they are retrieved.
+func removeExpiredModels(sliceVal reflect.Value) {
+	models := sliceVal.Elem()
+	kept := reflect.MakeSlice(models.Type(), 0, models.Len())
+	for i := 0; i < models.Len(); i++ {
+		m := models.Index(i)
+		if isExpired(m.Interface().(Model)) {
+			if s, ok := m.Interface().(Syncer); ok {
+				s.Unlock()
+			}
+			continue
+		}
+		kept = reflect.Append(kept, m)
+	}
+	models.Set(kept)
+}
@@ -0,0 +1,237 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File explain.go contains code for describing how a query will be run,
+// which is useful for finding out why a query is slow.
+
+package zoom
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// idStage keeps track of the commands in the query transaction which get the
+// ids for one of the keys in the idData of a query.
+type idStage struct {
+	key          string
+	description  string
+	firstCommand int
+	// estimate is the estimated number of ids for stages which are computed
+	// without any commands in the transaction, or -1 if it is not known
+	estimate int
+}
+
+// QueryPlan describes how a query will be run. It is returned by
+// Query.Explain.
+type QueryPlan struct {
+	Query             string      `json:"query"`             // the string representation of the query
+	Stages            []PlanStage `json:"stages"`            // each set of ids which is retrieved
+	IntersectionOrder []string    `json:"intersectionOrder"` // the names of the stages, in the order they are intersected
+	OrderedBy         string      `json:"orderedBy"`         // the name of the stage which determines the order of the ids, if any
+	LimitOffset       string      `json:"limitOffset"`       // where limit and offset are applied: "none", "server" or "client"
+}
+
+// PlanStage describes the commands which retrieve one set of ids for a query.
+type PlanStage struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Commands    []PlanCommand `json:"commands"`
+	Estimate    int           `json:"estimate"` // the estimated number of ids, or -1 if unknown
+}
+
+// PlanCommand describes a single command which will be sent to redis.
+type PlanCommand struct {
+	Name     string   `json:"name"`
+	Key      string   `json:"key"`
+	Args     []string `json:"args"`
+	Estimate int      `json:"estimate"` // the estimated number of ids returned, or -1 if unknown
+}
+
+// String returns a human-readable summary of the plan.
+func (p *QueryPlan) String() string {
+	lines := []string{p.Query}
+	for _, stage := range p.Stages {
+		lines = append(lines, fmt.Sprintf("  %s %s: ~%s ids", stage.Name, stage.Description, estimateString(stage.Estimate)))
+		for _, c := range stage.Commands {
+			lines = append(lines, fmt.Sprintf("    %s %s %s: ~%s ids", c.Name, c.Key, strings.Join(c.Args, " "), estimateString(c.Estimate)))
+		}
+	}
+	lines = append(lines, "  intersection order: "+strings.Join(p.IntersectionOrder, ", "))
+	if p.OrderedBy != "" {
+		lines = append(lines, "  ordered by: "+p.OrderedBy)
+	}
+	lines = append(lines, "  limit/offset: "+p.LimitOffset)
+	return strings.Join(lines, "\n")
+}
+
+func estimateString(estimate int) string {
+	if estimate < 0 {
+		return "?"
+	}
+	return strconv.Itoa(estimate)
+}
+
+// Explain returns a plan which describes how the query will be run without
+// running it. The plan includes each command that will be used to retrieve the
+// ids of the matching models along with an estimate of the number of ids it
+// will return (computed with commands such as ZCOUNT and SCARD), the order in
+// which the sets of ids will be intersected, and whether limit and offset are
+// applied by the database or after the ids are retrieved. Only the estimates
+// are retrieved from the database: the ids themselves, including the
+// candidates for a very selective filter and the ids of an unordered query
+// after a cursor, are not. Explain will also return the first error that
+// occured during the lifetime of the query object (if any).
+func (q *Query) Explain() (*QueryPlan, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	q.trans = newReadTransaction(q.modelSpec.ns())
+	defer q.trans.conn.Close()
+	q.explaining = true
+	defer func() {
+		q.explaining = false
+	}()
+	if err := q.sendIdData(); err != nil {
+		return nil, err
+	}
+	plan := &QueryPlan{
+		Query:             q.String(),
+		IntersectionOrder: q.idData,
+		LimitOffset:       "none",
+	}
+	if q.limit != 0 || q.offset != 0 {
+		if q.limitsClientSide() {
+			plan.LimitOffset = "client"
+		} else {
+			plan.LimitOffset = "server"
+		}
+	}
+	if q.order.fieldName != "" {
+		plan.OrderedBy = q.idData[0]
+		for _, key := range q.idData {
+			if key == "primaryIds" {
+				plan.OrderedBy = key
+			}
+		}
+	}
+	conn := getReadConn()
+	defer conn.Close()
+	for i, stage := range q.stages {
+		last := len(q.trans.commands)
+		if i+1 < len(q.stages) {
+			last = q.stages[i+1].firstCommand
+		}
+		planStage := PlanStage{Name: stage.key, Description: stage.description, Commands: []PlanCommand{}}
+		if stage.firstCommand == last {
+			// the ids were computed without any commands in the transaction
+			planStage.Estimate = stage.estimate
+			if ids, err := convertDataToStrings(q.trans.data[stage.key]); err == nil {
+				planStage.Estimate = len(ids)
+			}
+		}
+		for _, c := range q.trans.commands[stage.firstCommand:last] {
+			planCommand, err := explainCommand(conn, c)
+			if err != nil {
+				return nil, err
+			}
+			planStage.Commands = append(planStage.Commands, planCommand)
+			if planStage.Estimate >= 0 && planCommand.Estimate >= 0 {
+				planStage.Estimate += planCommand.Estimate
+			} else {
+				planStage.Estimate = -1
+			}
+		}
+		plan.Stages = append(plan.Stages, planStage)
+	}
+	return plan, nil
+}
+
+// explainCommand returns a description of c along with an estimate of the
+// number of ids it will return.
+func explainCommand(conn redis.Conn, c command) (PlanCommand, error) {
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		if b, ok := arg.([]byte); ok {
+			args[i] = string(b)
+		} else {
+			args[i] = fmt.Sprint(arg)
+		}
+	}
+	pc := PlanCommand{Name: c.name, Estimate: -1}
+	if c.name == "EVAL" {
+		// don't include the script itself
+		args = args[1:]
+		if numKeys, err := strconv.Atoi(args[0]); err == nil && numKeys > 0 {
+			pc.Key = args[1]
+			pc.Args = args[2:]
+		} else {
+			pc.Args = args
+		}
+		return pc, nil
+	}
+	if len(args) > 0 {
+		pc.Key = args[0]
+		pc.Args = args[1:]
+	}
+	var estimate int
+	var err error
+	switch c.name {
+	case "SMEMBERS":
+		estimate, err = redis.Int(conn.Do("SCARD", pc.Key))
+	case "SSCAN":
+		// the scan continues until the limit is reached, so this is only an
+		// upper bound
+		estimate, err = redis.Int(conn.Do("SCARD", pc.Key))
+	case "SRANDMEMBER":
+		if estimate, err = redis.Int(conn.Do("SCARD", pc.Key)); err == nil && len(pc.Args) == 1 {
+			if n, err := strconv.Atoi(pc.Args[0]); err == nil && n < estimate {
+				estimate = n
+			}
+		}
+	case "ZRANGEBYSCORE":
+		estimate, err = redis.Int(conn.Do("ZCOUNT", pc.Key, pc.Args[0], pc.Args[1]))
+	case "ZREVRANGEBYSCORE":
+		estimate, err = redis.Int(conn.Do("ZCOUNT", pc.Key, pc.Args[1], pc.Args[0]))
+	case "ZRANGEBYLEX":
+		estimate, err = redis.Int(conn.Do("ZLEXCOUNT", pc.Key, pc.Args[0], pc.Args[1]))
+	case "ZRANGE", "ZREVRANGE":
+		if estimate, err = redis.Int(conn.Do("ZCARD", pc.Key)); err == nil {
+			estimate = rangeSize(estimate, pc.Args[0], pc.Args[1])
+		}
+	default:
+		return pc, nil
+	}
+	if err != nil {
+		return pc, err
+	}
+	pc.Estimate = estimate
+	return pc, nil
+}
+
+// rangeSize returns the number of elements returned by ZRANGE with the given
+// start and stop for a sorted set with size elements.
+func rangeSize(size int, start, stop string) int {
+	startIndex, err := strconv.Atoi(start)
+	if err != nil {
+		return size
+	}
+	stopIndex, err := strconv.Atoi(stop)
+	if err != nil {
+		return size
+	}
+	if stopIndex < 0 {
+		stopIndex += size
+	}
+	if stopIndex >= size {
+		stopIndex = size - 1
+	}
+	if startIndex > stopIndex {
+		return 0
+	}
+	return stopIndex - startIndex + 1
+}
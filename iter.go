@@ -0,0 +1,324 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File iter.go contains code for iterating through the results of a
+// query in batches, so that large result sets don't need to be held in
+// memory all at once.
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// defaultBatchSize is the number of models retrieved at once by an Iterator
+// if no batch size was specified with Query.BatchSize.
+const defaultBatchSize = 100
+
+// Iterator iterates through the models that match a query, retrieving them
+// from the database in batches. It is returned by Query.Iter. The typical
+// usage looks like this:
+//
+//	iter := zoom.NewQuery("Person").Iter()
+//	person := &Person{}
+//	for iter.Next(person) {
+//		// do something with person
+//	}
+//	if err := iter.Err(); err != nil {
+//		// handle err
+//	}
+type Iterator struct {
+	query  *Query
+	mode   iterMode
+	buffer []Model
+	err    error
+	done   bool
+	// used for iterScan
+	cursor string
+	// used for iterIds
+	remaining []string
+	// used for iterScan and iterRank
+	fetched uint
+}
+
+type iterMode int
+
+const (
+	// iterate through the set of all models with SSCAN
+	iterScan iterMode = iota
+	// iterate through an index with ZRANGE or ZREVRANGE windows
+	iterRank
+	// get all the matching ids at once and then retrieve the models in batches
+	iterIds
+)
+
+// Iter returns an Iterator which can be used to iterate through the models
+// that match the query without retrieving all of them at once. If the query
+// has no filters, the ids are also retrieved in batches using SSCAN (if the
+// query is unordered) or ZRANGE (if the query is ordered). Otherwise all the
+// matching ids are retrieved when the iteration starts, but the models themselves
+// are still retrieved in batches. Use BatchSize to change the number of models
+// retrieved at once. If an unordered query has no filters, models which are
+// saved or deleted during the iteration may or may not be returned, models
+// which are deleted after their id is retrieved are skipped, and a model may
+// be returned more than once if the set of all models is resized during the
+// iteration.
+func (q *Query) Iter() *Iterator {
+	it := &Iterator{query: q, err: q.err, cursor: "0"}
+	if len(q.filters) == 0 && !q.ordersClientSide() && !q.scopesDeleted() {
+		if q.order.fieldName == "" {
+			if q.offset != 0 {
+				it.err = errors.New("zoom: offset cannot be applied to queries without an order.")
+			}
+			it.mode = iterScan
+		} else if _, found := q.modelSpec.indexTypeForField(q.order.fieldName); found {
+			it.mode = iterRank
+		} else {
+			it.mode = iterIds
+		}
+	} else {
+		it.mode = iterIds
+	}
+	return it
+}
+
+// Each calls f for each model that matches the query, retrieving the models in
+// batches in the same way as Iter. If f returns an error, the iteration stops
+// and Each returns the error.
+func (q *Query) Each(f func(Model) error) error {
+	it := q.Iter()
+	for {
+		for len(it.buffer) == 0 {
+			if it.err != nil {
+				return it.err
+			} else if it.done {
+				return nil
+			}
+			it.fetch()
+		}
+		m := it.buffer[0]
+		it.buffer = it.buffer[1:]
+		if err := f(m); err != nil {
+			return err
+		}
+	}
+}
+
+// Next scans the next model into model, which must be a pointer to a struct of
+// the registered type being queried. It returns false when there are no more
+// models or if there was an error. Use Err to check for errors after Next
+// returns false.
+func (it *Iterator) Next(model Model) bool {
+	for len(it.buffer) == 0 {
+		if it.err != nil || it.done {
+			return false
+		}
+		it.fetch()
+	}
+	if reflect.TypeOf(model) != it.query.modelSpec.modelType {
+		it.err = fmt.Errorf("zoom: error in Iterator.Next: expected %s but got %T", it.query.modelSpec.modelType.String(), model)
+		return false
+	}
+	reflect.ValueOf(model).Elem().Set(reflect.ValueOf(it.buffer[0]).Elem())
+	it.buffer = it.buffer[1:]
+	return true
+}
+
+// Err returns the first error that occured during the iteration (if any).
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// batchSize returns the number of models which should be retrieved at once.
+func (it *Iterator) batchSize() uint {
+	if it.query.batchSize == 0 {
+		return defaultBatchSize
+	}
+	return it.query.batchSize
+}
+
+// fetch retrieves the next batch of models and adds them to the buffer. It
+// sets it.done if there are no more models to retrieve.
+func (it *Iterator) fetch() {
+	var ids []string
+	var err error
+	switch it.mode {
+	case iterScan:
+		ids, err = it.nextScanIds()
+	case iterRank:
+		ids, err = it.nextRankIds()
+	case iterIds:
+		ids, err = it.nextIds()
+	}
+	if err != nil {
+		it.err = err
+		return
+	}
+	models, err := it.query.findModels(ids)
+	if err != nil {
+		it.err = err
+		return
+	}
+	for _, m := range models {
+		if isExpired(m) {
+			// the model expired during the iteration
+			if s, ok := m.(Syncer); ok {
+				s.Unlock()
+			}
+			continue
+		}
+		it.buffer = append(it.buffer, m)
+	}
+}
+
+// nextScanIds returns the next batch of ids using SSCAN on the set of all
+// models.
+func (it *Iterator) nextScanIds() ([]string, error) {
+	q := it.query
+	conn := getReadConn()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("SSCAN", q.modelSpec.indexKey(), it.cursor, "COUNT", it.batchSize()))
+	if err != nil {
+		return nil, err
+	}
+	var scanned []string
+	if _, err := redis.Scan(reply, &it.cursor, &scanned); err != nil {
+		return nil, err
+	}
+	if it.cursor == "0" {
+		it.done = true
+	}
+	// SSCAN may return the same id more than once. Duplicates are only removed
+	// within a batch so that the memory used doesn't grow with the number of
+	// models.
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, id := range scanned {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if q.limit != 0 && it.fetched+uint(len(ids)) >= q.limit {
+		ids = ids[:q.limit-it.fetched]
+		it.done = true
+	}
+	it.fetched += uint(len(ids))
+	return ids, nil
+}
+
+// nextRankIds returns the next batch of ids from the index for the order of
+// the query using ZRANGE or ZREVRANGE.
+func (it *Iterator) nextRankIds() ([]string, error) {
+	q := it.query
+	size := it.batchSize()
+	if q.limit != 0 && it.fetched+size >= q.limit {
+		size = q.limit - it.fetched
+		it.done = true
+	}
+	start := int(q.offset + it.fetched)
+	stop := start + int(size) - 1
+	var command string
+	if q.order.orderType == ascending {
+		command = "ZRANGE"
+	} else {
+		command = "ZREVRANGE"
+	}
+	conn := getReadConn()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do(command, q.modelSpec.key(q.order.redisName), start, stop))
+	if err != nil {
+		return nil, err
+	}
+	if uint(len(ids)) < size {
+		it.done = true
+	}
+	if q.order.indexType == indexAlpha {
+		for i, valueAndId := range ids {
+			ids[i] = extractModelIdFromAlphaIndexValue(valueAndId)
+		}
+	}
+	it.fetched += uint(len(ids))
+	return ids, nil
+}
+
+// nextIds returns the next batch of ids from all the ids which match the
+// query, which are retrieved the first time nextIds is called.
+func (it *Iterator) nextIds() ([]string, error) {
+	if it.remaining == nil {
+		ids, err := it.query.IdsOnly()
+		if err != nil {
+			return nil, err
+		}
+		it.remaining = ids
+	}
+	size := int(it.batchSize())
+	if size >= len(it.remaining) {
+		size = len(it.remaining)
+		it.done = true
+	}
+	ids := it.remaining[:size]
+	it.remaining = it.remaining[size:]
+	return ids, nil
+}
+
+// findModels retrieves the models with the given ids in a single transaction,
+// taking into account the includes and excludes of the query. Ids for models
+// which no longer exist are skipped.
+func (q *Query) findModels(ids []string) ([]Model, error) {
+	return q.findModelsIn(newReadTransaction, ids)
+}
+
+// findModelsIn is like findModels, but retrieves the models in a transaction
+// created by newTrans.
+func (q *Query) findModelsIn(newTrans func(*Namespace) *transaction, ids []string) ([]Model, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	t := newTrans(q.modelSpec.ns())
+	models := []Model{}
+	for _, id := range ids {
+		mr, err := newModelRefFromName(q.modelSpec.ns(), q.modelSpec.modelName)
+		if err != nil {
+			return nil, err
+		}
+		mr.model.SetId(id)
+		// findModel locks the model if it is a Syncer, even if it returns an
+		// error, so the model is added before the error is checked in order
+		// to unlock it
+		err = t.findModel(mr, q.getIncludes())
+		models = append(models, mr.model)
+		if err != nil {
+			unlockModels(models)
+			return nil, err
+		}
+	}
+	if err := t.exec(); err != nil {
+		// the models must be unlocked before they are found again, since the
+		// mutexes are not reentrant
+		unlockModels(models)
+		if _, ok := err.(*KeyNotFoundError); !ok {
+			return nil, err
+		} else if len(ids) == 1 {
+			// the model was deleted
+			return nil, nil
+		}
+		// at least one of the models was deleted, so find them one at a time
+		// and skip any which no longer exist
+		models = []Model{}
+		for _, id := range ids {
+			found, err := q.findModelsIn(newTrans, []string{id})
+			if err != nil {
+				unlockModels(models)
+				return nil, err
+			}
+			models = append(models, found...)
+		}
+	}
+	return models, nil
+}
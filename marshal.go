@@ -11,6 +11,7 @@ package zoom
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 )
 
 // Interface MarshalerUnmarshaler defines a handler for marshaling
@@ -50,3 +51,18 @@ func (gobMarshalerUnmarshaler) Unmarshal(data []byte, v interface{}) error {
 	}
 	return nil
 }
+
+// jsonMarshalerUnmarshaler is an implementation of MarshalerUnmarshaler that
+// uses the builtin json encoding. It is used for fields with the zoom:"json"
+// struct tag.
+type jsonMarshalerUnmarshaler struct{}
+
+// Marshal returns the json encoding of v.
+func (jsonMarshalerUnmarshaler) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the json-encoded data and stores the result in the value pointed to by v.
+func (jsonMarshalerUnmarshaler) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
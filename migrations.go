@@ -0,0 +1,362 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File migrations.go contains code for versioning the way models are
+// stored in the database and migrating stored data from one version to
+// the next. It also includes helpers for common migrations.
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// the key which holds the version of the most recent migration that was run
+const schemaVersionKey = "zoom:schema_version"
+
+// the key which is used as a lock to make sure only one process runs
+// migrations at a time
+const schemaLockKey = "zoom:schema_version:lock"
+
+// migrationLockTimeout is the amount of time after which the migration lock
+// expires if it is not refreshed, e.g. because the process running the
+// migrations crashed. The lock is refreshed before each migration.
+var migrationLockTimeout = 5 * time.Minute
+
+// migrationPollInterval is the amount of time to wait between attempts to
+// acquire the migration lock.
+var migrationPollInterval = 100 * time.Millisecond
+
+// migrationLockWait is the maximum amount of time Migrate waits for another
+// process to release the migration lock before returning an error.
+var migrationLockWait = 2 * migrationLockTimeout
+
+// releaseLockScript deletes the lock at KEYS[1] iff it is still held by the
+// process which acquired it, identified by the token in ARGV[1].
+var releaseLockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// refreshLockScript resets the expiration of the lock at KEYS[1] to ARGV[2]
+// milliseconds iff it is still held by the process identified by the token in
+// ARGV[1]. It returns 0 if the lock was lost.
+var refreshLockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`
+
+// setVersionScript sets the schema version at KEYS[2] to ARGV[2] iff the lock
+// at KEYS[1] is still held by the process identified by the token in ARGV[1].
+// It returns 0 if the lock was lost.
+var setVersionScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('SET', KEYS[2], ARGV[2])
+	return 1
+end
+return 0`
+
+// errMigrationLockLost is returned by Migrate when the migration lock expired
+// (or was taken by another process) while the migrations were running.
+var errMigrationLockLost = errors.New("zoom: the migration lock expired while migrations were running. Another process may be running them too")
+
+// schemaKeys returns the keys for the schema version and its lock in the
+// namespace. In cluster mode the lock has the version key as its hash tag, so
+// that both are in the same slot and can be used by the same script.
+func (ns *Namespace) schemaKeys() (versionKey string, lockKey string) {
+	versionKey = ns.key(schemaVersionKey)
+	if currentConfiguration.Cluster && hashTag(versionKey) == versionKey {
+		return versionKey, "{" + versionKey + "}:lock"
+	}
+	return versionKey, ns.key(schemaLockKey)
+}
+
+// MigrationTx is passed to each migration. It provides helpers for common
+// changes to the way models are stored, and a connection which can be used to
+// run any other commands. Commands are run immediately, i.e. not as part of a
+// redis transaction, so migrations should be written so that they can safely
+// be run again if they fail part way through. Any keys used with Conn directly
+// should be passed through Key first, so that they are in the namespace being
+// migrated.
+type MigrationTx struct {
+	Conn    redis.Conn // The connection used to run the migration
+	Version int        // The version of the migration being run
+	ns      *Namespace
+}
+
+// Key returns the key with the prefix for the namespace being migrated, i.e.
+// Configuration.KeyPrefix and the name of the namespace, if any.
+func (tx *MigrationTx) Key(key string) string {
+	return tx.ns.key(key)
+}
+
+// migrations maps a version to the migration which should be run to bring
+// the database up to that version
+var migrations = map[int]func(*MigrationTx) error{}
+
+// RegisterMigration adds a migration which will be run by Migrate to bring the
+// database up to the given version. Versions must be positive and unique, and
+// migrations are always run in order of ascending version. Migrations should be
+// registered during application startup, before calling Migrate.
+func RegisterMigration(version int, migration func(*MigrationTx) error) error {
+	if version <= 0 {
+		return fmt.Errorf("zoom: migration version must be positive. Got: %d", version)
+	}
+	if _, found := migrations[version]; found {
+		return fmt.Errorf("zoom: a migration for version %d was already registered", version)
+	}
+	migrations[version] = migration
+	return nil
+}
+
+// SchemaVersion returns the version of the most recent migration that was run,
+// or 0 if no migrations have been run.
+func SchemaVersion() (int, error) {
+	return defaultNamespace.SchemaVersion()
+}
+
+// SchemaVersion is like the package-level SchemaVersion but returns the
+// schema version of the namespace.
+func (ns *Namespace) SchemaVersion() (int, error) {
+	conn := GetConn()
+	defer conn.Close()
+	version, err := redis.Int(conn.Do("GET", ns.key(schemaVersionKey)))
+	if err != nil && err != redis.ErrNil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Migrate runs all the registered migrations which have a version greater than
+// the current schema version, in order of ascending version. The schema version
+// is updated after each migration succeeds, so running Migrate more than once
+// has no additional effect. Migrate acquires a lock before running any
+// migrations, so it is safe for more than one process to call Migrate at the
+// same time, e.g. during application startup. If a migration returns an error,
+// Migrate returns it immediately and the schema version will be that of the
+// last successful migration. Migrate also returns an error if the lock is held
+// by another process for too long, or if the lock expires while the migrations
+// are running, in which case the schema version is not updated.
+func Migrate() error {
+	return defaultNamespace.Migrate()
+}
+
+// Migrate is like the package-level Migrate but migrates the models in the
+// namespace, which has its own schema version.
+func (ns *Namespace) Migrate() error {
+	conn := GetConn()
+	defer conn.Close()
+
+	// acquire the lock, waiting for any other process to finish first
+	token := generateRandomId()
+	timeout := int64(migrationLockTimeout / time.Millisecond)
+	versionKey, lockKey := ns.schemaKeys()
+	deadline := time.Now().Add(migrationLockWait)
+	for {
+		reply, err := conn.Do("SET", lockKey, token, "NX", "PX", timeout)
+		if err != nil {
+			return err
+		} else if reply != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("zoom: could not acquire the migration lock within %s. Another process may still be running migrations", migrationLockWait)
+		}
+		time.Sleep(migrationPollInterval)
+	}
+	defer conn.Do("EVAL", releaseLockScript, 1, lockKey, token)
+
+	current, err := redis.Int(conn.Do("GET", versionKey))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	versions := []int{}
+	for version := range migrations {
+		if version > current {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	if len(versions) != 0 {
+		// the migrations change models without removing them from the cache
+		defer ClearCache()
+	}
+	for _, version := range versions {
+		if held, err := redis.Bool(conn.Do("EVAL", refreshLockScript, 1, lockKey, token, timeout)); err != nil {
+			return err
+		} else if !held {
+			return errMigrationLockLost
+		}
+		tx := &MigrationTx{Conn: conn, Version: version, ns: ns}
+		if err := migrations[version](tx); err != nil {
+			return fmt.Errorf("zoom: error in migration for version %d: %s", version, err)
+		}
+		if held, err := redis.Bool(conn.Do("EVAL", setVersionScript, 2, lockKey, versionKey, token, version)); err != nil {
+			return err
+		} else if !held {
+			return errMigrationLockLost
+		}
+	}
+	return nil
+}
+
+// eachModelKey calls f with the key for each model of the type identified by
+// modelName, iterating through the set of all ids with SSCAN. The model type
+// does not need to be registered.
+func (tx *MigrationTx) eachModelKey(modelName string, f func(key string) error) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(tx.Conn.Do("SSCAN", tx.Key(modelKeyName(modelName)+":all"), cursor, "COUNT", reindexBatchSize))
+		if err != nil {
+			return err
+		}
+		var ids []string
+		if _, err := redis.Scan(reply, &cursor, &ids); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := f(tx.Key(modelKeyName(modelName) + ":" + id)); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// renameFieldScript renames a field in the main hash for a model, along with
+// any list, set, or relationship key for the field. KEYS[1] is the main hash,
+// ARGV[1] is the old field name and ARGV[2] is the new field name.
+var renameFieldScript = `
+local value = redis.call('HGET', KEYS[1], ARGV[1])
+if value then
+	redis.call('HSET', KEYS[1], ARGV[2], value)
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+local oldKey = KEYS[1] .. ':' .. ARGV[1]
+if redis.call('EXISTS', oldKey) == 1 then
+	redis.call('RENAME', oldKey, KEYS[1] .. ':' .. ARGV[2])
+end
+return {}`
+
+// RenameField renames a field for all models of the type identified by
+// modelName. oldName and newName are the names used in redis, i.e. the value
+// of the redis struct tag if there is one, otherwise the name of the struct
+// field. Any list, set, or relationship keys for the field are renamed too, as
+// well as any indexes on the field. Models which have already been migrated are
+// left alone.
+func (tx *MigrationTx) RenameField(modelName, oldName, newName string) error {
+	if err := tx.eachModelKey(modelName, func(key string) error {
+		_, err := tx.Conn.Do("EVAL", renameFieldScript, 1, key, oldName, newName)
+		return err
+	}); err != nil {
+		return err
+	}
+	// rename the indexes for the field
+	for _, suffix := range []string{"", ":null", ":unique"} {
+		oldKey := tx.Key(modelKeyName(modelName) + ":" + oldName + suffix)
+		if exists, err := redis.Bool(tx.Conn.Do("EXISTS", oldKey)); err != nil {
+			return err
+		} else if exists {
+			if _, err := tx.Conn.Do("RENAME", oldKey, tx.Key(modelKeyName(modelName)+":"+newName+suffix)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ConvertGobToJSON converts the stored values for a field from the default gob
+// encoding to json for all models of the type identified by modelName. It is
+// useful after adding the zoom:"json" struct tag to a field which was already
+// saved. fieldName is the name used in redis, and v should be a pointer to a
+// value of the type of the field, which is used for decoding. Values which
+// are already valid json are left alone.
+func (tx *MigrationTx) ConvertGobToJSON(modelName, fieldName string, v interface{}) error {
+	typ := reflect.TypeOf(v)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return fmt.Errorf("zoom: ConvertGobToJSON requires a pointer as an argument. Got: %T", v)
+	}
+	gobEncoding, jsonEncoding := gobMarshalerUnmarshaler{}, jsonMarshalerUnmarshaler{}
+	return tx.eachModelKey(modelName, func(key string) error {
+		data, err := redis.Bytes(tx.Conn.Do("HGET", key, fieldName))
+		if err != nil {
+			if err == redis.ErrNil {
+				return nil
+			}
+			return err
+		}
+		if string(data) == "NULL" || len(data) == 0 {
+			return nil
+		}
+		val := reflect.New(typ.Elem())
+		if err := jsonEncoding.Unmarshal(data, val.Interface()); err == nil {
+			// the value was already converted
+			return nil
+		}
+		if err := gobEncoding.Unmarshal(data, val.Interface()); err != nil {
+			return fmt.Errorf("could not decode %s of %s: %s", fieldName, key, err)
+		}
+		converted, err := jsonEncoding.Marshal(val.Elem().Interface())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Conn.Do("HSET", key, fieldName, converted)
+		return err
+	})
+}
+
+// listToSetScript converts the list at KEYS[1] to a set with the same members.
+var listToSetScript = `
+if redis.call('TYPE', KEYS[1]).ok == 'list' then
+	local members = redis.call('LRANGE', KEYS[1], 0, -1)
+	redis.call('DEL', KEYS[1])
+	for i = 1, #members do
+		redis.call('SADD', KEYS[1], members[i])
+	end
+end
+return {}`
+
+// setToListScript converts the set at KEYS[1] to a list with the same members.
+var setToListScript = `
+if redis.call('TYPE', KEYS[1]).ok == 'set' then
+	local members = redis.call('SMEMBERS', KEYS[1])
+	redis.call('DEL', KEYS[1])
+	for i = 1, #members do
+		redis.call('RPUSH', KEYS[1], members[i])
+	end
+end
+return {}`
+
+// ListToSet converts the stored values for a field from a list to a set for
+// all models of the type identified by modelName. It should be used when the
+// redisType struct tag for a field changes from "list" to "set". fieldName is
+// the name used in redis. Duplicate values in the list are discarded.
+func (tx *MigrationTx) ListToSet(modelName, fieldName string) error {
+	return tx.eachModelKey(modelName, func(key string) error {
+		_, err := tx.Conn.Do("EVAL", listToSetScript, 1, key+":"+fieldName)
+		return err
+	})
+}
+
+// SetToList converts the stored values for a field from a set to a list for
+// all models of the type identified by modelName. It should be used when the
+// redisType struct tag for a field changes from "set" to "list". fieldName is
+// the name used in redis. Since sets are unordered, the order of the values in
+// the list is undefined.
+func (tx *MigrationTx) SetToList(modelName, fieldName string) error {
+	return tx.eachModelKey(modelName, func(key string) error {
+		_, err := tx.Conn.Do("EVAL", setToListScript, 1, key+":"+fieldName)
+		return err
+	})
+}
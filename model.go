@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
 // DefaultData should be embedded in any struct you wish to save.
@@ -29,6 +30,14 @@ type Model interface {
 	// TODO: add getters and setters for other default fields?
 }
 
+// IndexScorer is an interface for custom field types which can be indexed
+// with the zoom:"index" struct tag. IndexScore should return the score used to
+// order and filter models by the field. Fields which implement IndexScorer are
+// always indexed as numeric fields.
+type IndexScorer interface {
+	IndexScore() float64
+}
+
 type modelSpec struct {
 	modelType        reflect.Type
 	modelName        string
@@ -41,7 +50,14 @@ type modelSpec struct {
 	relationships    map[string]*fieldSpec // pointers to structs of registered types
 	primativeIndexes map[string]*fieldSpec // indexes specified with the zoom:"index" tag on primative field types
 	pointerIndexes   map[string]*fieldSpec // indexes specified with the zoom:"index" tag on pointer to primative field types
+	uniques          map[string]*fieldSpec // unique constraints specified with the zoom:"unique" tag on primative or pointer field types
+	compoundIndexes  []*compoundIndex      // indexes specified with the zoom:"index=name" tag or with RegisterIndex
 	numKeys          int                   // number of keys which might be used to store the model (useful for determining whether the model was found)
+	audit            bool                  // whether changes are recorded in the change log, specified with the zoom:"audit" tag on DefaultData
+	cacheFor         time.Duration         // how long models are kept in the in-process cache, specified with the zoom:"cache=<duration>" tag on DefaultData
+	expirable        bool                  // whether the model embeds Expirable
+	softDelete       bool                  // whether the model embeds SoftDelete
+	namespace        *Namespace            // the namespace for the keys of the model, or nil for the default namespace
 	// TODO add external hashes
 }
 
@@ -75,6 +91,9 @@ type fieldSpec struct {
 	indexType      indexType
 	relType        relationshipType
 	index          int
+	unique         bool
+	marshaler      MarshalerUnmarshaler // used to encode inconvertible fields
+	rules          []validationRule     // validation options from the zoom struct tag
 }
 
 type fieldClassification int
@@ -129,10 +148,11 @@ func newModelSpec(name string, typ reflect.Type) modelSpec {
 		relationships:    make(map[string]*fieldSpec),
 		primativeIndexes: make(map[string]*fieldSpec),
 		pointerIndexes:   make(map[string]*fieldSpec),
+		uniques:          make(map[string]*fieldSpec),
 	}
 }
 
-func newModelRefFromModel(m Model) (modelRef, error) {
+func newModelRefFromModel(ns *Namespace, m Model) (modelRef, error) {
 	mr := modelRef{
 		model: m,
 	}
@@ -140,11 +160,11 @@ func newModelRefFromModel(m Model) (modelRef, error) {
 	if err != nil {
 		return mr, err
 	}
-	mr.modelSpec = modelSpecs[modelName]
+	mr.modelSpec, _ = ns.modelSpec(modelName)
 	return mr, nil
 }
 
-func newModelRefFromInterface(in interface{}) (modelRef, error) {
+func newModelRefFromInterface(ns *Namespace, in interface{}) (modelRef, error) {
 	mr := modelRef{}
 	m, ok := in.(Model)
 	if !ok {
@@ -156,14 +176,13 @@ func newModelRefFromInterface(in interface{}) (modelRef, error) {
 	if err != nil {
 		return mr, err
 	}
-	mr.modelSpec = modelSpecs[modelName]
+	mr.modelSpec, _ = ns.modelSpec(modelName)
 	return mr, nil
 }
 
-func newModelRefFromName(modelName string) (modelRef, error) {
-	mr := modelRef{
-		modelSpec: modelSpecs[modelName],
-	}
+func newModelRefFromName(ns *Namespace, modelName string) (modelRef, error) {
+	mr := modelRef{}
+	mr.modelSpec, _ = ns.modelSpec(modelName)
 	// create a new struct of the proper type
 	val := reflect.New(mr.modelSpec.modelType.Elem())
 	m, ok := val.Interface().(Model)
@@ -215,6 +234,9 @@ func RegisterName(name string, model Model) error {
 	modelTypeToName[typ] = name
 	modelNameToType[name] = typ
 	if err := compileModelSpecs(); err != nil {
+		// the type is invalid, so it should not remain registered
+		delete(modelNameToType, name)
+		delete(modelTypeToName, typ)
 		return err
 	}
 
@@ -235,13 +257,57 @@ func compileModelSpecs() error {
 // TODO: take into account embedded structs
 func compileModelSpec(typ reflect.Type, ms *modelSpec) error {
 
+	// keep track of the fields in each compound index specified with the
+	// zoom:"index=name" tag, in the order they were first seen
+	compoundNames := []string{}
+	compoundFields := map[string][]*fieldSpec{}
+
 	// iterate through fields
 	elem := typ.Elem()
 	numFields := elem.NumField()
 	for i := 0; i < numFields; i++ {
 		field := elem.Field(i)
-		if field.Name == "DefaultData" || field.Name == "Sync" {
-			continue // skip default data and sync
+		if field.Name == "DefaultData" {
+			// options for the model as a whole are specified in the zoom tag
+			// of DefaultData (e.g. audit)
+			if zoomTag := field.Tag.Get("zoom"); zoomTag != "" {
+				for _, op := range strings.Split(zoomTag, ",") {
+					switch op {
+					case "audit":
+						ms.audit = true
+					default:
+						if strings.HasPrefix(op, "cache=") {
+							d, err := time.ParseDuration(strings.TrimPrefix(op, "cache="))
+							if err != nil {
+								return fmt.Errorf("zoom: invalid cache duration specified in struct tag: %s", op)
+							}
+							ms.cacheFor = d
+							continue
+						}
+						return fmt.Errorf("zoom: unrecognized model option specified in struct tag: %s", op)
+					}
+				}
+			}
+			continue // skip default data
+		}
+		if field.Name == "Sync" {
+			continue // skip sync
+		}
+		if field.Anonymous && field.Type == expirableType {
+			// the ExpiresAt field of Expirable is stored like any other time field
+			fs := &fieldSpec{fieldName: "ExpiresAt", redisName: "ExpiresAt", fieldType: timeType, index: i, marshaler: defaultMarshalerUnmarshaler, classification: primative}
+			ms.fieldSpecs = append(ms.fieldSpecs, fs)
+			ms.primatives[fs.fieldName] = fs
+			ms.expirable = true
+			continue
+		}
+		if field.Anonymous && field.Type == softDeleteType {
+			// the DeletedAt field of SoftDelete is stored like any other time field
+			fs := &fieldSpec{fieldName: "DeletedAt", redisName: "DeletedAt", fieldType: timeType, index: i, marshaler: defaultMarshalerUnmarshaler, classification: primative}
+			ms.fieldSpecs = append(ms.fieldSpecs, fs)
+			ms.primatives[fs.fieldName] = fs
+			ms.softDelete = true
+			continue
 		}
 		// get the redisName
 		tag := field.Tag
@@ -251,18 +317,39 @@ func compileModelSpec(typ reflect.Type, ms *modelSpec) error {
 		} else if redisName == "" {
 			redisName = field.Name
 		}
-		fs := &fieldSpec{fieldName: field.Name, redisName: redisName, fieldType: field.Type, index: i}
+		fs := &fieldSpec{fieldName: field.Name, redisName: redisName, fieldType: field.Type, index: i, marshaler: defaultMarshalerUnmarshaler}
 		ms.fieldSpecs = append(ms.fieldSpecs, fs)
 		// parse additional options in the zoom tag (e.g. index)
 		zoomTag := tag.Get("zoom")
 		index := false
 		if zoomTag != "" {
-			options := strings.Split(zoomTag, ",")
+			options, err := splitZoomTag(zoomTag)
+			if err != nil {
+				return err
+			}
 			for _, op := range options {
 				switch op {
 				case "index":
 					index = true
+				case "unique":
+					fs.unique = true
+				case "json":
+					fs.marshaler = jsonMarshalerUnmarshaler{}
 				default:
+					if strings.HasPrefix(op, "index=") {
+						name := strings.TrimPrefix(op, "index=")
+						if _, found := compoundFields[name]; !found {
+							compoundNames = append(compoundNames, name)
+						}
+						compoundFields[name] = append(compoundFields[name], fs)
+						continue
+					}
+					if rule, ok, err := newValidationRule(field.Type, op); err != nil {
+						return err
+					} else if ok {
+						fs.rules = append(fs.rules, rule)
+						continue
+					}
 					return fmt.Errorf("zoom: unrecognized option specified in struct tag: %s", op)
 				}
 			}
@@ -272,7 +359,7 @@ func compileModelSpec(typ reflect.Type, ms *modelSpec) error {
 			fs.classification = primative
 			ms.primatives[field.Name] = fs
 			if index {
-				if typeIsNumeric(field.Type) {
+				if typeIsNumeric(field.Type) || typeIsTime(field.Type) {
 					fs.indexType = indexNumeric
 				} else if typeIsString(field.Type) {
 					fs.indexType = indexAlpha
@@ -290,7 +377,7 @@ func compileModelSpec(typ reflect.Type, ms *modelSpec) error {
 				fs.classification = pointer
 				ms.pointers[field.Name] = fs
 				if index {
-					if typeIsNumeric(field.Type.Elem()) {
+					if typeIsNumeric(field.Type.Elem()) || typeIsTime(field.Type.Elem()) {
 						fs.indexType = indexNumeric
 					} else if typeIsString(field.Type.Elem()) {
 						fs.indexType = indexAlpha
@@ -351,6 +438,48 @@ func compileModelSpec(typ reflect.Type, ms *modelSpec) error {
 			fs.classification = inconvertible
 			ms.inconvertibles[field.Name] = fs
 		}
+		if index && fs.classification == inconvertible {
+			// inconvertible types can only be indexed if they implement IndexScorer
+			if !typeIsIndexScorer(field.Type) {
+				return fmt.Errorf("zoom: Requested index on unsupported type %s\n", field.Type.String())
+			}
+			fs.indexType = indexNumeric
+			if field.Type.Kind() == reflect.Ptr {
+				ms.pointerIndexes[field.Name] = fs
+			} else {
+				ms.primativeIndexes[field.Name] = fs
+			}
+		}
+		if _, isJSON := fs.marshaler.(jsonMarshalerUnmarshaler); isJSON && fs.classification != inconvertible {
+			return fmt.Errorf("zoom: the json option can only be used on types which are not directly convertible. Got: %s\n", field.Type.String())
+		}
+		if fs.unique {
+			if fs.classification != primative && fs.classification != pointer {
+				return fmt.Errorf("zoom: Requested unique constraint on unsupported type %s\n", field.Type.String())
+			}
+			ms.uniques[field.Name] = fs
+		}
+	}
+
+	// add the compound indexes specified with struct tags, followed by those
+	// specified with RegisterIndex
+	for _, name := range compoundNames {
+		if err := ms.addCompoundIndex(name, compoundFields[name]); err != nil {
+			return err
+		}
+	}
+	for _, fieldNames := range registeredIndexes[ms.modelName] {
+		fields := []*fieldSpec{}
+		for _, fieldName := range fieldNames {
+			fs, found := ms.fieldSpec(fieldName)
+			if !found {
+				return fmt.Errorf("zoom: Requested compound index on nonexistent field %s of type %s", fieldName, typ.String())
+			}
+			fields = append(fields, fs)
+		}
+		if err := ms.addCompoundIndex(strings.Join(fieldNames, "_"), fields); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -366,6 +495,7 @@ func Unregister(model Model) error {
 	}
 	delete(modelNameToType, name)
 	delete(modelTypeToName, modelType)
+	delete(registeredIndexes, name)
 	return nil
 }
 
@@ -379,6 +509,7 @@ func UnregisterName(name string) error {
 	}
 	delete(modelNameToType, name)
 	delete(modelTypeToName, typ)
+	delete(registeredIndexes, name)
 	return nil
 }
 
@@ -443,13 +574,24 @@ func (mr modelRef) value(fieldName string) reflect.Value {
 
 // key returns a key which is used in redis to store the model
 func (mr modelRef) key() string {
-	return mr.modelSpec.modelName + ":" + mr.model.GetId()
+	return mr.modelSpec.key(mr.model.GetId())
 }
 
 func (mr modelRef) indexKey() string {
 	return mr.modelSpec.indexKey()
 }
 
+// fieldSpec returns the fieldSpec for the field identified by fieldName, or
+// (nil, false) if there is no such field.
+func (ms modelSpec) fieldSpec(fieldName string) (*fieldSpec, bool) {
+	for _, fs := range ms.fieldSpecs {
+		if fs.fieldName == fieldName {
+			return fs, true
+		}
+	}
+	return nil, false
+}
+
 func (ms modelSpec) field(fieldName string) (reflect.StructField, bool) {
 	return ms.modelType.Elem().FieldByName(fieldName)
 }
@@ -474,6 +616,8 @@ func (ms modelSpec) redisNameForFieldName(fieldName string) (string, bool) {
 		return f.redisName, true
 	} else if f, found := ms.pointers[fieldName]; found {
 		return f.redisName, true
+	} else if f, found := ms.inconvertibles[fieldName]; found {
+		return f.redisName, true
 	} else {
 		return "", false
 	}
@@ -482,7 +626,13 @@ func (ms modelSpec) redisNameForFieldName(fieldName string) (string, bool) {
 // indexKey returns a key which is used in redis to store all the ids of every model of a
 // given type.
 func (ms modelSpec) indexKey() string {
-	return ms.modelName + ":all"
+	return ms.key("all")
+}
+
+// nullIndexKey returns a key which is used in redis to store the ids of all
+// models for which the pointer field identified by redisName is nil.
+func (ms modelSpec) nullIndexKey(redisName string) string {
+	return ms.key(redisName + ":null")
 }
 
 // returns the args that should be sent to the redis driver
@@ -493,10 +643,10 @@ func (mr modelRef) mainHashArgs() ([]interface{}, error) {
 	for _, fs := range ms.fieldSpecs {
 		switch fs.classification {
 		case primative:
-			args = append(args, fs.redisName, mr.value(fs.fieldName).Interface())
+			args = append(args, fs.redisName, hashValue(mr.value(fs.fieldName)))
 		case pointer:
 			if !mr.value(fs.fieldName).IsNil() {
-				args = append(args, fs.redisName, mr.value(fs.fieldName).Elem().Interface())
+				args = append(args, fs.redisName, hashValue(mr.value(fs.fieldName).Elem()))
 			} else {
 				args = append(args, fs.redisName, "NULL")
 			}
@@ -504,8 +654,7 @@ func (mr modelRef) mainHashArgs() ([]interface{}, error) {
 			if mr.value(fs.fieldName).Type().Kind() == reflect.Ptr && mr.value(fs.fieldName).IsNil() {
 				args = append(args, fs.redisName, "NULL")
 			} else {
-				// TODO: account for the possibility of json, msgpack or custom fallbacks
-				valBytes, err := defaultMarshalerUnmarshaler.Marshal(mr.value(fs.fieldName).Interface())
+				valBytes, err := fs.marshaler.Marshal(mr.value(fs.fieldName).Interface())
 				if err != nil {
 					return args, err
 				}
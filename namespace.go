@@ -0,0 +1,79 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File namespace.go contains code for namespaces, which prefix every key zoom
+// reads or writes so that more than one application or tenant can share the
+// same database without their models colliding.
+
+package zoom
+
+// Namespace is a handle for storing and finding models under a separate key
+// prefix. Every key used by the methods of a Namespace (including the main
+// hashes, indexes, relationships, external lists and sets, change events, and
+// the change log) starts with Configuration.KeyPrefix followed by the name of
+// the namespace, so models in one namespace are never visible from another.
+// The methods of Namespace are the same as the package-level functions, which
+// use the default namespace (i.e. only Configuration.KeyPrefix). A Namespace
+// is safe for concurrent use and can be created as often as needed, e.g. once
+// per request.
+type Namespace struct {
+	name string
+}
+
+// defaultNamespace is the namespace used by the package-level functions.
+var defaultNamespace = &Namespace{}
+
+// WithNamespace returns a handle which stores and finds models in the
+// namespace identified by name. Models must still be registered with Register
+// or RegisterName, which applies to every namespace.
+func WithNamespace(name string) *Namespace {
+	return &Namespace{name: name}
+}
+
+// Name returns the name of the namespace, which is empty for the default
+// namespace.
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// keyPrefix returns the prefix for every key in the namespace, including the
+// trailing colon (or an empty string if there is no prefix).
+func (ns *Namespace) keyPrefix() string {
+	prefix := currentConfiguration.KeyPrefix
+	if prefix != "" {
+		prefix += ":"
+	}
+	if ns.name != "" {
+		prefix += ns.name + ":"
+	}
+	return prefix
+}
+
+// key returns the key in the namespace for a key which would otherwise be
+// unprefixed.
+func (ns *Namespace) key(key string) string {
+	return ns.keyPrefix() + key
+}
+
+// modelSpec returns the modelSpec for the type registered with modelName, set
+// up to use the keys in the namespace, or false if there is no such type.
+func (ns *Namespace) modelSpec(modelName string) (modelSpec, bool) {
+	ms, found := modelSpecs[modelName]
+	ms.namespace = ns
+	return ms, found
+}
+
+// ns returns the namespace the keys for the type belong to.
+func (ms modelSpec) ns() *Namespace {
+	if ms.namespace == nil {
+		return defaultNamespace
+	}
+	return ms.namespace
+}
+
+// key returns the key for the given suffix (e.g. a model id, "all", or the
+// name of an index) for the type in its namespace.
+func (ms modelSpec) key(suffix string) string {
+	return ms.ns().keyPrefix() + modelKeyName(ms.modelName) + ":" + suffix
+}
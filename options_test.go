@@ -11,6 +11,7 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // Test that the redis ignore struct tag causes a field to be ignored
@@ -438,6 +439,276 @@ func TestUpdateIndexedBooleanModel(t *testing.T) {
 	validateBooleanIndexNotExists(t, "indexedPrimativesModel", m.Id, "Bool", false, conn)
 }
 
+// Test that the unique struct tag prevents two models from having the same value
+func TestUniqueOption(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type uniqueModel struct {
+		Email string `zoom:"unique"`
+		DefaultData
+	}
+	Register(&uniqueModel{})
+	defer Unregister(&uniqueModel{})
+
+	// check the spec
+	spec, found := modelSpecs["uniqueModel"]
+	if !found {
+		t.Error("Could not find spec for model of type uniqueModel")
+	}
+	if _, found := spec.uniques["Email"]; !found {
+		t.Error("Expected Email to have a unique constraint in model spec")
+	}
+
+	first := &uniqueModel{Email: "x@y"}
+	if err := Save(first); err != nil {
+		t.Error(err)
+	}
+
+	// saving another model with the same value should fail
+	second := &uniqueModel{Email: "x@y"}
+	if err := Save(second); err == nil {
+		t.Error("Expected error when saving model with duplicate unique value")
+	} else if uErr, ok := err.(*UniqueConstraintError); !ok {
+		t.Errorf("Expected UniqueConstraintError but got: %T: %s", err, err)
+	} else if uErr.ConflictingId != first.Id {
+		t.Errorf("Conflicting id was incorrect.\nExpected: %s\nGot: %s\n", first.Id, uErr.ConflictingId)
+	}
+	conn := GetConn()
+	defer conn.Close()
+	if exists, err := redis.Bool(conn.Do("EXISTS", "uniqueModel:"+second.Id)); err != nil {
+		t.Error(err)
+	} else if exists {
+		t.Error("Expected model with duplicate unique value not to be saved")
+	}
+
+	// FindByUnique should find the first model
+	got, err := FindByUnique("uniqueModel", "Email", "x@y")
+	if err != nil {
+		t.Error(err)
+	} else if got.GetId() != first.Id {
+		t.Errorf("FindByUnique returned the wrong model.\nExpected: %s\nGot: %s\n", first.Id, got.GetId())
+	}
+	if _, err := FindByUnique("uniqueModel", "Email", "not@used"); err == nil {
+		t.Error("Expected error from FindByUnique for unused value")
+	}
+
+	// changing the value of the first model should free up the old value
+	first.Email = "z@y"
+	if err := Save(first); err != nil {
+		t.Error(err)
+	}
+	if err := Save(second); err != nil {
+		t.Error(err)
+	}
+
+	// deleting a model should free up its value
+	if err := Delete(first); err != nil {
+		t.Error(err)
+	}
+	third := &uniqueModel{Email: "z@y"}
+	if err := Save(third); err != nil {
+		t.Error(err)
+	}
+
+	// MSave should not save anything if one of the models has a duplicate
+	// value, including models without unique fields
+	other := &basicModel{Attr: "other"}
+	duplicate := &uniqueModel{Email: "z@y"}
+	if err := MSave([]Model{other, duplicate}); err == nil {
+		t.Error("Expected error when saving models with a duplicate unique value with MSave")
+	} else if _, ok := err.(*UniqueConstraintError); !ok {
+		t.Errorf("Expected UniqueConstraintError but got: %T: %s", err, err)
+	}
+	for _, key := range []string{"basicModel:" + other.Id, "uniqueModel:" + duplicate.Id} {
+		if exists, err := redis.Bool(conn.Do("EXISTS", key)); err != nil {
+			t.Error(err)
+		} else if exists {
+			t.Errorf("Expected %s not to be saved by a failed MSave", key)
+		}
+	}
+
+	// two new models with the same value can't both be saved by MSave
+	fourth, fifth := &uniqueModel{Email: "w@y"}, &uniqueModel{Email: "w@y"}
+	if err := MSave([]Model{fourth, fifth}); err == nil {
+		t.Error("Expected error when saving two models with the same unique value with MSave")
+	}
+	if _, err := FindByUnique("uniqueModel", "Email", "w@y"); err == nil {
+		t.Error("Expected the value not to be claimed by a failed MSave")
+	}
+	if err := Save(fifth); err != nil {
+		t.Error(err)
+	}
+}
+
+// multiHookConn calls beforeMulti the first time MULTI is sent over it, so
+// that a test can change a key after it was checked but before EXEC.
+type multiHookConn struct {
+	redis.Conn
+	beforeMulti func()
+}
+
+func (c *multiHookConn) Send(cmd string, args ...interface{}) error {
+	if cmd == "MULTI" && c.beforeMulti != nil {
+		c.beforeMulti()
+		c.beforeMulti = nil
+	}
+	return c.Conn.Send(cmd, args...)
+}
+
+// Test that a unique value claimed by another client after it was checked but
+// before the model is written causes the check to run again
+func TestUniqueClaimedConcurrently(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type concurrentUniqueModel struct {
+		Email string `zoom:"unique"`
+		DefaultData
+	}
+	if err := Register(&concurrentUniqueModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&concurrentUniqueModel{})
+
+	conn := GetConn()
+	defer conn.Close()
+	hooked := &multiHookConn{Conn: GetConn(), beforeMulti: func() {
+		if _, err := conn.Do("HSET", "concurrentUniqueModel:Email:unique", "x@y", "other"); err != nil {
+			t.Error(err)
+		}
+	}}
+	tx := newTransactionOnConn(defaultNamespace, hooked)
+	m := &concurrentUniqueModel{Email: "x@y"}
+	if err := tx.saveModel(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.exec(); err == nil {
+		t.Error("Expected error when the unique value was claimed concurrently")
+	} else if uErr, ok := err.(*UniqueConstraintError); !ok {
+		t.Errorf("Expected UniqueConstraintError but got: %T: %s", err, err)
+	} else if uErr.ConflictingId != "other" {
+		t.Errorf("Conflicting id was incorrect.\nExpected: other\nGot: %s\n", uErr.ConflictingId)
+	}
+	if exists, err := redis.Bool(conn.Do("EXISTS", "concurrentUniqueModel:"+m.Id)); err != nil {
+		t.Error(err)
+	} else if exists {
+		t.Error("Expected model with a concurrently claimed unique value not to be saved")
+	}
+}
+
+// Test that unique times are claimed, released, and found by the instant
+// they represent, regardless of the time zone
+func TestUniqueTime(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type uniqueTimeModel struct {
+		StartsAt time.Time `zoom:"unique"`
+		DefaultData
+	}
+	Register(&uniqueTimeModel{})
+	defer Unregister(&uniqueTimeModel{})
+
+	startsAt := time.Date(2015, time.March, 1, 12, 0, 0, 0, time.UTC)
+	elsewhere := startsAt.In(time.FixedZone("UTC+2", 2*60*60))
+	first := &uniqueTimeModel{StartsAt: startsAt}
+	if err := Save(first); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := FindByUnique("uniqueTimeModel", "StartsAt", elsewhere); err != nil {
+		t.Error(err)
+	} else if got.GetId() != first.Id {
+		t.Errorf("FindByUnique returned the wrong model.\nExpected: %s\nGot: %s\n", first.Id, got.GetId())
+	}
+	if err := Save(&uniqueTimeModel{StartsAt: elsewhere}); err == nil {
+		t.Error("Expected error when saving the same instant in another time zone")
+	}
+
+	// changing the time should release the old one
+	first.StartsAt = startsAt.Add(time.Hour)
+	if err := Save(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(&uniqueTimeModel{StartsAt: startsAt}); err != nil {
+		t.Error(err)
+	}
+	conn := GetConn()
+	defer conn.Close()
+	if count, err := redis.Int(conn.Do("HLEN", "uniqueTimeModel:StartsAt:unique")); err != nil {
+		t.Error(err)
+	} else if count != 2 {
+		t.Errorf("Expected 2 claimed times but got %d", count)
+	}
+}
+
+// Test that FindOrCreate only creates one model for each unique value
+func TestFindOrCreate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type findOrCreateModel struct {
+		Email string `zoom:"unique"`
+		Name  string
+		DefaultData
+	}
+	Register(&findOrCreateModel{})
+	defer Unregister(&findOrCreateModel{})
+
+	first := &findOrCreateModel{Email: "x@y", Name: "first"}
+	if created, err := FindOrCreate(first, "Email"); err != nil {
+		t.Fatal(err)
+	} else if !created {
+		t.Error("Expected the first model to be created")
+	}
+
+	// a model with the same value should be scanned from the existing one
+	second := &findOrCreateModel{Email: "x@y", Name: "second"}
+	if created, err := FindOrCreate(second, "Email"); err != nil {
+		t.Fatal(err)
+	} else if created {
+		t.Error("Expected the second model not to be created")
+	}
+	if second.Id != first.Id || second.Name != "first" {
+		t.Errorf("Expected the existing model to be found but got: %+v", second)
+	}
+
+	// concurrent calls for a new value should create exactly one model
+	results := make(chan *findOrCreateModel, 10)
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			m := &findOrCreateModel{Email: "a@b"}
+			if _, err := FindOrCreate(m, "Email"); err != nil {
+				errs <- err
+				return
+			}
+			results <- m
+		}()
+	}
+	ids := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		select {
+		case err := <-errs:
+			t.Error(err)
+		case m := <-results:
+			ids[m.Id] = true
+		}
+	}
+	if len(ids) != 1 {
+		t.Errorf("Expected all calls to return the same model but got %d different ids", len(ids))
+	}
+	if count, err := NewQuery("findOrCreateModel").Count(); err != nil {
+		t.Error(err)
+	} else if count != 2 {
+		t.Errorf("Expected 2 models to be saved but got %d", count)
+	}
+
+	if _, err := FindOrCreate(&findOrCreateModel{}, "Name"); err == nil {
+		t.Error("Expected an error for a field without a unique constraint")
+	}
+}
+
 // returns true if the numeric index exists
 // if err is not nil there was an unexpected error
 func numericIndexExists(modelName string, modelId string, fieldName string, fieldValue reflect.Value, conn redis.Conn) (bool, error) {
@@ -546,3 +817,90 @@ func validateBooleanIndexNotExists(t *testing.T, modelName string, modelId strin
 		t.Errorf("bool index was set\nExpected member %s to be gone.\n", modelId)
 	}
 }
+
+// Test that indexes can be added to and removed from models which were
+// already saved using ReindexField and RebuildIndexes
+func TestReindex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type unindexedModel struct {
+		Age  int
+		Name string
+		DefaultData
+		Expirable
+	}
+	type indexedModel struct {
+		Name string `zoom:"index=name_age"`
+		Age  int    `zoom:"index,index=name_age"`
+		DefaultData
+	}
+	RegisterName("reindexModel", &unindexedModel{})
+	models := []*unindexedModel{{Age: 3, Name: "a"}, {Age: 1, Name: "b"}, {Age: 2, Name: "a"}}
+	for _, m := range models {
+		if err := Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// add the indexes and rebuild them
+	Unregister(&unindexedModel{})
+	if err := RegisterName("reindexModel", &indexedModel{}); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	if err := ReindexField("reindexModel", "Age", func(done, total int) {
+		calls++
+		if total != len(models) {
+			t.Errorf("Expected total to be %d but got %d", len(models), total)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 {
+		t.Error("Expected progress to be reported but it was not")
+	}
+	testCases := []struct {
+		q        *Query
+		expected []string
+	}{
+		{NewQuery("reindexModel").Order("Age"), []string{models[1].Id, models[2].Id, models[0].Id}},
+		{NewQuery("reindexModel").Filter("Name =", "a").Order("Age"), []string{models[2].Id, models[0].Id}},
+	}
+	for _, tc := range testCases {
+		ids, err := tc.q.IdsOnly()
+		if err != nil {
+			t.Errorf("Unexpected error for query %s: %s", tc.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.expected, ids) {
+			t.Errorf("Ids were incorrect for query %s.\nExpected: %v\nGot: %v", tc.q, tc.expected, ids)
+		}
+	}
+
+	// remove the indexes and make sure the obsolete keys are deleted
+	Unregister(&indexedModel{})
+	RegisterName("reindexModel", &unindexedModel{})
+	defer Unregister(&unindexedModel{})
+	expiring := &unindexedModel{Age: 4, Name: "c"}
+	if err := SaveWithTTL(expiring, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := RebuildIndexes("reindexModel", nil); err != nil {
+		t.Fatal(err)
+	}
+	conn := GetConn()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("KEYS", "reindexModel:*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(models)+3 {
+		t.Errorf("Expected only the main hashes, the set of all ids, and the set of expiring ids to remain.\nGot: %v", keys)
+	}
+
+	// the set of expiring models is not an obsolete index
+	if _, err := redis.Float64(conn.Do("ZSCORE", "reindexModel:expires", expiring.Id)); err != nil {
+		t.Errorf("Expected the expiring model to still be in reindexModel:expires but got: %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File planner.go contains code for choosing how to get the ids for a
+// query with filters based on the estimated number of ids which match each
+// filter.
+
+package zoom
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// candidateCheckCost is the estimated cost of checking whether one candidate
+// id matches one filter (or of looking up the value used to order it),
+// relative to the cost of transferring one id.
+var candidateCheckCost = 4
+
+// plannedFilter is a filter along with the ranges which contain the ids that
+// match it and the estimated number of those ids.
+type plannedFilter struct {
+	filter   filter
+	ranges   []countRange
+	estimate int
+}
+
+// costBasedIds estimates the number of ids which match each filter of the
+// query. If it is cheaper to get the ids for the most selective filter and
+// then check each of them against the other filters (and look up the value
+// used to order them) than it is to get the ids for every filter, costBasedIds
+// does so and returns the ids in the correct order along with the most
+// selective filter, which is used to describe the plan. Otherwise it returns
+// the filters sorted from most to least selective, so that they can be
+// intersected in that order. If the filters can't be estimated, it returns the
+// filters unchanged. When the query is being explained, only the estimates are
+// retrieved and the ids are nil.
+func (q *Query) costBasedIds() (ids []string, primary *plannedFilter, filters []filter, err error) {
+	if len(q.filters) == 0 || q.after != nil || q.ordersClientSide() {
+		return nil, nil, q.filters, nil
+	}
+	if q.order.fieldName != "" {
+		if _, found := q.modelSpec.indexTypeForField(q.order.fieldName); !found {
+			return nil, nil, q.filters, nil
+		}
+	}
+	if plan, _ := q.compoundPlan(); plan != nil {
+		return nil, nil, q.filters, nil
+	}
+	allRanges, countable := q.countRanges()
+	if !countable {
+		return nil, nil, q.filters, nil
+	}
+
+	// use the connection of the query transaction, so that the estimates and
+	// the candidates come from the same server as the rest of the query
+	conn := q.trans.conn
+
+	// estimate the number of ids for each filter and for the stage which gets
+	// all ids (in order, if the query is ordered)
+	planned := make([]plannedFilter, len(q.filters))
+	for i, f := range q.filters {
+		planned[i] = plannedFilter{filter: f, ranges: allRanges[i]}
+		for _, r := range allRanges[i] {
+			switch r.kind {
+			case "set":
+				conn.Send("SCARD", r.key)
+			case "lex":
+				conn.Send("ZLEXCOUNT", r.key, r.min, r.max)
+			default:
+				conn.Send("ZCOUNT", r.key, r.min, r.max)
+			}
+		}
+	}
+	if q.order.fieldName == "" {
+		conn.Send("SCARD", q.modelSpec.indexKey())
+	} else {
+		conn.Send("ZCARD", q.orderIndexKey())
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, nil, nil, err
+	}
+	for i := range planned {
+		for range planned[i].ranges {
+			n, err := redis.Int(conn.Receive())
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			planned[i].estimate += n
+		}
+	}
+	allEstimate, err := redis.Int(conn.Receive())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sort.Stable(byEstimate(planned))
+
+	// compare the number of ids which would be transferred by getting the ids
+	// for every filter with the cost of checking each candidate
+	checks := len(planned) - 1
+	fullCost := 0
+	for _, p := range planned {
+		fullCost += p.estimate
+	}
+	primaryCovered := false
+	for _, f := range q.filters {
+		if f.fieldName == q.order.fieldName {
+			primaryCovered = true
+		}
+	}
+	if !primaryCovered {
+		fullCost += allEstimate
+	}
+	if q.order.fieldName != "" {
+		checks++
+	}
+	if planned[0].estimate*checks*candidateCheckCost >= fullCost {
+		filters = make([]filter, len(planned))
+		for i, p := range planned {
+			filters[i] = p.filter
+		}
+		return nil, nil, filters, nil
+	}
+
+	if q.explaining {
+		// the candidates are only retrieved when the query is run
+		return nil, &planned[0], nil, nil
+	}
+	ids, err = q.candidateIds(conn, planned)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ids, &planned[0], nil, nil
+}
+
+// byEstimate sorts planned filters from most to least selective.
+type byEstimate []plannedFilter
+
+func (b byEstimate) Len() int           { return len(b) }
+func (b byEstimate) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byEstimate) Less(i, j int) bool { return b[i].estimate < b[j].estimate }
+
+// candidateIds gets the ids which match the first of the planned filters,
+// removes the ids which don't match the others, and then sorts the remaining
+// ids according to the order of the query.
+func (q *Query) candidateIds(conn redis.Conn, planned []plannedFilter) ([]string, error) {
+	candidates, err := rangeIds(conn, planned[0].ranges)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range planned[1:] {
+		if len(candidates) == 0 {
+			break
+		}
+		if candidates, err = q.checkCandidates(conn, candidates, p); err != nil {
+			return nil, err
+		}
+	}
+	if q.order.fieldName == "" || len(candidates) == 0 {
+		return candidates, nil
+	}
+	return q.sortCandidates(conn, candidates)
+}
+
+// rangeIds returns the ids in all the given ranges.
+func rangeIds(conn redis.Conn, ranges []countRange) ([]string, error) {
+	for _, r := range ranges {
+		switch r.kind {
+		case "set":
+			conn.Send("SMEMBERS", r.key)
+		case "lex":
+			conn.Send("ZRANGEBYLEX", r.key, r.min, r.max)
+		default:
+			conn.Send("ZRANGEBYSCORE", r.key, r.min, r.max)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, r := range ranges {
+		members, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if r.kind == "lex" {
+			for i, member := range members {
+				members[i] = extractModelIdFromAlphaIndexValue(member)
+			}
+		}
+		ids = append(ids, members...)
+	}
+	return ids, nil
+}
+
+// checkCandidates returns the candidates which match the filter p. It uses
+// SISMEMBER for null filters, ZSCORE for numeric and boolean filters, and
+// HGET for alpha filters, since the members of alpha indexes include the
+// value.
+func (q *Query) checkCandidates(conn redis.Conn, candidates []string, p plannedFilter) ([]string, error) {
+	f := p.filter
+	_, isPointer := q.modelSpec.pointerIndexes[f.fieldName]
+	kind := "score"
+	if f.filterType == isNull {
+		kind = "set"
+	} else if f.indexType == indexAlpha {
+		kind = "lex"
+	}
+	for _, id := range candidates {
+		switch kind {
+		case "set":
+			conn.Send("SISMEMBER", q.modelSpec.nullIndexKey(f.redisName), id)
+		case "lex":
+			conn.Send("HGET", q.modelSpec.key(id), f.redisName)
+		default:
+			conn.Send("ZSCORE", q.modelSpec.key(f.redisName), id)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	matches := []string{}
+	for _, id := range candidates {
+		reply, err := conn.Receive()
+		if err != nil {
+			return nil, err
+		}
+		var match bool
+		switch kind {
+		case "set":
+			if match, err = redis.Bool(reply, nil); err != nil {
+				return nil, err
+			}
+		case "lex":
+			if reply == nil {
+				continue
+			}
+			value, err := redis.String(reply, nil)
+			if err != nil {
+				return nil, err
+			}
+			if isPointer && value == "NULL" {
+				// nil values are not in the index
+				continue
+			}
+			member := value + " " + id
+			for _, r := range p.ranges {
+				if inLexRange(member, r.min.(string), r.max.(string)) {
+					match = true
+				}
+			}
+		default:
+			if reply == nil {
+				continue
+			}
+			score, err := redis.Float64(reply, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range p.ranges {
+				if inScoreRange(score, fmt.Sprint(r.min), fmt.Sprint(r.max)) {
+					match = true
+				}
+			}
+		}
+		if match {
+			matches = append(matches, id)
+		}
+	}
+	return matches, nil
+}
+
+// inScoreRange returns true iff score is between min and max, which have the
+// same format as the arguments to ZRANGEBYSCORE.
+func inScoreRange(score float64, min, max string) bool {
+	if bound, exclusive := parseScoreBound(min, "-inf"); score < bound || (exclusive && score == bound) {
+		return false
+	}
+	if bound, exclusive := parseScoreBound(max, "+inf"); score > bound || (exclusive && score == bound) {
+		return false
+	}
+	return true
+}
+
+// parseScoreBound parses a min or max argument for ZRANGEBYSCORE.
+func parseScoreBound(bound string, defaultBound string) (float64, bool) {
+	exclusive := strings.HasPrefix(bound, "(")
+	bound = strings.TrimPrefix(bound, "(")
+	value, err := strconv.ParseFloat(bound, 64)
+	if err != nil {
+		// ParseFloat handles "-inf" and "+inf", so this should never happen
+		value, _ = strconv.ParseFloat(defaultBound, 64)
+	}
+	return value, exclusive
+}
+
+// inLexRange returns true iff member is between min and max, which have the
+// same format as the arguments to ZRANGEBYLEX.
+func inLexRange(member, min, max string) bool {
+	switch {
+	case min == "-":
+	case min == "+":
+		return false
+	case strings.HasPrefix(min, "("):
+		if member <= min[1:] {
+			return false
+		}
+	default:
+		if member < strings.TrimPrefix(min, "[") {
+			return false
+		}
+	}
+	switch {
+	case max == "+":
+	case max == "-":
+		return false
+	case strings.HasPrefix(max, "("):
+		if member >= max[1:] {
+			return false
+		}
+	default:
+		if member > strings.TrimPrefix(max, "[") {
+			return false
+		}
+	}
+	return true
+}
+
+// sortCandidates sorts the ids in the same order they would be returned from
+// the index for the order of the query, i.e. by score (or by value for alpha
+// indexes) and then by id.
+func (q *Query) sortCandidates(conn redis.Conn, ids []string) ([]string, error) {
+	for _, id := range ids {
+		if q.order.indexType == indexAlpha {
+			conn.Send("HGET", q.modelSpec.key(id), q.order.redisName)
+		} else {
+			conn.Send("ZSCORE", q.orderIndexKey(), id)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	sorted := make(rankedMembers, 0, len(ids))
+	for _, id := range ids {
+		reply, err := conn.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if reply == nil {
+			// the model is not in the index for the order
+			continue
+		}
+		if q.order.indexType == indexAlpha {
+			value, err := redis.String(reply, nil)
+			if err != nil {
+				return nil, err
+			}
+			sorted = append(sorted, rankedMember{id: id, member: value + " " + id})
+		} else {
+			score, err := redis.Float64(reply, nil)
+			if err != nil {
+				return nil, err
+			}
+			sorted = append(sorted, rankedMember{id: id, score: score, member: id})
+		}
+	}
+	sort.Sort(sorted)
+	result := make([]string, len(sorted))
+	for i, rm := range sorted {
+		if q.order.orderType == descending {
+			result[len(sorted)-1-i] = rm.id
+		} else {
+			result[i] = rm.id
+		}
+	}
+	return result, nil
+}
+
+// rankedMember is an id along with its score and member in a sorted set.
+type rankedMember struct {
+	id     string
+	score  float64
+	member string
+}
+
+// rankedMembers sorts members in the same order as redis, i.e. by score
+// and then lexicographically by member.
+type rankedMembers []rankedMember
+
+func (r rankedMembers) Len() int      { return len(r) }
+func (r rankedMembers) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rankedMembers) Less(i, j int) bool {
+	if r[i].score != r[j].score {
+		return r[i].score < r[j].score
+	}
+	return r[i].member < r[j].member
+}
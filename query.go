@@ -10,8 +10,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
-	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -21,16 +21,26 @@ import (
 // and can be run in several different ways with different query
 // finishers.
 type Query struct {
-	modelSpec modelSpec
-	trans     *transaction
-	includes  []string
-	excludes  []string
-	order     order
-	limit     uint
-	offset    uint
-	filters   []filter
-	idData    []string
-	err       error
+	modelSpec  modelSpec
+	trans      *transaction
+	includes   []string
+	excludes   []string
+	order      order
+	limit      uint
+	offset     uint
+	filters    []filter
+	idData     []string
+	relations  map[string]string
+	nullsFirst bool
+	batchSize  uint
+	after      *queryCursor
+	pageIds    []string
+	scanCursor string
+	scanLastId string
+	stages     []idStage
+	explaining bool
+	deleted    deletedScope
+	err        error
 }
 
 type order struct {
@@ -39,6 +49,8 @@ type order struct {
 	orderType orderType
 	indexed   bool
 	indexType indexType
+	relation  *relation
+	nullable  bool
 }
 
 type orderType int
@@ -55,6 +67,18 @@ type filter struct {
 	filterValue reflect.Value
 	indexType   indexType
 	byId        bool
+	relation    *relation
+	// indexValue is the value used for filterValue in commands on a numeric
+	// index
+	indexValue interface{}
+}
+
+// relation is used for filters and orders which target a field of a related
+// model, e.g. "Author.Country". It holds the relationship field on the queried
+// model and the spec of the related model.
+type relation struct {
+	fieldSpec *fieldSpec
+	modelSpec modelSpec
 }
 
 type filterType int
@@ -66,6 +90,20 @@ const (
 	less
 	greaterOrEqual
 	lessOrEqual
+	isNull
+	isNotNull
+)
+
+// NullFilter is used as the value argument for Filter to select models based
+// on whether an indexed pointer field is nil. When a NullFilter is used, the
+// filterString passed to Filter should consist only of the field name.
+type NullFilter int
+
+const (
+	// IsNull selects models for which the field is nil
+	IsNull NullFilter = iota
+	// IsNotNull selects models for which the field is not nil
+	IsNotNull
 )
 
 var filterSymbols = map[string]filterType{
@@ -92,8 +130,14 @@ var delString string = string([]byte{byte(127)})
 // the query is executed the first error that occured during the lifetime of the
 // query object (if any) will be returned.
 func NewQuery(modelName string) *Query {
+	return defaultNamespace.NewQuery(modelName)
+}
+
+// NewQuery is like the package-level NewQuery but queries the models in the
+// namespace.
+func (ns *Namespace) NewQuery(modelName string) *Query {
 	q := &Query{}
-	spec, found := modelSpecs[modelName]
+	spec, found := ns.modelSpec(modelName)
 	if !found {
 		q.setErrorIfNone(NewModelNameNotRegisteredError(modelName))
 	} else {
@@ -117,6 +161,9 @@ func (q *Query) setErrorIfNone(e error) {
 // in the future this may change. Only one order may be specified per query.
 // However in the future, secondary orders may be allowed, and will take effect
 // when two or more models have the same value for the primary order field.
+// You can also order by an indexed field of a related model by using a field
+// name of the form "<Relationship>.<Field>", e.g. "Author.Name". Models without
+// a related model are placed at the end of the results.
 // Order will set an error on the query if the fieldName is invalid, if another
 // order has already been applied to the query, or if the fieldName specified
 // does not correspond to an indexed field. The error, same as any other error
@@ -136,8 +183,16 @@ func (q *Query) Order(fieldName string) *Query {
 	} else {
 		ot = ascending
 	}
+	if strings.Contains(fieldName, ".") {
+		// special case for fields of related models
+		return q.orderByRelatedField(fieldName, ot)
+	}
 	if _, found := q.modelSpec.field(fieldName); found {
 		indexType, found := q.modelSpec.indexTypeForField(fieldName)
+		if fs, isSortField := q.modelSpec.compoundSortField(fieldName); !found && isSortField {
+			// the order can only be used together with a compound index
+			indexType, found = fs.indexType, true
+		}
 		if !found {
 			// the field was not indexed
 			// TODO: add support for ordering unindexed fields in some cases?
@@ -145,12 +200,14 @@ func (q *Query) Order(fieldName string) *Query {
 			q.setErrorIfNone(err)
 		}
 		redisName, _ := q.modelSpec.redisNameForFieldName(fieldName)
+		_, nullable := q.modelSpec.pointerIndexes[fieldName]
 		q.order = order{
 			fieldName: fieldName,
 			redisName: redisName,
 			orderType: ot,
 			indexType: indexType,
 			indexed:   true,
+			nullable:  nullable,
 		}
 	} else {
 		// fieldName was invalid
@@ -161,6 +218,87 @@ func (q *Query) Order(fieldName string) *Query {
 	return q
 }
 
+// orderByRelatedField sets the order of the query to a field of a related
+// model. fieldName should be of the form "<Relationship>.<Field>", where
+// <Field> is an indexed field of the related model.
+func (q *Query) orderByRelatedField(fieldName string, ot orderType) *Query {
+	rel, relatedFieldName, err := q.modelSpec.relatedField(fieldName)
+	if err != nil {
+		q.setErrorIfNone(err)
+		return q
+	}
+	indexType, found := rel.modelSpec.indexTypeForField(relatedFieldName)
+	if !found {
+		err := fmt.Errorf("zoom: error in Query.Order: field %s in type %s is not indexed. Can only order by indexed fields", relatedFieldName, rel.modelSpec.modelType.String())
+		q.setErrorIfNone(err)
+		return q
+	}
+	redisName, _ := rel.modelSpec.redisNameForFieldName(relatedFieldName)
+	q.order = order{
+		fieldName: fieldName,
+		redisName: redisName,
+		orderType: ot,
+		indexType: indexType,
+		indexed:   true,
+		relation:  rel,
+	}
+	return q
+}
+
+// relatedField parses a fieldName of the form "<Relationship>.<Field>" and
+// returns the corresponding relation and the name of the field on the related
+// model. It returns an error if the relationship or field does not exist.
+func (ms modelSpec) relatedField(fieldName string) (*relation, string, error) {
+	split := strings.SplitN(fieldName, ".", 2)
+	relName, relatedFieldName := split[0], split[1]
+	fs, found := ms.relationships[relName]
+	if !found {
+		return nil, "", fmt.Errorf("zoom: invalid fieldName %s.\nType %s has no relationship %s", fieldName, ms.modelType.String(), relName)
+	}
+	relatedType := fs.fieldType
+	if fs.relType == oneToMany {
+		relatedType = fs.fieldType.Elem()
+	}
+	relatedName, err := getRegisteredNameFromType(relatedType)
+	if err != nil {
+		return nil, "", err
+	}
+	relatedSpec, _ := ms.ns().modelSpec(relatedName)
+	rel := &relation{
+		fieldSpec: fs,
+		modelSpec: relatedSpec,
+	}
+	if _, found := rel.modelSpec.field(relatedFieldName); !found || strings.Contains(relatedFieldName, ".") {
+		return nil, "", fmt.Errorf("zoom: invalid fieldName %s.\nType %s has no field %s", fieldName, rel.modelSpec.modelType.String(), relatedFieldName)
+	}
+	return rel, relatedFieldName, nil
+}
+
+// NullsFirst causes models which have a nil value for the order field to be
+// placed at the start of the results. It only has an effect when the query is
+// ordered by an indexed pointer field.
+func (q *Query) NullsFirst() *Query {
+	q.nullsFirst = true
+	return q
+}
+
+// NullsLast causes models which have a nil value for the order field to be
+// placed at the end of the results. This is the default. It only has an effect
+// when the query is ordered by an indexed pointer field.
+func (q *Query) NullsLast() *Query {
+	q.nullsFirst = false
+	return q
+}
+
+// BatchSize specifies the number of models which are retrieved from the
+// database at once by Iter and Each. The default is 100. A batch size of 0
+// means the default should be used. BatchSize has no effect on the other
+// query finishers.
+func (q *Query) BatchSize(size uint) *Query {
+	q.batchSize = size
+	return q
+}
+
 // Limit specifies an upper limit on the number of records to return. If amount
 // is 0, no limit will be applied. The default value is 0.
 func (q *Query) Limit(amount uint) *Query {
@@ -234,7 +372,12 @@ func (q *Query) getIncludes() []string {
 // `zoom:"index"` struct tag. If multiple filters are applied to the same query,
 // the query will only return models which have matches for ALL of the filters.
 // I.e. applying multiple filters is logially equivalent to combining them with
-// a AND or INTERSECT operator. Filter will set an error on the query if the
+// a AND or INTERSECT operator. You can also filter by an indexed field of a
+// related model by using a field name of the form "<Relationship>.<Field>",
+// e.g. "Author.Country =". To filter by whether an indexed pointer field is
+// nil, use IsNull or IsNotNull as the value and only the field name as the
+// filterString, e.g. Filter("Age", IsNull). Filter("Age =", nil) and
+// Filter("Age !=", nil) are equivalent. Filter will set an error on the query if the
 // arguments are improperly formated, if the field you are attempting to filter
 // is not indexed, or if the type of value does not match the type of the field.
 // The error, same as any other error that occurs during the lifetime of the
@@ -251,77 +394,148 @@ func (q *Query) Filter(filterString string, value interface{}) *Query {
 		// special case for Id
 		return q.filterById(operator, value)
 	}
-	f := filter{
-		fieldName: fieldName,
+	if strings.Contains(fieldName, ".") {
+		// special case for fields of related models
+		return q.filterByRelatedField(fieldName, operator, value)
 	}
-	// get the filterType based on the operator
-	if typ, found := filterSymbols[operator]; !found {
-		q.setErrorIfNone(errors.New("zoom: invalid operator in fieldStr. should be one of =, !=, >, <, >=, or <=."))
+	f, err := newFilter(q.modelSpec, fieldName, operator, value)
+	if err != nil {
+		q.setErrorIfNone(err)
 		return q
-	} else {
-		f.filterType = typ
+	}
+	q.filters = append(q.filters, f)
+	return q
+}
+
+// newFilter parses and validates a filter on the field identified by fieldName
+// for models described by ms. It returns an error if the operator is invalid,
+// if the field is not indexed, or if the type of value does not match the type
+// of the field.
+func newFilter(ms modelSpec, fieldName string, operator string, value interface{}) (filter, error) {
+	f := filter{
+		fieldName: fieldName,
 	}
 	// get the redisName based on the fieldName
-	if redisName, found := q.modelSpec.redisNameForFieldName(fieldName); !found {
-		err := fmt.Errorf("zoom: invalid fieldName in filterString.\nType %s has no field %s", q.modelSpec.modelType.String(), fieldName)
-		q.setErrorIfNone(err)
-		return q
+	if redisName, found := ms.redisNameForFieldName(fieldName); !found {
+		return f, fmt.Errorf("zoom: invalid fieldName in filterString.\nType %s has no field %s", ms.modelType.String(), fieldName)
 	} else {
 		f.redisName = redisName
 	}
 	// get the indexType based on the fieldName
-	if indexType, found := q.modelSpec.indexTypeForField(fieldName); !found {
-		err := fmt.Errorf("zoom: filters are only allowed on indexed fields.\n%s.%s is not indexed.", q.modelSpec.modelType.String(), fieldName)
-		q.setErrorIfNone(err)
-		return q
-	} else {
+	if indexType, found := ms.indexTypeForField(fieldName); found {
 		f.indexType = indexType
+	} else if fs, found := ms.compoundIndexField(fieldName); found {
+		// the filter can only be used together with a compound index
+		f.indexType = fs.indexType
+	} else {
+		return f, fmt.Errorf("zoom: filters are only allowed on indexed fields.\n%s.%s is not indexed.", ms.modelType.String(), fieldName)
+	}
+	// special case for null filters
+	if nullFilter, ok := value.(NullFilter); ok || value == nil {
+		return newNullFilter(ms, f, operator, nullFilter, ok)
+	}
+	// get the filterType based on the operator
+	if typ, found := filterSymbols[operator]; !found {
+		return f, errors.New("zoom: invalid operator in fieldStr. should be one of =, !=, >, <, >=, or <=.")
+	} else {
+		f.filterType = typ
 	}
 	// get type of the field and make sure it matches type of value arg
 	// Here we iterate through pointer inderections. This is so you can
 	// just pass in a primative instead of a pointer to a primative for
 	// filtering on fields which have pointer values.
-	structField, _ := q.modelSpec.field(fieldName)
+	structField, _ := ms.field(fieldName)
 	fieldType := structField.Type
+	if _, found := ms.pointerIndexes[fieldName]; found {
+		fieldType = fieldType.Elem()
+	}
 	valueType := reflect.TypeOf(value)
 	valueVal := reflect.ValueOf(value)
 	for valueType.Kind() == reflect.Ptr {
 		valueType = valueType.Elem()
 		valueVal = valueVal.Elem()
 		if !valueVal.IsValid() {
-			q.setErrorIfNone(errors.New("zoom: invalid value arg for Filter. Is it a nil pointer?"))
-			return q
+			return f, errors.New("zoom: invalid value arg for Filter. Is it a nil pointer?")
 		}
 	}
 	if valueType != fieldType {
-		err := fmt.Errorf("zoom: invalid value arg for Filter. Parsed type of value (%s) does not match type of field (%s).", valueType.String(), fieldType.String())
-		q.setErrorIfNone(err)
-		return q
+		return f, fmt.Errorf("zoom: invalid value arg for Filter. Parsed type of value (%s) does not match type of field (%s).", valueType.String(), fieldType.String())
+	}
+	if !valueVal.CanAddr() {
+		// use an addressable copy so that an IndexScore method with a pointer
+		// receiver can be called
+		f.filterValue = reflect.New(valueType).Elem()
+		f.filterValue.Set(valueVal)
 	} else {
 		f.filterValue = valueVal
 	}
-	q.filters = append(q.filters, f)
-	return q
+	if f.indexType == indexNumeric {
+		indexValue, err := numericIndexValue(f.filterValue)
+		if err != nil {
+			return f, err
+		}
+		f.indexValue = indexValue
+	}
+	return f, nil
+}
+
+// newNullFilter finishes constructing a null filter. If isNullFilter is true,
+// nullFilter was given as the value and operator should be empty. Otherwise the
+// value was nil and operator should be either "=" or "!=".
+func newNullFilter(ms modelSpec, f filter, operator string, nullFilter NullFilter, isNullFilter bool) (filter, error) {
+	if _, found := ms.pointerIndexes[f.fieldName]; !found {
+		return f, fmt.Errorf("zoom: null filters are only allowed on indexed pointer fields.\n%s.%s is not a pointer.", ms.modelType.String(), f.fieldName)
+	}
+	if isNullFilter {
+		if operator != "" {
+			return f, errors.New("zoom: invalid fieldStr for null filter. should be only a field name.")
+		}
+	} else {
+		switch operator {
+		case "=":
+			nullFilter = IsNull
+		case "!=":
+			nullFilter = IsNotNull
+		default:
+			return f, errors.New("zoom: invalid operator for nil value. should be one of = or !=.")
+		}
+	}
+	if nullFilter == IsNull {
+		f.filterType = isNull
+	} else {
+		f.filterType = isNotNull
+	}
+	return f, nil
 }
 
 func splitFilterString(filterString string) (fieldName string, operator string, err error) {
 	split := strings.Split(filterString, " ")
-	if len(split) != 2 {
+	if len(split) == 1 {
+		// a field name without an operator, which is only valid for null filters
+		return split[0], "", nil
+	} else if len(split) != 2 {
 		return "", "", errors.New("zoom: too many spaces in fieldStr argument. should be a field name, a space, and an operator.")
 	}
 	return split[0], split[1], nil
 }
 
 func (q *Query) filterById(operator string, value interface{}) *Query {
-	if operator != "=" {
-		q.setErrorIfNone(errors.New("zoom: only the = operator can be used with Filter on Id field."))
+	f, err := newIdFilter(operator, value)
+	if err != nil {
+		q.setErrorIfNone(err)
 		return q
 	}
+	q.filters = append(q.filters, f)
+	return q
+}
+
+func newIdFilter(operator string, value interface{}) (filter, error) {
+	if operator != "=" {
+		return filter{}, errors.New("zoom: only the = operator can be used with Filter on Id field.")
+	}
 	idVal := reflect.ValueOf(value)
 	if idVal.Kind() != reflect.String {
-		err := fmt.Errorf("zoom: for a Filter on Id field, value must be a string type. Was type %s", idVal.Kind().String())
-		q.setErrorIfNone(err)
-		return q
+		return filter{}, fmt.Errorf("zoom: for a Filter on Id field, value must be a string type. Was type %s", idVal.Kind().String())
 	}
 	f := filter{
 		fieldName:   "Id",
@@ -330,6 +544,31 @@ func (q *Query) filterById(operator string, value interface{}) *Query {
 		filterValue: idVal,
 		byId:        true,
 	}
+	return f, nil
+}
+
+// filterByRelatedField adds a filter on a field of a related model. fieldName
+// should be of the form "<Relationship>.<Field>", where <Field> is either Id or
+// an indexed field of the related model. The query will only return models
+// which have at least one related model matching the filter.
+func (q *Query) filterByRelatedField(fieldName string, operator string, value interface{}) *Query {
+	rel, relatedFieldName, err := q.modelSpec.relatedField(fieldName)
+	if err != nil {
+		q.setErrorIfNone(err)
+		return q
+	}
+	var f filter
+	if relatedFieldName == "Id" {
+		f, err = newIdFilter(operator, value)
+	} else {
+		f, err = newFilter(rel.modelSpec, relatedFieldName, operator, value)
+	}
+	if err != nil {
+		q.setErrorIfNone(err)
+		return q
+	}
+	f.fieldName = fieldName
+	f.relation = rel
 	q.filters = append(q.filters, f)
 	return q
 }
@@ -344,7 +583,10 @@ func (q *Query) Run() (interface{}, error) {
 	if q.err != nil {
 		return nil, q.err
 	}
-	q.trans = newTransaction()
+	if err := q.sweepExpired(); err != nil {
+		return nil, err
+	}
+	q.trans = newReadTransaction(q.modelSpec.ns())
 	if err := q.sendIdData(); err != nil {
 		return nil, err
 	}
@@ -396,7 +638,10 @@ func (q *Query) Scan(in interface{}) error {
 	if q.err != nil {
 		return q.err
 	}
-	q.trans = newTransaction()
+	if err := q.sweepExpired(); err != nil {
+		return err
+	}
+	q.trans = newReadTransaction(q.modelSpec.ns())
 
 	// make sure we are dealing with the right type
 	typ := reflect.TypeOf(in).Elem()
@@ -450,7 +695,21 @@ func (q *Query) ScanOne(in interface{}) error {
 // error that occured during the lifetime of the query object (if any).
 // Otherwise, the second return value will be nil.
 func (q *Query) Count() (int, error) {
-	if len(q.filters) != 0 {
+	if err := q.sweepExpired(); err != nil {
+		return 0, err
+	}
+	if len(q.filters) != 0 && !q.modelSpec.softDelete && q.after == nil && q.err == nil {
+		// count the ids in the database without retrieving them (which is
+		// not possible if the indexes contain models which were soft deleted)
+		if allRanges, ok := q.countRanges(); ok {
+			count, err := q.countFilters(allRanges)
+			if err != nil {
+				return 0, err
+			}
+			return q.limitOffsetCount(count), nil
+		}
+	}
+	if len(q.filters) != 0 || q.scopesDeleted() || q.after != nil {
 		if ids, err := q.IdsOnly(); err != nil {
 			return 0, err
 		} else {
@@ -461,7 +720,7 @@ func (q *Query) Count() (int, error) {
 		return 0, q.err
 	}
 
-	conn := GetConn()
+	conn := getReadConn()
 	defer conn.Close()
 
 	args := redis.Args{}
@@ -472,7 +731,7 @@ func (q *Query) Count() (int, error) {
 			return 0, errors.New("zoom: offset cannot be applied to queries without an order.")
 		}
 		command = "SCARD"
-		indexKey := q.modelSpec.modelName + ":all"
+		indexKey := q.modelSpec.key("all")
 		args = args.Add(indexKey)
 		count, err := redis.Int(conn.Do("SCARD", args...))
 		if err != nil {
@@ -489,35 +748,33 @@ func (q *Query) Count() (int, error) {
 				return count, nil
 			}
 		}
+	} else if q.order.relation != nil {
+		// models are ordered by a related model, or placed at the end if they
+		// do not have one, so every model is included
+		count, err := redis.Int(conn.Do("SCARD", q.modelSpec.indexKey()))
+		if err != nil {
+			return 0, err
+		}
+		return q.limitOffsetCount(count), nil
 	} else {
 		// with ordering
 		// this is a little more complicated
 		command = "ZCARD"
-		indexKey := q.modelSpec.modelName + ":" + q.order.redisName
+		indexKey := q.modelSpec.key(q.order.redisName)
 		args = args.Add(indexKey)
 		count, err := redis.Int(conn.Do(command, args...))
 		if err != nil {
 			return 0, err
 		}
-		if q.limit == 0 && q.offset == 0 {
-			// simple case (no limit, no offset)
-			return count, nil
-		} else {
-			// we need to take limit and offset into account
-			// in order to return the correct number of models which
-			// would have been returned by running the query
-			if q.offset > uint(count) {
-				// special case for offset > count
-				return 0, nil
-			} else if q.limit == 0 {
-				// special case if limit = 0 (really means unlimited)
-				return count - int(q.offset), nil
-			} else {
-				// holy type coercion, batman!
-				// it's ugly but it works
-				return int(math.Min(float64(count-int(q.offset)), float64(q.limit))), nil
+		if q.order.nullable {
+			// models for which the field is nil are not in the index
+			nullCount, err := redis.Int(conn.Do("SCARD", q.modelSpec.nullIndexKey(q.order.redisName)))
+			if err != nil {
+				return 0, err
 			}
+			count += nullCount
 		}
+		return q.limitOffsetCount(count), nil
 	}
 }
 
@@ -529,7 +786,10 @@ func (q *Query) IdsOnly() ([]string, error) {
 	if q.err != nil {
 		return nil, q.err
 	}
-	q.trans = newTransaction()
+	if err := q.sweepExpired(); err != nil {
+		return nil, err
+	}
+	q.trans = newReadTransaction(q.modelSpec.ns())
 	if err := q.sendIdData(); err != nil {
 		return nil, err
 	}
@@ -561,12 +821,64 @@ func (q *Query) IdsOnly() ([]string, error) {
 func (q *Query) sendIdData() error {
 	// clear out any previous id data
 	q.idData = []string{}
-	if len(q.filters) == 0 {
+	q.stages = []idStage{}
+	q.relations = map[string]string{}
+	if q.order.fieldName != "" && q.order.relation == nil {
+		if _, found := q.modelSpec.indexTypeForField(q.order.fieldName); !found {
+			if plan, _ := q.compoundPlan(); plan == nil {
+				return fmt.Errorf("zoom: %s.%s is only indexed as part of a compound index, which could not be used to order the query.", q.modelSpec.modelType.String(), q.order.fieldName)
+			}
+		}
+	}
+	if q.after != nil {
+		if err := q.checkAfter(); err != nil {
+			return err
+		}
+	}
+	if len(q.filters) == 0 && !q.ordersClientSide() && !q.scopesDeleted() && q.after != nil {
+		// keyset pagination with a cursor
+		idsDataKey := "modelIds"
+		q.addIdData(idsDataKey, "(after cursor)")
+		if q.order.fieldName == "" && q.explaining {
+			// the ids are only scanned when the query is run
+			cursor, count := q.after.Scan, q.limit
+			if cursor == "" {
+				cursor = "0"
+			}
+			if count == 0 {
+				count = defaultBatchSize
+			}
+			q.trans.command("SSCAN", redis.Args{}.Add(q.modelSpec.indexKey()).Add(cursor).Add("COUNT").Add(count), nil)
+		} else if q.order.fieldName == "" {
+			ids, err := q.scanIdsAfterCursor()
+			if err != nil {
+				return err
+			}
+			q.trans.sendData(idsDataKey, ids)
+		} else {
+			q.sendIdDataForCursor(idsDataKey, q.limit)
+		}
+		return nil
+	} else if len(q.filters) == 0 && q.order.nullable && !q.scopesDeleted() {
+		// the order is on a pointer field, so the ids of models for which the
+		// field is nil are added before or after the ordered ids
+		idsDataKey := "modelIds"
+		q.addIdData(idsDataKey, q.order.string())
+		q.sendIdDataForNullableOrderPage(idsDataKey)
+		return nil
+	} else if q.pagesAroundDeleted() {
+		// the index for the order also contains the ids of deleted models, so
+		// they are removed from a page which is longer by their number
+		idsDataKey := "modelIds"
+		q.addIdData(idsDataKey, "(not deleted)")
+		q.sendIdDataForLivePage(idsDataKey)
+		return nil
+	} else if len(q.filters) == 0 && !q.ordersClientSide() && !q.scopesDeleted() {
 		if cmd, args, err := q.getAllModelsArgs(true); err != nil {
 			return err
 		} else {
 			idsDataKey := "modelIds"
-			q.idData = append(q.idData, idsDataKey)
+			q.addIdData(idsDataKey, "(all ids)")
 			if q.order.fieldName != "" && q.order.indexType == indexAlpha {
 				// special case for parsing ids from the redis response
 				q.trans.command(cmd, args, newSendAlphaIdsHandler(q.trans, idsDataKey, false))
@@ -578,25 +890,86 @@ func (q *Query) sendIdData() error {
 		}
 	} else {
 		// with filters, we need to iterate through each filter and get the ids
+		ids, primary, filters, err := q.costBasedIds()
+		if err != nil {
+			return err
+		} else if primary != nil {
+			// the ids were found by checking the candidates for the most selective
+			// filter, and are already in the correct order
+			idsDataKey := "candidateIds"
+			if q.order.fieldName != "" {
+				idsDataKey = "primaryIds"
+			}
+			q.addIdData(idsDataKey, fmt.Sprintf("%s with ~%d candidates checked against the other filters", primary.filter.string(), primary.estimate))
+			if q.explaining {
+				q.stages[len(q.stages)-1].estimate = primary.estimate
+			} else {
+				q.trans.sendData(idsDataKey, ids)
+			}
+			if q.modelSpec.softDelete {
+				q.sendIdDataForDeletedScope()
+			}
+			return nil
+		}
 		primaryCovered := false
-		for i, f := range q.filters {
+		// scoped is true if the ids of models which were soft deleted have
+		// already been excluded (or included) by one of the stages
+		scoped := false
+		if plan, remaining := q.compoundPlan(); plan != nil {
+			// some of the filters are covered by a single sorted set of a
+			// compound index, which is also in the correct order
+			compoundIdsKey := "compoundIds"
+			if q.order.fieldName != "" {
+				compoundIdsKey = "primaryIds"
+				primaryCovered = true
+			}
+			q.addIdData(compoundIdsKey, "(compound index "+plan.index.name+")")
+			if err := q.sendIdDataForCompoundPlan(plan, compoundIdsKey); err != nil {
+				return err
+			}
+			filters = remaining
+		}
+		if q.after != nil {
+			// only the ids after the cursor should be returned
+			cursorIdsKey := "cursorIds"
+			q.addIdData(cursorIdsKey, "(after cursor)")
+			q.sendIdDataForCursor(cursorIdsKey, 0)
+		}
+		for i, f := range filters {
 			filterIdsKey := "filter" + strconv.Itoa(i)
-			if f.fieldName == q.order.fieldName {
+			if !primaryCovered && f.fieldName == q.order.fieldName && f.relation == nil {
 				filterIdsKey = "primaryIds"
 				primaryCovered = true
 			}
-			q.idData = append(q.idData, filterIdsKey)
-			q.sendIdDataForFilter(f, filterIdsKey)
+			q.addIdData(filterIdsKey, f.string())
+			if err := q.sendIdDataForFilter(f, filterIdsKey); err != nil {
+				return err
+			}
 		}
-		if !primaryCovered {
+		if !primaryCovered && q.order.relation != nil {
+			// the order is on a field of a related model, so the ids need to be
+			// sorted according to the related models
+			orderedIdsKey := "primaryIds"
+			q.addIdData(orderedIdsKey, q.order.string())
+			q.sendIdDataForRelatedOrder(orderedIdsKey)
+		} else if !primaryCovered && q.order.nullable {
+			// the order is on a pointer field, so the ids of models for which the
+			// field is nil need to be added to the ordered ids
+			orderedIdsKey := "primaryIds"
+			q.addIdData(orderedIdsKey, q.order.string())
+			if err := q.sendIdDataForNullableOrder(orderedIdsKey); err != nil {
+				return err
+			}
+		} else if !primaryCovered && (q.order.fieldName != "" || len(q.idData) == 0) {
 			// no filter had the same field name as the order, so we need to add a
 			// command to get the ordered ids and use them as a basis for ordering
-			// all the others.
+			// all the others. Unordered queries with filters don't need them,
+			// since the ids which match the filters are all that is returned.
 			if cmd, args, err := q.getAllModelsArgs(false); err != nil {
 				return err
 			} else {
 				orderedIdsKey := "primaryIds"
-				q.idData = append(q.idData, orderedIdsKey)
+				q.addIdData(orderedIdsKey, "(all ids)")
 				if q.order.fieldName != "" && q.order.indexType == indexAlpha {
 					// special case for parsing ids from the redis response
 					q.trans.command(cmd, args, newSendAlphaIdsHandler(q.trans, orderedIdsKey, false))
@@ -604,12 +977,40 @@ func (q *Query) sendIdData() error {
 					// send the database response directly
 					q.trans.command(cmd, args, newSendDataHandler(q.trans, orderedIdsKey))
 				}
+				// without an order, the ids come from the set of all models
+				// (or deleted models) rather than an index
+				scoped = q.order.fieldName == ""
 			}
 		}
+		if q.modelSpec.softDelete && !scoped {
+			q.sendIdDataForDeletedScope()
+		}
 	}
 	return nil
 }
 
+// addIdData adds key to the idData of the query. It also keeps track of the
+// commands which are added to the query transaction for the key, which must be
+// added right after addIdData is called, so that they can be shown by Explain.
+// description is a short human-readable description of the ids.
+func (q *Query) addIdData(key string, description string) {
+	q.idData = append(q.idData, key)
+	q.stages = append(q.stages, idStage{key: key, description: description, firstCommand: len(q.trans.commands), estimate: -1})
+}
+
+// limitsClientSide returns true iff limit and offset are applied after the ids
+// are retrieved, rather than by the commands which retrieve them.
+func (q *Query) limitsClientSide() bool {
+	return len(q.filters) > 0 || q.order.relation != nil || (q.scopesDeleted() && !q.pagesAroundDeleted())
+}
+
+// ordersClientSide returns true iff the order of the query cannot be read
+// directly from a single index, in which case all the ids must be retrieved and
+// limit and offset must be applied after they are ordered.
+func (q *Query) ordersClientSide() bool {
+	return q.order.relation != nil || q.order.nullable
+}
+
 // returns a function which, when run, extracts ids from alpha index values and then sends the ids as transaction data
 func newSendAlphaIdsHandler(t *transaction, key string, reverse bool) func(interface{}) error {
 	return func(reply interface{}) error {
@@ -663,7 +1064,13 @@ func (q *Query) executeAndScan(sliceVal reflect.Value) error {
 			return q.scanModelsByIds(ids, sliceVal)
 		}
 	})
-	return q.trans.exec()
+	if err := q.trans.exec(); err != nil {
+		return err
+	}
+	if q.modelSpec.expirable {
+		removeExpiredModels(sliceVal)
+	}
+	return nil
 }
 
 // NOTE: should be placed inside a doWhenDataReady function, otherwise
@@ -675,10 +1082,13 @@ func (q *Query) intersectAllIds() ([]string, error) {
 		if err != nil {
 			return nil, err
 		}
-		switch i {
-		case 0:
+		switch {
+		case i == 0:
 			// on the first iteration just set allModelIds
 			allModelIds = theseIds
+		case idDataKey == "excludedIds":
+			// indicates these ids should be removed (e.g. deleted models)
+			allModelIds = orderedSubtractStrings(allModelIds, theseIds)
 		default:
 			// on subsequent iterations, do an ordered intersect with allModelIds
 			if idDataKey == "primaryIds" {
@@ -689,9 +1099,11 @@ func (q *Query) intersectAllIds() ([]string, error) {
 			}
 		}
 	}
-	if len(q.filters) > 0 {
+	if q.limitsClientSide() {
 		allModelIds = applyLimitOffset(allModelIds, q.limit, q.offset)
 	}
+	// keep track of the ids so that NextCursor can find the last one
+	q.pageIds = allModelIds
 	return allModelIds, nil
 }
 
@@ -712,7 +1124,7 @@ func convertDataToStrings(data interface{}) ([]string, error) {
 // pointers to model structs
 func (q *Query) scanModelsByIds(ids []string, sliceVal reflect.Value) error {
 	for _, id := range ids {
-		mr, err := newModelRefFromName(q.modelSpec.modelName)
+		mr, err := newModelRefFromName(q.modelSpec.ns(), q.modelSpec.modelName)
 		if err != nil {
 			return err
 		}
@@ -733,7 +1145,12 @@ func (q *Query) getAllModelsArgs(applyLimitOffset bool) (string, redis.Args, err
 		if q.offset != 0 {
 			return "", nil, errors.New("zoom: offset cannot be applied to queries without an order.")
 		}
-		indexKey := q.modelSpec.modelName + ":all"
+		if q.scopesDeleted() {
+			// the ids of deleted models are not in the set of all models
+			command, args := q.deletedScopeArgs()
+			return command, args, nil
+		}
+		indexKey := q.modelSpec.key("all")
 		args = args.Add(indexKey)
 		if q.limit == 0 || !applyLimitOffset {
 			command = "SMEMBERS"
@@ -747,7 +1164,7 @@ func (q *Query) getAllModelsArgs(applyLimitOffset bool) (string, redis.Args, err
 		} else if q.order.orderType == descending {
 			command = "ZREVRANGE"
 		}
-		indexKey := q.modelSpec.modelName + ":" + q.order.redisName
+		indexKey := q.modelSpec.key(q.order.redisName)
 		args = args.Add(indexKey)
 		if applyLimitOffset {
 			start, stop := q.getStartStop()
@@ -771,219 +1188,582 @@ func (q *Query) getStartStop() (int, int) {
 }
 
 func (q *Query) sendIdDataForFilter(f filter, dataKey string) error {
+	if f.relation != nil {
+		// special case for filters on fields of related models
+		return q.sendIdDataForRelatedFilter(f, dataKey)
+	}
+	if _, found := q.modelSpec.indexTypeForField(f.fieldName); !found && !f.byId {
+		return fmt.Errorf("zoom: %s.%s is only indexed as part of a compound index, which could not be used for the filter %s.", q.modelSpec.modelType.String(), f.fieldName, f.string())
+	}
+	reverse := q.order.orderType == descending && q.order.fieldName == f.fieldName
+	return q.sendIdDataForIndex(q.modelSpec, f, dataKey, reverse)
+}
+
+// sendIdDataForIndex adds commands to the query transaction which will send
+// the ids of all models described by ms which match the filter f. If reverse
+// is true, the ids will be sent in descending order.
+func (q *Query) sendIdDataForIndex(ms modelSpec, f filter, dataKey string, reverse bool) error {
 	// special case for id filters
 	if f.byId {
 		id := f.filterValue.String()
 		q.trans.sendData(dataKey, []string{id})
+	} else if f.filterType == isNull {
+		// the ids are stored in a separate set
+		args := redis.Args{}.Add(ms.nullIndexKey(f.redisName))
+		q.trans.command("SMEMBERS", args, newSendDataHandler(q.trans, dataKey))
+	} else if f.filterType == isNotNull {
+		// every model in the index has a non-nil value
+		var command string
+		if !reverse {
+			command = "ZRANGE"
+		} else {
+			command = "ZREVRANGE"
+		}
+		args := redis.Args{}.Add(ms.key(f.redisName)).Add(0).Add(-1)
+		if f.indexType == indexAlpha {
+			q.trans.command(command, args, newSendAlphaIdsHandler(q.trans, dataKey, false))
+		} else {
+			q.trans.command(command, args, newSendDataHandler(q.trans, dataKey))
+		}
 	} else {
-		setKey := q.modelSpec.modelName + ":" + f.redisName
-		reverse := q.order.orderType == descending && q.order.fieldName == f.fieldName
-		switch f.indexType {
+		setKey := ms.key(f.redisName)
+		return q.sendIdDataForIndexKey(ms, setKey, f, dataKey, reverse)
+	}
+	return nil
+}
 
-		case indexNumeric:
-			args := redis.Args{}.Add(setKey)
-			switch f.filterType {
-			case equal, less, greater, lessOrEqual, greaterOrEqual:
-				min, max := getMinMaxForNumericFilter(f)
-				var command string
+// sendIdDataForIndexKey adds commands to the query transaction which will send
+// the ids of all models in the sorted set identified by setKey which match the
+// filter f. If reverse is true, the ids will be sent in descending order.
+func (q *Query) sendIdDataForIndexKey(ms modelSpec, setKey string, f filter, dataKey string, reverse bool) error {
+	switch f.indexType {
+
+	case indexNumeric:
+		args := redis.Args{}.Add(setKey)
+		switch f.filterType {
+		case equal, less, greater, lessOrEqual, greaterOrEqual:
+			min, max := getMinMaxForNumericFilter(f)
+			var command string
+			if !reverse {
+				command = "ZRANGEBYSCORE"
+				args = args.Add(min).Add(max)
+			} else {
+				command = "ZREVRANGEBYSCORE"
+				args = args.Add(max).Add(min)
+			}
+			q.trans.command(command, args, newSendDataHandler(q.trans, dataKey))
+		case notEqual:
+			// special case for not equals
+			// split into two different queries (less and greater) and
+			// use union to combine the results
+			max := fmt.Sprintf("(%v", f.indexValue)
+			lessArgs := args.Add("-inf").Add(max)
+			lessIdsKey := dataKey + "lessIds"
+			q.trans.command("ZRANGEBYSCORE", lessArgs, newSendDataHandler(q.trans, lessIdsKey))
+			min := fmt.Sprintf("(%v", f.indexValue)
+			greaterIdsKey := dataKey + "greaterIds"
+			greaterArgs := args.Add(min).Add("+inf")
+			q.trans.command("ZRANGEBYSCORE", greaterArgs, newSendDataHandler(q.trans, greaterIdsKey))
+
+			// when both lessIds and greaterIds are ready, combine them into a single set of ids
+			q.trans.doWhenDataReady([]string{lessIdsKey, greaterIdsKey}, func() error {
+				lessIds, err := convertDataToStrings(q.trans.data[lessIdsKey])
+				if err != nil {
+					return err
+				}
+				greaterIds, err := convertDataToStrings(q.trans.data[greaterIdsKey])
+				if err != nil {
+					return err
+				}
+				allFilterIds := make([]string, 0)
 				if !reverse {
-					command = "ZRANGEBYSCORE"
-					args = args.Add(min).Add(max)
+					allFilterIds = append(lessIds, greaterIds...)
 				} else {
-					command = "ZREVRANGEBYSCORE"
-					args = args.Add(max).Add(min)
-				}
-				q.trans.command(command, args, newSendDataHandler(q.trans, dataKey))
-			case notEqual:
-				// special case for not equals
-				// split into two different queries (less and greater) and
-				// use union to combine the results
-				max := fmt.Sprintf("(%v", f.filterValue.Interface())
-				lessArgs := args.Add("-inf").Add(max)
-				lessIdsKey := dataKey + "lessIds"
-				q.trans.command("ZRANGEBYSCORE", lessArgs, newSendDataHandler(q.trans, lessIdsKey))
-				min := fmt.Sprintf("(%v", f.filterValue.Interface())
-				greaterIdsKey := dataKey + "greaterIds"
-				greaterArgs := args.Add(min).Add("+inf")
-				q.trans.command("ZRANGEBYSCORE", greaterArgs, newSendDataHandler(q.trans, greaterIdsKey))
-
-				// when both lessIds and greaterIds are ready, combine them into a single set of ids
-				q.trans.doWhenDataReady([]string{lessIdsKey, greaterIdsKey}, func() error {
-					lessIds, err := convertDataToStrings(q.trans.data[lessIdsKey])
-					if err != nil {
-						return err
+					for i, j := 0, len(lessIds)-1; i <= j; i, j = i+1, j-1 {
+						lessIds[i], lessIds[j] = lessIds[j], lessIds[i]
 					}
-					greaterIds, err := convertDataToStrings(q.trans.data[greaterIdsKey])
-					if err != nil {
-						return err
-					}
-					allFilterIds := make([]string, 0)
-					if !reverse {
-						allFilterIds = append(lessIds, greaterIds...)
-					} else {
-						for i, j := 0, len(lessIds)-1; i <= j; i, j = i+1, j-1 {
-							lessIds[i], lessIds[j] = lessIds[j], lessIds[i]
-						}
-						for i, j := 0, len(greaterIds)-1; i <= j; i, j = i+1, j-1 {
-							greaterIds[i], greaterIds[j] = greaterIds[j], greaterIds[i]
-						}
-						allFilterIds = append(greaterIds, lessIds...)
+					for i, j := 0, len(greaterIds)-1; i <= j; i, j = i+1, j-1 {
+						greaterIds[i], greaterIds[j] = greaterIds[j], greaterIds[i]
 					}
-					q.trans.sendData(dataKey, allFilterIds)
-					return nil
-				})
-			}
+					allFilterIds = append(greaterIds, lessIds...)
+				}
+				q.trans.sendData(dataKey, allFilterIds)
+				return nil
+			})
+		}
 
-		case indexBoolean:
-			args := redis.Args{}.Add(setKey)
-			var min, max interface{}
+	case indexBoolean:
+		args := redis.Args{}.Add(setKey)
+		var min, max interface{}
+		switch f.filterType {
+		case equal:
+			if f.filterValue.Bool() == true {
+				// use 1 for true
+				min, max = 1, 1
+			} else {
+				// use 0 for false
+				min, max = 0, 0
+			}
+		case less:
+			if f.filterValue.Bool() == true {
+				// false is less than true
+				// 0 < 1
+				min, max = 0, 0
+			} else {
+				// can't be less than false (0)
+				q.trans.sendData(dataKey, []string{})
+				return nil
+			}
+		case greater:
+			if f.filterValue.Bool() == true {
+				// can't be greater than true (1)
+				q.trans.sendData(dataKey, []string{})
+				return nil
+			} else {
+				// true is greater than false
+				// 1 > 0
+				min, max = 1, 1
+			}
+		case lessOrEqual:
+			if f.filterValue.Bool() == true {
+				// true and false are <= true
+				// 1 <= 1 and 0 <= 1
+				min = 0
+				max = 1
+			} else {
+				// false <= false
+				// 0 <= 0
+				min, max = 0, 0
+			}
+		case greaterOrEqual:
+			if f.filterValue.Bool() == true {
+				// true >= true
+				// 1 >= 1
+				min, max = 1, 1
+			} else {
+				// false and true are >= false
+				// 0 >= 0 and 1 >= 0
+				min = 0
+				max = 1
+			}
+		case notEqual:
+			if f.filterValue.Bool() == true {
+				// not true means false
+				// false == 0
+				min, max = 0, 0
+			} else {
+				// not false means true
+				// true == 1
+				min, max = 1, 1
+			}
+		default:
+			return fmt.Errorf("zoom: Filter operator out of range. Got: %d", f.filterType)
+		}
+		// execute command to get the ids
+		// TODO: try and do this inside of a transaction
+		var command string
+		if !reverse {
+			command = "ZRANGEBYSCORE"
+			args = args.Add(min).Add(max)
+		} else {
+			command = "ZREVRANGEBYSCORE"
+			args = args.Add(max).Add(min)
+		}
+		q.trans.command(command, args, newSendDataHandler(q.trans, dataKey))
+
+	case indexAlpha:
+		args := redis.Args{}.Add(setKey)
+		switch f.filterType {
+		case equal, less, greater, lessOrEqual, greaterOrEqual:
+			var min, max string
+			valString := f.filterValue.String()
 			switch f.filterType {
 			case equal:
-				if f.filterValue.Bool() == true {
-					// use 1 for true
-					min, max = 1, 1
-				} else {
-					// use 0 for false
-					min, max = 0, 0
-				}
+				min = "(" + valString
+				max = "(" + valString + delString
 			case less:
-				if f.filterValue.Bool() == true {
-					// false is less than true
-					// 0 < 1
-					min, max = 0, 0
-				} else {
-					// can't be less than false (0)
-					q.trans.sendData(dataKey, []string{})
-					return nil
-				}
+				min = "-"
+				max = "(" + valString
 			case greater:
-				if f.filterValue.Bool() == true {
-					// can't be greater than true (1)
-					q.trans.sendData(dataKey, []string{})
-					return nil
-				} else {
-					// true is greater than false
-					// 1 > 0
-					min, max = 1, 1
-				}
+				min = "(" + valString + delString
+				max = "+"
 			case lessOrEqual:
-				if f.filterValue.Bool() == true {
-					// true and false are <= true
-					// 1 <= 1 and 0 <= 1
-					min = 0
-					max = 1
-				} else {
-					// false <= false
-					// 0 <= 0
-					min, max = 0, 0
-				}
+				min = "-"
+				max = "(" + valString + delString
 			case greaterOrEqual:
-				if f.filterValue.Bool() == true {
-					// true >= true
-					// 1 >= 1
-					min, max = 1, 1
-				} else {
-					// false and true are >= false
-					// 0 >= 0 and 1 >= 0
-					min = 0
-					max = 1
+				min = "(" + valString
+				max = "+"
+			}
+			args = args.Add(min).Add(max)
+			q.trans.command("ZRANGEBYLEX", args, newSendAlphaIdsHandler(q.trans, dataKey, reverse))
+		case notEqual:
+			// special case for not equals
+			// split into two different queries (less and greater) and
+			// combine the results
+			valString := f.filterValue.String()
+			max := "(" + valString
+			lessArgs := args.Add("-").Add(max)
+			lessIdsKey := dataKey + "lessIds"
+			q.trans.command("ZRANGEBYLEX", lessArgs, newSendAlphaIdsHandler(q.trans, lessIdsKey, false))
+			min := "(" + valString + delString
+			greaterIdsKey := dataKey + "greaterIds"
+			greaterArgs := args.Add(min).Add("+")
+			q.trans.command("ZRANGEBYLEX", greaterArgs, newSendAlphaIdsHandler(q.trans, greaterIdsKey, false))
+
+			// when both lessIds and greaterIds are ready, combine them into a single set of ids
+			q.trans.doWhenDataReady([]string{lessIdsKey, greaterIdsKey}, func() error {
+				lessIds, err := convertDataToStrings(q.trans.data[lessIdsKey])
+				if err != nil {
+					return err
+				}
+				greaterIds, err := convertDataToStrings(q.trans.data[greaterIdsKey])
+				if err != nil {
+					return err
 				}
-			case notEqual:
-				if f.filterValue.Bool() == true {
-					// not true means false
-					// false == 0
-					min, max = 0, 0
+				allFilterIds := make([]string, 0)
+				if !reverse {
+					allFilterIds = append(lessIds, greaterIds...)
 				} else {
-					// not false means true
-					// true == 1
-					min, max = 1, 1
+					for i, j := 0, len(lessIds)-1; i <= j; i, j = i+1, j-1 {
+						lessIds[i], lessIds[j] = lessIds[j], lessIds[i]
+					}
+					for i, j := 0, len(greaterIds)-1; i <= j; i, j = i+1, j-1 {
+						greaterIds[i], greaterIds[j] = greaterIds[j], greaterIds[i]
+					}
+					allFilterIds = append(greaterIds, lessIds...)
+				}
+				q.trans.sendData(dataKey, allFilterIds)
+				return nil
+			})
+		}
+
+	default:
+		return fmt.Errorf("zoom: cannot use filters on unindexed field %s for model name %s.", f.fieldName, ms.modelName)
+	}
+	return nil
+}
+
+// sendIdDataForRelatedFilter adds commands to the query transaction which will
+// send the ids of all models which have at least one related model matching
+// the filter f. The ids of the matching related models are found using the
+// index of the related model, and are then resolved through the relationship
+// keys of the queried model.
+func (q *Query) sendIdDataForRelatedFilter(f filter, dataKey string) error {
+	relatedIdsKey := dataKey + "relatedIds"
+	if err := q.sendIdDataForIndex(f.relation.modelSpec, f, relatedIdsKey, false); err != nil {
+		return err
+	}
+	relationsKey := q.sendRelationIds(f.relation)
+	q.trans.doWhenDataReady([]string{relatedIdsKey, relationsKey}, func() error {
+		relatedIds, err := convertDataToStrings(q.trans.data[relatedIdsKey])
+		if err != nil {
+			return err
+		}
+		memo := make(map[string]struct{})
+		for _, id := range relatedIds {
+			memo[id] = struct{}{}
+		}
+		relations := q.trans.data[relationsKey].(map[string][]string)
+		ids := make([]string, 0)
+		for id, rIds := range relations {
+			for _, rId := range rIds {
+				if _, found := memo[rId]; found {
+					ids = append(ids, id)
+					break
 				}
-			default:
-				return fmt.Errorf("zoom: Filter operator out of range. Got: %d", f.filterType)
 			}
-			// execute command to get the ids
-			// TODO: try and do this inside of a transaction
-			var command string
-			if !reverse {
-				command = "ZRANGEBYSCORE"
-				args = args.Add(min).Add(max)
+		}
+		q.trans.sendData(dataKey, ids)
+		return nil
+	})
+	return nil
+}
+
+// sendIdDataForNullableOrder adds commands to the query transaction which will
+// send the ids of all models ordered by a pointer field. The ids of models for
+// which the field is nil are placed at the start or end, depending on whether
+// NullsFirst was used.
+func (q *Query) sendIdDataForNullableOrder(dataKey string) error {
+	cmd, args, err := q.getAllModelsArgs(false)
+	if err != nil {
+		return err
+	}
+	nonNullIdsKey := dataKey + "nonNullIds"
+	if q.order.indexType == indexAlpha {
+		// special case for parsing ids from the redis response
+		q.trans.command(cmd, args, newSendAlphaIdsHandler(q.trans, nonNullIdsKey, false))
+	} else {
+		q.trans.command(cmd, args, newSendDataHandler(q.trans, nonNullIdsKey))
+	}
+	nullIdsKey := dataKey + "nullIds"
+	nullArgs := redis.Args{}.Add(q.modelSpec.nullIndexKey(q.order.redisName))
+	q.trans.command("SMEMBERS", nullArgs, newSendDataHandler(q.trans, nullIdsKey))
+	q.trans.doWhenDataReady([]string{nonNullIdsKey, nullIdsKey}, func() error {
+		nonNullIds, err := convertDataToStrings(q.trans.data[nonNullIdsKey])
+		if err != nil {
+			return err
+		}
+		nullIds, err := convertDataToStrings(q.trans.data[nullIdsKey])
+		if err != nil {
+			return err
+		}
+		// sort the null ids so that the order is consistent between queries
+		sort.Strings(nullIds)
+		if q.nullsFirst {
+			q.trans.sendData(dataKey, append(nullIds, nonNullIds...))
+		} else {
+			q.trans.sendData(dataKey, append(nonNullIds, nullIds...))
+		}
+		return nil
+	})
+	return nil
+}
+
+// sendIdDataForNullableOrderPage is like sendIdDataForNullableOrder, but for
+// queries without filters. Limit and offset are applied by the database: the
+// sizes of the index and of the set of nil values are used to find which part
+// of each is needed, and only that part of the index is retrieved. The set of
+// nil values is only retrieved if some of its ids are needed.
+func (q *Query) sendIdDataForNullableOrderPage(dataKey string) {
+	indexKey := q.modelSpec.key(q.order.redisName)
+	nullKey := q.modelSpec.nullIndexKey(q.order.redisName)
+	nonNullCountKey, nullCountKey := dataKey+"nonNullCount", dataKey+"nullCount"
+	q.trans.command("ZCARD", redis.Args{}.Add(indexKey), newSendDataHandler(q.trans, nonNullCountKey))
+	q.trans.command("SCARD", redis.Args{}.Add(nullKey), newSendDataHandler(q.trans, nullCountKey))
+	q.trans.doWhenDataReady([]string{nonNullCountKey, nullCountKey}, func() error {
+		nonNullCount, err := redis.Int(q.trans.data[nonNullCountKey], nil)
+		if err != nil {
+			return err
+		}
+		nullCount, err := redis.Int(q.trans.data[nullCountKey], nil)
+		if err != nil {
+			return err
+		}
+		nonNullPosition, nullPosition := 0, nonNullCount
+		if q.nullsFirst {
+			nonNullPosition, nullPosition = nullCount, 0
+		}
+		// send the ids once both parts have been retrieved
+		nonNullIds, nullIds := []string{}, []string{}
+		parts := 2
+		partDone := func() {
+			if parts--; parts != 0 {
+				return
+			}
+			if q.nullsFirst {
+				q.trans.sendData(dataKey, append(nullIds, nonNullIds...))
 			} else {
-				command = "ZREVRANGEBYSCORE"
-				args = args.Add(max).Add(min)
+				q.trans.sendData(dataKey, append(nonNullIds, nullIds...))
 			}
-			q.trans.command(command, args, newSendDataHandler(q.trans, dataKey))
+		}
+		if start, stop, ok := q.pageOfPart(nonNullPosition, nonNullCount); ok {
+			command := "ZRANGE"
+			if q.order.orderType == descending {
+				command = "ZREVRANGE"
+			}
+			args := redis.Args{}.Add(indexKey).Add(start).Add(stop - 1)
+			q.trans.command(command, args, func(reply interface{}) error {
+				ids, err := redis.Strings(reply, nil)
+				if err != nil {
+					return err
+				}
+				if q.order.indexType == indexAlpha {
+					for i, valueAndId := range ids {
+						ids[i] = extractModelIdFromAlphaIndexValue(valueAndId)
+					}
+				}
+				nonNullIds = ids
+				partDone()
+				return nil
+			})
+		} else {
+			partDone()
+		}
+		if start, stop, ok := q.pageOfPart(nullPosition, nullCount); ok {
+			q.trans.command("SMEMBERS", redis.Args{}.Add(nullKey), func(reply interface{}) error {
+				ids, err := redis.Strings(reply, nil)
+				if err != nil {
+					return err
+				}
+				// sort the null ids so that the order is consistent between queries
+				sort.Strings(ids)
+				if stop > len(ids) {
+					stop = len(ids)
+				}
+				if start < stop {
+					nullIds = ids[start:stop]
+				}
+				partDone()
+				return nil
+			})
+		} else {
+			partDone()
+		}
+		return nil
+	})
+}
 
-		case indexAlpha:
-			args := redis.Args{}.Add(setKey)
-			switch f.filterType {
-			case equal, less, greater, lessOrEqual, greaterOrEqual:
-				var min, max string
-				valString := f.filterValue.String()
-				switch f.filterType {
-				case equal:
-					min = "(" + valString
-					max = "(" + valString + delString
-				case less:
-					min = "-"
-					max = "(" + valString
-				case greater:
-					min = "(" + valString + delString
-					max = "+"
-				case lessOrEqual:
-					min = "-"
-					max = "(" + valString + delString
-				case greaterOrEqual:
-					min = "(" + valString
-					max = "+"
+// pageOfPart returns the range [start, stop) of the ids which are needed from
+// a part of the results which has count ids and begins at position, given the
+// limit and offset of the query. ok is false if none of them are needed.
+func (q *Query) pageOfPart(position int, count int) (start int, stop int, ok bool) {
+	start = int(q.offset) - position
+	if start < 0 {
+		start = 0
+	}
+	stop = count
+	if q.limit != 0 {
+		if end := int(q.offset+q.limit) - position; end < stop {
+			stop = end
+		}
+	}
+	return start, stop, start < stop
+}
+
+// sendIdDataForRelatedOrder adds commands to the query transaction which will
+// send the ids of all models, ordered by a field of a related model. For
+// one-to-many relationships, the first related model in the order determines
+// the position. Models without a related model are placed at the end.
+func (q *Query) sendIdDataForRelatedOrder(dataKey string) {
+	rel := q.order.relation
+	relatedIdsKey := dataKey + "relatedIds"
+	var command string
+	if q.order.orderType == ascending {
+		command = "ZRANGE"
+	} else {
+		command = "ZREVRANGE"
+	}
+	args := redis.Args{}.Add(rel.modelSpec.key(q.order.redisName)).Add(0).Add(-1)
+	if q.order.indexType == indexAlpha {
+		// special case for parsing ids from the redis response
+		q.trans.command(command, args, newSendAlphaIdsHandler(q.trans, relatedIdsKey, false))
+	} else {
+		q.trans.command(command, args, newSendDataHandler(q.trans, relatedIdsKey))
+	}
+	relationsKey := q.sendRelationIds(rel)
+	q.trans.doWhenDataReady([]string{relatedIdsKey, relationsKey}, func() error {
+		relatedIds, err := convertDataToStrings(q.trans.data[relatedIdsKey])
+		if err != nil {
+			return err
+		}
+		positions := make(map[string]int)
+		for i, id := range relatedIds {
+			positions[id] = i
+		}
+		relations := q.trans.data[relationsKey].(map[string][]string)
+		ranked := rankedIds{}
+		for id, rIds := range relations {
+			rank := len(relatedIds)
+			for _, rId := range rIds {
+				if pos, found := positions[rId]; found && pos < rank {
+					rank = pos
 				}
-				args = args.Add(min).Add(max)
-				q.trans.command("ZRANGEBYLEX", args, newSendAlphaIdsHandler(q.trans, dataKey, reverse))
-			case notEqual:
-				// special case for not equals
-				// split into two different queries (less and greater) and
-				// combine the results
-				valString := f.filterValue.String()
-				max := "(" + valString
-				lessArgs := args.Add("-").Add(max)
-				lessIdsKey := dataKey + "lessIds"
-				q.trans.command("ZRANGEBYLEX", lessArgs, newSendAlphaIdsHandler(q.trans, lessIdsKey, false))
-				min := "(" + valString + delString
-				greaterIdsKey := dataKey + "greaterIds"
-				greaterArgs := args.Add(min).Add("+")
-				q.trans.command("ZRANGEBYLEX", greaterArgs, newSendAlphaIdsHandler(q.trans, greaterIdsKey, false))
-
-				// when both lessIds and greaterIds are ready, combine them into a single set of ids
-				q.trans.doWhenDataReady([]string{lessIdsKey, greaterIdsKey}, func() error {
-					lessIds, err := convertDataToStrings(q.trans.data[lessIdsKey])
-					if err != nil {
-						return err
+			}
+			ranked.ids = append(ranked.ids, id)
+			ranked.ranks = append(ranked.ranks, rank)
+		}
+		sort.Sort(ranked)
+		q.trans.sendData(dataKey, ranked.ids)
+		return nil
+	})
+}
+
+// sendRelationIds adds commands to the query transaction which will send a
+// map of model ids to the ids of their related models for the relation rel.
+// It returns the key under which the data will be sent. The commands are only
+// added once per relation per transaction. Since the relationship of every
+// model of the queried type is read, the transaction returns an error if there
+// are more models than Configuration.MaxRelatedScan.
+func (q *Query) sendRelationIds(rel *relation) string {
+	fs := rel.fieldSpec
+	if dataKey, found := q.relations[fs.fieldName]; found {
+		return dataKey
+	}
+	dataKey := "relation" + fs.fieldName
+	q.relations[fs.fieldName] = dataKey
+	allIdsKey := dataKey + "allIds"
+	cmd, args := q.deletedScopeArgs()
+	q.trans.command(cmd, args, newSendDataHandler(q.trans, allIdsKey))
+	q.trans.doWhenDataReady([]string{allIdsKey}, func() error {
+		ids, err := convertDataToStrings(q.trans.data[allIdsKey])
+		if err != nil {
+			return err
+		}
+		if max := currentConfiguration.MaxRelatedScan; max > 0 && len(ids) > max {
+			return fmt.Errorf("zoom: the query on %s would scan the relationships of %d models of type %s, which is more than Configuration.MaxRelatedScan (%d)", rel.modelSpec.modelName, len(ids), q.modelSpec.modelName, max)
+		}
+		relations := make(map[string][]string)
+		if len(ids) == 0 {
+			q.trans.sendData(dataKey, relations)
+			return nil
+		}
+		switch fs.relType {
+		case oneToOne:
+			// the relationship key for each model holds a single id
+			args := redis.Args{}
+			for _, id := range ids {
+				args = args.Add(q.modelSpec.key(id + ":" + fs.redisName))
+			}
+			q.trans.command("MGET", args, func(reply interface{}) error {
+				rIds, err := redis.Strings(reply, nil)
+				if err != nil {
+					return err
+				}
+				for i, id := range ids {
+					if rIds[i] != "" {
+						relations[id] = []string{rIds[i]}
+					} else {
+						relations[id] = nil
 					}
-					greaterIds, err := convertDataToStrings(q.trans.data[greaterIdsKey])
+				}
+				q.trans.sendData(dataKey, relations)
+				return nil
+			})
+		case oneToMany:
+			// the relationship key for each model is a set of ids
+			for i, id := range ids {
+				id, last := id, i == len(ids)-1
+				relationKey := q.modelSpec.key(id + ":" + fs.redisName)
+				q.trans.command("SMEMBERS", redis.Args{}.Add(relationKey), func(reply interface{}) error {
+					rIds, err := redis.Strings(reply, nil)
 					if err != nil {
 						return err
 					}
-					allFilterIds := make([]string, 0)
-					if !reverse {
-						allFilterIds = append(lessIds, greaterIds...)
-					} else {
-						for i, j := 0, len(lessIds)-1; i <= j; i, j = i+1, j-1 {
-							lessIds[i], lessIds[j] = lessIds[j], lessIds[i]
-						}
-						for i, j := 0, len(greaterIds)-1; i <= j; i, j = i+1, j-1 {
-							greaterIds[i], greaterIds[j] = greaterIds[j], greaterIds[i]
-						}
-						allFilterIds = append(greaterIds, lessIds...)
+					relations[id] = rIds
+					if last {
+						q.trans.sendData(dataKey, relations)
 					}
-					q.trans.sendData(dataKey, allFilterIds)
 					return nil
 				})
 			}
-
-		default:
-			return fmt.Errorf("zoom: cannot use filters on unindexed field %s for model name %s.", f.fieldName, q.modelSpec.modelName)
 		}
+		return nil
+	})
+	return dataKey
+}
+
+// rankedIds is used to sort a slice of ids by a corresponding slice of ranks.
+// Ids with the same rank are sorted by the id itself so that the order is
+// consistent between queries.
+type rankedIds struct {
+	ids   []string
+	ranks []int
+}
+
+func (r rankedIds) Len() int {
+	return len(r.ids)
+}
+
+func (r rankedIds) Swap(i, j int) {
+	r.ids[i], r.ids[j] = r.ids[j], r.ids[i]
+	r.ranks[i], r.ranks[j] = r.ranks[j], r.ranks[i]
+}
+
+func (r rankedIds) Less(i, j int) bool {
+	if r.ranks[i] != r.ranks[j] {
+		return r.ranks[i] < r.ranks[j]
 	}
-	return nil
+	return r.ids[i] < r.ids[j]
 }
 
 // do some math wrt limit and offset and return the results
@@ -1006,22 +1786,23 @@ func applyLimitOffset(slice []string, limit uint, offset uint) []string {
 }
 
 func getMinMaxForNumericFilter(f filter) (min interface{}, max interface{}) {
+	value := f.indexValue
 	switch f.filterType {
 	case equal:
-		min, max = f.filterValue.Interface(), f.filterValue.Interface()
+		min, max = value, value
 	case less:
 		min = "-inf"
 		// use "(" for exclusive
-		max = fmt.Sprintf("(%v", f.filterValue.Interface())
+		max = fmt.Sprintf("(%v", value)
 	case greater:
 		// use "(" for exclusive
-		min = fmt.Sprintf("(%v", f.filterValue.Interface())
+		min = fmt.Sprintf("(%v", value)
 		max = "+inf"
 	case lessOrEqual:
 		min = "-inf"
-		max = f.filterValue.Interface()
+		max = value
 	case greaterOrEqual:
-		min = f.filterValue.Interface()
+		min = value
 		max = "+inf"
 	}
 	return min, max
@@ -1042,12 +1823,19 @@ func (ft filterType) string() string {
 		return ">="
 	case lessOrEqual:
 		return "<="
+	case isNull:
+		return "IS NULL"
+	case isNotNull:
+		return "IS NOT NULL"
 	}
 	return ""
 }
 
 // string returns a string representation of the filter
 func (f filter) string() string {
+	if f.filterType == isNull || f.filterType == isNotNull {
+		return fmt.Sprintf("(filter %s %s)", f.fieldName, f.filterType.string())
+	}
 	return fmt.Sprintf("(filter %s %s %v)", f.fieldName, f.filterType.string(), f.filterValue.Interface())
 }
 
@@ -8,11 +8,16 @@ package zoom
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/garyburd/redigo/redis"
 	"math/rand"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestQueryAll(t *testing.T) {
@@ -372,6 +377,321 @@ func TestQueryScanOne(t *testing.T) {
 	}
 }
 
+func TestQueryRelatedField(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type relatedAuthor struct {
+		Country string `zoom:"index"`
+		Age     int    `zoom:"index"`
+		DefaultData
+	}
+	type relatedPost struct {
+		Title  string
+		Author *relatedAuthor
+		DefaultData
+	}
+	Register(&relatedAuthor{})
+	defer Unregister(&relatedAuthor{})
+	Register(&relatedPost{})
+	defer Unregister(&relatedPost{})
+
+	authors := []*relatedAuthor{
+		{Country: "NZ", Age: 40},
+		{Country: "US", Age: 20},
+		{Country: "NZ", Age: 30},
+	}
+	for _, a := range authors {
+		if err := Save(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	posts := []*relatedPost{
+		{Title: "a", Author: authors[0]},
+		{Title: "b", Author: authors[1]},
+		{Title: "c", Author: authors[2]},
+		{Title: "d"},
+	}
+	for _, p := range posts {
+		if err := Save(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// filter by a related field
+	ids, err := NewQuery("relatedPost").Filter("Author.Country =", "NZ").IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eql, msg := compareAsStringSet([]string{posts[0].Id, posts[2].Id}, ids); !eql {
+		t.Errorf("Ids were incorrect for related filter: %s", msg)
+	}
+
+	// filter by a related id
+	ids, err = NewQuery("relatedPost").Filter("Author.Id =", authors[1].Id).IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eql, msg := compareAsStringSet([]string{posts[1].Id}, ids); !eql {
+		t.Errorf("Ids were incorrect for related id filter: %s", msg)
+	}
+
+	// order by a related field. models without a related model should come last
+	ids, err = NewQuery("relatedPost").Order("Author.Age").IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{posts[1].Id, posts[2].Id, posts[0].Id, posts[3].Id}
+	if !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Ids were incorrect for related order.\nExpected: %v\nGot: %v", expected, ids)
+	}
+
+	// combine a related filter, a related order and a limit
+	ids, err = NewQuery("relatedPost").Filter("Author.Country =", "NZ").Order("-Author.Age").Limit(1).IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{posts[0].Id}
+	if !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Ids were incorrect for related filter and order.\nExpected: %v\nGot: %v", expected, ids)
+	}
+
+	// unindexed or invalid related fields should cause an error
+	if _, err := NewQuery("relatedPost").Filter("Author.Bogus =", "NZ").Run(); err == nil {
+		t.Error("Expected an error for an invalid related field but got none")
+	}
+	if _, err := NewQuery("relatedPost").Order("Title.Country").Run(); err == nil {
+		t.Error("Expected an error for an invalid relationship but got none")
+	}
+
+	// queries which would scan more models than MaxRelatedScan should fail
+	currentConfiguration.MaxRelatedScan = 3
+	defer func() {
+		currentConfiguration.MaxRelatedScan = defaultConfiguration.MaxRelatedScan
+	}()
+	if _, err := NewQuery("relatedPost").Filter("Author.Country =", "NZ").IdsOnly(); err == nil {
+		t.Error("Expected an error for a related filter which scans more than MaxRelatedScan models")
+	}
+	if _, err := NewQuery("relatedPost").Order("Author.Age").IdsOnly(); err == nil {
+		t.Error("Expected an error for a related order which scans more than MaxRelatedScan models")
+	}
+	currentConfiguration.MaxRelatedScan = -1
+	if ids, err := NewQuery("relatedPost").Filter("Author.Country =", "NZ").IdsOnly(); err != nil {
+		t.Error(err)
+	} else if len(ids) != 2 {
+		t.Errorf("Expected 2 ids without a limit on the scan but got %v", ids)
+	}
+}
+
+// scoredPrice is used to test indexes on types which implement IndexScorer
+type scoredPrice struct {
+	Cents int64
+}
+
+func (p scoredPrice) IndexScore() float64 {
+	return float64(p.Cents)
+}
+
+// scoredWeight is used to test indexes on types which implement IndexScorer
+// with a pointer receiver
+type scoredWeight struct {
+	Grams int64
+}
+
+func (w *scoredWeight) IndexScore() float64 {
+	return float64(w.Grams)
+}
+
+func TestQueryTimeAndScorerIndexes(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type timeModel struct {
+		CreatedAt time.Time   `zoom:"index"`
+		UpdatedAt *time.Time  `zoom:"index"`
+		Price     scoredPrice  `zoom:"index"`
+		Weight    scoredWeight `zoom:"index"`
+		DefaultData
+	}
+	Register(&timeModel{})
+	defer Unregister(&timeModel{})
+
+	base := time.Date(2015, time.March, 1, 12, 0, 0, 123456789, time.UTC)
+	models := []*timeModel{
+		{CreatedAt: base, Price: scoredPrice{300}, Weight: scoredWeight{20}},
+		{CreatedAt: base.Add(time.Hour), Price: scoredPrice{100}, Weight: scoredWeight{30}},
+		{CreatedAt: base.Add(2 * time.Hour), Price: scoredPrice{200}, Weight: scoredWeight{10}},
+	}
+	updated := base.Add(time.Minute)
+	models[1].UpdatedAt = &updated
+	for _, m := range models {
+		if err := Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// times should be stored in a readable format
+	conn := GetConn()
+	defer conn.Close()
+	stored, err := redis.String(conn.Do("HGET", "timeModel:"+models[0].Id, "CreatedAt"))
+	if err != nil {
+		t.Error(err)
+	} else if stored != base.Format(time.RFC3339Nano) {
+		t.Errorf("Stored time was incorrect.\nExpected: %s\nGot: %s\n", base.Format(time.RFC3339Nano), stored)
+	}
+
+	// times should be scored in milliseconds, which a float64 can hold exactly
+	expectedScore := float64(base.UnixNano() / int64(time.Millisecond))
+	if score, err := redis.Float64(conn.Do("ZSCORE", "timeModel:CreatedAt", models[0].Id)); err != nil {
+		t.Error(err)
+	} else if score != expectedScore {
+		t.Errorf("Score for time was incorrect.\nExpected: %f\nGot: %f\n", expectedScore, score)
+	}
+
+	// times should be scanned back into the model
+	result, err := FindById("timeModel", models[1].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := result.(*timeModel)
+	if !got.CreatedAt.Equal(models[1].CreatedAt) {
+		t.Errorf("CreatedAt was incorrect.\nExpected: %s\nGot: %s\n", models[1].CreatedAt, got.CreatedAt)
+	}
+	if got.UpdatedAt == nil || !got.UpdatedAt.Equal(updated) {
+		t.Errorf("UpdatedAt was incorrect.\nExpected: %s\nGot: %v\n", updated, got.UpdatedAt)
+	}
+
+	testCases := []struct {
+		q        *Query
+		expected []*timeModel
+	}{
+		{NewQuery("timeModel").Order("CreatedAt"), models},
+		{NewQuery("timeModel").Order("-CreatedAt"), []*timeModel{models[2], models[1], models[0]}},
+		{NewQuery("timeModel").Filter("CreatedAt >", base).Order("CreatedAt"), []*timeModel{models[1], models[2]}},
+		{NewQuery("timeModel").Filter("CreatedAt =", base.Add(time.Hour)), []*timeModel{models[1]}},
+		{NewQuery("timeModel").Order("Price"), []*timeModel{models[1], models[2], models[0]}},
+		{NewQuery("timeModel").Filter("Price <", scoredPrice{250}).Order("-Price"), []*timeModel{models[2], models[1]}},
+		{NewQuery("timeModel").Filter("Weight >", scoredWeight{15}).Order("Weight"), []*timeModel{models[0], models[1]}},
+		{NewQuery("timeModel").Filter("Weight =", &scoredWeight{10}), []*timeModel{models[2]}},
+	}
+	for _, tc := range testCases {
+		ids, err := tc.q.IdsOnly()
+		if err != nil {
+			t.Errorf("Unexpected error for query %s: %s", tc.q, err)
+			continue
+		}
+		expected := modelIds(Models(tc.expected))
+		if !reflect.DeepEqual(expected, ids) {
+			t.Errorf("Ids were incorrect for query %s.\nExpected: %v\nGot: %v", tc.q, expected, ids)
+		}
+	}
+}
+
+func TestQueryNullFilters(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type nullableModel struct {
+		Age  *int    `zoom:"index"`
+		Name *string `zoom:"index"`
+		DefaultData
+	}
+	Register(&nullableModel{})
+	defer Unregister(&nullableModel{})
+
+	ages := []int{30, 20}
+	names := []string{"b", "a"}
+	models := []*nullableModel{
+		{Age: &ages[0], Name: &names[0]},
+		{},
+		{Age: &ages[1], Name: &names[1]},
+		{},
+	}
+	for _, m := range models {
+		if err := Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nullModels := []*nullableModel{models[1], models[3]}
+	if models[1].Id > models[3].Id {
+		nullModels = []*nullableModel{models[3], models[1]}
+	}
+
+	testCases := []struct {
+		q        *Query
+		expected []*nullableModel
+	}{
+		{NewQuery("nullableModel").Filter("Age", IsNull), nullModels},
+		{NewQuery("nullableModel").Filter("Age =", nil), nullModels},
+		{NewQuery("nullableModel").Filter("Age", IsNotNull).Order("Age"), []*nullableModel{models[2], models[0]}},
+		{NewQuery("nullableModel").Filter("Name !=", nil).Order("-Name"), []*nullableModel{models[0], models[2]}},
+		{NewQuery("nullableModel").Filter("Name", IsNull).Filter("Age", IsNull), nullModels},
+		{NewQuery("nullableModel").Order("Age"), []*nullableModel{models[2], models[0], nullModels[0], nullModels[1]}},
+		{NewQuery("nullableModel").Order("-Name").NullsFirst(), []*nullableModel{nullModels[0], nullModels[1], models[0], models[2]}},
+		{NewQuery("nullableModel").Order("Age").NullsFirst().Limit(2).Offset(1), []*nullableModel{nullModels[1], models[2]}},
+		{NewQuery("nullableModel").Order("Age").Limit(1), []*nullableModel{models[2]}},
+		{NewQuery("nullableModel").Order("Age").Limit(2).Offset(1), []*nullableModel{models[0], nullModels[0]}},
+		{NewQuery("nullableModel").Order("Age").Offset(3), []*nullableModel{nullModels[1]}},
+		{NewQuery("nullableModel").Order("-Age").NullsFirst().Limit(2).Offset(1), []*nullableModel{nullModels[1], models[0]}},
+		{NewQuery("nullableModel").Order("-Age").NullsFirst().Offset(2), []*nullableModel{models[0], models[2]}},
+		{NewQuery("nullableModel").Order("Name").Offset(4), []*nullableModel{}},
+	}
+	for _, tc := range testCases {
+		ids, err := tc.q.IdsOnly()
+		if err != nil {
+			t.Errorf("Unexpected error for query %s: %s", tc.q, err)
+			continue
+		}
+		if tc.q.order.fieldName == "" {
+			// the order is only guaranteed for ordered queries
+			sort.Strings(ids)
+		}
+		expected := modelIds(Models(tc.expected))
+		if !reflect.DeepEqual(expected, ids) {
+			t.Errorf("Ids were incorrect for query %s.\nExpected: %v\nGot: %v", tc.q, expected, ids)
+		}
+		if count, err := tc.q.Count(); err != nil {
+			t.Errorf("Unexpected error counting query %s: %s", tc.q, err)
+		} else if count != len(expected) {
+			t.Errorf("Count was incorrect for query %s.\nExpected: %d\nGot: %d", tc.q, len(expected), count)
+		}
+	}
+
+	// limit and offset should be applied by the database for queries ordered
+	// by a pointer field
+	if plan, err := NewQuery("nullableModel").Order("Age").Limit(2).Explain(); err != nil {
+		t.Error(err)
+	} else if plan.LimitOffset != "server" {
+		t.Errorf("Expected limit and offset to be applied by the database but got %s", plan.LimitOffset)
+	}
+
+	// setting a field to nil should move the model into the null index
+	models[0].Age = nil
+	if err := Save(models[0]); err != nil {
+		t.Fatal(err)
+	}
+	count, err := NewQuery("nullableModel").Filter("Age", IsNull).Count()
+	if err != nil {
+		t.Error(err)
+	} else if count != 3 {
+		t.Errorf("Expected 3 models with null Age but got %d", count)
+	}
+	count, err = NewQuery("nullableModel").Filter("Age", IsNotNull).Count()
+	if err != nil {
+		t.Error(err)
+	} else if count != 1 {
+		t.Errorf("Expected 1 model with non-null Age but got %d", count)
+	}
+
+	// null filters should only be allowed on pointer fields with valid operators
+	if _, err := NewQuery("nullableModel").Filter("Age >", nil).Run(); err == nil {
+		t.Error("Expected an error for null filter with > operator but got none")
+	}
+	if _, err := NewQuery("indexedPrimativesModel").Filter("Int", IsNull).Run(); err == nil {
+		t.Error("Expected an error for null filter on a non-pointer field but got none")
+	}
+}
+
 // create a number of models with all fields filled out.
 // we will use these to test a lot of different queries.
 // on each iteration from i=0 to num-1 a model is created with:
@@ -1495,3 +1815,847 @@ func TestInternalModelsContainDuplicates(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryCompoundIndex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type compoundModel struct {
+		TenantId  string `zoom:"index=tenant_created"`
+		CreatedAt int64  `zoom:"index=tenant_created"`
+		Title     string
+		Public    bool
+		DefaultData
+	}
+	Register(&compoundModel{})
+	defer Unregister(&compoundModel{})
+	if err := RegisterIndex("compoundModel", "TenantId", "Public", "Title"); err != nil {
+		t.Fatal(err)
+	}
+
+	models := []*compoundModel{
+		{TenantId: "a", CreatedAt: 3, Title: "x", Public: true},
+		{TenantId: "b", CreatedAt: 1, Title: "y", Public: true},
+		{TenantId: "a", CreatedAt: 1, Title: "z", Public: false},
+		{TenantId: "a", CreatedAt: 2, Title: "w", Public: true},
+	}
+	for _, m := range models {
+		if err := Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		q        *Query
+		expected []*compoundModel
+	}{
+		{NewQuery("compoundModel").Filter("TenantId =", "a").Order("CreatedAt"), []*compoundModel{models[2], models[3], models[0]}},
+		{NewQuery("compoundModel").Filter("TenantId =", "a").Order("-CreatedAt"), []*compoundModel{models[0], models[3], models[2]}},
+		{NewQuery("compoundModel").Filter("TenantId =", "a").Filter("CreatedAt >=", int64(2)).Order("-CreatedAt"), []*compoundModel{models[0], models[3]}},
+		{NewQuery("compoundModel").Filter("TenantId =", "a").Order("-CreatedAt").Limit(1).Offset(1), []*compoundModel{models[3]}},
+		{NewQuery("compoundModel").Filter("TenantId =", "b"), []*compoundModel{models[1]}},
+		{NewQuery("compoundModel").Filter("TenantId =", "c").Order("CreatedAt"), []*compoundModel{}},
+		{NewQuery("compoundModel").Filter("Public =", true).Filter("TenantId =", "a").Order("Title"), []*compoundModel{models[3], models[0]}},
+		{NewQuery("compoundModel").Filter("TenantId =", "a").Filter("Public =", true).Filter("Title <", "x"), []*compoundModel{models[3]}},
+	}
+	for _, tc := range testCases {
+		ids, err := tc.q.IdsOnly()
+		if err != nil {
+			t.Errorf("Unexpected error for query %s: %s", tc.q, err)
+			continue
+		}
+		expected := modelIds(Models(tc.expected))
+		if !reflect.DeepEqual(expected, ids) {
+			t.Errorf("Ids were incorrect for query %s.\nExpected: %v\nGot: %v", tc.q, expected, ids)
+		}
+	}
+
+	// changing a prefix field should move the model to a different sorted set
+	models[0].TenantId = "b"
+	if err := Save(models[0]); err != nil {
+		t.Fatal(err)
+	}
+	conn := GetConn()
+	defer conn.Close()
+	for key, expected := range map[string]int{
+		`compoundModel:tenant_created:"a"`: 2,
+		`compoundModel:tenant_created:"b"`: 2,
+	} {
+		count, err := redis.Int(conn.Do("ZCARD", key))
+		if err != nil {
+			t.Error(err)
+		} else if count != expected {
+			t.Errorf("Expected %s to have %d members but got %d", key, expected, count)
+		}
+	}
+
+	// deleting a model should remove it from the compound indexes
+	if err := DeleteById("compoundModel", models[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := NewQuery("compoundModel").Filter("TenantId =", "b").Order("CreatedAt").IdsOnly()
+	if err != nil {
+		t.Error(err)
+	} else if expected := []string{models[0].Id}; !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Ids were incorrect after delete.\nExpected: %v\nGot: %v", expected, ids)
+	}
+
+	// fields which are only part of a compound index can't be used on their own
+	if _, err := NewQuery("compoundModel").Filter("CreatedAt >", int64(1)).Run(); err == nil {
+		t.Error("Expected an error for a filter which can't use the compound index but got none")
+	}
+	if err := RegisterIndex("compoundModel", "TenantId"); err == nil {
+		t.Error("Expected an error for a compound index with one field but got none")
+	}
+}
+
+func TestQueryIter(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newIndexedPrimativesModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range models {
+		m.Int = i
+		m.String = strconv.Itoa(9 - i)
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		q        *Query
+		expected []*indexedPrimativesModel
+		ordered  bool
+	}{
+		{NewQuery("indexedPrimativesModel").BatchSize(3), models, false},
+		{NewQuery("indexedPrimativesModel").BatchSize(3).Limit(4), nil, false},
+		{NewQuery("indexedPrimativesModel").BatchSize(3).Order("Int"), models, true},
+		{NewQuery("indexedPrimativesModel").BatchSize(4).Order("-String").Limit(5).Offset(2), models[2:7], true},
+		{NewQuery("indexedPrimativesModel").BatchSize(2).Filter("Int >=", 5).Order("-Int"), []*indexedPrimativesModel{models[9], models[8], models[7], models[6], models[5]}, true},
+	}
+	for _, tc := range testCases {
+		// use both Iter and Each to get the ids
+		ids := []string{}
+		it := tc.q.Iter()
+		m := &indexedPrimativesModel{}
+		for it.Next(m) {
+			ids = append(ids, m.Id)
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("Unexpected error for query %s: %s", tc.q, err)
+			continue
+		}
+		eachIds := []string{}
+		if err := tc.q.Each(func(m Model) error {
+			eachIds = append(eachIds, m.GetId())
+			return nil
+		}); err != nil {
+			t.Errorf("Unexpected error in Each for query %s: %s", tc.q, err)
+			continue
+		}
+		if !tc.ordered {
+			sort.Strings(ids)
+			sort.Strings(eachIds)
+		}
+		if !reflect.DeepEqual(ids, eachIds) {
+			t.Errorf("Ids from Iter and Each were different for query %s.\nIter: %v\nEach: %v", tc.q, ids, eachIds)
+		}
+		if tc.expected == nil {
+			// only the number of models is known
+			if len(ids) != int(tc.q.limit) {
+				t.Errorf("Expected %d models for query %s but got %d", tc.q.limit, tc.q, len(ids))
+			}
+			continue
+		}
+		expected := modelIds(Models(tc.expected))
+		if !tc.ordered {
+			sort.Strings(expected)
+		}
+		if !reflect.DeepEqual(expected, ids) {
+			t.Errorf("Ids were incorrect for query %s.\nExpected: %v\nGot: %v", tc.q, expected, ids)
+		}
+	}
+
+	// Each should stop when the function returns an error
+	count := 0
+	stop := errors.New("stop")
+	if err := NewQuery("indexedPrimativesModel").BatchSize(3).Each(func(Model) error {
+		count++
+		if count == 5 {
+			return stop
+		}
+		return nil
+	}); err != stop {
+		t.Errorf("Expected Each to return the error from the function but got %v", err)
+	}
+	if count != 5 {
+		t.Errorf("Expected the function to be called 5 times but got %d", count)
+	}
+}
+
+func TestQueryAfterCursor(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newIndexedPrimativesModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range models {
+		// use duplicate values so that ties are broken by id
+		m.Int = i / 2
+		m.String = strconv.Itoa(9 - i)
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+
+	// pages returns the ids for each page of a query with the given limit
+	pages := func(newQuery func() *Query) ([][]string, error) {
+		result := [][]string{}
+		cursor := ""
+		for i := 0; i < 20; i++ {
+			q := newQuery().After(cursor)
+			ids, err := q.IdsOnly()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, ids)
+			cursor, err = q.NextCursor()
+			if err != nil {
+				return nil, err
+			}
+			if cursor == "" {
+				return result, nil
+			}
+		}
+		return nil, errors.New("too many pages")
+	}
+
+	testCases := []struct {
+		newQuery func() *Query
+		ordered  bool
+	}{
+		{func() *Query { return NewQuery("indexedPrimativesModel").Order("Int").Limit(3) }, true},
+		{func() *Query { return NewQuery("indexedPrimativesModel").Order("-Int").Limit(4) }, true},
+		{func() *Query { return NewQuery("indexedPrimativesModel").Order("String").Limit(3) }, true},
+		{func() *Query { return NewQuery("indexedPrimativesModel").Order("-String").Limit(5) }, true},
+		{func() *Query { return NewQuery("indexedPrimativesModel").Order("Int").Filter("String >", "2").Limit(2) }, true},
+		{func() *Query { return NewQuery("indexedPrimativesModel").Limit(3) }, false},
+	}
+	for _, tc := range testCases {
+		q := tc.newQuery()
+		expected, err := tc.newQuery().Limit(0).IdsOnly()
+		if err != nil {
+			t.Errorf("Unexpected error for query %s: %s", q, err)
+			continue
+		}
+		result, err := pages(tc.newQuery)
+		if err != nil {
+			t.Errorf("Unexpected error paging through query %s: %s", q, err)
+			continue
+		}
+		got := []string{}
+		for i, page := range result {
+			if i != len(result)-1 && len(page) != int(q.limit) {
+				t.Errorf("Expected page %d of query %s to have %d ids but got %d", i, q, q.limit, len(page))
+			}
+			got = append(got, page...)
+		}
+		if !tc.ordered {
+			sort.Strings(expected)
+			sort.Strings(got)
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Ids were incorrect for query %s.\nExpected: %v\nGot: %v", q, expected, got)
+		}
+	}
+
+	// the next page should not change when a model is saved before the cursor
+	q := NewQuery("indexedPrimativesModel").Order("Int").Limit(4).After("")
+	if _, err := q.IdsOnly(); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := q.NextCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserted, err := newIndexedPrimativesModels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserted[0].Int = -1
+	if err := Save(inserted[0]); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := NewQuery("indexedPrimativesModel").Order("Int").Limit(4).After(cursor).IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allIds, err := NewQuery("indexedPrimativesModel").Order("Int").IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the new model comes first, so the next page starts at index 5
+	expected := allIds[5:9]
+	if !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Expected next page to be unaffected by the new model.\nExpected: %v\nGot: %v", expected, ids)
+	}
+
+	// a page of an unordered query which resumes in the middle of an SSCAN
+	// batch should start after the last id of the previous page, even if an
+	// earlier id in the batch was deleted
+	q = NewQuery("indexedPrimativesModel").Limit(3).After("")
+	batch, err := q.IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteById("indexedPrimativesModel", batch[0]); err != nil {
+		t.Fatal(err)
+	}
+	q = NewQuery("indexedPrimativesModel").Limit(3).After("")
+	q.after.Id = batch[1]
+	ids, err = q.IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) == 0 || ids[0] != batch[2] {
+		t.Errorf("Expected the page to start with %s but got %v", batch[2], ids)
+	}
+	if cursor, err := q.NextCursor(); err != nil {
+		t.Error(err)
+	} else if cursor == "" {
+		t.Error("Expected a cursor for the next page")
+	}
+
+	// a cursor cannot be used with a different order or with an offset
+	if _, err := NewQuery("indexedPrimativesModel").Order("String").After(cursor).IdsOnly(); err == nil {
+		t.Error("Expected an error when using a cursor with a different order")
+	}
+	if _, err := NewQuery("indexedPrimativesModel").Order("Int").Offset(1).After(cursor).IdsOnly(); err == nil {
+		t.Error("Expected an error when using After and Offset together")
+	}
+	if _, err := NewQuery("indexedPrimativesModel").After("not a cursor").IdsOnly(); err == nil {
+		t.Error("Expected an error for an invalid cursor")
+	}
+}
+
+func TestQueryAggregations(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newIndexedPrimativesModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range models {
+		m.Int = i
+		m.Float64 = float64(i) / 2
+		m.Bool = i%2 == 0
+		m.String = []string{"a", "b", "c"}[i%3]
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		q                  *Query
+		field              string
+		sum, avg, min, max float64
+	}{
+		{NewQuery("indexedPrimativesModel"), "Int", 45, 4.5, 0, 9},
+		{NewQuery("indexedPrimativesModel"), "Float64", 22.5, 2.25, 0, 4.5},
+		{NewQuery("indexedPrimativesModel").Filter("Int >=", 5), "Int", 35, 7, 5, 9},
+		{NewQuery("indexedPrimativesModel").Filter("Bool =", true), "Int", 20, 4, 0, 8},
+		{NewQuery("indexedPrimativesModel").Order("-Int").Limit(3), "Int", 24, 8, 7, 9},
+	}
+	for _, tc := range testCases {
+		for _, agg := range []struct {
+			name     string
+			f        func(string) (float64, error)
+			expected float64
+		}{{"Sum", tc.q.Sum, tc.sum}, {"Avg", tc.q.Avg, tc.avg}, {"Min", tc.q.Min, tc.min}, {"Max", tc.q.Max, tc.max}} {
+			got, err := agg.f(tc.field)
+			if err != nil {
+				t.Errorf("Unexpected error in %s(%s) for query %s: %s", agg.name, tc.field, tc.q, err)
+				continue
+			}
+			if got != agg.expected {
+				t.Errorf("Expected %s(%s) for query %s to be %v but got %v", agg.name, tc.field, tc.q, agg.expected, got)
+			}
+		}
+	}
+
+	// aggregations over no models
+	q := NewQuery("indexedPrimativesModel").Filter("Int >", 100)
+	if sum, err := q.Sum("Int"); err != nil {
+		t.Error(err)
+	} else if sum != 0 {
+		t.Errorf("Expected sum of no models to be 0 but got %v", sum)
+	}
+	if _, err := q.Max("Int"); err == nil {
+		t.Error("Expected an error for the max of no models")
+	} else if _, ok := err.(*ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got %T: %s", err, err)
+	}
+	if _, err := NewQuery("indexedPrimativesModel").Sum("String"); err == nil {
+		t.Error("Expected an error when aggregating a non-numeric field")
+	}
+
+	// group by
+	groupCases := []struct {
+		q        *GroupQuery
+		expected map[string]int
+	}{
+		{NewQuery("indexedPrimativesModel").GroupBy("String"), map[string]int{"a": 4, "b": 3, "c": 3}},
+		{NewQuery("indexedPrimativesModel").GroupBy("Bool"), map[string]int{"true": 5, "false": 5}},
+		{NewQuery("indexedPrimativesModel").Filter("Int <", 4).GroupBy("String"), map[string]int{"a": 2, "b": 1, "c": 1}},
+	}
+	for _, tc := range groupCases {
+		got, err := tc.q.Count()
+		if err != nil {
+			t.Errorf("Unexpected error in GroupBy count for query %s: %s", tc.q.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.expected, got) {
+			t.Errorf("Group counts were incorrect for query %s.\nExpected: %v\nGot: %v", tc.q.query, tc.expected, got)
+		}
+	}
+
+	// nil pointers are skipped by aggregations and grouped under <nil>
+	pointerModels, err := newIndexedPointersModels(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range pointerModels {
+		if i == 0 {
+			m.Int = nil
+			continue
+		}
+		n := i * 10
+		m.Int = &n
+	}
+	if err := MSave(Models(pointerModels)); err != nil {
+		t.Fatal(err)
+	}
+	if avg, err := NewQuery("indexedPointersModel").Avg("Int"); err != nil {
+		t.Error(err)
+	} else if avg != 20 {
+		t.Errorf("Expected average of non-nil values to be 20 but got %v", avg)
+	}
+	if counts, err := NewQuery("indexedPointersModel").GroupBy("Int").Count(); err != nil {
+		t.Error(err)
+	} else if expected := map[string]int{"<nil>": 1, "10": 1, "20": 1, "30": 1}; !reflect.DeepEqual(expected, counts) {
+		t.Errorf("Group counts were incorrect.\nExpected: %v\nGot: %v", expected, counts)
+	}
+}
+
+func TestQueryCountFilters(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newIndexedPrimativesModels(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range models {
+		m.Int = i % 7
+		m.Bool = i%3 == 0
+		m.String = strconv.Itoa(i % 5)
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []*Query{
+		NewQuery("indexedPrimativesModel").Filter("Int =", 3),
+		NewQuery("indexedPrimativesModel").Filter("Int !=", 3),
+		NewQuery("indexedPrimativesModel").Filter("Int >", 2).Limit(5),
+		NewQuery("indexedPrimativesModel").Filter("Int <=", 4).Offset(3).Order("Int"),
+		NewQuery("indexedPrimativesModel").Filter("Bool =", true),
+		NewQuery("indexedPrimativesModel").Filter("Bool <", false),
+		NewQuery("indexedPrimativesModel").Filter("Bool !=", true),
+		NewQuery("indexedPrimativesModel").Filter("String =", "2"),
+		NewQuery("indexedPrimativesModel").Filter("String !=", "2"),
+		NewQuery("indexedPrimativesModel").Filter("String >=", "3"),
+		NewQuery("indexedPrimativesModel").Filter("Int >=", 2).Filter("Bool =", false),
+		NewQuery("indexedPrimativesModel").Filter("Int !=", 1).Filter("String <", "3").Filter("Bool =", true),
+		NewQuery("indexedPrimativesModel").Filter("Int >", 100).Filter("String =", "1"),
+	}
+	for _, q := range queries {
+		if _, ok := q.countRanges(); !ok {
+			t.Errorf("Expected query %s to be counted in the database", q)
+		}
+		ids, err := q.IdsOnly()
+		if err != nil {
+			t.Errorf("Unexpected error in IdsOnly for query %s: %s", q, err)
+			continue
+		}
+		if count, err := q.Count(); err != nil {
+			t.Errorf("Unexpected error in Count for query %s: %s", q, err)
+		} else if count != len(ids) {
+			t.Errorf("Count was incorrect for query %s. Expected %d but got %d", q, len(ids), count)
+		}
+	}
+
+	// make sure the temporary keys were deleted
+	conn := GetConn()
+	defer conn.Close()
+	if keys, err := redis.Strings(conn.Do("KEYS", "zoom:tmp:*")); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Errorf("Expected temporary keys to be deleted but got: %v", keys)
+	}
+}
+
+func TestQueryDeleteAndUpdate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newIndexedPrimativesModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range models {
+		m.Int = i
+		m.String = "old"
+		m.Bool = false
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+
+	// update the models with Int >= 4 in batches of 3
+	updated, err := NewQuery("indexedPrimativesModel").Filter("Int >=", 4).BatchSize(3).Update(map[string]interface{}{
+		"String": "new",
+		"Int64":  42,
+		"Bool":   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 6 {
+		t.Errorf("Expected 6 models to be updated but got %d", updated)
+	}
+	// the indexes should reflect the new values
+	for _, tc := range []struct {
+		q        *Query
+		expected []*indexedPrimativesModel
+	}{
+		{NewQuery("indexedPrimativesModel").Filter("String =", "new").Order("Int"), models[4:]},
+		{NewQuery("indexedPrimativesModel").Filter("String =", "old").Order("Int"), models[:4]},
+		{NewQuery("indexedPrimativesModel").Filter("Int64 =", int64(42)).Order("Int"), models[4:]},
+		{NewQuery("indexedPrimativesModel").Filter("Bool =", true).Order("Int"), models[4:]},
+	} {
+		ids, err := tc.q.IdsOnly()
+		if err != nil {
+			t.Errorf("Unexpected error for query %s: %s", tc.q, err)
+			continue
+		}
+		if expected := modelIds(Models(tc.expected)); !reflect.DeepEqual(expected, ids) {
+			t.Errorf("Ids were incorrect for query %s after Update.\nExpected: %v\nGot: %v", tc.q, expected, ids)
+		}
+	}
+	// invalid fields and values should be rejected before anything is updated
+	if _, err := NewQuery("indexedPrimativesModel").Update(map[string]interface{}{"Foo": 1}); err == nil {
+		t.Error("Expected an error when updating a field which doesn't exist")
+	}
+	if _, err := NewQuery("indexedPrimativesModel").Update(map[string]interface{}{"Int": "a string"}); err == nil {
+		t.Error("Expected an error when updating a field with a value of the wrong type")
+	}
+
+	// delete the models with Int < 7 in batches of 4
+	deleted, err := NewQuery("indexedPrimativesModel").Filter("Int <", 7).BatchSize(4).Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 7 {
+		t.Errorf("Expected 7 models to be deleted but got %d", deleted)
+	}
+	ids, err := NewQuery("indexedPrimativesModel").Order("Int").IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := modelIds(Models(models[7:])); !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Ids were incorrect after Delete.\nExpected: %v\nGot: %v", expected, ids)
+	}
+	for _, m := range models[:7] {
+		if _, err := FindById("indexedPrimativesModel", m.Id); err == nil {
+			t.Errorf("Expected model %s to be deleted", m.Id)
+		}
+	}
+	if count, err := NewQuery("indexedPrimativesModel").Filter("String =", "new").Count(); err != nil {
+		t.Error(err)
+	} else if count != 3 {
+		t.Errorf("Expected the deleted models to be removed from the indexes. Expected 3 but got %d", count)
+	}
+
+	// models which no longer exist are skipped and not counted, even if they
+	// are still in a field index
+	conn := GetConn()
+	defer conn.Close()
+	if _, err := conn.Do("DEL", "indexedPrimativesModel:"+models[7].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("SREM", "indexedPrimativesModel:all", models[7].Id); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = NewQuery("indexedPrimativesModel").Filter("Int <", 9).Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 model to be deleted but got %d", deleted)
+	}
+	if _, err := FindById("indexedPrimativesModel", models[8].Id); err == nil {
+		t.Errorf("Expected model %s to be deleted", models[8].Id)
+	}
+}
+
+// concurrentlyUpdatedModel calls beforeConcurrentSave from Validate, which
+// Update calls after the models are retrieved and before they are saved.
+type concurrentlyUpdatedModel struct {
+	Name  string `zoom:"index"`
+	Other string
+	DefaultData
+}
+
+var beforeConcurrentSave func()
+
+func (m *concurrentlyUpdatedModel) Validate() error {
+	if f := beforeConcurrentSave; f != nil {
+		beforeConcurrentSave = nil
+		f()
+	}
+	return nil
+}
+
+func TestQueryUpdateConcurrentChange(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	if err := Register(&concurrentlyUpdatedModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&concurrentlyUpdatedModel{})
+	m := &concurrentlyUpdatedModel{Name: "a", Other: "old"}
+	if err := Save(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// another client changes a different field after the model was retrieved
+	conn := GetConn()
+	defer conn.Close()
+	beforeConcurrentSave = func() {
+		if _, err := conn.Do("HSET", "concurrentlyUpdatedModel:"+m.Id, "Other", "new"); err != nil {
+			t.Error(err)
+		}
+	}
+	updated, err := NewQuery("concurrentlyUpdatedModel").Update(map[string]interface{}{"Name": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 1 {
+		t.Errorf("Expected 1 model to be updated but got %d", updated)
+	}
+	got := &concurrentlyUpdatedModel{}
+	if err := ScanById(m.Id, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "b" || got.Other != "new" {
+		t.Errorf("Expected Name to be updated without overwriting the concurrent change to Other but got %+v", got)
+	}
+	if ids, err := NewQuery("concurrentlyUpdatedModel").Filter("Name =", "b").IdsOnly(); err != nil {
+		t.Error(err)
+	} else if len(ids) != 1 {
+		t.Errorf("Expected the index to be updated but got %v", ids)
+	}
+}
+
+func TestQueryExplain(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newIndexedPrimativesModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range models {
+		m.Int = i
+		m.String = strconv.Itoa(i % 2)
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a query without filters applies limit and offset on the server
+	plan, err := NewQuery("indexedPrimativesModel").Order("-Int").Limit(3).Offset(2).Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.LimitOffset != "server" {
+		t.Errorf("Expected limit and offset to be applied on the server but got %s", plan.LimitOffset)
+	}
+	if len(plan.Stages) != 1 || len(plan.Stages[0].Commands) != 1 {
+		t.Fatalf("Expected one stage with one command but got:\n%s", plan)
+	}
+	if c := plan.Stages[0].Commands[0]; c.Name != "ZREVRANGE" || c.Key != "indexedPrimativesModel:Int" || c.Estimate != 3 {
+		t.Errorf("Command was incorrect. Got: %+v", c)
+	}
+
+	// a query with filters applies limit on the client and estimates each filter
+	plan, err = NewQuery("indexedPrimativesModel").Filter("String =", "1").Filter("Int >", 6).Order("Int").Limit(1).Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.LimitOffset != "client" {
+		t.Errorf("Expected limit to be applied on the client but got %s", plan.LimitOffset)
+	}
+	if plan.OrderedBy != "primaryIds" {
+		t.Errorf("Expected the order to be determined by primaryIds but got %s", plan.OrderedBy)
+	}
+	estimates := map[string]int{}
+	for _, stage := range plan.Stages {
+		estimates[stage.Description] = stage.Estimate
+	}
+	expected := map[string]int{"(filter String = 1)": 5, "(filter Int > 6)": 3}
+	if !reflect.DeepEqual(expected, estimates) {
+		t.Errorf("Estimates were incorrect.\nExpected: %v\nGot: %v\nPlan:\n%s", expected, estimates, plan)
+	}
+	// the most selective filter should be intersected first
+	if !reflect.DeepEqual(plan.IntersectionOrder, []string{"primaryIds", "filter1"}) {
+		t.Errorf("Intersection order was incorrect. Got: %v", plan.IntersectionOrder)
+	}
+
+	// a very selective filter is used to get candidates which are checked
+	// against the other filters
+	candidatesQuery := NewQuery("indexedPrimativesModel").Filter("String =", "1").Filter("Int =", 3)
+	plan, err = candidatesQuery.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Stages) != 1 {
+		t.Fatalf("Expected one stage but got:\n%s", plan)
+	}
+	if stage := plan.Stages[0]; !strings.HasPrefix(stage.Description, "(filter Int = 3) with ~1 candidates") || stage.Estimate != 1 {
+		t.Errorf("Stage was incorrect. Got: %+v", stage)
+	}
+	// the candidates should only be estimated, not retrieved
+	if candidatesQuery.trans.dataReady["candidateIds"] {
+		t.Error("Expected Explain not to retrieve the candidates")
+	}
+
+	// an unordered query after a cursor should not be scanned
+	scanQuery := NewQuery("indexedPrimativesModel").Limit(3).After("")
+	plan, err = scanQuery.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Stages) != 1 || len(plan.Stages[0].Commands) != 1 || plan.Stages[0].Commands[0].Name != "SSCAN" {
+		t.Errorf("Expected one stage with an SSCAN command but got:\n%s", plan)
+	}
+	if scanQuery.scanCursor != "" {
+		t.Errorf("Expected Explain not to scan the ids but the scan cursor was %q", scanQuery.scanCursor)
+	}
+
+	// explaining a query should not prevent it from being run
+	q := NewQuery("indexedPrimativesModel").Filter("Int >=", 5)
+	if _, err := q.Explain(); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := q.Count(); err != nil {
+		t.Error(err)
+	} else if count != 5 {
+		t.Errorf("Expected count to be 5 but got %d", count)
+	}
+}
+
+func TestQueryCostBasedPlanning(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	primatives, err := newIndexedPrimativesModels(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range primatives {
+		m.Int, m.String, m.Bool = i%10, strconv.Itoa(i%3), i%2 == 0
+	}
+	if err := MSave(Models(primatives)); err != nil {
+		t.Fatal(err)
+	}
+	pointers, err := newIndexedPointersModels(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range pointers {
+		n, s := i%10, strconv.Itoa(i%3)
+		m.Int, m.String = &n, &s
+		if i%7 == 0 {
+			m.String = nil
+		}
+	}
+	if err := MSave(Models(pointers)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every query should return the same ids in the same order whether the
+	// candidates are checked against the other filters or the ids for every
+	// filter are intersected.
+	queries := []func() *Query{
+		func() *Query {
+			return NewQuery("indexedPrimativesModel").Filter("Int =", 4).Filter("String =", "1")
+		},
+		func() *Query {
+			return NewQuery("indexedPrimativesModel").Filter("Int <", 3).Filter("Bool =", true).Order("-String")
+		},
+		func() *Query {
+			return NewQuery("indexedPrimativesModel").Filter("String >=", "2").Filter("Int !=", 5).Order("Int").Limit(4).Offset(1)
+		},
+		func() *Query {
+			return NewQuery("indexedPrimativesModel").Filter("Bool !=", true).Filter("String <", "2").Filter("Int <=", 6).Order("String")
+		},
+		func() *Query {
+			return NewQuery("indexedPointersModel").Filter("String =", nil).Filter("Int >", 2)
+		},
+		func() *Query {
+			return NewQuery("indexedPointersModel").Filter("Int <", 5).Filter("String !=", "1")
+		},
+	}
+	defer func(cost int) {
+		candidateCheckCost = cost
+	}(candidateCheckCost)
+	for i, query := range queries {
+		candidateCheckCost = 1 << 20
+		expected, err := query().IdsOnly()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) == 0 {
+			t.Errorf("Expected query %d to match some models", i)
+		}
+		candidateCheckCost = 0
+		plan, err := query().Explain()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Stages) != 1 || !strings.Contains(plan.Stages[0].Description, "candidates") {
+			t.Errorf("Expected query %d to check candidates but got plan:\n%s", i, plan)
+		}
+		got, err := query().IdsOnly()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query().order.fieldName == "" {
+			// the order of the ids is not defined
+			sort.Strings(expected)
+			sort.Strings(got)
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Ids were incorrect for query %d (%s).\nExpected: %v\nGot: %v", i, query(), expected, got)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File reindex.go contains code for rebuilding indexes after the struct
+// tags for a model type have changed, e.g. when zoom:"index" is added to or
+// removed from a field of a model type which already has saved models.
+
+package zoom
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ProgressFunc is used to report the progress of ReindexField and
+// RebuildIndexes. It is called after each batch of models with the number of
+// models processed so far and the number of models that existed when the
+// operation started.
+type ProgressFunc func(done, total int)
+
+// reindexBatchSize is the number of models which are read and indexed in
+// a single transaction during a reindex. It is also used as the COUNT hint
+// for SSCAN.
+var reindexBatchSize = 100
+
+// ReindexField rebuilds all the indexes for the field identified by fieldName
+// for every saved model of the type identified by modelName. This includes the
+// regular index for the field, its unique constraint, and any compound indexes
+// which contain the field. Indexes which no longer apply to the field (e.g.
+// because the zoom:"index" struct tag was removed) are deleted. Models are read
+// in batches, so ReindexField can safely be used while the application is
+// running. If progress is not nil, it will be called after each batch.
+func ReindexField(modelName, fieldName string, progress ProgressFunc) error {
+	return defaultNamespace.ReindexField(modelName, fieldName, progress)
+}
+
+// ReindexField is like the package-level ReindexField but rebuilds the index
+// in the namespace.
+func (ns *Namespace) ReindexField(modelName, fieldName string, progress ProgressFunc) error {
+	ms, found := ns.modelSpec(modelName)
+	if !found {
+		return NewModelNameNotRegisteredError(modelName)
+	}
+	fs, found := ms.fieldSpec(fieldName)
+	if !found {
+		return fmt.Errorf("zoom: error in ReindexField: type %s has no field %s", ms.modelType.String(), fieldName)
+	}
+
+	// delete any indexes which no longer apply to the field
+	obsoleteKeys := []interface{}{}
+	if _, found := ms.indexTypeForField(fieldName); !found {
+		obsoleteKeys = append(obsoleteKeys, ms.key(fs.redisName))
+	}
+	if _, found := ms.pointerIndexes[fieldName]; !found {
+		obsoleteKeys = append(obsoleteKeys, ms.nullIndexKey(fs.redisName))
+	}
+	if !fs.unique {
+		obsoleteKeys = append(obsoleteKeys, ms.uniqueKey(fs.redisName))
+	}
+	conn := GetConn()
+	_, err := conn.Do("DEL", obsoleteKeys...)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+
+	return ms.reindexModels(progress, func(t *transaction, mr modelRef) error {
+		return t.saveFieldIndexes(mr, fs)
+	})
+}
+
+// RebuildIndexes rebuilds all the indexes for every saved model of the type
+// identified by modelName. Before the indexes are rebuilt, any indexes which
+// are no longer specified for the model type are deleted. Models are read in
+// batches, so RebuildIndexes can safely be used while the application is
+// running. If progress is not nil, it will be called after each batch.
+func RebuildIndexes(modelName string, progress ProgressFunc) error {
+	return defaultNamespace.RebuildIndexes(modelName, progress)
+}
+
+// RebuildIndexes is like the package-level RebuildIndexes but rebuilds the
+// indexes in the namespace.
+func (ns *Namespace) RebuildIndexes(modelName string, progress ProgressFunc) error {
+	ms, found := ns.modelSpec(modelName)
+	if !found {
+		return NewModelNameNotRegisteredError(modelName)
+	}
+	if err := ms.deleteObsoleteIndexes(); err != nil {
+		return err
+	}
+	return ms.reindexModels(progress, func(t *transaction, mr modelRef) error {
+		if err := t.saveModelIndexes(mr); err != nil {
+			return err
+		}
+		for _, fs := range mr.modelSpec.uniques {
+			t.reindexUnique(mr, fs)
+		}
+		return nil
+	})
+}
+
+// reindexModels iterates through the ids in the set of all models (and the
+// set of deleted models, for types which embed SoftDelete) using SSCAN, and
+// calls index for each model that still exists in a new transaction for each
+// batch.
+func (ms modelSpec) reindexModels(progress ProgressFunc, index func(*transaction, modelRef) error) error {
+	conn := GetConn()
+	defer conn.Close()
+	total := 0
+	for _, setKey := range ms.idSetKeys() {
+		n, err := redis.Int(conn.Do("SCARD", setKey))
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	done := 0
+	for _, setKey := range ms.idSetKeys() {
+		cursor := "0"
+		for {
+			reply, err := redis.Values(conn.Do("SSCAN", setKey, cursor, "COUNT", reindexBatchSize))
+			if err != nil {
+				return err
+			}
+			var ids []string
+			if _, err := redis.Scan(reply, &cursor, &ids); err != nil {
+				return err
+			}
+			if err := ms.reindexBatch(ids, index); err != nil {
+				return err
+			}
+			done += len(ids)
+			if progress != nil {
+				progress(done, total)
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// reindexBatch reads the models with the given ids and then calls index for
+// each of them. Ids for which there is no main hash are skipped.
+func (ms modelSpec) reindexBatch(ids []string, index func(*transaction, modelRef) error) error {
+	t := newTransaction(ms.ns())
+	mrs := []modelRef{}
+	for _, id := range ids {
+		mr, err := newModelRefFromName(ms.ns(), ms.modelName)
+		if err != nil {
+			return err
+		}
+		mr.model.SetId(id)
+		exists := false
+		t.command("EXISTS", redis.Args{}.Add(mr.key()), func(reply interface{}) error {
+			var err error
+			exists, err = redis.Bool(reply, nil)
+			return err
+		})
+		args := redis.Args{}.Add(mr.key()).AddFlat(ms.mainHashFieldNames())
+		scan := newScanModelHandler(t, mr, nil)
+		t.command("HMGET", args, func(reply interface{}) error {
+			if !exists {
+				// there is nothing to index
+				return nil
+			}
+			if err := scan(reply); err != nil {
+				return err
+			}
+			mrs = append(mrs, mr)
+			return nil
+		})
+	}
+	if err := t.exec(); err != nil {
+		return err
+	}
+	t = newTransaction(ms.ns())
+	for _, mr := range mrs {
+		if err := index(t, mr); err != nil {
+			t.discard()
+			return err
+		}
+	}
+	return t.exec()
+}
+
+// saveFieldIndexes adds commands to the transaction which will save all the
+// indexes which contain the field described by fs.
+func (t *transaction) saveFieldIndexes(mr modelRef, fs *fieldSpec) error {
+	if p, found := mr.modelSpec.primativeIndexes[fs.fieldName]; found {
+		switch p.indexType {
+		case indexNumeric:
+			if err := t.saveModelPrimativeIndexNumeric(mr, p); err != nil {
+				return err
+			}
+		case indexAlpha:
+			t.saveModelPrimativeIndexAlpha(mr, p)
+		case indexBoolean:
+			t.saveModelPrimativeIndexBoolean(mr, p)
+		}
+	}
+	if p, found := mr.modelSpec.pointerIndexes[fs.fieldName]; found {
+		switch p.indexType {
+		case indexNumeric:
+			if err := t.saveModelPointerIndexNumeric(mr, p); err != nil {
+				return err
+			}
+		case indexAlpha:
+			t.saveModelPointerIndexAlpha(mr, p)
+		case indexBoolean:
+			t.saveModelPointerIndexBoolean(mr, p)
+		}
+	}
+	if fs.unique {
+		t.reindexUnique(mr, fs)
+	}
+	for _, ci := range mr.modelSpec.compoundIndexes {
+		for _, field := range ci.fields {
+			if field.fieldName == fs.fieldName {
+				if err := t.saveModelCompoundIndex(mr, ci); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// reindexUnique adds a command to the transaction which will claim the unique
+// value of the field described by fs for the model, unless the value has
+// already been claimed by another model.
+func (t *transaction) reindexUnique(mr modelRef, fs *fieldSpec) {
+	val := mr.value(fs.fieldName)
+	if fs.classification == pointer {
+		if val.IsNil() {
+			return
+		}
+		val = val.Elem()
+	}
+	args := redis.Args{}.Add(mr.modelSpec.uniqueKey(fs.redisName)).Add(hashValue(val)).Add(mr.model.GetId())
+	t.command("HSETNX", args, nil)
+}
+
+// deleteObsoleteIndexes deletes all the index keys for the model type which
+// are no longer used, i.e. field indexes, null indexes, unique indexes, and
+// compound indexes which are no longer specified for the model type. It uses
+// SCAN to iterate through all the keys with the model name (in the namespace
+// of the type) as a prefix.
+func (ms modelSpec) deleteObsoleteIndexes() error {
+	conn := GetConn()
+	defer conn.Close()
+
+	// keep track of the indexes which are still used, including the sorted
+	// set of models which expire
+	fieldIndexes := map[string]bool{"all": true, "expires": true}
+	nullIndexes := map[string]bool{}
+	uniqueIndexes := map[string]bool{}
+	compoundIndexes := map[string]bool{}
+	for _, fs := range ms.primativeIndexes {
+		fieldIndexes[fs.redisName] = true
+	}
+	for _, fs := range ms.pointerIndexes {
+		fieldIndexes[fs.redisName] = true
+		nullIndexes[fs.redisName] = true
+	}
+	for _, fs := range ms.uniques {
+		uniqueIndexes[fs.redisName] = true
+	}
+	for _, ci := range ms.compoundIndexes {
+		compoundIndexes[ci.name] = true
+	}
+
+	prefix := ms.key("")
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", reindexBatchSize))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			parts := strings.Split(strings.TrimPrefix(key, prefix), ":")
+			var obsolete bool
+			var keyType string
+			switch {
+			case len(parts) == 1 && !fieldIndexes[parts[0]]:
+				obsolete, keyType = true, "zset"
+			case len(parts) == 2 && parts[1] == "null" && !nullIndexes[parts[0]]:
+				obsolete, keyType = true, "set"
+			case len(parts) == 2 && parts[1] == "unique" && !uniqueIndexes[parts[0]]:
+				obsolete, keyType = true, "hash"
+			case len(parts) == 2 && parts[1] == "refs" && !compoundIndexes[parts[0]]:
+				obsolete, keyType = true, "hash"
+			}
+			if !obsolete {
+				continue
+			}
+			// make sure the key is not the main hash or a relationship key for
+			// a model whose id happens to look like the name of an index
+			if actualType, err := redis.String(conn.Do("TYPE", key)); err != nil {
+				return err
+			} else if actualType != keyType {
+				continue
+			}
+			if len(parts) == 2 {
+				if isId, err := ms.idExists(conn, parts[0]); err != nil {
+					return err
+				} else if isId {
+					continue
+				}
+			}
+			if parts[len(parts)-1] == "refs" {
+				// delete each of the sorted sets for the compound index
+				if err := deleteCompoundIndexSets(conn, key); err != nil {
+					return err
+				}
+			}
+			if _, err := conn.Do("DEL", key); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// deleteCompoundIndexSets deletes all the sorted sets which are referenced
+// by the refs hash of a compound index identified by refsKey.
+func deleteCompoundIndexSets(conn redis.Conn, refsKey string) error {
+	refs, err := redis.StringMap(conn.Do("HGETALL", refsKey))
+	if err != nil {
+		return err
+	}
+	setKeys := map[string]bool{}
+	for field, value := range refs {
+		if !strings.HasSuffix(field, ":member") {
+			setKeys[value] = true
+		}
+	}
+	for setKey := range setKeys {
+		if _, err := conn.Do("DEL", setKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
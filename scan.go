@@ -12,18 +12,29 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"reflect"
 	"strconv"
+	"time"
 )
 
-func scanModel(replies []interface{}, mr modelRef, includes []string) error {
+func scanModel(conn redis.Conn, replies []interface{}, mr modelRef, includes []string) error {
 	fieldNames := []string{}
 	if len(includes) == 0 {
 		fieldNames = mr.modelSpec.mainHashFieldNames()
 	} else {
 		fieldNames = includes
 	}
+	checkedExists := false
 	for i, reply := range replies {
 		if reply == nil {
-			return checkModelExists(mr)
+			// the field might be missing because it was added to the struct after
+			// the model was saved, in which case the other fields should still be
+			// scanned
+			if !checkedExists {
+				if err := checkModelExists(conn, mr); err != nil {
+					return err
+				}
+				checkedExists = true
+			}
+			continue
 		}
 		replyBytes, err := redis.Bytes(reply, nil)
 		if err != nil {
@@ -44,8 +55,8 @@ func scanModel(replies []interface{}, mr modelRef, includes []string) error {
 				return err
 			}
 		}
-		if _, found := ms.inconvertibles[fieldName]; found {
-			if err := scanInconvertibleVal(replyBytes, mr.value(fieldName)); err != nil {
+		if fs, found := ms.inconvertibles[fieldName]; found {
+			if err := scanInconvertibleVal(replyBytes, mr.value(fieldName), fs.marshaler); err != nil {
 				return err
 			}
 		}
@@ -62,7 +73,18 @@ func scanPrimativeVal(src interface{}, dest reflect.Value) error {
 	if len(srcBytes) == 0 {
 		return nil // skip blanks
 	}
-	if typeIsString(typ) {
+	if typeIsTime(typ) {
+		srcTime, err := time.Parse(time.RFC3339Nano, string(srcBytes))
+		if err != nil {
+			// times used to be stored with the default marshaler, so fall back
+			// to that for any values written by older versions of zoom
+			if err := defaultMarshalerUnmarshaler.Unmarshal(srcBytes, dest.Addr().Interface()); err != nil {
+				return fmt.Errorf("zoom: could not convert %s to time.\n", string(srcBytes))
+			}
+			return nil
+		}
+		dest.Set(reflect.ValueOf(srcTime))
+	} else if typeIsString(typ) {
 		switch typ.Kind() {
 		case reflect.String:
 			// straight up string types
@@ -119,7 +141,7 @@ func scanPointerVal(src interface{}, dest reflect.Value) error {
 	return scanPrimativeVal(src, dest.Elem())
 }
 
-func scanInconvertibleVal(src interface{}, dest reflect.Value) error {
+func scanInconvertibleVal(src interface{}, dest reflect.Value, marshaler MarshalerUnmarshaler) error {
 	srcBytes, ok := src.([]byte)
 	if !ok {
 		return fmt.Errorf("zoom: could not convert %v of type %T to []byte.\n", src, src)
@@ -128,8 +150,7 @@ func scanInconvertibleVal(src interface{}, dest reflect.Value) error {
 		return nil // skip blanks
 	}
 
-	// TODO: account for json, msgpack or other custom fallbacks
-	if err := defaultMarshalerUnmarshaler.Unmarshal(srcBytes, dest.Addr().Interface()); err != nil {
+	if err := marshaler.Unmarshal(srcBytes, dest.Addr().Interface()); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,315 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sentinel.go contains code for finding the master (and optionally the
+// replicas) through Redis Sentinel, which is enabled by setting
+// Configuration.Sentinel, so that applications keep working after a failover.
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// sentinelTimeout is the timeout for connecting to a sentinel and for reading
+// and writing its replies, so that a sentinel which is unreachable does not
+// stop the others from being asked.
+var sentinelTimeout = time.Second
+
+// sentinelReplicaInterval is how often the list of replicas is requested from
+// the sentinels when reads are routed to replicas.
+var sentinelReplicaInterval = 10 * time.Second
+
+// SentinelConfiguration contains the options for finding the master through
+// Redis Sentinel. It is used for Configuration.Sentinel.
+type SentinelConfiguration struct {
+	Addresses  []string // Addresses of the sentinels to ask for the master. Default: none (Sentinel is not used)
+	MasterName string   // Name of the master, as configured in the sentinels
+	// ReadFromReplicas routes the commands which Query uses to read ids and
+	// models (including Count, aggregates, iterators and cursors) to the
+	// replicas of the master, so that reads are spread over more servers.
+	// Commands which write still go to the master. Replicas are updated
+	// asynchronously, so queries may not see models which were saved a moment
+	// ago. Default: false
+	ReadFromReplicas bool
+}
+
+// sentinel keeps track of the address of the current master and its replicas
+// according to a group of sentinels. The master is resolved when a connection
+// is needed and then remembered until a connection error or a READONLY reply
+// means it has probably changed.
+type sentinel struct {
+	masterName string
+	dial       func(addr string) (redis.Conn, error)
+
+	mu sync.Mutex
+	// addrs are the addresses of the sentinels, starting with the one which
+	// last replied
+	addrs    []string
+	master   string
+	replicas []string
+	// replicasChecked is when the list of replicas was last requested
+	replicasChecked time.Time
+	next            int
+}
+
+// newSentinel returns a sentinel which finds the master with the given name by
+// connecting to the sentinels at addrs with dial.
+func newSentinel(addrs []string, masterName string, dial func(addr string) (redis.Conn, error)) *sentinel {
+	return &sentinel{
+		masterName: masterName,
+		dial:       dial,
+		addrs:      append([]string{}, addrs...),
+	}
+}
+
+// ask calls f with a connection to each of the sentinels in turn until it
+// succeeds, and moves the sentinel which succeeded to the front of the list so
+// that it is asked first next time. The sentinel must be locked.
+func (s *sentinel) ask(f func(conn redis.Conn) error) error {
+	if s.masterName == "" {
+		return errors.New("zoom: Configuration.Sentinel.MasterName is required when using Sentinel")
+	}
+	var lastErr error
+	for i, addr := range s.addrs {
+		conn, err := s.dial(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = f(conn)
+		conn.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("%s (from sentinel at %s)", err, addr)
+			continue
+		}
+		copy(s.addrs[1:i+1], s.addrs[:i])
+		s.addrs[0] = addr
+		return nil
+	}
+	return fmt.Errorf("zoom: could not get the address of master %s from any sentinel: %s", s.masterName, lastErr)
+}
+
+// masterAddr returns the address of the current master, asking the sentinels
+// for it if it is not known.
+func (s *sentinel) masterAddr() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.master != "" {
+		return s.master, nil
+	}
+	if err := s.ask(func(conn redis.Conn) error {
+		reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+		if err == redis.ErrNil {
+			return fmt.Errorf("unknown master %s", s.masterName)
+		} else if err != nil {
+			return err
+		} else if len(reply) != 2 {
+			return fmt.Errorf("unexpected reply %v", reply)
+		}
+		s.master = net.JoinHostPort(reply[0], reply[1])
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return s.master, nil
+}
+
+// replicaAddr returns the address of one of the replicas of the master, taking
+// turns between them, or an empty string if there are no replicas which are
+// up.
+func (s *sentinel) replicaAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.replicasChecked) > sentinelReplicaInterval {
+		s.replicasChecked = time.Now()
+		replicas := []string{}
+		if err := s.ask(func(conn redis.Conn) error {
+			reply, err := redis.Values(conn.Do("SENTINEL", "replicas", s.masterName))
+			if _, ok := err.(redis.Error); ok {
+				// sentinels before redis 5 only know the older name
+				reply, err = redis.Values(conn.Do("SENTINEL", "slaves", s.masterName))
+			}
+			if err != nil {
+				return err
+			}
+			for _, r := range reply {
+				info, err := redis.StringMap(r, nil)
+				if err != nil {
+					return err
+				}
+				if replicaIsUp(info) {
+					replicas = append(replicas, net.JoinHostPort(info["ip"], info["port"]))
+				}
+			}
+			return nil
+		}); err == nil {
+			s.replicas = replicas
+		}
+	}
+	if len(s.replicas) == 0 {
+		return ""
+	}
+	s.next = (s.next + 1) % len(s.replicas)
+	return s.replicas[s.next]
+}
+
+// replicaIsUp returns true iff the replica described by info (one of the
+// replies to SENTINEL replicas) can be used for reads.
+func replicaIsUp(info map[string]string) bool {
+	for _, flag := range strings.Split(info["flags"], ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return false
+		}
+	}
+	status, found := info["master-link-status"]
+	return !found || status == "ok"
+}
+
+// invalidate forgets addr if it is the address of the master or one of the
+// replicas, so that the sentinels are asked again.
+func (s *sentinel) invalidate(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.master == addr {
+		s.master = ""
+	}
+	for _, replica := range s.replicas {
+		if replica == addr {
+			s.replicas, s.replicasChecked = nil, time.Time{}
+			break
+		}
+	}
+}
+
+// serves returns true iff the server at addr is still known to be the master
+// (or, if replica is true, one of the replicas).
+func (s *sentinel) serves(addr string, replica bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if addr == s.master {
+		return true
+	}
+	if replica {
+		for _, r := range s.replicas {
+			if r == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialMaster connects to the current master with dialNode. If the connection
+// fails the sentinels are asked for the master again, in case it has just
+// changed.
+func (s *sentinel) dialMaster(dialNode func(addr string) (redis.Conn, error)) (redis.Conn, error) {
+	var lastErr error
+	for i := 0; i < 2; i++ {
+		addr, err := s.masterAddr()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialNode(addr)
+		if err != nil {
+			s.invalidate(addr)
+			lastErr = err
+			continue
+		}
+		return &sentinelConn{Conn: conn, sentinel: s, addr: addr}, nil
+	}
+	return nil, lastErr
+}
+
+// dialReplica connects to one of the replicas with dialNode, or to the master
+// if there are no replicas which are up.
+func (s *sentinel) dialReplica(dialNode func(addr string) (redis.Conn, error)) (redis.Conn, error) {
+	if addr := s.replicaAddr(); addr != "" {
+		if conn, err := dialNode(addr); err == nil {
+			return &sentinelConn{Conn: conn, sentinel: s, addr: addr, replica: true}, nil
+		}
+		s.invalidate(addr)
+	}
+	return s.dialMaster(dialNode)
+}
+
+// testOnBorrow is used for the connection pools so that idle connections to a
+// server which is no longer the master (or a replica) are closed instead of
+// being used.
+func (s *sentinel) testOnBorrow(conn redis.Conn, _ time.Time) error {
+	if sc, ok := conn.(*sentinelConn); ok && !s.serves(sc.addr, sc.replica) {
+		return fmt.Errorf("zoom: %s is no longer the master", sc.addr)
+	}
+	return nil
+}
+
+// sentinelConn is a connection to a server which was found through Redis
+// Sentinel. After a connection error or a READONLY reply (which means the
+// master has become a replica) the server is invalidated, so that the next
+// connection is made to the new master, and Err returns an error so that the
+// connection is not reused.
+type sentinelConn struct {
+	redis.Conn
+	sentinel *sentinel
+	addr     string
+	replica  bool
+	readOnly bool
+}
+
+func (c *sentinelConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *sentinelConn) Send(cmd string, args ...interface{}) error {
+	err := c.Conn.Send(cmd, args...)
+	c.check(err)
+	return err
+}
+
+func (c *sentinelConn) Flush() error {
+	err := c.Conn.Flush()
+	c.check(err)
+	return err
+}
+
+func (c *sentinelConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+func (c *sentinelConn) Err() error {
+	if c.readOnly {
+		return fmt.Errorf("zoom: %s is no longer the master", c.addr)
+	}
+	return c.Conn.Err()
+}
+
+// check invalidates the server if err is a READONLY reply or the connection
+// has failed.
+func (c *sentinelConn) check(err error) {
+	if err == nil {
+		return
+	}
+	if rerr, ok := err.(redis.Error); ok {
+		if strings.HasPrefix(string(rerr), "READONLY") && !c.replica {
+			c.readOnly = true
+			c.sentinel.invalidate(c.addr)
+		}
+		return
+	}
+	if c.Conn.Err() != nil {
+		c.sentinel.invalidate(c.addr)
+	}
+}
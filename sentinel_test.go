@@ -0,0 +1,408 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+package zoom
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakeSentinelSetup simulates a group of sentinels monitoring a master and its
+// replicas. Servers whose address is in down can't be connected to, and
+// connections to them fail.
+type fakeSentinelSetup struct {
+	mu       sync.Mutex
+	master   string
+	replicas []string
+	flags    string
+	down     map[string]bool
+}
+
+func (fs *fakeSentinelSetup) isDown(addr string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.down[addr]
+}
+
+// sentinelReply returns the reply of a sentinel to the SENTINEL command.
+func (fs *fakeSentinelSetup) sentinelReply(args []interface{}) (interface{}, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(args) != 2 || argString(args[1]) != "mymaster" {
+		return nil, nil
+	}
+	switch argString(args[0]) {
+	case "get-master-addr-by-name":
+		host, port, _ := net.SplitHostPort(fs.master)
+		return []interface{}{[]byte(host), []byte(port)}, nil
+	case "replicas":
+		reply := []interface{}{}
+		for _, replica := range fs.replicas {
+			host, port, _ := net.SplitHostPort(replica)
+			info := []string{"name", replica, "ip", host, "port", port, "flags", fs.flags, "master-link-status", "ok"}
+			fields := []interface{}{}
+			for _, field := range info {
+				fields = append(fields, []byte(field))
+			}
+			reply = append(reply, fields)
+		}
+		return reply, nil
+	}
+	return nil, redis.Error("ERR unknown sentinel subcommand")
+}
+
+func (fs *fakeSentinelSetup) dialSentinel(addr string) (redis.Conn, error) {
+	if fs.isDown(addr) {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	return &fakeServerConn{setup: fs, addr: addr, sentinel: true}, nil
+}
+
+func (fs *fakeSentinelSetup) dialNode(addr string) (redis.Conn, error) {
+	if fs.isDown(addr) {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	return &fakeServerConn{setup: fs, addr: addr}, nil
+}
+
+// fakeServerConn is a connection to a sentinel or a redis server in a
+// fakeSentinelSetup. Redis servers reply to SET with READONLY unless they are
+// the master.
+type fakeServerConn struct {
+	setup    *fakeSentinelSetup
+	addr     string
+	sentinel bool
+	err      error
+}
+
+func (c *fakeServerConn) Close() error { return nil }
+func (c *fakeServerConn) Err() error   { return c.err }
+func (c *fakeServerConn) Send(string, ...interface{}) error {
+	return errors.New("Send is not supported")
+}
+func (c *fakeServerConn) Flush() error { return nil }
+func (c *fakeServerConn) Receive() (interface{}, error) {
+	return nil, errors.New("Receive is not supported")
+}
+func (c *fakeServerConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.setup.isDown(c.addr) {
+		c.err = io.EOF
+		return nil, c.err
+	}
+	if c.sentinel {
+		return c.setup.sentinelReply(args)
+	}
+	c.setup.mu.Lock()
+	defer c.setup.mu.Unlock()
+	if cmd == "SET" && c.addr != c.setup.master {
+		return nil, redis.Error("READONLY You can't write against a read only replica.")
+	}
+	return "OK", nil
+}
+
+func TestSentinelFailover(t *testing.T) {
+	fs := &fakeSentinelSetup{
+		master:   "10.0.0.1:6379",
+		replicas: []string{"10.0.0.2:6379"},
+		flags:    "slave",
+		down:     map[string]bool{"sentinel1:26379": true},
+	}
+	s := newSentinel([]string{"sentinel1:26379", "sentinel2:26379"}, "mymaster", fs.dialSentinel)
+
+	// the sentinel which is down should be skipped
+	conn, err := s.dialMaster(fs.dialNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if s.addrs[0] != "sentinel2:26379" {
+		t.Errorf("Expected the sentinel which replied to be asked first but got %v", s.addrs)
+	}
+
+	// after a failover, the old master replies with READONLY
+	fs.mu.Lock()
+	fs.master, fs.replicas = "10.0.0.2:6379", []string{"10.0.0.1:6379"}
+	fs.mu.Unlock()
+	if _, err := conn.Do("SET", "foo", "bar"); err == nil {
+		t.Error("Expected a READONLY error from the old master")
+	}
+	if conn.Err() == nil {
+		t.Error("Expected the connection to the old master not to be reused")
+	}
+	if err := s.testOnBorrow(conn, time.Now()); err == nil {
+		t.Error("Expected idle connections to the old master to be closed")
+	}
+	conn, err = s.dialMaster(fs.dialNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := conn.(*sentinelConn).addr; addr != "10.0.0.2:6379" {
+		t.Errorf("Expected to connect to the new master but got %s", addr)
+	}
+	if _, err := conn.Do("SET", "foo", "bar"); err != nil {
+		t.Error(err)
+	}
+
+	// a connection error should also cause the master to be resolved again
+	fs.mu.Lock()
+	fs.master, fs.down["10.0.0.2:6379"] = "10.0.0.3:6379", true
+	fs.mu.Unlock()
+	if _, err := conn.Do("SET", "foo", "bar"); err == nil {
+		t.Error("Expected an error from the master which is down")
+	}
+	if addr, err := s.masterAddr(); err != nil {
+		t.Error(err)
+	} else if addr != "10.0.0.3:6379" {
+		t.Errorf("Expected the master to be resolved again after a connection error but got %s", addr)
+	}
+
+	// reads can be routed to replicas which are up, or to the master if there
+	// are none
+	if conn, err := s.dialReplica(fs.dialNode); err != nil {
+		t.Error(err)
+	} else if sc := conn.(*sentinelConn); sc.addr != "10.0.0.1:6379" || !sc.replica {
+		t.Errorf("Expected to connect to the replica but got %s", sc.addr)
+	}
+	fs.mu.Lock()
+	fs.flags = "s_down,slave"
+	fs.mu.Unlock()
+	s.replicasChecked = time.Time{}
+	if conn, err := s.dialReplica(fs.dialNode); err != nil {
+		t.Error(err)
+	} else if addr := conn.(*sentinelConn).addr; addr != "10.0.0.3:6379" {
+		t.Errorf("Expected to connect to the master when no replicas are up but got %s", addr)
+	}
+}
+
+// startFakeSentinel starts a server which replies to SENTINEL commands like a
+// sentinel which monitors the master at addr (which is also its only
+// replica), and returns its address.
+func startFakeSentinel(t *testing.T, addr string) (string, func()) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeSentinelSetup{master: net.JoinHostPort(host, port), replicas: []string{addr}, flags: "slave"}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			netConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer netConn.Close()
+				// commands are read like replies, since they are arrays of
+				// bulk strings
+				conn := redis.NewConn(netConn, 0, 0)
+				w := bufio.NewWriter(netConn)
+				for {
+					request, err := redis.Values(conn.Receive())
+					if err != nil || len(request) == 0 {
+						return
+					}
+					reply, err := fs.sentinelReply(request[1:])
+					writeFakeReply(w, reply, err)
+					w.Flush()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// writeFakeReply writes a reply in the redis protocol.
+func writeFakeReply(w *bufio.Writer, reply interface{}, err error) {
+	if err != nil {
+		fmt.Fprintf(w, "-%s\r\n", err)
+		return
+	}
+	switch reply := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, r := range reply {
+			writeFakeReply(w, r, nil)
+		}
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	if *network != "tcp" {
+		t.Skip("Skipping the sentinel test because it requires a tcp connection")
+	}
+	sentinelAddr, stop := startFakeSentinel(t, *address)
+	defer stop()
+	Init(&Configuration{
+		Address:  "localhost:1", // not used
+		Network:  *network,
+		Database: *database,
+		Sentinel: SentinelConfiguration{
+			Addresses:        []string{"127.0.0.1:1", sentinelAddr},
+			MasterName:       "mymaster",
+			ReadFromReplicas: true,
+		},
+	})
+	if readPool == nil {
+		t.Fatal("Expected a connection pool for the replicas")
+	}
+	models, err := newBasicModels(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+	results := []*basicModel{}
+	if err := NewQuery("basicModel").Scan(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Errorf("Incorrect query results: %+v", results)
+	}
+	if count, err := NewQuery("basicModel").Count(); err != nil {
+		t.Error(err)
+	} else if count != 3 {
+		t.Errorf("Expected a count of 3 but got %d", count)
+	}
+}
+
+// countingConn counts the commands sent over a connection.
+type countingConn struct {
+	redis.Conn
+	commands *int64
+}
+
+func (c countingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		atomic.AddInt64(c.commands, 1)
+	}
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c countingConn) Send(cmd string, args ...interface{}) error {
+	atomic.AddInt64(c.commands, 1)
+	return c.Conn.Send(cmd, args...)
+}
+
+// newCountingPool returns a pool of connections to the test database which
+// count the commands sent over them.
+func newCountingPool(commands *int64) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial(*network, *address, redis.DialDatabase(*database))
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, commands: commands}, nil
+		},
+	}
+}
+
+// Test that all the reads of a query use the pool of connections to the
+// replicas when reads are routed to replicas
+func TestReadFromReplicas(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newIndexedPrimativesModels(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+	pool.Close()
+	var masterCommands, replicaCommands int64
+	pool, readPool = newCountingPool(&masterCommands), newCountingPool(&replicaCommands)
+
+	q := func() *Query {
+		return NewQuery("indexedPrimativesModel")
+	}
+	reads := map[string]func() error{
+		"Run": func() error {
+			_, err := q().Filter("Int >", -1).Filter("String !=", "").Order("Int").Run()
+			return err
+		},
+		"Count": func() error {
+			_, err := q().Filter("Int >", -1).Count()
+			return err
+		},
+		"Sum": func() error {
+			_, err := q().Sum("Int")
+			return err
+		},
+		"Max": func() error {
+			_, err := q().Max("Int")
+			return err
+		},
+		"GroupBy": func() error {
+			_, err := q().GroupBy("Bool").Count()
+			return err
+		},
+		"Iter": func() error {
+			return q().Each(func(Model) error { return nil })
+		},
+		"Iter ordered": func() error {
+			return q().Order("Int").Each(func(Model) error { return nil })
+		},
+		"After": func() error {
+			query := q().After("").Limit(2)
+			if _, err := query.Run(); err != nil {
+				return err
+			}
+			_, err := query.NextCursor()
+			return err
+		},
+		"NextCursor": func() error {
+			query := q().Order("Int").Limit(2)
+			if _, err := query.Run(); err != nil {
+				return err
+			}
+			_, err := query.NextCursor()
+			return err
+		},
+		"Explain": func() error {
+			_, err := q().Filter("Int >", -1).Explain()
+			return err
+		},
+	}
+	for name, read := range reads {
+		atomic.StoreInt64(&masterCommands, 0)
+		atomic.StoreInt64(&replicaCommands, 0)
+		if err := read(); err != nil {
+			t.Errorf("Unexpected error for %s: %s", name, err)
+			continue
+		}
+		if n := atomic.LoadInt64(&masterCommands); n != 0 {
+			t.Errorf("Expected %s not to send any commands to the master but got %d", name, n)
+		}
+		if atomic.LoadInt64(&replicaCommands) == 0 {
+			t.Errorf("Expected %s to send commands to the replicas", name)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File softdelete.go contains code for models which are soft deleted, which
+// is enabled by embedding SoftDelete. Soft deleted models keep their data and
+// indexes so that they can be restored later.
+
+package zoom
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var softDeleteType = reflect.TypeOf(SoftDelete{})
+
+// softDeleteScript marks a model as deleted by moving its id from the set of
+// all models to the set of deleted models and then setting DeletedAt in the
+// main hash. KEYS[1] is the set of all models, KEYS[2] is the set of deleted
+// models and KEYS[3] is the main hash. ARGV[1] is the model id, ARGV[2] is the
+// name of the DeletedAt field and ARGV[3] is its value. Nothing is changed for
+// models which do not exist or which have already been deleted.
+var softDeleteScript = `
+if redis.call('SMOVE', KEYS[1], KEYS[2], ARGV[1]) == 1 then
+	redis.call('HSET', KEYS[3], ARGV[2], ARGV[3])
+	return 1
+end
+return 0`
+
+// SoftDelete can be embedded into model structs so that deleting them can be
+// undone. Delete, DeleteById, and the other delete functions set DeletedAt and
+// move the model id from the set of all models to the set of deleted models,
+// but the main hash, indexes, external lists and sets, and relationships are
+// kept. Queries do not return deleted models unless WithDeleted or OnlyDeleted
+// is used, but FindById and the other find functions still do. Deleted models
+// can be brought back with Restore, or removed permanently with PurgeDeleted.
+// Deleted models release their unique values, so that FindByUnique does not
+// find them and other models can use the values. DeletedAt is stored in the
+// main hash like any other time field.
+type SoftDelete struct {
+	DeletedAt time.Time
+}
+
+// SoftDeleter is an interface for models which can be soft deleted. Any struct
+// which includes an embedded SoftDelete satisfies the SoftDeleter interface.
+type SoftDeleter interface {
+	GetDeletedAt() time.Time
+	SetDeletedAt(time.Time)
+}
+
+func (d SoftDelete) GetDeletedAt() time.Time {
+	return d.DeletedAt
+}
+
+func (d *SoftDelete) SetDeletedAt(t time.Time) {
+	d.DeletedAt = t
+}
+
+// deletedKey returns the key for the set of ids of the models which have been
+// soft deleted.
+func (ms modelSpec) deletedKey() string {
+	return ms.key("deleted")
+}
+
+// idSetKeys returns the keys for the sets which contain the ids of all the
+// stored models of this type, including any which have been soft deleted.
+func (ms modelSpec) idSetKeys() []string {
+	if ms.softDelete {
+		return []string{ms.indexKey(), ms.deletedKey()}
+	}
+	return []string{ms.indexKey()}
+}
+
+// softDeleteModel adds commands to the transaction which soft delete the model
+// with the given id, setting DeletedAt to deletedAt.
+func (t *transaction) softDeleteModel(ms modelSpec, id string, deletedAt time.Time) {
+	// add an operation to record the deletion in the change log
+	if ms.logsChanges() {
+		t.logDelete(ms, id)
+	}
+
+	// add an operation to publish a change event, which must come before the
+	// model id is moved to the set of deleted models
+	t.publishChange(ms, id, "delete")
+
+	if len(ms.uniques) != 0 {
+		t.releaseUniques(ms, id)
+	}
+	args := redis.Args{}.Add(softDeleteScript).Add(3).Add(ms.indexKey()).Add(ms.deletedKey()).Add(ms.key(id))
+	args = args.Add(id).Add("DeletedAt").Add(hashValue(reflect.ValueOf(deletedAt)))
+	t.command("EVAL", args, nil)
+	t.invalidateCachedModel(ms, id)
+}
+
+// indexSoftDeleted adds commands to the transaction which add the id of the
+// model to the set of deleted models if DeletedAt is set, or to the set of all
+// models otherwise, and remove it from the other set.
+func (t *transaction) indexSoftDeleted(mr modelRef) {
+	id := mr.model.GetId()
+	from, to := mr.modelSpec.deletedKey(), mr.modelSpec.indexKey()
+	if !mr.model.(SoftDeleter).GetDeletedAt().IsZero() {
+		from, to = to, from
+	}
+	t.unindex(from, id)
+	t.command("SADD", redis.Args{}.Add(to).Add(id), nil)
+}
+
+// Restore restores a model which was soft deleted by setting DeletedAt to the
+// zero time and saving the model, so that it is returned by queries again. The
+// model must embed SoftDelete (or otherwise implement SoftDeleter) and have an
+// id. Since the model is saved, any other changes to it are saved as well. The
+// unique values of the model are claimed again, so Restore returns a
+// UniqueConstraintError (and the model stays deleted) if another model has
+// used one of them in the meantime.
+func Restore(model Model) error {
+	return defaultNamespace.Restore(model)
+}
+
+// Restore is like the package-level Restore but restores the model in the
+// namespace.
+func (ns *Namespace) Restore(model Model) error {
+	d, ok := model.(SoftDeleter)
+	if !ok {
+		return fmt.Errorf("zoom: error in Restore: %T does not implement SoftDeleter (does it embed zoom.SoftDelete?)", model)
+	}
+	if model.GetId() == "" {
+		return errors.New("zoom: cannot restore because model Id field is empty")
+	}
+	deletedAt := d.GetDeletedAt()
+	d.SetDeletedAt(time.Time{})
+	if err := ns.Save(model); err != nil {
+		d.SetDeletedAt(deletedAt)
+		return err
+	}
+	return nil
+}
+
+// PurgeDeleted permanently deletes the models of the type identified by
+// modelName which were soft deleted more than olderThan ago, along with their
+// indexes, external lists and sets, and relationships, and returns the number
+// of models deleted. It can be called periodically to remove deleted models
+// once they no longer need to be recoverable. If olderThan is 0, all the
+// deleted models are purged. The type must embed SoftDelete.
+func PurgeDeleted(modelName string, olderThan time.Duration) (int, error) {
+	return defaultNamespace.PurgeDeleted(modelName, olderThan)
+}
+
+// PurgeDeleted is like the package-level PurgeDeleted but deletes the models
+// in the namespace.
+func (ns *Namespace) PurgeDeleted(modelName string, olderThan time.Duration) (int, error) {
+	ms, found := ns.modelSpec(modelName)
+	if !found {
+		return 0, NewModelNameNotRegisteredError(modelName)
+	}
+	if !ms.softDelete {
+		return 0, fmt.Errorf("zoom: error in PurgeDeleted: %s does not embed zoom.SoftDelete", ms.modelType.String())
+	}
+	cutoff := time.Now().Add(-olderThan)
+	purged := 0
+	cursor := "0"
+	for {
+		conn := GetConn()
+		reply, err := redis.Values(conn.Do("SSCAN", ms.deletedKey(), cursor, "COUNT", sweepBatchSize))
+		conn.Close()
+		if err != nil {
+			return purged, err
+		}
+		var ids []string
+		if _, err := redis.Scan(reply, &cursor, &ids); err != nil {
+			return purged, err
+		}
+		models, err := ms.findModelsById(ids)
+		if err != nil {
+			return purged, err
+		}
+		t := newTransaction(ns)
+		found := map[string]bool{}
+		for _, m := range models {
+			found[m.GetId()] = true
+			// check the stored value, in case the model was restored after the
+			// ids were retrieved
+			if deletedAt := m.(SoftDeleter).GetDeletedAt(); deletedAt.IsZero() || deletedAt.After(cutoff) {
+				continue
+			}
+			mr, err := newModelRefFromModel(ns, m)
+			if err != nil {
+				unlockModels(models)
+				return purged, err
+			}
+			t.purgeModel(mr)
+			t.deleteExternalKeys(mr)
+			purged++
+		}
+		for _, id := range ids {
+			if !found[id] {
+				// the model no longer exists
+				t.unindex(ms.deletedKey(), id)
+			}
+		}
+		err = t.exec()
+		unlockModels(models)
+		if err != nil {
+			return purged, err
+		}
+		if cursor == "0" {
+			return purged, nil
+		}
+	}
+}
+
+// deletedScope determines whether a query returns models which were soft
+// deleted.
+type deletedScope int
+
+const (
+	excludeDeleted deletedScope = iota
+	withDeleted
+	onlyDeleted
+)
+
+// WithDeleted causes the query to return models which were soft deleted along
+// with the ones which were not. It has no effect for types which do not embed
+// SoftDelete.
+func (q *Query) WithDeleted() *Query {
+	q.deleted = withDeleted
+	return q
+}
+
+// OnlyDeleted causes the query to return only models which were soft deleted.
+// It has no effect for types which do not embed SoftDelete.
+func (q *Query) OnlyDeleted() *Query {
+	q.deleted = onlyDeleted
+	return q
+}
+
+// scopesDeleted returns true iff the ids for the query can't be read directly
+// from the set of all models or from the index for its order, because the type
+// embeds SoftDelete and either the query returns deleted models (which are not
+// in the set of all models) or it is ordered (and the index also contains the
+// ids of deleted models). Limit and offset must then be applied after the ids
+// are retrieved, unless the query pages around the deleted models.
+func (q *Query) scopesDeleted() bool {
+	if !q.modelSpec.softDelete {
+		return false
+	}
+	return q.deleted != excludeDeleted || q.order.fieldName != ""
+}
+
+// pagesAroundDeleted returns true iff the query has no filters, is ordered by
+// a single index and excludes deleted models. Only a page of the index then
+// needs to be read, which is made longer by the number of deleted models so
+// that it still holds enough ids once they are removed.
+func (q *Query) pagesAroundDeleted() bool {
+	if !q.modelSpec.softDelete || q.deleted != excludeDeleted || len(q.filters) != 0 || q.ordersClientSide() {
+		return false
+	}
+	if q.order.fieldName == "" {
+		return false
+	}
+	_, found := q.modelSpec.indexTypeForField(q.order.fieldName)
+	return found
+}
+
+// deletedScopeArgs returns the command and arguments which get the ids of all
+// the models the query could return, depending on whether it returns models
+// which were soft deleted.
+func (q *Query) deletedScopeArgs() (string, redis.Args) {
+	ms := q.modelSpec
+	if ms.softDelete {
+		switch q.deleted {
+		case withDeleted:
+			return "SUNION", redis.Args{}.Add(ms.indexKey()).Add(ms.deletedKey())
+		case onlyDeleted:
+			return "SMEMBERS", redis.Args{}.Add(ms.deletedKey())
+		}
+	}
+	return "SMEMBERS", redis.Args{}.Add(ms.indexKey())
+}
+
+// sendIdDataForDeletedScope adds a command to the query transaction which
+// will send the ids of the models which were soft deleted, so that they can be
+// removed from (or, for OnlyDeleted, intersected with) the ids from the
+// indexes. The set of deleted models is read instead of the set of all models
+// because it is usually much smaller. Nothing is added for WithDeleted, since
+// the indexes contain the ids of every model.
+func (q *Query) sendIdDataForDeletedScope() {
+	idsDataKey, description := "excludedIds", "(not deleted)"
+	switch q.deleted {
+	case withDeleted:
+		return
+	case onlyDeleted:
+		idsDataKey, description = "deletedIds", "(deleted)"
+	}
+	q.addIdData(idsDataKey, description)
+	q.trans.command("SMEMBERS", redis.Args{}.Add(q.modelSpec.deletedKey()), newSendDataHandler(q.trans, idsDataKey))
+}
+
+// sendIdDataForLivePage adds commands to the query transaction which will send
+// the page of ids from the index for the order of the query which excludes the
+// deleted models, for queries which page around them. The deleted ids are read
+// first, so that the page can be read with limit and offset (or after the
+// cursor) by redis and made longer by the number of deleted ids, which are then
+// removed before limit and offset are applied to the remaining ids.
+func (q *Query) sendIdDataForLivePage(dataKey string) {
+	q.trans.command("SMEMBERS", redis.Args{}.Add(q.modelSpec.deletedKey()), newSendDataHandler(q.trans, "pageDeletedIds"))
+	q.trans.doWhenDataReady([]string{"pageDeletedIds"}, func() error {
+		deletedIds, err := convertDataToStrings(q.trans.data["pageDeletedIds"])
+		if err != nil {
+			return err
+		}
+		var limit uint
+		if q.limit != 0 {
+			limit = q.offset + q.limit + uint(len(deletedIds))
+		}
+		if q.after != nil {
+			q.sendIdDataForCursor("pageIds", limit)
+			return nil
+		}
+		cmd := "ZRANGE"
+		if q.order.orderType == descending {
+			cmd = "ZREVRANGE"
+		}
+		stop := -1
+		if limit != 0 {
+			stop = int(limit) - 1
+		}
+		q.sendIdDataForOrderIndex(cmd, redis.Args{}.Add(q.orderIndexKey()).Add(0).Add(stop), "pageIds")
+		return nil
+	})
+	q.trans.doWhenDataReady([]string{"pageDeletedIds", "pageIds"}, func() error {
+		deletedIds, err := convertDataToStrings(q.trans.data["pageDeletedIds"])
+		if err != nil {
+			return err
+		}
+		ids, err := convertDataToStrings(q.trans.data["pageIds"])
+		if err != nil {
+			return err
+		}
+		ids = orderedSubtractStrings(ids, deletedIds)
+		q.trans.sendData(dataKey, applyLimitOffset(ids, q.limit, q.offset))
+		return nil
+	})
+}
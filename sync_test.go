@@ -5,6 +5,7 @@
 package zoom
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -69,3 +70,44 @@ func TestAsyncUpdate(t *testing.T) {
 		t.Errorf("Attr2 was not updated! Expected C but got %s", mCopy3.Attr2)
 	}
 }
+
+func TestFindDeletedSyncerInBatch(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*modelWithSync{{Attr1: "a"}, {Attr1: "b"}, {Attr1: "c"}}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+	// delete the model in the middle of the batch, so that the batch has to be
+	// retried one model at a time
+	if err := DeleteById("modelWithSync", models[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{models[0].Id, models[1].Id, models[2].Id}
+	ms := modelSpecs["modelWithSync"]
+	done := make(chan []Model)
+	go func() {
+		found, err := ms.findModelsById(ids)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- found
+	}()
+	select {
+	case found := <-done:
+		if len(found) != 2 || found[0].GetId() != ids[0] || found[1].GetId() != ids[2] {
+			t.Errorf("Expected the models which still exist to be found but got %v", found)
+		}
+		unlockModels(found)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out finding a batch with a deleted Syncer model")
+	}
+
+	// every model should have been unlocked
+	for _, id := range ids {
+		mutex := GetMutexById(fmt.Sprintf("%T:%s", &modelWithSync{}, id))
+		mutex.Lock()
+		mutex.Unlock()
+	}
+}
@@ -181,6 +181,7 @@ type modelWithSync struct {
 var address *string = flag.String("address", "localhost:6379", "the address of a redis server to connect to")
 var network *string = flag.String("network", "tcp", "the network to use for the database connection (e.g. 'tcp' or 'unix')")
 var database *int = flag.Int("database", 9, "the redis database number to use for testing")
+var clusterAddress *string = flag.String("cluster-address", "", "the address of a node in a redis cluster to use for the cluster tests (if empty, they use -address and are skipped unless it supports CLUSTER SLOTS)")
 
 var testingTypes []Model = []Model{
 	&basicModel{},
@@ -12,16 +12,35 @@ import (
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"reflect"
+	"time"
 )
 
 type transaction struct {
-	conn       redis.Conn
-	commands   []command
-	handlers   []func(interface{}) error
-	dataReady  map[string]bool
-	data       map[string]interface{}
-	waiters    []waiter
-	modelCache map[string]interface{}
+	ns           *Namespace
+	conn         redis.Conn
+	commands     []command
+	handlers     []func(interface{}) error
+	dataReady    map[string]bool
+	data         map[string]interface{}
+	waiters      []waiter
+	modelCache   map[string]interface{}
+	uniqueClaims []modelRef
+	// uniqueChecks are the models whose unique values must be checked before
+	// the current stage is executed (see checkUniques)
+	uniqueChecks []modelRef
+	// invalidations are the keys of the models which must be removed from the
+	// in-process cache after the transaction is executed
+	invalidations []string
+	// fromReplica is true if the transaction uses a connection to a replica
+	fromReplica bool
+	// pipelined is true if the commands in each stage are sent without
+	// MULTI/EXEC, which is used to read models with keys watched on the
+	// connection (since EXEC would unwatch them)
+	pipelined bool
+	// watched is true if keys were watched on the connection before the
+	// transaction was created, in which case exec returns redis.ErrNil if one
+	// of them was changed instead of trying again
+	watched bool
 }
 
 type command struct {
@@ -48,9 +67,23 @@ func (w waiter) ready() bool {
 	return true
 }
 
-func newTransaction() *transaction {
+func newTransaction(ns *Namespace) *transaction {
+	return newTransactionOnConn(ns, GetConn())
+}
+
+// newReadTransaction is like newTransaction, but the transaction may only be
+// used for commands which read data, since it uses a connection to a replica
+// when reads are routed to replicas.
+func newReadTransaction(ns *Namespace) *transaction {
+	t := newTransactionOnConn(ns, getReadConn())
+	t.fromReplica = readPool != nil
+	return t
+}
+
+func newTransactionOnConn(ns *Namespace, conn redis.Conn) *transaction {
 	t := &transaction{
-		conn:       GetConn(),
+		ns:         ns,
+		conn:       conn,
 		modelCache: make(map[string]interface{}),
 		dataReady:  make(map[string]bool),
 		data:       make(map[string]interface{}),
@@ -80,6 +113,7 @@ func (t *transaction) command(cmd string, args []interface{}, handler func(inter
 
 func (t *transaction) exec() error {
 	defer t.conn.Close()
+	defer t.invalidateCache()
 
 	// execute any of the waiting functions if they are ready before any commands
 	// are run
@@ -88,7 +122,7 @@ func (t *transaction) exec() error {
 	}
 
 	for len(t.commands) > 0 {
-		if len(t.commands) == 1 {
+		if len(t.commands) == 1 && len(t.uniqueChecks) == 0 {
 			// if there is only one command, no need to use MULTI/EXEC
 			c := t.commands[0]
 			reply, err := t.conn.Do(c.name, c.args...)
@@ -101,18 +135,21 @@ func (t *transaction) exec() error {
 				}
 			}
 		} else {
-			// send all the pending commands at once using MULTI/EXEC
-			t.conn.Send("MULTI")
-			for _, c := range t.commands {
-				if err := t.conn.Send(c.name, c.args...); err != nil {
-					return err
-				}
+			var replies []interface{}
+			var err error
+			if t.pipelined {
+				// send all the pending commands at once without MULTI/EXEC
+				replies, err = t.execPipelined()
+			} else {
+				// send all the pending commands at once using MULTI/EXEC
+				replies, err = t.execMulti()
 			}
-
-			// invoke redis driver to execute the transaction
-			replies, err := redis.MultiBulk(t.conn.Do("EXEC"))
 			if err != nil {
-				t.discard()
+				// the claims from a previous stage must be released, since the
+				// models which claimed them were not written
+				if len(t.uniqueClaims) != 0 {
+					t.restoreUniqueClaims()
+				}
 				return err
 			}
 
@@ -130,6 +167,7 @@ func (t *transaction) exec() error {
 		// reset all handlers and commands and prepare for the next stage
 		t.commands = make([]command, 0)
 		t.handlers = make([]func(interface{}) error, 0)
+		t.uniqueChecks = nil
 
 		// execute any of the waiting functions if they are now ready
 		if err := t.executeWaitersIfReady(); err != nil {
@@ -155,6 +193,77 @@ func (t *transaction) exec() error {
 	return nil
 }
 
+// invalidateCache removes the models which were saved or deleted by the
+// transaction from the in-process cache.
+func (t *transaction) invalidateCache() {
+	if c := findCache; c != nil {
+		for _, key := range t.invalidations {
+			c.invalidate(key)
+		}
+	}
+}
+
+// execMulti executes all the pending commands in a single MULTI/EXEC block and
+// returns the replies. If unique values need to be checked, they are checked
+// with the unique hashes watched, and the block is tried again if another
+// client changes one of the hashes before EXEC.
+func (t *transaction) execMulti() ([]interface{}, error) {
+	for attempt := 1; ; attempt++ {
+		if len(t.uniqueChecks) != 0 {
+			if err := t.checkUniques(); err != nil {
+				return nil, err
+			}
+		}
+		t.conn.Send("MULTI")
+		for _, c := range t.commands {
+			if err := t.conn.Send(c.name, c.args...); err != nil {
+				return nil, err
+			}
+		}
+
+		// invoke redis driver to execute the transaction
+		replies, err := redis.MultiBulk(t.conn.Do("EXEC"))
+		if err == redis.ErrNil && t.watched {
+			// one of the keys watched by the caller was changed
+			return nil, err
+		} else if err == redis.ErrNil && len(t.uniqueChecks) != 0 {
+			// one of the watched unique hashes was changed
+			if attempt < maxUniqueCheckAttempts {
+				continue
+			}
+			return nil, fmt.Errorf("zoom: could not save the models because their unique values were changed by another client %d times in a row", attempt)
+		} else if err != nil {
+			t.discard()
+			return nil, err
+		}
+		return replies, nil
+	}
+}
+
+// execPipelined sends all the pending commands at once without MULTI/EXEC and
+// returns the replies. All the replies are received before any error is
+// returned, so that none of them are left on the connection.
+func (t *transaction) execPipelined() ([]interface{}, error) {
+	for _, c := range t.commands {
+		if err := t.conn.Send(c.name, c.args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.conn.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(t.commands))
+	var firstErr error
+	for i := range t.commands {
+		reply, err := t.conn.Receive()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
 func (t *transaction) executeWaitersIfReady() error {
 	stillWaiting := make([]waiter, 0)
 	for _, w := range t.waiters {
@@ -183,7 +292,7 @@ func (t *transaction) discard() error {
 // Useful Handlers
 
 // newScanModelHandler invokes redis driver to scan multiple values into scannable (a struct)
-func newScanModelHandler(mr modelRef, includes []string) func(interface{}) error {
+func newScanModelHandler(t *transaction, mr modelRef, includes []string) func(interface{}) error {
 	return func(reply interface{}) error {
 		bulk, err := redis.MultiBulk(reply, nil)
 		if err != nil {
@@ -192,9 +301,9 @@ func newScanModelHandler(mr modelRef, includes []string) func(interface{}) error
 		if len(bulk) == 0 {
 			// if there is nothing in the hash, we should check if the model exists
 			// it might still exist if there are relationships, but no other data
-			return checkModelExists(mr)
+			return checkModelExists(t.conn, mr)
 		}
-		if err := scanModel(bulk, mr, includes); err != nil {
+		if err := scanModel(t.conn, bulk, mr, includes); err != nil {
 			return err
 		} else {
 			return nil
@@ -206,7 +315,7 @@ func newScanModelHandler(mr modelRef, includes []string) func(interface{}) error
 // slice or array. The reflect.Value of the slice or array should be passed as an argument.
 // it requires a passed in mr and keeps track of miss counts. Will return an error
 // if the model does not exist. Use this for scanning into a struct field.
-func newScanModelSliceHandler(mr modelRef, scanVal reflect.Value) func(interface{}) error {
+func newScanModelSliceHandler(t *transaction, mr modelRef, scanVal reflect.Value) func(interface{}) error {
 	return func(reply interface{}) error {
 		bulk, err := redis.MultiBulk(reply, nil)
 		if err != nil {
@@ -216,7 +325,7 @@ func newScanModelSliceHandler(mr modelRef, scanVal reflect.Value) func(interface
 			// there was a miss
 			// if there is nothing in the hash, we should check if the model exists
 			// it might still exist if there are relationships, but no other data
-			return checkModelExists(mr)
+			return checkModelExists(t.conn, mr)
 		}
 		scanType := scanVal.Type()
 		scanElem := scanType.Elem()
@@ -243,7 +352,7 @@ func newSendDataHandler(t *transaction, key string) func(interface{}) error {
 // saveModel adds all the necessary commands to save a given model to the redis database
 // this includes indeces and external sets/lists
 func (t *transaction) saveModel(m Model) error {
-	mr, err := newModelRefFromModel(m)
+	mr, err := newModelRefFromModel(t.ns, m)
 	if err != nil {
 		return err
 	}
@@ -253,20 +362,65 @@ func (t *transaction) saveModel(m Model) error {
 		m.SetId(generateRandomId())
 	}
 
+	if len(mr.modelSpec.uniques) != 0 && !currentConfiguration.Cluster {
+		// the unique values are checked with WATCH right before the stage is
+		// executed, so they can be claimed in the same MULTI/EXEC block as the
+		// model is written
+		t.uniqueChecks = append(t.uniqueChecks, mr)
+		t.command("EVAL", redis.Args{}.Add(claimUniquesScript).AddFlat(mr.uniqueArgs()), nil)
+		return t.saveModelData(mr)
+	} else if len(mr.modelSpec.uniques) != 0 {
+		// in cluster mode the unique values must be claimed before anything is
+		// written, so wait until the claim has succeeded to add the other
+		// operations
+		claimKey := t.claimUniques(mr)
+		t.doWhenDataReady([]string{claimKey}, func() error {
+			if err := t.saveModelData(mr); err != nil {
+				t.restoreUniqueClaims()
+				return err
+			}
+			return nil
+		})
+		return nil
+	}
+	return t.saveModelData(mr)
+}
+
+// saveModelData adds all the commands needed to write the data for a model,
+// its indexes, external sets/lists, and relationships.
+func (t *transaction) saveModelData(mr modelRef) error {
 	// add operations to save the model indexes
 	// we do this first becuase it may require a read before write :(
 	if err := t.saveModelIndexes(mr); err != nil {
 		return err
 	}
 
+	// add an operation to record the changes in the change log, which must
+	// come before the data is written
+	if mr.modelSpec.logsChanges() {
+		if err := t.logSave(mr); err != nil {
+			return err
+		}
+	}
+
 	// add an operation to write data to database
 	if err := t.saveModelStruct(mr); err != nil {
 		return err
 	}
+	t.invalidateCachedModel(mr.modelSpec, mr.model.GetId())
+
+	// add an operation to publish a change event, which must come before the
+	// model is added to the index for this model
+	t.publishChange(mr.modelSpec, mr.model.GetId(), "save")
 
 	// add an operation to add to index for this model
 	t.index(mr)
 
+	// add an operation to record when the model expires
+	if mr.modelSpec.expirable {
+		t.saveExpiration(mr)
+	}
+
 	// add operations to save external lists and sets
 	t.saveModelLists(mr)
 	t.saveModelSets(mr)
@@ -288,6 +442,10 @@ func (t *transaction) saveModelStruct(mr modelRef) error {
 }
 
 func (t *transaction) index(mr modelRef) {
+	if mr.modelSpec.softDelete {
+		t.indexSoftDeleted(mr)
+		return
+	}
 	args := redis.Args{}.Add(mr.indexKey()).Add(mr.model.GetId())
 	t.command("SADD", args, nil)
 }
@@ -411,12 +569,18 @@ func (t *transaction) saveModelIndexes(mr modelRef) error {
 			t.saveModelPointerIndexBoolean(mr, p)
 		}
 	}
+
+	for _, ci := range mr.modelSpec.compoundIndexes {
+		if err := t.saveModelCompoundIndex(mr, ci); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (t *transaction) saveModelPrimativeIndexNumeric(mr modelRef, primative *fieldSpec) error {
-	indexKey := mr.modelSpec.modelName + ":" + primative.redisName
-	score, err := convertNumericToFloat64(mr.value(primative.fieldName))
+	indexKey := mr.modelSpec.key(primative.redisName)
+	score, err := indexScore(mr.value(primative.fieldName))
 	if err != nil {
 		return err
 	}
@@ -426,12 +590,15 @@ func (t *transaction) saveModelPrimativeIndexNumeric(mr modelRef, primative *fie
 }
 
 func (t *transaction) saveModelPointerIndexNumeric(mr modelRef, pointer *fieldSpec) error {
+	indexKey := mr.modelSpec.key(pointer.redisName)
 	if mr.value(pointer.fieldName).IsNil() {
-		// TODO: special case for indexing nil pointers?
-		return nil // skip nil pointers for now
+		// nil pointers are stored in a separate null index
+		t.unindexNumeric(indexKey, mr.model.GetId())
+		t.indexNull(mr, pointer)
+		return nil
 	}
-	indexKey := mr.modelSpec.modelName + ":" + pointer.redisName
-	score, err := convertNumericToFloat64(mr.value(pointer.fieldName).Elem())
+	t.unindexNull(mr, pointer)
+	score, err := indexScore(mr.value(pointer.fieldName).Elem())
 	if err != nil {
 		return err
 	}
@@ -447,7 +614,7 @@ func (t *transaction) indexNumeric(indexKey string, score float64, id string) {
 
 func (t *transaction) saveModelPrimativeIndexAlpha(mr modelRef, primative *fieldSpec) {
 	t.removeOldAlphaIndex(mr, primative.fieldName, primative.redisName)
-	indexKey := mr.modelSpec.modelName + ":" + primative.redisName
+	indexKey := mr.modelSpec.key(primative.redisName)
 	value := mr.value(primative.fieldName).String()
 	id := mr.model.GetId()
 	t.indexAlpha(indexKey, value, id)
@@ -456,10 +623,12 @@ func (t *transaction) saveModelPrimativeIndexAlpha(mr modelRef, primative *field
 func (t *transaction) saveModelPointerIndexAlpha(mr modelRef, pointer *fieldSpec) {
 	t.removeOldAlphaIndex(mr, pointer.fieldName, pointer.redisName)
 	if mr.value(pointer.fieldName).IsNil() {
-		// TODO: special case for indexing nil pointers?
-		return // skip nil pointers for now
+		// nil pointers are stored in a separate null index
+		t.indexNull(mr, pointer)
+		return
 	}
-	indexKey := mr.modelSpec.modelName + ":" + pointer.redisName
+	t.unindexNull(mr, pointer)
+	indexKey := mr.modelSpec.key(pointer.redisName)
 	value := mr.value(pointer.fieldName).Elem().String()
 	id := mr.model.GetId()
 	t.indexAlpha(indexKey, value, id)
@@ -494,7 +663,7 @@ func (t *transaction) removeOldAlphaIndex(mr modelRef, fieldName string, redisNa
 			// if there are more than one old indexes to be removed?
 			conn := GetConn()
 			defer conn.Close()
-			alphaIndexKey := mr.modelSpec.modelName + ":" + fieldName
+			alphaIndexKey := mr.modelSpec.key(fieldName)
 			member := oldFieldValue + " " + mr.model.GetId()
 			if _, err := conn.Do("ZREM", alphaIndexKey, member); err != nil {
 				return err
@@ -507,7 +676,7 @@ func (t *transaction) removeOldAlphaIndex(mr modelRef, fieldName string, redisNa
 func (t *transaction) saveModelPrimativeIndexBoolean(mr modelRef, primative *fieldSpec) {
 	value := mr.value(primative.fieldName).Bool()
 	id := mr.model.GetId()
-	indexKey := mr.modelSpec.modelName + ":" + primative.redisName
+	indexKey := mr.modelSpec.key(primative.redisName)
 	var score float64
 	if value == true {
 		score = 1.0
@@ -518,13 +687,16 @@ func (t *transaction) saveModelPrimativeIndexBoolean(mr modelRef, primative *fie
 }
 
 func (t *transaction) saveModelPointerIndexBoolean(mr modelRef, pointer *fieldSpec) {
+	id := mr.model.GetId()
+	indexKey := mr.modelSpec.key(pointer.redisName)
 	if mr.value(pointer.fieldName).IsNil() {
-		// TODO: special case for indexing nil pointers?
-		return // skip nil pointers for now
+		// nil pointers are stored in a separate null index
+		t.unindexNumeric(indexKey, id)
+		t.indexNull(mr, pointer)
+		return
 	}
+	t.unindexNull(mr, pointer)
 	value := mr.value(pointer.fieldName).Elem().Bool()
-	id := mr.model.GetId()
-	indexKey := mr.modelSpec.modelName + ":" + pointer.redisName
 	var score float64
 	if value == true {
 		score = 1.0
@@ -534,10 +706,23 @@ func (t *transaction) saveModelPointerIndexBoolean(mr modelRef, pointer *fieldSp
 	t.indexNumeric(indexKey, score, id)
 }
 
+// indexNull adds the model id to the null index for the pointer field, which
+// holds the ids of all models for which the field is nil.
+func (t *transaction) indexNull(mr modelRef, pointer *fieldSpec) {
+	args := redis.Args{}.Add(mr.modelSpec.nullIndexKey(pointer.redisName)).Add(mr.model.GetId())
+	t.command("SADD", args, nil)
+}
+
+// unindexNull removes the model id from the null index for the pointer field.
+func (t *transaction) unindexNull(mr modelRef, pointer *fieldSpec) {
+	args := redis.Args{}.Add(mr.modelSpec.nullIndexKey(pointer.redisName)).Add(mr.model.GetId())
+	t.command("SREM", args, nil)
+}
+
 func (t *transaction) findModel(mr modelRef, includes []string) error {
 	// check for mutex
 	if s, ok := mr.model.(Syncer); ok {
-		mutexId := fmt.Sprintf("%T:%s", mr.model, mr.model.GetId())
+		mutexId := mr.modelSpec.ns().key(fmt.Sprintf("%T:%s", mr.model, mr.model.GetId()))
 		s.SetMutexId(mutexId)
 		s.Lock()
 	}
@@ -549,11 +734,19 @@ func (t *transaction) findModel(mr modelRef, includes []string) error {
 	}
 	t.modelCache[mr.key()] = mr.model
 
+	// check the in-process cache, if it is enabled
+	found, cacheAfter := t.findCachedModel(mr, includes)
+	if found {
+		return nil
+	} else if cacheAfter != nil {
+		defer cacheAfter(len(t.commands))
+	}
+
 	// scan the hash values directly into the struct
 	if includes == nil {
 		// use HMGET to get all the fields for the model
 		args := redis.Args{}.Add(mr.key()).AddFlat(mr.modelSpec.mainHashFieldNames())
-		t.command("HMGET", args, newScanModelHandler(mr, nil))
+		t.command("HMGET", args, newScanModelHandler(t, mr, nil))
 	} else {
 		// get the appropriate scannable fields
 		fields := make([]interface{}, 0)
@@ -564,7 +757,7 @@ func (t *transaction) findModel(mr modelRef, includes []string) error {
 		// use HMGET to get only the included fields for the model
 		if len(fields) != 0 {
 			args := redis.Args{}.Add(mr.key()).AddFlat(includes)
-			t.command("HMGET", args, newScanModelHandler(mr, includes))
+			t.command("HMGET", args, newScanModelHandler(t, mr, includes))
 		}
 	}
 
@@ -599,7 +792,7 @@ func (t *transaction) findModelLists(mr modelRef, includes []string) {
 		// use LRANGE to get all the members of the list
 		listKey := mr.key() + ":" + list.redisName
 		args := redis.Args{listKey, 0, -1}
-		t.command("LRANGE", args, newScanModelSliceHandler(mr, field))
+		t.command("LRANGE", args, newScanModelSliceHandler(t, mr, field))
 	}
 }
 
@@ -616,7 +809,7 @@ func (t *transaction) findModelSets(mr modelRef, includes []string) {
 		// use SMEMBERS to get all the members of the set
 		setKey := mr.key() + ":" + set.redisName
 		args := redis.Args{setKey}
-		t.command("SMEMBERS", args, newScanModelSliceHandler(mr, field))
+		t.command("SMEMBERS", args, newScanModelSliceHandler(t, mr, field))
 	}
 }
 
@@ -664,7 +857,8 @@ func (t *transaction) findModelOneToOneRelation(mr modelRef, relationship *field
 
 	// check if a model with key is already cached in this transaction
 	rModelName, _ := getRegisteredNameFromType(field.Type())
-	rModelKey := rModelName + ":" + id
+	rModelSpec, _ := mr.modelSpec.ns().modelSpec(rModelName)
+	rModelKey := rModelSpec.key(id)
 	if prior, found := t.modelCache[rModelKey]; found {
 		// use the same pointer (it's the same object)
 		field.Set(reflect.ValueOf(prior))
@@ -682,7 +876,7 @@ func (t *transaction) findModelOneToOneRelation(mr modelRef, relationship *field
 
 	// set id and create modelRef
 	rModel.SetId(id)
-	rModelRef, err := newModelRefFromModel(rModel)
+	rModelRef, err := newModelRefFromModel(mr.modelSpec.ns(), rModel)
 	if err != nil {
 		return err
 	}
@@ -717,7 +911,8 @@ func (t *transaction) findModelOneToManyRelation(mr modelRef, relationship *fiel
 
 		// check if a model with key is already cached in this transaction
 		rModelName, _ := getRegisteredNameFromType(rType)
-		rModelKey := rModelName + ":" + id
+		rModelSpec, _ := mr.modelSpec.ns().modelSpec(rModelName)
+		rModelKey := rModelSpec.key(id)
 		if prior, found := t.modelCache[rModelKey]; found {
 			// use the same pointer (it's the same object)
 			sliceVal := reflect.Append(field, reflect.ValueOf(prior))
@@ -733,7 +928,7 @@ func (t *transaction) findModelOneToManyRelation(mr modelRef, relationship *fiel
 
 		// set id and create modelRef
 		rModel.SetId(id)
-		rModelRef, err := newModelRefFromModel(rModel)
+		rModelRef, err := newModelRefFromModel(mr.modelSpec.ns(), rModel)
 		if err != nil {
 			return err
 		}
@@ -752,57 +947,116 @@ func (t *transaction) findModelOneToManyRelation(mr modelRef, relationship *fiel
 }
 
 func (t *transaction) deleteModel(mr modelRef) {
-	modelName := mr.modelSpec.modelName
+	if mr.modelSpec.softDelete {
+		// the model keeps its data and indexes so that it can be restored
+		deletedAt := time.Now()
+		mr.model.(SoftDeleter).SetDeletedAt(deletedAt)
+		t.softDeleteModel(mr.modelSpec, mr.model.GetId(), deletedAt)
+		return
+	}
+	t.purgeModel(mr)
+}
+
+// purgeModel adds all the commands needed to permanently delete a model, even
+// if the model embeds SoftDelete.
+func (t *transaction) purgeModel(mr modelRef) {
 	id := mr.model.GetId()
 
+	// add an operation to release any unique values for the model
+	if len(mr.modelSpec.uniques) != 0 {
+		t.releaseUniques(mr.modelSpec, id)
+	}
+
+	// add an operation to record the deletion in the change log
+	if mr.modelSpec.logsChanges() {
+		t.logDelete(mr.modelSpec, id)
+	}
+
 	// add an operation to delete the model itself
-	key := modelName + ":" + id
-	t.delete(key)
+	t.delete(mr.key())
+	t.invalidateCachedModel(mr.modelSpec, id)
+
+	// add an operation to publish a change event, which must come before the
+	// model id is removed from the index
+	t.publishChange(mr.modelSpec, id, "delete")
 
 	// add an operation to remove the model id from the index
-	indexKey := modelName + ":all"
-	t.unindex(indexKey, id)
+	t.unindex(mr.indexKey(), id)
+	if mr.modelSpec.softDelete {
+		t.unindex(mr.modelSpec.deletedKey(), id)
+	}
+
+	// add an operation to remove the model from the set of expiring models
+	if mr.modelSpec.expirable {
+		t.removeExpiration(mr.modelSpec, id)
+	}
 
 	// add an operation to remove all the field indexes for the model
 	t.removeModelIndexes(mr)
+	t.removeCompoundIndexes(mr.modelSpec, id)
 }
 
 func (t *transaction) deleteModelById(modelName, id string) error {
 
-	ms, found := modelSpecs[modelName]
+	ms, found := t.ns.modelSpec(modelName)
 	if !found {
 		return NewModelNameNotRegisteredError(modelName)
 	}
+	if ms.softDelete {
+		// the model keeps its data and indexes so that it can be restored
+		t.softDeleteModel(ms, id, time.Now())
+		return nil
+	}
 
 	// add an operation to remove all the field indexes for the model
 	// we want to do this first because if there is an error or if the model
 	// never existed, there is no need to continue
 	if len(ms.primativeIndexes) != 0 || len(ms.pointerIndexes) != 0 {
-		m, err := FindById(modelName, id)
+		// the model is retrieved even if it has expired, since it still needs to
+		// be deleted
+		models, err := ms.findModelsById([]string{id})
 		if err != nil {
-			if _, ok := err.(*KeyNotFoundError); ok {
-				// if it was a key not found error, the model we're trying to delete
-				// doesn't exist in the first place. so return nil
-				return nil
-			} else {
-				// this means there was an unexpected error
-				return err
-			}
+			return err
+		} else if len(models) == 0 {
+			// the model we're trying to delete doesn't exist in the first place.
+			// so return nil
+			return nil
 		}
-		mr, err := newModelRefFromModel(m)
+		mr, err := newModelRefFromModel(ms.ns(), models[0])
 		if err != nil {
 			return err
 		}
 		t.removeModelIndexes(mr)
 	}
 
+	// add an operation to remove the model from any compound indexes
+	t.removeCompoundIndexes(ms, id)
+
+	// add an operation to release any unique values for the model
+	if len(ms.uniques) != 0 {
+		t.releaseUniques(ms, id)
+	}
+
+	// add an operation to record the deletion in the change log
+	if ms.logsChanges() {
+		t.logDelete(ms, id)
+	}
+
 	// add an operation to delete the model itself
-	key := modelName + ":" + id
-	t.delete(key)
+	t.delete(ms.key(id))
+	t.invalidateCachedModel(ms, id)
+
+	// add an operation to publish a change event, which must come before the
+	// model id is removed from the index
+	t.publishChange(ms, id, "delete")
 
 	// add an operation to remove the model id from the index
-	indexKey := modelName + ":all"
-	t.unindex(indexKey, id)
+	t.unindex(ms.indexKey(), id)
+
+	// add an operation to remove the model from the set of expiring models
+	if ms.expirable {
+		t.removeExpiration(ms, id)
+	}
 
 	return nil
 }
@@ -828,6 +1082,7 @@ func (t *transaction) removeModelIndexes(mr modelRef) {
 	}
 
 	for _, p := range mr.modelSpec.pointerIndexes {
+		t.unindexNull(mr, p)
 		if p.indexType == indexNumeric {
 			t.removeModelPointerIndexNumeric(mr, p)
 		} else if p.indexType == indexAlpha {
@@ -839,17 +1094,16 @@ func (t *transaction) removeModelIndexes(mr modelRef) {
 }
 
 func (t *transaction) removeModelPrimativeIndexNumeric(mr modelRef, primative *fieldSpec) {
-	indexKey := mr.modelSpec.modelName + ":" + primative.redisName
+	indexKey := mr.modelSpec.key(primative.redisName)
 	id := mr.model.GetId()
 	t.unindexNumeric(indexKey, id)
 }
 
 func (t *transaction) removeModelPointerIndexNumeric(mr modelRef, pointer *fieldSpec) {
 	if mr.value(pointer.fieldName).IsNil() {
-		// TODO: special case for indexing nil pointers?
-		return // skip nil pointers for now
+		return // nil pointers are only in the null index
 	}
-	indexKey := mr.modelSpec.modelName + ":" + pointer.redisName
+	indexKey := mr.modelSpec.key(pointer.redisName)
 	id := mr.model.GetId()
 	t.unindexNumeric(indexKey, id)
 }
@@ -860,7 +1114,7 @@ func (t *transaction) unindexNumeric(indexKey string, id string) {
 }
 
 func (t *transaction) removeModelPrimativeIndexAlpha(mr modelRef, primative *fieldSpec) {
-	indexKey := mr.modelSpec.modelName + ":" + primative.redisName
+	indexKey := mr.modelSpec.key(primative.redisName)
 	value := mr.value(primative.fieldName).String()
 	id := mr.model.GetId()
 	t.unindexAlpha(indexKey, value, id)
@@ -868,10 +1122,9 @@ func (t *transaction) removeModelPrimativeIndexAlpha(mr modelRef, primative *fie
 
 func (t *transaction) removeModelPointerIndexAlpha(mr modelRef, pointer *fieldSpec) {
 	if mr.value(pointer.fieldName).IsNil() {
-		// TODO: special case for indexing nil pointers?
-		return // skip nil pointers for now
+		return // nil pointers are only in the null index
 	}
-	indexKey := mr.modelSpec.modelName + ":" + pointer.redisName
+	indexKey := mr.modelSpec.key(pointer.redisName)
 	value := mr.value(pointer.fieldName).Elem().String()
 	id := mr.model.GetId()
 	t.unindexAlpha(indexKey, value, id)
@@ -885,24 +1138,21 @@ func (t *transaction) unindexAlpha(indexKey, value, id string) {
 
 func (t *transaction) removeModelPrimativeIndexBoolean(mr modelRef, primative *fieldSpec) {
 	id := mr.model.GetId()
-	indexKey := mr.modelSpec.modelName + ":" + primative.redisName
+	indexKey := mr.modelSpec.key(primative.redisName)
 	t.unindexNumeric(indexKey, id)
 }
 
 func (t *transaction) removeModelPointerIndexBoolean(mr modelRef, pointer *fieldSpec) {
 	id := mr.model.GetId()
-	indexKey := mr.modelSpec.modelName + ":" + pointer.redisName
+	indexKey := mr.modelSpec.key(pointer.redisName)
 	t.unindexNumeric(indexKey, id)
 }
 
 // check to see if the model id exists in the index. If it doesn't,
-// return KeyNotFoundError
-func checkModelExists(mr modelRef) error {
-	conn := GetConn()
-	defer conn.Close()
-
-	indexKey := mr.modelSpec.modelName + ":all"
-	if exists, err := redis.Bool(conn.Do("SISMEMBER", indexKey, mr.model.GetId())); err != nil {
+// return KeyNotFoundError. conn should be the connection of the transaction
+// which found the model, so that the check reads from the same server.
+func checkModelExists(conn redis.Conn, mr modelRef) error {
+	if exists, err := mr.modelSpec.idExists(conn, mr.model.GetId()); err != nil {
 		return err
 	} else if !exists {
 		return NewKeyNotFoundError(mr.key(), mr.modelSpec.modelType)
@@ -0,0 +1,343 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File unique.go contains code related to unique constraints, which
+// are specified with the zoom:"unique" struct tag. Each unique field
+// is backed by a redis hash which maps field values to model ids.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// claimUniquesScript atomically checks that none of the unique values for a
+// model are used by another model and then claims them. KEYS[1] is the key
+// for the model itself and KEYS[2:] are the unique hashes. ARGV[1] is the model
+// id, followed by a redisName and value pair for each unique hash. It returns
+// an empty array on success, or the redisName and conflicting id on failure.
+var claimUniquesScript = `
+local id = ARGV[1]
+for i = 2, #KEYS do
+	local value = ARGV[2*i-1]
+	if value ~= 'NULL' then
+		local owner = redis.call('HGET', KEYS[i], value)
+		if owner and owner ~= id then
+			return {ARGV[2*i-2], owner}
+		end
+	end
+end
+for i = 2, #KEYS do
+	local value = ARGV[2*i-1]
+	local old = redis.call('HGET', KEYS[1], ARGV[2*i-2])
+	if old and old ~= value and redis.call('HGET', KEYS[i], old) == id then
+		redis.call('HDEL', KEYS[i], old)
+	end
+	if value ~= 'NULL' then
+		redis.call('HSET', KEYS[i], value, id)
+	end
+end
+return {}`
+
+// restoreUniquesScript undoes the work of claimUniquesScript when the rest of
+// the transaction could not be completed. It releases the claimed values and
+// restores the claims for the values which are currently stored. It takes the
+// same arguments as claimUniquesScript.
+var restoreUniquesScript = `
+local id = ARGV[1]
+for i = 2, #KEYS do
+	local value = ARGV[2*i-1]
+	if redis.call('HGET', KEYS[i], value) == id then
+		redis.call('HDEL', KEYS[i], value)
+	end
+	local stored = redis.call('HGET', KEYS[1], ARGV[2*i-2])
+	if stored and stored ~= 'NULL' then
+		redis.call('HSETNX', KEYS[i], stored, id)
+	end
+end
+return {}`
+
+// releaseUniquesScript releases the claims for the values which are currently
+// stored for a model. It is used when a model is deleted. KEYS[1] is the key
+// for the model itself and KEYS[2:] are the unique hashes. ARGV[1] is the model
+// id, followed by the redisName for each unique hash.
+var releaseUniquesScript = `
+local id = ARGV[1]
+for i = 2, #KEYS do
+	local stored = redis.call('HGET', KEYS[1], ARGV[i])
+	if stored and redis.call('HGET', KEYS[i], stored) == id then
+		redis.call('HDEL', KEYS[i], stored)
+	end
+end
+return {}`
+
+// FindByUnique gets a model from the database by the value of a field with
+// the zoom:"unique" struct tag. It only requires a single lookup, so it is
+// much faster than running an equivalent query. It returns a
+// ModelNotFoundError if there is no model with the given value.
+func FindByUnique(modelName, fieldName string, value interface{}) (Model, error) {
+	return defaultNamespace.FindByUnique(modelName, fieldName, value)
+}
+
+// FindByUnique is like the package-level FindByUnique but finds the model in
+// the namespace.
+func (ns *Namespace) FindByUnique(modelName, fieldName string, value interface{}) (Model, error) {
+	ms, found := ns.modelSpec(modelName)
+	if !found {
+		return nil, NewModelNameNotRegisteredError(modelName)
+	}
+	fs, found := ms.uniques[fieldName]
+	if !found {
+		return nil, fmt.Errorf("zoom: error in FindByUnique: field %s in type %s does not have a unique constraint", fieldName, ms.modelType.String())
+	}
+	// the value is looked up the same way it is stored in the main hash
+	val := reflect.ValueOf(value)
+	for val.Kind() == reflect.Ptr && !val.IsNil() {
+		val = val.Elem()
+	}
+	if !val.IsValid() || val.Kind() == reflect.Ptr {
+		return nil, NewModelNotFoundError()
+	}
+	conn := GetConn()
+	defer conn.Close()
+	id, err := redis.String(conn.Do("HGET", ms.uniqueKey(fs.redisName), hashValue(val)))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, NewModelNotFoundError()
+		}
+		return nil, err
+	}
+	return ns.FindById(modelName, id)
+}
+
+// findOrCreateAttempts is the maximum number of times FindOrCreate will look
+// for an existing model and try to save a new one before giving up. More than
+// one attempt is only needed if another model claims the value, or the model
+// which had the value is deleted, in between.
+var findOrCreateAttempts = 5
+
+// FindOrCreate looks for a model with the same value for the field identified
+// by fieldName as model, and scans it into model if it exists. Otherwise model
+// is saved as a new model. The field must have the zoom:"unique" struct tag.
+// The first return value is true iff model was saved. Since the unique value
+// is claimed atomically when model is saved, only one model will be created
+// even if FindOrCreate is called for the same value at the same time by more
+// than one process.
+func FindOrCreate(model Model, fieldName string) (bool, error) {
+	return defaultNamespace.FindOrCreate(model, fieldName)
+}
+
+// FindOrCreate is like the package-level FindOrCreate but finds or saves the
+// model in the namespace.
+func (ns *Namespace) FindOrCreate(model Model, fieldName string) (bool, error) {
+	mr, err := newModelRefFromModel(ns, model)
+	if err != nil {
+		return false, err
+	}
+	fs, found := mr.modelSpec.uniques[fieldName]
+	if !found {
+		return false, fmt.Errorf("zoom: error in FindOrCreate: field %s in type %s does not have a unique constraint", fieldName, mr.modelSpec.modelType.String())
+	}
+	val := mr.value(fieldName)
+	if fs.classification == pointer {
+		if val.IsNil() {
+			return false, fmt.Errorf("zoom: error in FindOrCreate: field %s in type %s cannot be nil", fieldName, mr.modelSpec.modelType.String())
+		}
+		val = val.Elem()
+	}
+	conn := GetConn()
+	defer conn.Close()
+	for i := 0; i < findOrCreateAttempts; i++ {
+		id, err := redis.String(conn.Do("HGET", mr.modelSpec.uniqueKey(fs.redisName), hashValue(val)))
+		if err == nil {
+			if err := ns.ScanById(id, model); err != nil {
+				if _, ok := err.(*KeyNotFoundError); ok {
+					// the model was deleted, so try again
+					continue
+				}
+				return false, err
+			}
+			return false, nil
+		} else if err != redis.ErrNil {
+			return false, err
+		}
+		if err := ns.Save(model); err != nil {
+			if uniqueErr, ok := err.(*UniqueConstraintError); ok && uniqueErr.FieldName == fieldName {
+				// another model claimed the value first, so try to find it
+				continue
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("zoom: error in FindOrCreate: could not find or create a model with %s = %v after %d attempts", fieldName, val.Interface(), findOrCreateAttempts)
+}
+
+// uniqueKey returns the key for the hash which maps values of the field
+// identified by redisName to model ids.
+func (ms modelSpec) uniqueKey(redisName string) string {
+	return ms.key(redisName + ":unique")
+}
+
+// uniqueValue is the value of a unique field of a model, as it is stored in
+// the unique hash for the field. value is "NULL" if the field does not claim a
+// value.
+type uniqueValue struct {
+	fieldSpec *fieldSpec
+	key       string
+	value     string
+}
+
+// uniqueValues returns the values of all the unique fields of the model.
+// Models which have been soft deleted do not claim any values.
+func (mr modelRef) uniqueValues() []uniqueValue {
+	deleted := mr.modelSpec.softDelete && !mr.model.(SoftDeleter).GetDeletedAt().IsZero()
+	values := []uniqueValue{}
+	for _, fs := range mr.modelSpec.uniques {
+		uv := uniqueValue{fieldSpec: fs, key: mr.modelSpec.uniqueKey(fs.redisName), value: "NULL"}
+		if !deleted {
+			val := mr.value(fs.fieldName)
+			if fs.classification != pointer {
+				uv.value = argString(hashValue(val))
+			} else if !val.IsNil() {
+				uv.value = argString(hashValue(val.Elem()))
+			}
+		}
+		values = append(values, uv)
+	}
+	return values
+}
+
+// uniqueArgs returns the args for claimUniquesScript and restoreUniquesScript.
+func (mr modelRef) uniqueArgs() redis.Args {
+	keys := redis.Args{}.Add(mr.key())
+	values := redis.Args{}.Add(mr.model.GetId())
+	for _, uv := range mr.uniqueValues() {
+		keys = keys.Add(uv.key)
+		values = values.Add(uv.fieldSpec.redisName, uv.value)
+	}
+	return redis.Args{}.Add(len(keys)).AddFlat(keys).AddFlat(values)
+}
+
+// maxUniqueCheckAttempts is the number of times a stage of a transaction
+// which saves models with unique fields is tried before giving up, if the
+// unique hashes keep being changed by other clients between the check and
+// EXEC.
+const maxUniqueCheckAttempts = 10
+
+// checkUniques watches the unique hashes for all the models in t.uniqueChecks
+// and then checks that none of their unique values are used by another model,
+// either in the database or in the same transaction. The stage of the
+// transaction which claims the values and writes the models must be executed
+// on the same connection right after checkUniques returns, so that EXEC fails
+// if any of the watched hashes is changed in the meantime. It returns a
+// UniqueConstraintError if a value is already used.
+func (t *transaction) checkUniques() error {
+	keys := redis.Args{}
+	watched := map[string]bool{}
+	for _, mr := range t.uniqueChecks {
+		for _, uv := range mr.uniqueValues() {
+			if !watched[uv.key] {
+				watched[uv.key] = true
+				keys = keys.Add(uv.key)
+			}
+		}
+	}
+	if _, err := t.conn.Do("WATCH", keys...); err != nil {
+		return err
+	}
+	claimed := map[uniqueValue]string{}
+	for _, mr := range t.uniqueChecks {
+		id := mr.model.GetId()
+		for _, uv := range mr.uniqueValues() {
+			if uv.value == "NULL" {
+				continue
+			}
+			owner, found := claimed[uv]
+			if !found {
+				var err error
+				owner, err = redis.String(t.conn.Do("HGET", uv.key, uv.value))
+				if err != nil && err != redis.ErrNil {
+					t.conn.Do("UNWATCH")
+					return err
+				}
+			}
+			if owner != "" && owner != id {
+				t.conn.Do("UNWATCH")
+				return NewUniqueConstraintError(mr.modelSpec.modelName, uv.fieldSpec.fieldName, owner)
+			}
+			claimed[uv] = id
+		}
+	}
+	return nil
+}
+
+// claimUniques adds a command to the transaction which will claim all the
+// unique values for the model. If any of the values are already used by another
+// model, all the claims made so far in the transaction are restored and a
+// UniqueConstraintError is returned when the transaction is executed. It returns
+// the key of the data which will be sent when the claim succeeds. It is only
+// used in cluster mode, which does not support WATCH, so the claims are made
+// in a separate stage before the models are written.
+func (t *transaction) claimUniques(mr modelRef) string {
+	dataKey := "unique:" + mr.key()
+	t.uniqueClaims = append(t.uniqueClaims, mr)
+	args := redis.Args{}.Add(claimUniquesScript).AddFlat(mr.uniqueArgs())
+	t.command("EVAL", args, func(reply interface{}) error {
+		conflict, err := redis.Strings(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(conflict) != 0 {
+			if err := t.restoreUniqueClaims(); err != nil {
+				return err
+			}
+			redisName, owner := conflict[0], conflict[1]
+			fieldName := redisName
+			for _, fs := range mr.modelSpec.uniques {
+				if fs.redisName == redisName {
+					fieldName = fs.fieldName
+				}
+			}
+			return NewUniqueConstraintError(mr.modelSpec.modelName, fieldName, owner)
+		}
+		t.sendData(dataKey, nil)
+		return nil
+	})
+	return dataKey
+}
+
+// restoreUniqueClaims restores all the unique values that were claimed in the
+// transaction.
+func (t *transaction) restoreUniqueClaims() error {
+	// TODO: Is there a way to do this without creating a new connection?
+	conn := GetConn()
+	defer conn.Close()
+	for _, mr := range t.uniqueClaims {
+		args := redis.Args{}.Add(restoreUniquesScript).AddFlat(mr.uniqueArgs())
+		if _, err := conn.Do("EVAL", args...); err != nil {
+			return err
+		}
+	}
+	t.uniqueClaims = nil
+	return nil
+}
+
+// releaseUniques adds a command to the transaction which will release the
+// unique values currently stored for the model. It must be added before the
+// command which deletes the model. It is also used when a model is soft
+// deleted.
+func (t *transaction) releaseUniques(ms modelSpec, id string) {
+	keys := redis.Args{}.Add(ms.key(id))
+	values := redis.Args{}.Add(id)
+	for _, fs := range ms.uniques {
+		keys = keys.Add(ms.uniqueKey(fs.redisName))
+		values = values.Add(fs.redisName)
+	}
+	args := redis.Args{}.Add(releaseUniquesScript).Add(len(keys)).AddFlat(keys).AddFlat(values)
+	t.command("EVAL", args, nil)
+}
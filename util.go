@@ -12,8 +12,13 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"time"
 )
 
+var timeType = reflect.TypeOf(time.Time{})
+
+var indexScorerType = reflect.TypeOf((*IndexScorer)(nil)).Elem()
+
 func reverseString(s string) string {
 	runes := []rune(s)
 	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
@@ -147,8 +152,16 @@ func typeIsBool(typ reflect.Type) bool {
 	return k == reflect.Bool
 }
 
+func typeIsTime(typ reflect.Type) bool {
+	return typ == timeType
+}
+
+func typeIsIndexScorer(typ reflect.Type) bool {
+	return typ.Implements(indexScorerType) || reflect.PtrTo(typ).Implements(indexScorerType)
+}
+
 func typeIsPrimative(typ reflect.Type) bool {
-	return typeIsString(typ) || typeIsNumeric(typ) || typeIsBool(typ)
+	return typeIsString(typ) || typeIsNumeric(typ) || typeIsBool(typ) || typeIsTime(typ)
 }
 
 // generate a random int from min to max (inclusively).
@@ -195,6 +208,46 @@ func convertNumericToFloat64(val reflect.Value) (float64, error) {
 	}
 }
 
+// indexScore returns the score used in a numeric index for val. val should be
+// a numeric type, a time.Time, or a type which implements IndexScorer. Times
+// are scored by the number of milliseconds since the unix epoch, since a
+// float64 score can't hold nanoseconds for current dates exactly. Times which
+// are less than a millisecond apart have the same score.
+func indexScore(val reflect.Value) (float64, error) {
+	if scorer, ok := val.Interface().(IndexScorer); ok {
+		return scorer.IndexScore(), nil
+	} else if val.CanAddr() {
+		if scorer, ok := val.Addr().Interface().(IndexScorer); ok {
+			return scorer.IndexScore(), nil
+		}
+	}
+	if typeIsTime(val.Type()) {
+		return float64(val.Interface().(time.Time).UnixNano() / int64(time.Millisecond)), nil
+	}
+	return convertNumericToFloat64(val)
+}
+
+// numericIndexValue returns the value which should be used for val in commands
+// on a numeric index. Numeric types are used directly, while other types are
+// converted to their scores.
+func numericIndexValue(val reflect.Value) (interface{}, error) {
+	if typeIsNumeric(val.Type()) {
+		return val.Interface(), nil
+	}
+	return indexScore(val)
+}
+
+// hashValue returns the value which should be written to the main hash for val.
+// Times are converted to a readable string in the RFC3339 format. They are
+// converted to UTC first so that the same instant is always stored the same
+// way, which is needed to look up unique values.
+func hashValue(val reflect.Value) interface{} {
+	if typeIsTime(val.Type()) {
+		return val.Interface().(time.Time).UTC().Format(time.RFC3339Nano)
+	}
+	return val.Interface()
+}
+
 func modelIds(ms []Model) []string {
 	results := make([]string, len(ms))
 	for i, m := range ms {
@@ -232,6 +285,23 @@ func orderedIntersectStrings(first []string, second []string) []string {
 	return results
 }
 
+// returns the strings in the first slice which are not in the second slice.
+// The order of the first slice will be preserved. The return value is a copy,
+// so neither the first or second slice will be mutated.
+func orderedSubtractStrings(first []string, second []string) []string {
+	results := make([]string, 0)
+	memo := make(map[string]struct{})
+	for _, a := range second {
+		memo[a] = struct{}{}
+	}
+	for _, a := range first {
+		if _, found := memo[a]; !found {
+			results = append(results, a)
+		}
+	}
+	return results
+}
+
 // intersects two model slices. The order will be preserved
 // with respect to the first slice. (The first slice is used
 // in the outer loop). The return value is a copy, so neither
@@ -0,0 +1,269 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File validate.go contains code for validating models before they are saved,
+// using the validation options in the zoom struct tag (required, min, max, len
+// and pattern) and the optional Validator interface.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validator is an interface for models which check their own fields before
+// they are saved. Validate is called by Save and MSave after the validation
+// options in the zoom struct tags have been checked. If it returns an error,
+// the model is not saved and the error is included in the ValidationError. A
+// Validate method may return a *ValidationError itself to report problems with
+// more than one field.
+type Validator interface {
+	Validate() error
+}
+
+// validationRule is a validation option from the zoom struct tag of a field.
+type validationRule struct {
+	option string // the option as it was written in the struct tag
+	// check returns a message describing why the value of the field is
+	// invalid, or an empty string if it is valid
+	check func(val reflect.Value) string
+}
+
+// splitZoomTag splits the options in the zoom struct tag of a field. Since a
+// pattern may contain commas, the pattern option must come last and everything
+// after "pattern=" is treated as the pattern. It returns an error if part of
+// the pattern looks like another option, since the option would otherwise be
+// silently treated as part of the pattern.
+func splitZoomTag(tag string) ([]string, error) {
+	pattern := ""
+	if i := strings.Index(tag, "pattern="); i == 0 || (i > 0 && tag[i-1] == ',') {
+		tag, pattern = strings.TrimSuffix(tag[:i], ","), tag[i:]
+		for _, part := range strings.Split(pattern, ",")[1:] {
+			if isZoomTagOption(part) {
+				return nil, fmt.Errorf("zoom: the pattern option in struct tag must be the last option, but it is followed by %s", part)
+			}
+		}
+	}
+	options := []string{}
+	if tag != "" {
+		options = strings.Split(tag, ",")
+	}
+	if pattern != "" {
+		options = append(options, pattern)
+	}
+	return options, nil
+}
+
+// isZoomTagOption returns true iff op is one of the options which can be used
+// in the zoom struct tag of a field.
+func isZoomTagOption(op string) bool {
+	switch op {
+	case "index", "unique", "json", "required":
+		return true
+	}
+	for _, prefix := range []string{"index=", "min=", "max=", "len<=", "len>=", "len=", "pattern="} {
+		if strings.HasPrefix(op, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// newValidationRule parses a validation option from the zoom struct tag of a
+// field of type typ. It returns false if op is not a validation option, or an
+// error if it is invalid or can't be used for fields of type typ.
+func newValidationRule(typ reflect.Type, op string) (validationRule, bool, error) {
+	rule := validationRule{option: op}
+	elemType := typ
+	if typ.Kind() == reflect.Ptr {
+		elemType = typ.Elem()
+	}
+	switch {
+	case op == "required":
+		rule.check = func(val reflect.Value) string {
+			if valueIsEmpty(val) {
+				return "is required"
+			}
+			return ""
+		}
+	case strings.HasPrefix(op, "min="), strings.HasPrefix(op, "max="):
+		if !typeIsNumeric(elemType) {
+			return rule, true, fmt.Errorf("zoom: the %s option in struct tag can only be used for numeric fields, not %s", op, typ.String())
+		}
+		limitString := op[len("min="):]
+		limit, err := strconv.ParseFloat(limitString, 64)
+		if err != nil {
+			return rule, true, fmt.Errorf("zoom: invalid number specified in struct tag: %s", op)
+		}
+		isMin := strings.HasPrefix(op, "min=")
+		rule.check = func(val reflect.Value) string {
+			val, ok := indirectValue(val)
+			if !ok {
+				return ""
+			}
+			num := numericValue(val)
+			if isMin && num < limit {
+				return "must be at least " + limitString
+			} else if !isMin && num > limit {
+				return "must be at most " + limitString
+			}
+			return ""
+		}
+	case strings.HasPrefix(op, "len"):
+		var comparison string
+		for _, prefix := range []string{"len<=", "len>=", "len="} {
+			if strings.HasPrefix(op, prefix) {
+				comparison = prefix[len("len"):]
+				break
+			}
+		}
+		if comparison == "" {
+			return rule, false, nil
+		}
+		switch elemType.Kind() {
+		case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		default:
+			return rule, true, fmt.Errorf("zoom: the %s option in struct tag can only be used for strings, slices, arrays, and maps, not %s", op, typ.String())
+		}
+		limit, err := strconv.Atoi(op[len("len")+len(comparison):])
+		if err != nil || limit < 0 {
+			return rule, true, fmt.Errorf("zoom: invalid length specified in struct tag: %s", op)
+		}
+		rule.check = func(val reflect.Value) string {
+			val, ok := indirectValue(val)
+			if !ok {
+				return ""
+			}
+			length := val.Len()
+			if val.Kind() == reflect.String {
+				length = utf8.RuneCountInString(val.String())
+			}
+			switch {
+			case comparison == "<=" && length > limit:
+				return fmt.Sprintf("must have a length of at most %d", limit)
+			case comparison == ">=" && length < limit:
+				return fmt.Sprintf("must have a length of at least %d", limit)
+			case comparison == "=" && length != limit:
+				return fmt.Sprintf("must have a length of %d", limit)
+			}
+			return ""
+		}
+	case strings.HasPrefix(op, "pattern="):
+		if elemType.Kind() != reflect.String {
+			return rule, true, fmt.Errorf("zoom: the pattern option in struct tag can only be used for strings, not %s", typ.String())
+		}
+		pattern := strings.TrimPrefix(op, "pattern=")
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return rule, true, fmt.Errorf("zoom: invalid pattern specified in struct tag: %s", err)
+		}
+		rule.check = func(val reflect.Value) string {
+			val, ok := indirectValue(val)
+			if !ok {
+				return ""
+			}
+			if !re.MatchString(val.String()) {
+				return "must match the pattern " + pattern
+			}
+			return ""
+		}
+	default:
+		return rule, false, nil
+	}
+	return rule, true, nil
+}
+
+// indirectValue returns the value val points to if it is a pointer, and false
+// if it is a nil pointer. Validation options other than required do not apply
+// to nil pointers, so pointers can be used for optional fields.
+func indirectValue(val reflect.Value) (reflect.Value, bool) {
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return val, false
+		}
+		return val.Elem(), true
+	}
+	return val, true
+}
+
+// numericValue returns the value of val, which must be numeric, as a float64.
+func numericValue(val reflect.Value) float64 {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint())
+	default:
+		return val.Float()
+	}
+}
+
+// valueIsEmpty returns true if val is the zero value for its type or is a
+// slice or map with no elements.
+func valueIsEmpty(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Slice, reflect.Map:
+		return val.Len() == 0
+	default:
+		return val.IsZero()
+	}
+}
+
+// validateModels checks the validation options in the zoom struct tags of each
+// model and calls Validate for models which implement Validator. It returns a
+// ValidationError listing every problem with every model, or nil if all the
+// models are valid.
+func validateModels(models []Model) error {
+	problems := []FieldError{}
+	for _, m := range models {
+		mr, err := newModelRefFromModel(defaultNamespace, m)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, mr.validate()...)
+	}
+	if len(problems) != 0 {
+		return NewValidationError(problems)
+	}
+	return nil
+}
+
+// validate returns the problems with the model, if any.
+func (mr modelRef) validate() []FieldError {
+	problems := []FieldError{}
+	modelName, id := mr.modelSpec.modelName, mr.model.GetId()
+	for _, fs := range mr.modelSpec.fieldSpecs {
+		for _, rule := range fs.rules {
+			if message := rule.check(mr.value(fs.fieldName)); message != "" {
+				problems = append(problems, FieldError{modelName, id, fs.fieldName, rule.option, message})
+			}
+		}
+	}
+	if v, ok := mr.model.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			if verr, ok := err.(*ValidationError); ok {
+				for _, f := range verr.Fields {
+					if f.ModelName == "" {
+						f.ModelName = modelName
+					}
+					if f.Id == "" {
+						f.Id = id
+					}
+					if f.Rule == "" {
+						f.Rule = "Validate"
+					}
+					problems = append(problems, f)
+				}
+			} else {
+				problems = append(problems, FieldError{modelName, id, "", "Validate", err.Error()})
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,274 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File verify.go contains code for detecting differences between the
+// registered model types and the data which is stored in the database,
+// e.g. after a struct was changed without migrating the stored data.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// VerifyReport describes the differences between a registered model type
+// and the models of that type which are stored in the database. It is
+// returned by Verify.
+type VerifyReport struct {
+	ModelName     string         `json:"modelName"`
+	ModelsChecked int            `json:"modelsChecked"`
+	UnknownFields []FieldProblem `json:"unknownFields"` // fields in a stored hash which are not part of the type
+	MissingFields []FieldProblem `json:"missingFields"` // fields of the type which are not in a stored hash
+	InvalidValues []FieldProblem `json:"invalidValues"` // stored values which could not be converted to the type of the field
+	OrphanIndexes []IndexProblem `json:"orphanIndexes"` // index members for ids which are not in the set of all models
+	MissingHashes []string       `json:"missingHashes"` // ids in the set of all models which have no stored hash
+}
+
+// FieldProblem describes a problem with a single field of a stored model.
+type FieldProblem struct {
+	Id    string `json:"id"`
+	Field string `json:"field"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// IndexProblem describes an index member for a model id which does not exist.
+type IndexProblem struct {
+	IndexKey string `json:"indexKey"`
+	Id       string `json:"id"`
+}
+
+// Ok returns true iff no problems were found.
+func (r *VerifyReport) Ok() bool {
+	return len(r.UnknownFields) == 0 && len(r.MissingFields) == 0 && len(r.InvalidValues) == 0 &&
+		len(r.OrphanIndexes) == 0 && len(r.MissingHashes) == 0
+}
+
+// String returns a human-readable summary of the report.
+func (r *VerifyReport) String() string {
+	lines := []string{fmt.Sprintf("%s: checked %d models", r.ModelName, r.ModelsChecked)}
+	for _, p := range r.UnknownFields {
+		lines = append(lines, fmt.Sprintf("  unknown field %s in model %s", p.Field, p.Id))
+	}
+	for _, p := range r.MissingFields {
+		lines = append(lines, fmt.Sprintf("  missing field %s in model %s", p.Field, p.Id))
+	}
+	for _, p := range r.InvalidValues {
+		lines = append(lines, fmt.Sprintf("  invalid value %q for field %s in model %s: %s", p.Value, p.Field, p.Id, p.Error))
+	}
+	for _, p := range r.OrphanIndexes {
+		lines = append(lines, fmt.Sprintf("  index %s contains nonexistent model %s", p.IndexKey, p.Id))
+	}
+	for _, id := range r.MissingHashes {
+		lines = append(lines, fmt.Sprintf("  model %s is in %s:all but has no hash", id, r.ModelName))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Verify scans all the stored models of the type identified by modelName and
+// all of the indexes for the type, and reports any differences between the
+// stored data and the registered type. It reports fields in the stored hashes
+// which are not part of the type, fields of the type which are missing from the
+// hashes, values which cannot be converted to the type of the field, index
+// members for ids which are not in the set of all models, and ids in the set of
+// all models which have no hash. For types which embed SoftDelete, the models
+// which were soft deleted are checked as well. An error is only returned if there was a
+// problem communicating with the database; any problems with the stored data
+// are described by the report.
+func Verify(modelName string) (*VerifyReport, error) {
+	return defaultNamespace.Verify(modelName)
+}
+
+// Verify is like the package-level Verify but checks the models in the
+// namespace.
+func (ns *Namespace) Verify(modelName string) (*VerifyReport, error) {
+	ms, found := ns.modelSpec(modelName)
+	if !found {
+		return nil, NewModelNameNotRegisteredError(modelName)
+	}
+	conn := GetConn()
+	defer conn.Close()
+	report := &VerifyReport{ModelName: modelName}
+	if err := ms.verifyHashes(conn, report); err != nil {
+		return nil, err
+	}
+	if err := ms.verifyIndexes(conn, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyHashes checks the main hash for each id in the set of all models.
+func (ms modelSpec) verifyHashes(conn redis.Conn, report *VerifyReport) error {
+	// the fields which are stored in the main hash
+	hashFields := map[string]*fieldSpec{}
+	for _, fs := range ms.fieldSpecs {
+		switch fs.classification {
+		case primative, pointer, inconvertible:
+			hashFields[fs.redisName] = fs
+		}
+	}
+	// soft deleted models are checked as well as the models in the set of
+	// all models
+	for _, setKey := range ms.idSetKeys() {
+		cursor := "0"
+		for {
+			reply, err := redis.Values(conn.Do("SSCAN", setKey, cursor, "COUNT", reindexBatchSize))
+			if err != nil {
+				return err
+			}
+			var ids []string
+			if _, err := redis.Scan(reply, &cursor, &ids); err != nil {
+				return err
+			}
+			for _, id := range ids {
+				report.ModelsChecked++
+				hash, err := redis.StringMap(conn.Do("HGETALL", ms.key(id)))
+				if err != nil {
+					return err
+				}
+				if len(hash) == 0 {
+					if len(hashFields) != 0 {
+						report.MissingHashes = append(report.MissingHashes, id)
+					}
+					continue
+				}
+				for field, value := range hash {
+					fs, found := hashFields[field]
+					if !found {
+						report.UnknownFields = append(report.UnknownFields, FieldProblem{Id: id, Field: field, Value: value})
+						continue
+					}
+					if err := verifyValue(fs, []byte(value)); err != nil {
+						report.InvalidValues = append(report.InvalidValues, FieldProblem{Id: id, Field: field, Value: value, Error: err.Error()})
+					}
+				}
+				for redisName := range hashFields {
+					if _, found := hash[redisName]; !found {
+						report.MissingFields = append(report.MissingFields, FieldProblem{Id: id, Field: redisName})
+					}
+				}
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// verifyValue returns an error if the stored value could not be scanned into
+// the field described by fs.
+func verifyValue(fs *fieldSpec, value []byte) error {
+	if string(value) == "NULL" && fs.fieldType.Kind() == reflect.Ptr {
+		return nil
+	}
+	dest := reflect.New(fs.fieldType).Elem()
+	switch fs.classification {
+	case primative:
+		return scanPrimativeVal(value, dest)
+	case pointer:
+		return scanPointerVal(value, dest)
+	default:
+		return scanInconvertibleVal(value, dest, fs.marshaler)
+	}
+}
+
+// verifyIndexes checks that every id in the indexes for the model type is in
+// the set of all models.
+func (ms modelSpec) verifyIndexes(conn redis.Conn, report *VerifyReport) error {
+	for _, fs := range ms.primativeIndexes {
+		if err := ms.verifyIndex(conn, report, "ZSCAN", ms.key(fs.redisName), fs.indexType == indexAlpha); err != nil {
+			return err
+		}
+	}
+	for _, fs := range ms.pointerIndexes {
+		if err := ms.verifyIndex(conn, report, "ZSCAN", ms.key(fs.redisName), fs.indexType == indexAlpha); err != nil {
+			return err
+		}
+		if err := ms.verifyIndex(conn, report, "SSCAN", ms.nullIndexKey(fs.redisName), false); err != nil {
+			return err
+		}
+	}
+	for _, fs := range ms.uniques {
+		if err := ms.verifyIndex(conn, report, "HSCAN", ms.uniqueKey(fs.redisName), false); err != nil {
+			return err
+		}
+	}
+	for _, ci := range ms.compoundIndexes {
+		if err := ms.verifyIndex(conn, report, "HSCAN", ms.compoundRefsKey(ci), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyIndex iterates through the index identified by key using scanCommand
+// (one of SSCAN, ZSCAN, or HSCAN) and adds an IndexProblem to the report for
+// each id which is not in the set of all models.
+func (ms modelSpec) verifyIndex(conn redis.Conn, report *VerifyReport, scanCommand string, key string, alpha bool) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do(scanCommand, key, cursor, "COUNT", reindexBatchSize))
+		if err != nil {
+			return err
+		}
+		var values []string
+		if _, err := redis.Scan(reply, &cursor, &values); err != nil {
+			return err
+		}
+		ids := []string{}
+		switch scanCommand {
+		case "SSCAN":
+			ids = values
+		case "ZSCAN":
+			// the values alternate between members and scores
+			for i := 0; i < len(values); i += 2 {
+				if alpha {
+					ids = append(ids, extractModelIdFromAlphaIndexValue(values[i]))
+				} else {
+					ids = append(ids, values[i])
+				}
+			}
+		case "HSCAN":
+			// the values alternate between fields and values. For unique
+			// indexes the values are ids, and for compound indexes the fields
+			// which don't end in ":member" are ids.
+			for i := 0; i < len(values); i += 2 {
+				if strings.HasSuffix(key, ":refs") {
+					if !strings.HasSuffix(values[i], ":member") {
+						ids = append(ids, values[i])
+					}
+				} else {
+					ids = append(ids, values[i+1])
+				}
+			}
+		}
+		for _, id := range ids {
+			if exists, err := ms.idExists(conn, id); err != nil {
+				return err
+			} else if !exists {
+				report.OrphanIndexes = append(report.OrphanIndexes, IndexProblem{IndexKey: key, Id: id})
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// idExists returns true iff id is in the set of all models, or in the set of
+// deleted models if the type embeds SoftDelete.
+func (ms modelSpec) idExists(conn redis.Conn, id string) (bool, error) {
+	for _, setKey := range ms.idSetKeys() {
+		if exists, err := redis.Bool(conn.Do("SISMEMBER", setKey, id)); err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
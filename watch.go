@@ -0,0 +1,236 @@
+// Copyright 2014 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File watch.go contains code for publishing an event whenever a model is
+// created, updated, or deleted, and for watching those events.
+
+package zoom
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// publishChangeScript publishes a change event for a model. It must run before
+// the model id is added to or removed from the set of all models, since that
+// is how it tells whether a saved model was created or updated. KEYS[1] is the
+// set of all models and KEYS[2], if given, is the set of soft deleted models.
+// ARGV[1] is the channel, ARGV[2] is the model id and ARGV[3] is either "save"
+// or "delete". Saving a model which was soft deleted (e.g. restoring it) is an
+// update. Nothing is published when a model which does not exist is deleted.
+var publishChangeScript = `
+local exists = redis.call('SISMEMBER', KEYS[1], ARGV[2]) == 1
+local event
+if ARGV[3] == 'save' then
+	if exists or (KEYS[2] and redis.call('SISMEMBER', KEYS[2], ARGV[2]) == 1) then
+		event = 'updated'
+	else
+		event = 'created'
+	end
+elseif exists then
+	event = 'deleted'
+else
+	return 0
+end
+return redis.call('PUBLISH', ARGV[1], event .. ' ' .. ARGV[2])`
+
+// ChangeType is the type of a ChangeEvent.
+type ChangeType string
+
+const (
+	Created ChangeType = "created"
+	Updated ChangeType = "updated"
+	Deleted ChangeType = "deleted"
+)
+
+// ChangeEvent describes a model which was created, updated, or deleted.
+type ChangeEvent struct {
+	Type      ChangeType
+	ModelName string
+	Id        string
+	// Model is the model as it was when the event was received. It is nil for
+	// Deleted events, or if the model was deleted before it could be retrieved.
+	Model Model
+}
+
+// eventsChannel returns the pub/sub channel which change events for the
+// models of this type are published to.
+func (ms modelSpec) eventsChannel() string {
+	return ms.ns().key("zoom:events:" + ms.modelName)
+}
+
+// publishChange adds a command to the transaction which publishes a change
+// event of the given kind ("save" or "delete") for the model with the given
+// id. It must be added before the command which adds the id to (or removes it
+// from) the set of all models.
+func (t *transaction) publishChange(ms modelSpec, id string, kind string) {
+	keys := ms.idSetKeys()
+	args := redis.Args{}.Add(publishChangeScript).Add(len(keys)).AddFlat(keys).Add(ms.eventsChannel()).Add(id).Add(kind)
+	t.command("EVAL", args, nil)
+}
+
+// Watcher receives the change events for a type of model. It is returned by
+// Watch.
+type Watcher struct {
+	// Events receives an event each time a model is created, updated, or
+	// deleted. It is closed when the Watcher is closed or when there is an
+	// error, which can then be retrieved with Err.
+	Events    <-chan ChangeEvent
+	events    chan ChangeEvent
+	modelSpec modelSpec
+	filter    func(ChangeEvent) bool
+	conn      redis.PubSubConn
+	closing   chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Watch returns a Watcher which receives an event each time a model of the
+// type identified by modelName is created, updated, or deleted by Save, MSave,
+// Delete, DeleteById, or any of the functions which use them. The events are
+// published in the same transaction as the change, using redis pub/sub, so they
+// are received by every process which is watching. Only the events for which
+// filter returns true are sent to the Events channel. If filter is nil, all
+// the events are sent. For Created and Updated events the model is retrieved
+// before filter is called. If the model implements Syncer it will be locked
+// (just like FindById), and it is up to the receiver of the event to unlock
+// it. Watch opens a dedicated connection, which is closed when the Watcher is
+// closed.
+func Watch(modelName string, filter func(ChangeEvent) bool) (*Watcher, error) {
+	return defaultNamespace.Watch(modelName, filter)
+}
+
+// Watch is like the package-level Watch but watches for changes to the models
+// in the namespace.
+func (ns *Namespace) Watch(modelName string, filter func(ChangeEvent) bool) (*Watcher, error) {
+	ms, found := ns.modelSpec(modelName)
+	if !found {
+		return nil, NewModelNameNotRegisteredError(modelName)
+	}
+	// the connection is not taken from the pool, since it can't be used for
+	// anything else while it is subscribed
+	conn, err := pool.Dial()
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan ChangeEvent, 100)
+	w := &Watcher{
+		Events:    events,
+		events:    events,
+		modelSpec: ms,
+		filter:    filter,
+		conn:      redis.PubSubConn{Conn: conn},
+		closing:   make(chan struct{}),
+	}
+	if err := w.conn.Subscribe(ms.eventsChannel()); err != nil {
+		w.conn.Close()
+		return nil, err
+	}
+	// wait until the subscription is confirmed, so that no events which are
+	// published after Watch returns are missed
+	switch reply := w.conn.Receive().(type) {
+	case redis.Subscription:
+	case error:
+		w.conn.Close()
+		return nil, reply
+	default:
+		w.conn.Close()
+		return nil, fmt.Errorf("zoom: error in Watch: unexpected reply %v", reply)
+	}
+	go w.receive()
+	return w, nil
+}
+
+// receive sends an event to the Events channel for each message which is
+// received, until the Watcher is closed or there is an error.
+func (w *Watcher) receive() {
+	defer close(w.events)
+	for {
+		switch reply := w.conn.Receive().(type) {
+		case redis.Message:
+			event, err := w.newChangeEvent(string(reply.Data))
+			if err != nil {
+				w.stop(err)
+				return
+			}
+			if w.filter != nil && !w.filter(event) {
+				if s, ok := event.Model.(Syncer); ok {
+					s.Unlock()
+				}
+				continue
+			}
+			select {
+			case w.events <- event:
+			case <-w.closing:
+				return
+			}
+		case error:
+			w.stop(reply)
+			return
+		}
+	}
+}
+
+// newChangeEvent converts a message published by publishChangeScript to a
+// ChangeEvent, retrieving the model if it was created or updated.
+func (w *Watcher) newChangeEvent(message string) (ChangeEvent, error) {
+	parts := strings.SplitN(message, " ", 2)
+	if len(parts) != 2 {
+		return ChangeEvent{}, fmt.Errorf("zoom: error in Watch: invalid change event %q", message)
+	}
+	event := ChangeEvent{
+		Type:      ChangeType(parts[0]),
+		ModelName: w.modelSpec.modelName,
+		Id:        parts[1],
+	}
+	if event.Type == Deleted {
+		return event, nil
+	}
+	if c := findCache; c != nil {
+		// the cache may not have received the event yet
+		c.invalidate(w.modelSpec.key(event.Id))
+	}
+	m, err := w.modelSpec.ns().FindById(event.ModelName, event.Id)
+	if err != nil {
+		switch err.(type) {
+		case *KeyNotFoundError, *ModelNotFoundError:
+			// the model was deleted before it could be retrieved
+			return event, nil
+		}
+		return event, err
+	}
+	event.Model = m
+	return event, nil
+}
+
+// stop records err, unless the Watcher is being closed, in which case the
+// error was caused by closing the connection.
+func (w *Watcher) stop(err error) {
+	select {
+	case <-w.closing:
+	default:
+		w.err = err
+		w.conn.Close()
+	}
+}
+
+// Close stops watching for change events, closes the connection used by the
+// Watcher, and then closes the Events channel.
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		err = w.conn.Close()
+	})
+	return err
+}
+
+// Err returns the error which caused the Events channel to be closed, if any.
+// It should only be called after the Events channel is closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
@@ -16,15 +16,29 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 // Save writes a model (a struct which satisfies the Model interface) to the redis
 // database. Save throws an error if the type of the struct has not yet been registered
 // or if there is a problem connecting to the database. If the Id field of the struct is
 // empty, Save will mutate the struct by setting the Id. To make a struct satisfy the Model
-// interface, you can embed zoom.DefaultData.
+// interface, you can embed zoom.DefaultData. If the model does not satisfy the validation
+// options in its struct tags or its Validate method returns an error, Save returns a
+// *ValidationError and nothing is written.
 func Save(model Model) error {
-	t := newTransaction()
+	return defaultNamespace.Save(model)
+}
+
+// Save is like the package-level Save but saves the model in the namespace.
+func (ns *Namespace) Save(model Model) error {
+	// validate the model before anything is sent to the database
+	if err := validateModels([]Model{model}); err != nil {
+		return err
+	}
+
+	t := newTransaction(ns)
 
 	// add a save operation to the transaction
 	if err := t.saveModel(model); err != nil {
@@ -42,9 +56,21 @@ func Save(model Model) error {
 // a single transaction. See http://redis.io/topics/transactions. If there
 // is an error in the middle of the transaction, any models that were saved
 // before the error was encountered will still be saved. Usually this is fine
-// because saving a model a second time will have no adverse effects.
+// because saving a model a second time will have no adverse effects. All the models
+// are validated first, and if any of them are invalid none of them are saved.
 func MSave(models []Model) error {
-	t := newTransaction()
+	return defaultNamespace.MSave(models)
+}
+
+// MSave is like the package-level MSave but saves the models in the
+// namespace.
+func (ns *Namespace) MSave(models []Model) error {
+	// validate all the models before anything is sent to the database
+	if err := validateModels(models); err != nil {
+		return err
+	}
+
+	t := newTransaction(ns)
 
 	// add a save operation for each model to the transaction
 	for _, m := range models {
@@ -67,6 +93,12 @@ func MSave(models []Model) error {
 // or package prefix). If you used RegisterName instead of Register,
 // modelName should be the custom name you used.
 func FindById(modelName, id string) (Model, error) {
+	return defaultNamespace.FindById(modelName, id)
+}
+
+// FindById is like the package-level FindById but finds the model in the
+// namespace.
+func (ns *Namespace) FindById(modelName, id string) (Model, error) {
 	// create a new struct of proper type
 	typ, err := getRegisteredTypeFromName(modelName)
 	if err != nil {
@@ -80,7 +112,7 @@ func FindById(modelName, id string) (Model, error) {
 	}
 
 	// invoke ScanById
-	if err := ScanById(id, m); err != nil {
+	if err := ns.ScanById(id, m); err != nil {
 		return m, err
 	}
 	return m, nil
@@ -94,13 +126,20 @@ func FindById(modelName, id string) (Model, error) {
 // the transaction, the function will halt and return the models retrieved so
 // far (as well as the error).
 func MFindById(modelNames, ids []string) ([]Model, error) {
+	return defaultNamespace.MFindById(modelNames, ids)
+}
+
+// MFindById is like the package-level MFindById but finds the models in the
+// namespace.
+func (ns *Namespace) MFindById(modelNames, ids []string) ([]Model, error) {
 
 	if len(modelNames) != len(ids) {
 		return nil, errors.New("Zoom: error in MFindById: modelNames and ids must be the same length")
 	}
 
-	t := newTransaction()
+	t := newTransaction(ns)
 	results := make([]Model, 0)
+	refs := make([]modelRef, 0)
 
 	for i := 0; i < len(modelNames); i++ {
 		name, id := modelNames[i], ids[i]
@@ -119,11 +158,12 @@ func MFindById(modelNames, ids []string) ([]Model, error) {
 		results = append(results, m)
 
 		// create a modelRef
-		mr, err := newModelRefFromModel(m)
+		mr, err := newModelRefFromModel(ns, m)
 		if err != nil {
 			return results, err
 		}
 		mr.model.SetId(id)
+		refs = append(refs, mr)
 
 		// add a find operation to the transaction
 		t.findModel(mr, nil)
@@ -133,6 +173,74 @@ func MFindById(modelNames, ids []string) ([]Model, error) {
 	if err := t.exec(); err != nil {
 		return results, err
 	}
+	for _, mr := range refs {
+		if err := checkNotExpired(mr); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// Exists returns true iff a model of the type identified by modelName with
+// the given id exists in the database.
+func Exists(modelName, id string) (bool, error) {
+	return defaultNamespace.Exists(modelName, id)
+}
+
+// Exists is like the package-level Exists but checks whether the model exists
+// in the namespace.
+func (ns *Namespace) Exists(modelName, id string) (bool, error) {
+	results, err := ns.MExists([]string{modelName}, []string{id})
+	if err != nil {
+		return false, err
+	}
+	return results[0], nil
+}
+
+// MExists is like Exists but accepts a slice of modelNames and ids and checks
+// whether each of the models exists in a single transaction. The slices of
+// modelNames and ids should be properly aligned so that, e.g., modelNames[0]
+// corresponds to ids[0].
+func MExists(modelNames, ids []string) ([]bool, error) {
+	return defaultNamespace.MExists(modelNames, ids)
+}
+
+// MExists is like the package-level MExists but checks whether the models
+// exist in the namespace.
+func (ns *Namespace) MExists(modelNames, ids []string) ([]bool, error) {
+	if len(modelNames) != len(ids) {
+		return nil, errors.New("Zoom: error in MExists: modelNames and ids must be the same length")
+	}
+
+	t := newTransaction(ns)
+	results := make([]bool, len(ids))
+	swept := map[string]bool{}
+	for i := 0; i < len(modelNames); i++ {
+		ms, found := ns.modelSpec(modelNames[i])
+		if !found {
+			return nil, NewModelNameNotRegisteredError(modelNames[i])
+		}
+		if !swept[ms.modelName] {
+			// delete expired models first, so that they don't exist
+			if _, err := ms.sweepExpired(); err != nil {
+				return nil, err
+			}
+			swept[ms.modelName] = true
+		}
+		// capture i for the handler
+		i := i
+		args := redis.Args{}.Add(ms.indexKey()).Add(ids[i])
+		t.command("SISMEMBER", args, func(reply interface{}) error {
+			exists, err := redis.Bool(reply, nil)
+			results[i] = exists
+			return err
+		})
+	}
+
+	// execute the transaction
+	if err := t.exec(); err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
@@ -142,22 +250,28 @@ func MFindById(modelNames, ids []string) ([]Model, error) {
 // if a model with that id does not exist or if there was a problem
 // connecting to the database.
 func ScanById(id string, model Model) error {
+	return defaultNamespace.ScanById(id, model)
+}
+
+// ScanById is like the package-level ScanById but finds the model in the
+// namespace.
+func (ns *Namespace) ScanById(id string, model Model) error {
 	// create a modelRef
-	mr, err := newModelRefFromModel(model)
+	mr, err := newModelRefFromModel(ns, model)
 	if err != nil {
 		return err
 	}
 	mr.model.SetId(id)
 
 	// start a transaction
-	t := newTransaction()
+	t := newTransaction(ns)
 	t.findModel(mr, nil)
 
 	// execute the transaction and return the result
 	if err := t.exec(); err != nil {
 		return err
 	}
-	return nil
+	return checkNotExpired(mr)
 }
 
 // MScanById is like ScanById but accepts a slice of ids and a pointer to
@@ -170,6 +284,12 @@ func ScanById(id string, model Model) error {
 // the models slice are nil, MScanById will use reflection to allocate memory
 // for them.
 func MScanById(ids []string, models interface{}) error {
+	return defaultNamespace.MScanById(ids, models)
+}
+
+// MScanById is like the package-level MScanById but finds the models in the
+// namespace.
+func (ns *Namespace) MScanById(ids []string, models interface{}) error {
 
 	// since this is somewhat type-unsafe, we need to verify that
 	// models is the correct type
@@ -186,7 +306,8 @@ func MScanById(ids []string, models interface{}) error {
 		return fmt.Errorf("Zoom: error in MScanById: the elements in models should be of a registered type\nType %s has not been registered.", modelType.String())
 	}
 
-	t := newTransaction()
+	t := newTransaction(ns)
+	refs := make([]modelRef, 0, len(ids))
 	for i := 0; i < len(ids); i++ {
 		id, mVal := ids[i], modelsVal.Index(i)
 
@@ -195,11 +316,12 @@ func MScanById(ids []string, models interface{}) error {
 		}
 
 		// create a modelRef
-		mr, err := newModelRefFromInterface(mVal.Interface())
+		mr, err := newModelRefFromInterface(ns, mVal.Interface())
 		if err != nil {
 			return err
 		}
 		mr.model.SetId(id)
+		refs = append(refs, mr)
 
 		// start a transaction
 		t.findModel(mr, nil)
@@ -209,6 +331,11 @@ func MScanById(ids []string, models interface{}) error {
 	if err := t.exec(); err != nil {
 		return err
 	}
+	for _, mr := range refs {
+		if err := checkNotExpired(mr); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -218,12 +345,18 @@ func MScanById(ids []string, models interface{}) error {
 // database. If the model does not exist in the database, Delete will
 // not return an error; it will simply have no effect.
 func Delete(model Model) error {
-	t := newTransaction()
+	return defaultNamespace.Delete(model)
+}
+
+// Delete is like the package-level Delete but deletes the model from the
+// namespace.
+func (ns *Namespace) Delete(model Model) error {
+	t := newTransaction(ns)
 
 	if model.GetId() == "" {
 		return errors.New("zoom: cannot delete because model Id field is empty")
 	}
-	mr, err := newModelRefFromModel(model)
+	mr, err := newModelRefFromModel(ns, model)
 	if err != nil {
 		return err
 	}
@@ -245,12 +378,18 @@ func Delete(model Model) error {
 // because calling Delete on a model a second time will have no adverse
 // effects.
 func MDelete(models []Model) error {
-	t := newTransaction()
+	return defaultNamespace.MDelete(models)
+}
+
+// MDelete is like the package-level MDelete but deletes the models from the
+// namespace.
+func (ns *Namespace) MDelete(models []Model) error {
+	t := newTransaction(ns)
 	for _, m := range models {
 		if m.GetId() == "" {
 			return errors.New("zoom: cannot delete because model Id field is empty")
 		}
-		mr, err := newModelRefFromModel(m)
+		mr, err := newModelRefFromModel(ns, m)
 		if err != nil {
 			return err
 		}
@@ -272,7 +411,13 @@ func MDelete(models []Model) error {
 // the model does not exist, DeleteById will not return an error; it will simply have
 // no effect.
 func DeleteById(modelName string, id string) error {
-	t := newTransaction()
+	return defaultNamespace.DeleteById(modelName, id)
+}
+
+// DeleteById is like the package-level DeleteById but deletes the model from
+// the namespace.
+func (ns *Namespace) DeleteById(modelName string, id string) error {
+	t := newTransaction(ns)
 	if err := t.deleteModelById(modelName, id); err != nil {
 		return err
 	}
@@ -293,11 +438,17 @@ func DeleteById(modelName string, id string) error {
 // deleted. Usually this is fine because calling Delete on a model a second time
 // will have no adverse effects.
 func MDeleteById(modelNames []string, ids []string) error {
+	return defaultNamespace.MDeleteById(modelNames, ids)
+}
+
+// MDeleteById is like the package-level MDeleteById but deletes the models
+// from the namespace.
+func (ns *Namespace) MDeleteById(modelNames []string, ids []string) error {
 	if len(modelNames) != len(ids) {
 		return errors.New("Zoom: error in MDeleteById: modelNames and ids must be the same length")
 	}
 
-	t := newTransaction()
+	t := newTransaction(ns)
 	for i := 0; i < len(modelNames); i++ {
 		name, id := modelNames[i], ids[i]
 		if err := t.deleteModelById(name, id); err != nil {
@@ -5,9 +5,13 @@
 package zoom
 
 import (
+	"errors"
 	"github.com/garyburd/redigo/redis"
 	"reflect"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestSave(t *testing.T) {
@@ -255,6 +259,41 @@ func TestMDeleteById(t *testing.T) {
 	}
 }
 
+func TestExists(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newBasicModels(2)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := Save(models[0]); err != nil {
+		t.Error(err)
+	}
+
+	if exists, err := Exists("basicModel", models[0].Id); err != nil {
+		t.Error(err)
+	} else if !exists {
+		t.Error("Expected saved model to exist")
+	}
+	if exists, err := Exists("basicModel", "invalidId"); err != nil {
+		t.Error(err)
+	} else if exists {
+		t.Error("Expected model with invalid id not to exist")
+	}
+
+	results, err := MExists([]string{"basicModel", "basicModel", "basicModel"}, []string{models[0].Id, "invalidId", models[0].Id})
+	if err != nil {
+		t.Error(err)
+	}
+	if expected := []bool{true, false, true}; !reflect.DeepEqual(expected, results) {
+		t.Errorf("MExists results were incorrect.\nExpected: %v\nGot: %v", expected, results)
+	}
+	if _, err := Exists("notRegistered", models[0].Id); err == nil {
+		t.Error("Expected an error for a model name which is not registered")
+	}
+}
+
 func checkBasicModelSaved(t *testing.T, m *basicModel, conn redis.Conn) {
 	// make sure it was assigned an id
 	if m.Id == "" {
@@ -309,3 +348,1153 @@ func checkBasicModelDeleted(t *testing.T, id string, conn redis.Conn) {
 		t.Error("model id is still in basicModel:all")
 	}
 }
+
+func TestMigrate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	defer func() {
+		migrations = map[int]func(*MigrationTx) error{}
+	}()
+
+	type migratedModel struct {
+		Title string
+		Tags  []string          `redisType:"set"`
+		Meta  map[string]string `zoom:"json"`
+		DefaultData
+	}
+	Register(&migratedModel{})
+	defer Unregister(&migratedModel{})
+
+	// store a model the way an older version of the type would have
+	conn := GetConn()
+	defer conn.Close()
+	meta, err := defaultMarshalerUnmarshaler.Marshal(map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := [][]interface{}{
+		{"HMSET", "migratedModel:1", "Name", "foo", "Meta", meta},
+		{"RPUSH", "migratedModel:1:Tags", "x", "y", "x"},
+		{"SADD", "migratedModel:all", "1"},
+	}
+	for _, c := range commands {
+		if _, err := conn.Do(c[0].(string), c[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs := 0
+	RegisterMigration(2, func(tx *MigrationTx) error {
+		runs++
+		if err := tx.ListToSet("migratedModel", "Tags"); err != nil {
+			return err
+		}
+		return tx.ConvertGobToJSON("migratedModel", "Meta", &map[string]string{})
+	})
+	RegisterMigration(1, func(tx *MigrationTx) error {
+		runs++
+		return tx.RenameField("migratedModel", "Name", "Title")
+	})
+	if err := RegisterMigration(1, nil); err == nil {
+		t.Error("Expected an error when registering a duplicate version but got none")
+	}
+
+	// running the migrations more than once should have no additional effect
+	for i := 0; i < 2; i++ {
+		if err := Migrate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs != 2 {
+		t.Errorf("Expected migrations to run 2 times but got %d", runs)
+	}
+	if version, err := SchemaVersion(); err != nil {
+		t.Error(err)
+	} else if version != 2 {
+		t.Errorf("Expected schema version to be 2 but got %d", version)
+	}
+
+	m := &migratedModel{}
+	if err := ScanById("1", m); err != nil {
+		t.Fatal(err)
+	}
+	expected := &migratedModel{
+		Title: "foo",
+		Tags:  []string{"x", "y"},
+		Meta:  map[string]string{"a": "b"},
+	}
+	expected.Id = "1"
+	sort.Strings(m.Tags)
+	if !reflect.DeepEqual(expected, m) {
+		t.Errorf("Migrated model was incorrect.\nExpected: %+v\nGot: %+v", expected, m)
+	}
+
+	// if the lock is lost during a migration, the version should not be
+	// updated and the lock of the other process should be kept
+	RegisterMigration(3, func(tx *MigrationTx) error {
+		_, err := tx.Conn.Do("SET", "zoom:schema_version:lock", "other")
+		return err
+	})
+	if err := Migrate(); err == nil {
+		t.Error("Expected an error when the migration lock is lost")
+	}
+	if version, err := SchemaVersion(); err != nil {
+		t.Error(err)
+	} else if version != 2 {
+		t.Errorf("Expected schema version to still be 2 but got %d", version)
+	}
+
+	// Migrate should give up if another process holds the lock for too long
+	defer func(wait time.Duration) {
+		migrationLockWait = wait
+	}(migrationLockWait)
+	migrationLockWait = 50 * time.Millisecond
+	if err := Migrate(); err == nil {
+		t.Error("Expected an error when the migration lock can't be acquired")
+	}
+	if owner, err := redis.String(conn.Do("GET", "zoom:schema_version:lock")); err != nil {
+		t.Error(err)
+	} else if owner != "other" {
+		t.Errorf("Expected the lock of the other process to be kept but got %s", owner)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := newIndexedPrimativesModels(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Verify("indexedPrimativesModel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() {
+		t.Errorf("Expected no problems but got:\n%s", report)
+	}
+
+	// introduce some drift between the stored data and the type
+	conn := GetConn()
+	defer conn.Close()
+	key := "indexedPrimativesModel:" + models[0].Id
+	commands := [][]interface{}{
+		{"HSET", key, "Extra", "foo"},
+		{"HDEL", key, "String"},
+		{"HSET", key, "Int", "not an int"},
+		{"ZADD", "indexedPrimativesModel:Int", 0, "orphan"},
+		{"SADD", "indexedPrimativesModel:all", "missing"},
+	}
+	for _, c := range commands {
+		if _, err := conn.Do(c[0].(string), c[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err = Verify("indexedPrimativesModel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ModelsChecked != 3 {
+		t.Errorf("Expected 3 models to be checked but got %d", report.ModelsChecked)
+	}
+	expected := &VerifyReport{
+		ModelName:     "indexedPrimativesModel",
+		ModelsChecked: 3,
+		UnknownFields: []FieldProblem{{Id: models[0].Id, Field: "Extra", Value: "foo"}},
+		MissingFields: []FieldProblem{{Id: models[0].Id, Field: "String"}},
+		InvalidValues: []FieldProblem{{Id: models[0].Id, Field: "Int", Value: "not an int", Error: "zoom: could not convert not an int to int.\n"}},
+		OrphanIndexes: []IndexProblem{{IndexKey: "indexedPrimativesModel:Int", Id: "orphan"}},
+		MissingHashes: []string{"missing"},
+	}
+	if !reflect.DeepEqual(expected, report) {
+		t.Errorf("Report was incorrect.\nExpected: %+v\nGot: %+v", expected, report)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// only watch for models with a large Int (and for all deletions)
+	w, err := Watch("indexedPrimativesModel", func(e ChangeEvent) bool {
+		return e.Type == Deleted || (e.Model != nil && e.Model.(*indexedPrimativesModel).Int > 5)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	expectEvent := func(typ ChangeType, id string, expectedInt int) {
+		select {
+		case event := <-w.Events:
+			if event.Type != typ || event.Id != id || event.ModelName != "indexedPrimativesModel" {
+				t.Errorf("Event was incorrect. Expected %s %s but got %+v", typ, id, event)
+				return
+			}
+			if typ == Deleted {
+				if event.Model != nil {
+					t.Errorf("Expected Model to be nil for a deleted event but got %+v", event.Model)
+				}
+			} else if got := event.Model.(*indexedPrimativesModel).Int; got != expectedInt {
+				t.Errorf("Expected Int to be %d but got %d", expectedInt, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %s event for %s", typ, id)
+		}
+	}
+
+	models, err := newIndexedPrimativesModels(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models[0].Int, models[1].Int = 10, 1
+	if err := MSave(Models(models)); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(Created, models[0].Id, 10)
+	models[0].Int = 11
+	if err := Save(models[0]); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(Updated, models[0].Id, 11)
+	if err := Delete(models[1]); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(Deleted, models[1].Id, 0)
+	if err := DeleteById("indexedPrimativesModel", models[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(Deleted, models[0].Id, 0)
+
+	// deleting a model which does not exist should not publish an event, and
+	// changes to other types of models should not be received
+	if err := DeleteById("indexedPrimativesModel", models[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(&basicModel{Attr: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-w.Events:
+		t.Errorf("Expected no more events but got %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// closing the watcher should close the channel without an error
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case _, ok := <-w.Events:
+		if ok {
+			t.Error("Expected Events to be closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for Events to be closed")
+	}
+	if err := w.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type auditedModel struct {
+		Name        string
+		Count       int
+		DefaultData `zoom:"audit"`
+	}
+	if err := Register(&auditedModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&auditedModel{})
+
+	reader, err := NewChangeLogReader("auditedModel", "indexer", "worker1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// creating the reader again should use the existing group
+	if _, err := NewChangeLogReader("auditedModel", "indexer", "worker1"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &auditedModel{Name: "foo", Count: 1}
+	if err := Save(m); err != nil {
+		t.Fatal(err)
+	}
+	m.Count = 2
+	if err := Save(m); err != nil {
+		t.Fatal(err)
+	}
+	// saving without any changes should not add an entry
+	if err := Save(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewQuery("auditedModel").Update(map[string]interface{}{"Name": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteById("auditedModel", m.Id); err != nil {
+		t.Fatal(err)
+	}
+	// models which are not audited should not be recorded
+	if err := Save(&basicModel{Attr: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := reader.Read(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Type: Created, Old: map[string]string{}, New: map[string]string{"Name": "foo", "Count": "1"}},
+		{Type: Updated, Old: map[string]string{"Count": "1"}, New: map[string]string{"Count": "2"}},
+		{Type: Updated, Old: map[string]string{"Name": "foo"}, New: map[string]string{"Name": "bar"}},
+		{Type: Deleted, Old: map[string]string{"Name": "bar", "Count": "2"}, New: map[string]string{}},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes but got %d: %+v", len(expected), len(changes), changes)
+	}
+	for i, change := range changes {
+		if change.EntryId == "" {
+			t.Errorf("Expected change %d to have an EntryId", i)
+		}
+		expected[i].EntryId = change.EntryId
+		expected[i].ModelName = "auditedModel"
+		expected[i].Id = m.Id
+		if !reflect.DeepEqual(expected[i], change) {
+			t.Errorf("Change %d was incorrect.\nExpected: %+v\nGot: %+v", i, expected[i], change)
+		}
+	}
+
+	// the changes should be pending until they are acknowledged
+	if changes, err := reader.Read(10, 0); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Errorf("Expected no new changes but got %+v", changes)
+	}
+	if pending, err := reader.Pending(10); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != 4 {
+		t.Errorf("Expected 4 pending changes but got %d", len(pending))
+	}
+	if err := reader.Ack(changes[:3]...); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := reader.Pending(10); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != 1 || pending[0].EntryId != changes[3].EntryId {
+		t.Errorf("Expected only the last change to be pending but got %+v", pending)
+	}
+
+	// a new group should replay every change
+	replay, err := NewChangeLogReader("auditedModel", "warehouse", "worker1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed, err := replay.Read(10, 0); err != nil {
+		t.Fatal(err)
+	} else if len(replayed) != 4 {
+		t.Errorf("Expected 4 replayed changes but got %d", len(replayed))
+	}
+
+	// Configuration.ChangeLog should record changes to every type of model
+	currentConfiguration.ChangeLog = true
+	defer func() {
+		currentConfiguration.ChangeLog = false
+	}()
+	basicReader, err := NewChangeLogReader("basicModel", "indexer", "worker1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(&basicModel{Attr: "logged"}); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := basicReader.Read(10, 0); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 1 || changes[0].New["Attr"] != "logged" {
+		t.Errorf("Expected one change for basicModel but got %+v", changes)
+	}
+
+	// Configuration.ChangeLogMaxLen should trim the oldest entries. Redis only
+	// trims whole nodes of the stream with MAXLEN ~, so the length is checked
+	// loosely.
+	currentConfiguration.ChangeLogMaxLen = 10
+	defer func() {
+		currentConfiguration.ChangeLogMaxLen = 0
+	}()
+	many := []*basicModel{}
+	for i := 0; i < 250; i++ {
+		many = append(many, &basicModel{Attr: strconv.Itoa(i)})
+	}
+	if err := MSave(Models(many)); err != nil {
+		t.Fatal(err)
+	}
+	conn := GetConn()
+	defer conn.Close()
+	if length, err := redis.Int(conn.Do("XLEN", "zoom:changes:basicModel")); err != nil {
+		t.Fatal(err)
+	} else if length < 10 || length >= 200 {
+		t.Errorf("Expected the change log to be trimmed to about 10 entries but it has %d", length)
+	}
+}
+
+func TestExpirable(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type expiringModel struct {
+		Name string   `zoom:"index"`
+		Tags []string `redisType:"set"`
+		Expirable
+		DefaultData
+	}
+	if err := Register(&expiringModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&expiringModel{})
+
+	expired := &expiringModel{Name: "expired", Tags: []string{"a"}}
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	later := &expiringModel{Name: "later"}
+	never := &expiringModel{Name: "never"}
+	if err := MSave([]Model{expired, never}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveWithTTL(later, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveWithTTL(&basicModel{}, time.Hour); err == nil {
+		t.Error("Expected an error when saving a model which does not embed Expirable with a TTL")
+	}
+
+	// expired models should not be found, even before they are deleted
+	if _, err := FindById("expiringModel", expired.Id); err == nil {
+		t.Error("Expected an error when finding an expired model")
+	} else if _, ok := err.(*KeyNotFoundError); !ok {
+		t.Errorf("Expected a KeyNotFoundError but got %T: %v", err, err)
+	}
+	found, err := FindById("expiringModel", later.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt := found.(*expiringModel).ExpiresAt; !expiresAt.Equal(later.ExpiresAt) {
+		t.Errorf("Expected ExpiresAt to be %v but got %v", later.ExpiresAt, expiresAt)
+	}
+
+	// queries should delete the expired models before running
+	conn := GetConn()
+	defer conn.Close()
+	if exists, err := redis.Bool(conn.Do("EXISTS", "expiringModel:"+expired.Id)); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Error("Expected the expired model to exist before it was swept")
+	}
+	ids, err := NewQuery("expiringModel").Order("Name").IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{later.Id, never.Id}; !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Ids were incorrect. Expected %v but got %v", expected, ids)
+	}
+	for _, key := range []string{"expiringModel:" + expired.Id, "expiringModel:" + expired.Id + ":Tags"} {
+		if exists, err := redis.Bool(conn.Do("EXISTS", key)); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected %s to be deleted", key)
+		}
+	}
+	if expiring, err := redis.Strings(conn.Do("ZRANGE", "expiringModel:expires", 0, -1)); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(expiring, []string{later.Id}) {
+		t.Errorf("Expected only %s to be expiring but got %v", later.Id, expiring)
+	}
+	if count, err := NewQuery("expiringModel").Filter("Name >=", "a").Count(); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Errorf("Expected count to be 2 but got %d", count)
+	}
+
+	// saving a model with a zero ExpiresAt should make it never expire
+	later.ExpiresAt = time.Time{}
+	if err := Save(later); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := redis.Int(conn.Do("ZCARD", "expiringModel:expires")); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Expected no models to be expiring but got %d", n)
+	}
+
+	// SweepExpired should delete expired models which are never queried
+	expired = &expiringModel{Name: "expired"}
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	if err := Save(expired); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := Exists("expiringModel", expired.Id); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Error("Expected the expired model not to exist")
+	}
+	expired = &expiringModel{Name: "expired"}
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	if err := Save(expired); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := SweepExpired(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Expected 1 model to be swept but got %d", n)
+	}
+
+	// a Sweeper should delete models after they expire
+	if err := SaveWithTTL(expired, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	sweeper := StartSweeper(10*time.Millisecond, func(err error) {
+		t.Error(err)
+	})
+	defer sweeper.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if exists, err := redis.Bool(conn.Do("SISMEMBER", "expiringModel:all", expired.Id)); err != nil {
+			t.Fatal(err)
+		} else if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the sweeper to delete the model")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sweeper.Stop()
+}
+
+func TestSoftDelete(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type softModel struct {
+		Name string   `zoom:"index"`
+		Tags []string `redisType:"set"`
+		SoftDelete
+		DefaultData
+	}
+	if err := Register(&softModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&softModel{})
+
+	a, b, c := &softModel{Name: "a", Tags: []string{"x"}}, &softModel{Name: "b"}, &softModel{Name: "c"}
+	if err := MSave([]Model{a, b, c}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.DeletedAt.IsZero() {
+		t.Error("Expected DeletedAt to be set by Delete")
+	}
+	if err := DeleteById("softModel", b.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data and indexes should be kept
+	conn := GetConn()
+	defer conn.Close()
+	if deleted, err := redis.Strings(conn.Do("SMEMBERS", "softModel:deleted")); err != nil {
+		t.Fatal(err)
+	} else if len(deleted) != 2 {
+		t.Errorf("Expected 2 deleted ids but got %v", deleted)
+	}
+	if all, err := redis.Strings(conn.Do("SMEMBERS", "softModel:all")); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(all, []string{c.Id}) {
+		t.Errorf("Expected only %s in softModel:all but got %v", c.Id, all)
+	}
+	if n, err := redis.Int(conn.Do("ZCARD", "softModel:Name")); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Errorf("Expected the index to contain 3 ids but got %d", n)
+	}
+	found, err := FindById("softModel", b.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.(*softModel).DeletedAt.IsZero() {
+		t.Error("Expected DeletedAt to be set by DeleteById")
+	}
+
+	// queries should exclude deleted models by default
+	testCases := []struct {
+		query    *Query
+		expected []string
+	}{
+		{NewQuery("softModel"), []string{c.Id}},
+		{NewQuery("softModel").Order("Name"), []string{c.Id}},
+		{NewQuery("softModel").Filter("Name >=", "a"), []string{c.Id}},
+		{NewQuery("softModel").Order("-Name").WithDeleted(), []string{c.Id, b.Id, a.Id}},
+		{NewQuery("softModel").Order("Name").WithDeleted().Limit(2), []string{a.Id, b.Id}},
+		{NewQuery("softModel").Order("Name").OnlyDeleted(), []string{a.Id, b.Id}},
+		{NewQuery("softModel").Order("Name").OnlyDeleted().Offset(1), []string{b.Id}},
+		{NewQuery("softModel").Filter("Name =", "a").OnlyDeleted(), []string{a.Id}},
+		{NewQuery("softModel").Filter("Name =", "c").OnlyDeleted(), []string{}},
+		{NewQuery("softModel").Order("Name").Limit(1), []string{c.Id}},
+		{NewQuery("softModel").Order("-Name").Offset(1), []string{}},
+		{NewQuery("softModel").Order("Name").Limit(1).After(""), []string{c.Id}},
+		{NewQuery("softModel").Filter("Name >=", "a").Order("-Name").Limit(1), []string{c.Id}},
+	}
+	for _, tc := range testCases {
+		ids, err := tc.query.IdsOnly()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.query.order.fieldName == "" {
+			sort.Strings(ids)
+			sort.Strings(tc.expected)
+		}
+		if !reflect.DeepEqual(tc.expected, ids) {
+			t.Errorf("Ids were incorrect for %s. Expected %v but got %v", tc.query, tc.expected, ids)
+		}
+		if count, err := tc.query.Count(); err != nil {
+			t.Fatal(err)
+		} else if count != len(tc.expected) {
+			t.Errorf("Count was incorrect for %s. Expected %d but got %d", tc.query, len(tc.expected), count)
+		}
+	}
+
+	// queries which exclude deleted models should read the set of deleted
+	// models instead of the set of all models, and ordered queries without
+	// filters should be paged by redis
+	for _, q := range []*Query{
+		NewQuery("softModel").Order("Name").Limit(1),
+		NewQuery("softModel").Filter("Name >=", "a").Order("Name"),
+		NewQuery("softModel").Filter("Name >=", "a"),
+	} {
+		plan, err := q.Explain()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stage := range plan.Stages {
+			for _, c := range stage.Commands {
+				if c.Key == "softModel:all" {
+					t.Errorf("Expected %s not to read the set of all models but got %s %s", q, c.Name, c.Key)
+				}
+			}
+		}
+		if q.limit != 0 && plan.LimitOffset != "server" {
+			t.Errorf("Expected limit to be applied on the server for %s but got %s", q, plan.LimitOffset)
+		}
+	}
+
+	ids, err := NewQuery("softModel").WithDeleted().IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Errorf("Expected 3 ids with deleted models but got %v", ids)
+	}
+
+	// Restore should bring the model back
+	if err := Restore(a); err != nil {
+		t.Fatal(err)
+	}
+	if !a.DeletedAt.IsZero() {
+		t.Error("Expected DeletedAt to be cleared by Restore")
+	}
+	ids, err = NewQuery("softModel").Order("Name").IdsOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{a.Id, c.Id}; !reflect.DeepEqual(expected, ids) {
+		t.Errorf("Ids were incorrect after Restore. Expected %v but got %v", expected, ids)
+	}
+	if err := Restore(&basicModel{}); err == nil {
+		t.Error("Expected an error when restoring a model which does not embed SoftDelete")
+	}
+
+	// PurgeDeleted should only delete models which were deleted long enough ago
+	if err := Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := PurgeDeleted("softModel", time.Hour); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Expected no models to be purged but got %d", n)
+	}
+	if n, err := PurgeDeleted("softModel", 0); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("Expected 2 models to be purged but got %d", n)
+	}
+	for _, key := range []string{"softModel:" + a.Id, "softModel:" + a.Id + ":Tags", "softModel:deleted"} {
+		if exists, err := redis.Bool(conn.Do("EXISTS", key)); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected %s to be deleted", key)
+		}
+	}
+	if n, err := redis.Int(conn.Do("ZCARD", "softModel:Name")); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Expected the index to contain 1 id but got %d", n)
+	}
+}
+
+// Test that soft deleted models release their unique values, and that
+// restoring a model claims them again and is recorded as an update
+func TestSoftDeleteUniques(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type softUniqueModel struct {
+		Email string `zoom:"unique"`
+		SoftDelete
+		DefaultData `zoom:"audit"`
+	}
+	if err := Register(&softUniqueModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&softUniqueModel{})
+	reader, err := NewChangeLogReader("softUniqueModel", "restores", "worker1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := Watch("softUniqueModel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	a := &softUniqueModel{Email: "x@y"}
+	if err := Save(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindByUnique("softUniqueModel", "Email", "x@y"); err == nil {
+		t.Error("Expected FindByUnique not to find a deleted model")
+	}
+
+	// another model can use the value, and then a can't be restored
+	b := &softUniqueModel{Email: "x@y"}
+	if err := Save(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(a); err == nil {
+		t.Error("Expected an error when restoring a model whose unique value was used")
+	} else if _, ok := err.(*UniqueConstraintError); !ok {
+		t.Errorf("Expected UniqueConstraintError but got: %T: %s", err, err)
+	}
+	if a.DeletedAt.IsZero() {
+		t.Error("Expected DeletedAt to be kept when Restore fails")
+	}
+	if ids, err := NewQuery("softUniqueModel").OnlyDeleted().IdsOnly(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []string{a.Id}) {
+		t.Errorf("Expected %s to still be deleted but got %v", a.Id, ids)
+	}
+
+	// once the value is released again, a can be restored
+	if err := Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(a); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := FindByUnique("softUniqueModel", "Email", "x@y"); err != nil {
+		t.Error(err)
+	} else if got.GetId() != a.Id {
+		t.Errorf("FindByUnique returned the wrong model.\nExpected: %s\nGot: %s\n", a.Id, got.GetId())
+	}
+
+	// restoring should be recorded and published as an update
+	changes, err := reader.Read(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ChangeType{Created, Deleted, Created, Deleted, Updated}
+	types := []ChangeType{}
+	for _, change := range changes {
+		types = append(types, change.Type)
+	}
+	if !reflect.DeepEqual(expected, types) {
+		t.Errorf("Change types were incorrect.\nExpected: %v\nGot: %v", expected, types)
+	}
+	for _, typ := range expected {
+		select {
+		case event := <-w.Events:
+			if event.Type != typ {
+				t.Errorf("Expected a %s event but got %+v", typ, event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %s event", typ)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	Init(&Configuration{
+		Address:   *address,
+		Network:   *network,
+		Database:  *database,
+		CacheSize: 2,
+	})
+
+	type cachedModel struct {
+		Name        string
+		Tags        []string `redisType:"set"`
+		DefaultData `zoom:"cache=1m"`
+	}
+	if err := Register(&cachedModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&cachedModel{})
+
+	// waitForCache waits until cond returns true for the cache
+	waitForCache := func(cond func(c *lruCache) bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			findCache.mu.Lock()
+			done := cond(findCache)
+			findCache.mu.Unlock()
+			if done {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for the cache")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	find := func(id string) *cachedModel {
+		m, err := FindById("cachedModel", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.(*cachedModel)
+	}
+
+	// the cache is used once it has subscribed to the change events
+	waitForCache(func(c *lruCache) bool { return c.ready })
+	epoch := findCache.currentEpoch()
+	models := []*cachedModel{{Name: "a", Tags: []string{"x"}}, {Name: "b"}, {Name: "c"}}
+	if err := MSave([]Model{models[0], models[1], models[2]}); err != nil {
+		t.Fatal(err)
+	}
+	// each model is invalidated once by MSave and once by its change event
+	waitForCache(func(c *lruCache) bool { return c.epoch >= epoch+6 })
+	find(models[0].Id)
+	if stats := GetCacheStats(); stats.Hits != 0 || stats.Misses != 1 {
+		t.Errorf("Expected 0 hits and 1 miss but got %+v", stats)
+	}
+	find(models[0].Id)
+	if stats := GetCacheStats(); stats.Hits != 1 {
+		t.Errorf("Expected 1 hit but got %+v", stats)
+	}
+
+	// changes which are not made by zoom are not seen until the model is
+	// invalidated
+	conn := GetConn()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", "cachedModel:"+models[0].Id, "Name", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	found := find(models[0].Id)
+	if found.Name != "a" {
+		t.Errorf("Expected the cached model to have Name a but got %s", found.Name)
+	}
+	found.Tags[0] = "mutated"
+	if found := find(models[0].Id); found.Tags[0] != "x" {
+		t.Errorf("Expected the cached model not to be changed by changing a found model but got Tags %v", found.Tags)
+	}
+
+	// saving a model should invalidate it
+	models[0].Name = "saved"
+	epoch = findCache.currentEpoch()
+	if err := Save(models[0]); err != nil {
+		t.Fatal(err)
+	}
+	waitForCache(func(c *lruCache) bool { return c.epoch >= epoch+2 })
+	if found := find(models[0].Id); found.Name != "saved" {
+		t.Errorf("Expected Name to be saved after Save but got %s", found.Name)
+	}
+
+	// change events from other processes should invalidate the model
+	if _, err := conn.Do("HSET", "cachedModel:"+models[0].Id, "Name", "remote"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("PUBLISH", "zoom:events:cachedModel", "updated "+models[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for find(models[0].Id).Name != "remote" {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the cached model to be invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the least recently used model should be evicted
+	find(models[1].Id)
+	find(models[2].Id)
+	stats := GetCacheStats()
+	if stats.Evictions == 0 {
+		t.Errorf("Expected a model to be evicted but got %+v", stats)
+	}
+	if stats.Size != 2 {
+		t.Errorf("Expected the cache to contain 2 models but got %d", stats.Size)
+	}
+	if stats.Invalidations == 0 || stats.Misses == 0 {
+		t.Errorf("Expected invalidations and misses to be counted but got %+v", stats)
+	}
+
+	// deleting a model should invalidate it
+	if err := Delete(models[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindById("cachedModel", models[2].Id); err == nil {
+		t.Error("Expected an error when finding a deleted model")
+	}
+
+	// types without a cache duration are not cached
+	basic := &basicModel{Attr: "test"}
+	if err := Save(basic); err != nil {
+		t.Fatal(err)
+	}
+	before := GetCacheStats()
+	if _, err := FindById("basicModel", basic.Id); err != nil {
+		t.Fatal(err)
+	}
+	if after := GetCacheStats(); after.Hits != before.Hits || after.Misses != before.Misses {
+		t.Errorf("Expected basicModel not to be cached but the stats changed from %+v to %+v", before, after)
+	}
+}
+
+type validatedModel struct {
+	Name     string   `zoom:"required,len<=5"`
+	Age      int      `zoom:"min=1,max=100"`
+	Nickname *string  `zoom:"len>=2"`
+	Code     string   `zoom:"pattern=^[a-z]{1,3}$"`
+	Tags     []string `zoom:"len=2"`
+	Password string
+	Confirm  string
+	DefaultData
+}
+
+func (m *validatedModel) Validate() error {
+	if m.Password != m.Confirm {
+		return errors.New("passwords do not match")
+	}
+	return nil
+}
+
+func TestValidation(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	if err := Register(&validatedModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&validatedModel{})
+
+	valid := &validatedModel{Name: "alice", Age: 30, Code: "ab", Tags: []string{"x", "y"}}
+	if err := Save(valid); err != nil {
+		t.Fatalf("Unexpected error saving a valid model: %s", err)
+	}
+
+	// every failing field of every model should be listed, and nothing should be saved
+	short := "x"
+	invalid := &validatedModel{Age: 101, Nickname: &short, Code: "abcd", Tags: []string{"x"}, Password: "a"}
+	other := &validatedModel{Name: "bobbyjoe", Age: 0, Code: "a,b", Tags: []string{"x", "y"}}
+	err := MSave([]Model{invalid, valid, other})
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a *ValidationError but got %T: %v", err, err)
+	}
+	got := []string{}
+	for _, f := range verr.Fields {
+		got = append(got, f.Field+" "+f.Rule)
+	}
+	expected := []string{
+		"Name required", "Age max=100", "Nickname len>=2", "Code pattern=^[a-z]{1,3}$", "Tags len=2", " Validate",
+		"Name len<=5", "Age min=1", "Code pattern=^[a-z]{1,3}$",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Incorrect validation errors.\nExpected: %v\nGot:      %v", expected, got)
+	}
+	if verr.Fields[5].Message != "passwords do not match" {
+		t.Errorf("Expected the message from Validate but got %q", verr.Fields[5].Message)
+	}
+	if invalid.Id != "" || other.Id != "" {
+		t.Error("Expected invalid models not to be assigned ids")
+	}
+	if count, err := NewQuery("validatedModel").Count(); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("Expected only the valid model to be saved but there are %d", count)
+	}
+
+	// Update should validate the new values as well
+	if _, err := NewQuery("validatedModel").Update(map[string]interface{}{"Age": 200}); err == nil {
+		t.Error("Expected a ValidationError from Update")
+	} else if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("Expected a *ValidationError from Update but got %T: %v", err, err)
+	}
+
+	// invalid options should be rejected when the type is registered
+	type badMin struct {
+		Name string `zoom:"min=1"`
+		DefaultData
+	}
+	if err := Register(&badMin{}); err == nil {
+		Unregister(&badMin{})
+		t.Error("Expected an error registering a min option on a string field")
+	}
+	type badPattern struct {
+		Name string `zoom:"pattern=("`
+		DefaultData
+	}
+	if err := Register(&badPattern{}); err == nil {
+		Unregister(&badPattern{})
+		t.Error("Expected an error registering an invalid pattern")
+	}
+	type patternBeforeIndex struct {
+		Name string `zoom:"pattern=^a+$,index"`
+		DefaultData
+	}
+	if err := Register(&patternBeforeIndex{}); err == nil {
+		Unregister(&patternBeforeIndex{})
+		t.Error("Expected an error registering an option after a pattern")
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+	Init(&Configuration{
+		Address:   *address,
+		Network:   *network,
+		Database:  *database,
+		KeyPrefix: "app",
+	})
+
+	type tenantModel struct {
+		Name  string   `zoom:"index"`
+		Email string   `zoom:"unique"`
+		Tags  []string `redisType:"set"`
+		DefaultData
+	}
+	if err := Register(&tenantModel{}); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(&tenantModel{})
+
+	a, b := WithNamespace("a"), WithNamespace("b")
+	ma := &tenantModel{Name: "alice", Email: "alice@example.com", Tags: []string{"x"}}
+	if err := a.Save(ma); err != nil {
+		t.Fatal(err)
+	}
+	// the same unique value can be used in another namespace
+	mb := &tenantModel{Name: "alice", Email: "alice@example.com"}
+	if err := b.Save(mb); err != nil {
+		t.Fatalf("Unexpected error saving the same unique value in another namespace: %s", err)
+	}
+
+	// every key should have the prefix for its namespace
+	conn := GetConn()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedKeys := []string{
+		"app:a:tenantModel:" + ma.Id, "app:a:tenantModel:" + ma.Id + ":Tags", "app:a:tenantModel:all",
+		"app:a:tenantModel:Name", "app:a:tenantModel:Email:unique",
+		"app:b:tenantModel:" + mb.Id, "app:b:tenantModel:all", "app:b:tenantModel:Name", "app:b:tenantModel:Email:unique",
+	}
+	sort.Strings(keys)
+	sort.Strings(expectedKeys)
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Incorrect keys.\nExpected: %v\nGot:      %v", expectedKeys, keys)
+	}
+
+	// models should only be found in their own namespace
+	if found, err := a.FindById("tenantModel", ma.Id); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(found, ma) {
+		t.Errorf("Expected %+v but got %+v", ma, found)
+	}
+	for _, ns := range []*Namespace{b, defaultNamespace} {
+		if _, err := ns.FindById("tenantModel", ma.Id); err == nil {
+			t.Errorf("Expected an error finding the model from namespace %q", ns.Name())
+		} else if _, ok := err.(*KeyNotFoundError); !ok {
+			t.Errorf("Expected a KeyNotFoundError but got %T: %v", err, err)
+		}
+	}
+	if found, err := b.FindByUnique("tenantModel", "Email", "alice@example.com"); err != nil {
+		t.Error(err)
+	} else if found.GetId() != mb.Id {
+		t.Errorf("Expected FindByUnique to return %s but got %s", mb.Id, found.GetId())
+	}
+	for ns, expected := range map[*Namespace]int{a: 1, b: 1, defaultNamespace: 0} {
+		if count, err := ns.NewQuery("tenantModel").Filter("Name =", "alice").Count(); err != nil {
+			t.Error(err)
+		} else if count != expected {
+			t.Errorf("Expected %d models in namespace %q but got %d", expected, ns.Name(), count)
+		}
+	}
+
+	// deleting from one namespace should not affect the other
+	if err := a.DeleteById("tenantModel", mb.Id); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := b.Exists("tenantModel", mb.Id); err != nil {
+		t.Error(err)
+	} else if !exists {
+		t.Error("Expected the model in namespace b to still exist")
+	}
+	if err := a.Delete(ma); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := a.NewQuery("tenantModel").Count(); err != nil {
+		t.Error(err)
+	} else if count != 0 {
+		t.Errorf("Expected no models in namespace a but got %d", count)
+	}
+	if count, err := b.NewQuery("tenantModel").Count(); err != nil {
+		t.Error(err)
+	} else if count != 1 {
+		t.Errorf("Expected 1 model in namespace b but got %d", count)
+	}
+
+	// relationships should be stored and found in the namespace
+	one := &basicModel{Attr: "one"}
+	if err := a.Save(one); err != nil {
+		t.Fatal(err)
+	}
+	parent := &oneToManyModelDifferentType{Attr: "parent", Many: []*basicModel{one}}
+	if err := a.Save(parent); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := redis.Bool(conn.Do("EXISTS", "app:a:oneToManyModelDifferentType:"+parent.Id+":Many")); err != nil {
+		t.Error(err)
+	} else if !exists {
+		t.Error("Expected the relationship key to have the prefix for the namespace")
+	}
+	found := &oneToManyModelDifferentType{}
+	if err := a.ScanById(parent.Id, found); err != nil {
+		t.Error(err)
+	} else if len(found.Many) != 1 || found.Many[0].Attr != "one" {
+		t.Errorf("Expected the related model to be found in the namespace but got %+v", found.Many)
+	}
+}